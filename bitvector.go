@@ -0,0 +1,530 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// BitVector is a packed bit vector, an alternative to []bool for large numbers of vectors. Bit i is
+// stored in word i/64, most significant bit first, so the big endian encoding of the words is the
+// payload of a .bv file. Bits past the length are always clear.
+type BitVector struct {
+	words []uint64
+	n     int
+}
+
+// NewBitVector returns a bit vector of length n with every bit clear
+func NewBitVector(n int) *BitVector {
+	return &BitVector{
+		words: make([]uint64, (n+63)/64),
+		n:     n,
+	}
+}
+
+// BitVectorFromBools packs a []bool vector
+func BitVectorFromBools(bv []bool) *BitVector {
+	v := NewBitVector(len(bv))
+	for i, x := range bv {
+		if x {
+			v.words[i/64] |= bitMask(i)
+		}
+	}
+	return v
+}
+
+// BitVectorFromBytes builds a bit vector of length n from packed bits in .bv file order. Missing
+// bytes are treated as clear.
+func BitVectorFromBytes(b []byte, n int) *BitVector {
+	v := NewBitVector(n)
+	numBytes := (n + 7) / 8
+	if len(b) > numBytes {
+		b = b[:numBytes]
+	}
+
+	for i := range v.words {
+		if len(b) >= 8 {
+			v.words[i] = binary.BigEndian.Uint64(b)
+			b = b[8:]
+			continue
+		}
+
+		var last [8]byte
+		copy(last[:], b)
+		v.words[i] = binary.BigEndian.Uint64(last[:])
+		break
+	}
+	v.clearTail()
+
+	return v
+}
+
+func bitMask(i int) uint64 {
+	return 1 << uint(63-i%64)
+}
+
+// clearTail clears the bits of the last word past the length of the vector
+func (v *BitVector) clearTail() {
+	if v.n%64 != 0 {
+		v.words[len(v.words)-1] &= ^uint64(0) << uint(64-v.n%64)
+	}
+}
+
+// Len returns the number of bits in the vector
+func (v *BitVector) Len() int {
+	return v.n
+}
+
+// Get returns bit i
+func (v *BitVector) Get(i int) bool {
+	return v.words[i/64]&bitMask(i) != 0
+}
+
+// Set sets bit i
+func (v *BitVector) Set(i int) {
+	v.words[i/64] |= bitMask(i)
+}
+
+// Clear clears bit i
+func (v *BitVector) Clear(i int) {
+	v.words[i/64] &^= bitMask(i)
+}
+
+// SetTo sets or clears bit i
+func (v *BitVector) SetTo(i int, x bool) {
+	if x {
+		v.Set(i)
+	} else {
+		v.Clear(i)
+	}
+}
+
+// Bools unpacks the vector into a []bool vector
+func (v *BitVector) Bools() []bool {
+	bv := make([]bool, v.n)
+	for i := range bv {
+		bv[i] = v.Get(i)
+	}
+	return bv
+}
+
+// Bytes returns the packed bits in .bv file order
+func (v *BitVector) Bytes() []byte {
+	b := make([]byte, len(v.words)*8)
+	for i, w := range v.words {
+		binary.BigEndian.PutUint64(b[i*8:], w)
+	}
+	return b[:(v.n+7)/8]
+}
+
+// Clone returns a copy of the vector
+func (v *BitVector) Clone() *BitVector {
+	c := &BitVector{
+		words: make([]uint64, len(v.words)),
+		n:     v.n,
+	}
+	copy(c.words, v.words)
+	return c
+}
+
+// Equal returns whether two vectors have the same length and bits
+func (v *BitVector) Equal(o *BitVector) bool {
+	if v.n != o.n {
+		return false
+	}
+	for i, w := range v.words {
+		if w != o.words[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *BitVector) checkLen(o *BitVector) error {
+	if v.n != o.n {
+		return errors.New("bv lengths do not match")
+	}
+	return nil
+}
+
+// And clears every bit of v that is clear in o
+func (v *BitVector) And(o *BitVector) error {
+	if err := v.checkLen(o); err != nil {
+		return err
+	}
+	for i, w := range o.words {
+		v.words[i] &= w
+	}
+	return nil
+}
+
+// Or sets every bit of v that is set in o
+func (v *BitVector) Or(o *BitVector) error {
+	if err := v.checkLen(o); err != nil {
+		return err
+	}
+	for i, w := range o.words {
+		v.words[i] |= w
+	}
+	return nil
+}
+
+// Xor flips every bit of v that is set in o
+func (v *BitVector) Xor(o *BitVector) error {
+	if err := v.checkLen(o); err != nil {
+		return err
+	}
+	for i, w := range o.words {
+		v.words[i] ^= w
+	}
+	return nil
+}
+
+// AndNot clears every bit of v that is set in o
+func (v *BitVector) AndNot(o *BitVector) error {
+	if err := v.checkLen(o); err != nil {
+		return err
+	}
+	for i, w := range o.words {
+		v.words[i] &^= w
+	}
+	return nil
+}
+
+// Not flips every bit of v
+func (v *BitVector) Not() {
+	for i := range v.words {
+		v.words[i] = ^v.words[i]
+	}
+	v.clearTail()
+}
+
+// Count returns the number of set bits
+func (v *BitVector) Count() int {
+	count := 0
+	for _, w := range v.words {
+		count += bits.OnesCount64(w)
+	}
+	return count
+}
+
+// CountAnd returns the number of bits set in both v and o
+func (v *BitVector) CountAnd(o *BitVector) (int, error) {
+	if err := v.checkLen(o); err != nil {
+		return 0, err
+	}
+	count := 0
+	for i, w := range v.words {
+		count += bits.OnesCount64(w & o.words[i])
+	}
+	return count, nil
+}
+
+// CountAndNot returns the number of bits set in v and clear in o
+func (v *BitVector) CountAndNot(o *BitVector) (int, error) {
+	if err := v.checkLen(o); err != nil {
+		return 0, err
+	}
+	count := 0
+	for i, w := range v.words {
+		count += bits.OnesCount64(w &^ o.words[i])
+	}
+	return count, nil
+}
+
+// CountXor returns the number of bits that differ between v and o
+func (v *BitVector) CountXor(o *BitVector) (int, error) {
+	if err := v.checkLen(o); err != nil {
+		return 0, err
+	}
+	count := 0
+	for i, w := range v.words {
+		count += bits.OnesCount64(w ^ o.words[i])
+	}
+	return count, nil
+}
+
+// NextSet returns the index of the first set bit at or after i, or -1 if there is none
+func (v *BitVector) NextSet(i int) int {
+	if i < 0 {
+		i = 0
+	}
+	if i >= v.n {
+		return -1
+	}
+
+	w := i / 64
+	word := v.words[w] << uint(i%64)
+	if word != 0 {
+		return i + bits.LeadingZeros64(word)
+	}
+	for w++; w < len(v.words); w++ {
+		if v.words[w] != 0 {
+			return w*64 + bits.LeadingZeros64(v.words[w])
+		}
+	}
+	return -1
+}
+
+// rangeWords calls fn with each word overlapping bits [start, end), masked to the bits in range
+func (v *BitVector) rangeWords(start int, end int, fn func(w uint64) bool) {
+	if start < 0 {
+		start = 0
+	}
+	if end > v.n {
+		end = v.n
+	}
+	if start >= end {
+		return
+	}
+
+	first, last := start/64, (end-1)/64
+	for w := first; w <= last; w++ {
+		mask := ^uint64(0)
+		if w == first {
+			mask >>= uint(start % 64)
+		}
+		if w == last {
+			mask &^= ^uint64(0) >> uint((end-1)%64+1)
+		}
+		if !fn(v.words[w] & mask) {
+			return
+		}
+	}
+}
+
+// AnyInRange returns whether any bit in [start, end) is set
+func (v *BitVector) AnyInRange(start int, end int) bool {
+	found := false
+	v.rangeWords(start, end, func(w uint64) bool {
+		found = w != 0
+		return !found
+	})
+	return found
+}
+
+// CountRange returns the number of set bits in [start, end)
+func (v *BitVector) CountRange(start int, end int) int {
+	count := 0
+	v.rangeWords(start, end, func(w uint64) bool {
+		count += bits.OnesCount64(w)
+		return true
+	})
+	return count
+}
+
+// ForEach calls fn with the index of every set bit, in order
+func (v *BitVector) ForEach(fn func(i int)) {
+	for w, word := range v.words {
+		for word != 0 {
+			j := bits.LeadingZeros64(word)
+			fn(w*64 + j)
+			word &^= 1 << uint(63-j)
+		}
+	}
+}
+
+// CombineBitVectors is CombineBVs for packed vectors. Nil vectors are skipped.
+func CombineBitVectors(vectors []*BitVector) (*BitVector, int, error) {
+	if len(vectors) == 0 || vectors[0] == nil {
+		return nil, 0, errors.New("no bit vectors to combine")
+	}
+
+	bv := NewBitVector(vectors[0].Len())
+	for _, v := range vectors {
+		if v == nil {
+			continue
+		}
+		if err := bv.Or(v); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return bv, bv.Count(), nil
+}
+
+// DiffTwoBitVectors is DiffTwoBVs for packed vectors
+func DiffTwoBitVectors(bv1 *BitVector, bv2 *BitVector) (int, error) {
+	return bv1.CountXor(bv2)
+}
+
+// DiffBitVectorsWithExclude is DiffBVsWithExclude for packed vectors
+func DiffBitVectorsWithExclude(bv1 *BitVector, bv2 *BitVector, excludeBV *BitVector) (int, int, error) {
+	if bv1.Len() != bv2.Len() {
+		return 0, 0, errors.New("bv lengths do not match")
+	}
+	if bv1.Len() != excludeBV.Len() {
+		return 0, 0, errors.New("bv lengths do not match exclude vector length")
+	}
+
+	diff := 0
+	for i, w := range bv1.words {
+		diff += bits.OnesCount64((w ^ bv2.words[i]) &^ excludeBV.words[i])
+	}
+
+	return diff, bv1.Len() - excludeBV.Count(), nil
+}
+
+// CountCoveredBitVector is CountCoveredRegions for packed vectors
+func CountCoveredBitVector(bv *BitVector) (int, int) {
+	return bv.Count(), bv.Len()
+}
+
+// CountCoveredBitVectorWithExclude is CountCoveredRegionsWithExclude for packed vectors
+func CountCoveredBitVectorWithExclude(bv *BitVector, excludeBV *BitVector) (int, int, error) {
+	if bv.Len() != excludeBV.Len() {
+		return 0, 0, errors.New("bv length does not match exclude vector length")
+	}
+
+	covered, err := bv.CountAndNot(excludeBV)
+	if err != nil {
+		return 0, 0, err
+	}
+	return covered, bv.Len() - excludeBV.Count(), nil
+}
+
+// GetMedianBitVector is GetMedianBV for packed vectors
+func GetMedianBitVector(vectors []*BitVector) (*BitVector, error) {
+	if len(vectors) <= 0 {
+		return nil, errors.New("no bit vectors passed to GetMedianBitVector()")
+	}
+	return thresholdBitVector(vectors, float64(len(vectors))/2.0)
+}
+
+// GetThresholdBitVector is GetThresholdBV for packed vectors
+func GetThresholdBitVector(vectors []*BitVector, threshold float64) (*BitVector, error) {
+	if len(vectors) <= 0 {
+		return nil, errors.New("no bit vectors passed to GetThresholdBitVector()")
+	}
+	return thresholdBitVector(vectors, float64(len(vectors))*threshold)
+}
+
+// thresholdBitVector sets every bit that is set in at least minCount vectors
+func thresholdBitVector(vectors []*BitVector, minCount float64) (*BitVector, error) {
+	n := vectors[0].Len()
+	if n == 0 {
+		return nil, errors.New("zero length vector passed to thresholdBitVector()")
+	}
+	for _, v := range vectors {
+		if v.Len() != n {
+			return nil, errors.New("bv lengths do not match")
+		}
+	}
+
+	counts := make([]int, n)
+	for _, v := range vectors {
+		v.ForEach(func(i int) {
+			counts[i] += 1
+		})
+	}
+
+	finalBV := NewBitVector(n)
+	for i, count := range counts {
+		if float64(count) >= minCount {
+			finalBV.Set(i)
+		}
+	}
+
+	return finalBV, nil
+}
+
+// ConvertCovMapToBitVector is ConvertCovMapToBools for packed vectors
+func ConvertCovMapToBitVector(covMap map[string]map[string][]bool) *BitVector {
+	return BitVectorFromBools(ConvertCovMapToBools(covMap))
+}
+
+// ConvertBitVectorToCovMap is ConvertBoolsToCovMap for packed vectors
+func ConvertBitVectorToCovMap(bv *BitVector, structure map[string]map[string]int) (map[string]map[string][]bool, error) {
+	return ConvertBoolsToCovMap(bv.Bools(), structure)
+}
+
+// GenerateExcludeBitVector is GenerateExcludeBV for packed vectors
+func GenerateExcludeBitVector(metadata map[string]map[string][]CodeRegion, filter RegionFilter) *BitVector {
+	return BitVectorFromBools(GenerateExcludeBV(metadata, filter))
+}
+
+// WriteBitVectorFile is WriteBVFile for packed vectors
+func WriteBitVectorFile(fName string, bv *BitVector, h BVHeader) error {
+	if h.Encoding == CompressedEncoding {
+		return WriteCompressedBitVectorFile(fName, CompressBitVector(bv), h)
+	}
+	return writeBVFile(fName, bv.Len(), bv.Bytes(), h)
+}
+
+// ReadBitVectorFile is ReadBVFile for packed vectors
+func ReadBitVectorFile(fName string) (*BitVector, BVHeader, error) {
+	content, err := readBVFileData(fName)
+	if err != nil {
+		return nil, BVHeader{}, err
+	}
+
+	return ParseBitVectorFile(content)
+}
+
+// ParseBitVectorFile is ParseBVFile for packed vectors
+func ParseBitVectorFile(data []byte) (*BitVector, BVHeader, error) {
+	if !isVersionedBVFile(data) {
+		if len(data) < 4 {
+			return nil, BVHeader{}, errors.New("invalid bit vector file")
+		}
+		numBits := int(binary.LittleEndian.Uint32(data))
+		if uint64(len(data)-4) != (uint64(numBits)+7)/8 {
+			return nil, BVHeader{}, errors.New("bit vector length does not match file size")
+		}
+		return BitVectorFromBytes(data[4:], numBits), BVHeader{Version: 1, NumBits: numBits}, nil
+	}
+
+	payload, h, err := parseVersionedBVFile(data)
+	if err != nil {
+		return nil, h, err
+	}
+	if h.Encoding == CompressedEncoding {
+		c, err := parseCompressedPayload(payload, h.NumBits)
+		if err != nil {
+			return nil, h, err
+		}
+		return c.BitVector(), h, nil
+	}
+
+	return BitVectorFromBytes(payload, h.NumBits), h, nil
+}
+
+// ReadBitVectorFileWithLayout is ReadBVFileWithLayout for packed vectors
+func ReadBitVectorFileWithLayout(fName string, l *CoverageLayout) (*BitVector, error) {
+	bv, h, err := ReadBitVectorFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.HasLayout() && h.Layout != l.Fingerprint() {
+		return nil, errors.New(fName + ": bit vector was built for a different layout")
+	}
+	if h.Granularity != RegionGranularity {
+		return nil, errors.New(fName + ": bit vector has " + h.Granularity.String() + " granularity")
+	}
+	if bv.Len() != l.NumRegions() {
+		return nil, errors.New(fName + ": bit vector length does not match layout")
+	}
+
+	return bv, nil
+}
+
+// ReadBitVectorFileWithProjection is ReadBVFileWithProjection for packed vectors
+func ReadBitVectorFileWithProjection(fName string, p *ProjectedLayout) (*BitVector, error) {
+	bv, h, err := ReadBitVectorFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Granularity != p.Granularity {
+		return nil, errors.New(fName + ": bit vector has " + h.Granularity.String() + " granularity")
+	}
+	if h.HasLayout() && h.Layout != p.fingerprint {
+		return nil, errors.New(fName + ": bit vector was built for a different layout")
+	}
+	if bv.Len() != p.Len() {
+		return nil, errors.New(fName + ": bit vector length does not match layout")
+	}
+
+	return bv, nil
+}
@@ -0,0 +1,410 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var bitVectorTestLengths = []int{1, 7, 8, 9, 63, 64, 65, 127, 128, 130, 1000}
+
+func TestBitVectorConversions(t *testing.T) {
+	r := rand.New(rand.NewSource(17))
+	for _, n := range append([]int{0}, bitVectorTestLengths...) {
+		bv := randomBools(r, n)
+		v := BitVectorFromBools(bv)
+		if v.Len() != n {
+			t.Errorf("%d: length %d", n, v.Len())
+		}
+		if !reflect.DeepEqual(v.Bools(), bv) {
+			t.Errorf("%d: unpacked %v, want %v", n, v.Bools(), bv)
+		}
+		if !reflect.DeepEqual(v.Bytes(), packBools(bv)) {
+			t.Errorf("%d: bytes %x, want %x", n, v.Bytes(), packBools(bv))
+		}
+		if !BitVectorFromBytes(packBools(bv), n).Equal(v) {
+			t.Errorf("%d: vector from bytes differs", n)
+		}
+
+		// Bits past the length, and bytes past the vector, are dropped
+		padded := append(packBools(bv), 0xff, 0xff)
+		if n%8 != 0 {
+			padded[len(padded)-3] |= 0xff >> uint(n%8)
+		}
+		if !BitVectorFromBytes(padded, n).Equal(v) {
+			t.Errorf("%d: vector from padded bytes differs", n)
+		}
+		if n > 0 && BitVectorFromBytes(nil, n).Count() != 0 {
+			t.Errorf("%d: vector from missing bytes has bits set", n)
+		}
+
+		c := v.Clone()
+		for i := 0; i < n; i += 3 {
+			c.SetTo(i, !c.Get(i))
+		}
+		if n > 0 && c.Equal(v) {
+			t.Errorf("%d: changing a clone changed the original", n)
+		}
+		if !reflect.DeepEqual(v.Bools(), bv) {
+			t.Errorf("%d: original changed", n)
+		}
+	}
+
+	if BitVectorFromBools(make([]bool, 8)).Equal(NewBitVector(9)) {
+		t.Error("vectors of different lengths are equal")
+	}
+}
+
+func TestBitVectorOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(18))
+	ops := []struct {
+		name string
+		op   func(v *BitVector, o *BitVector) error
+		want func(a bool, b bool) bool
+	}{
+		{"and", (*BitVector).And, func(a, b bool) bool { return a && b }},
+		{"or", (*BitVector).Or, func(a, b bool) bool { return a || b }},
+		{"xor", (*BitVector).Xor, func(a, b bool) bool { return a != b }},
+		{"and not", (*BitVector).AndNot, func(a, b bool) bool { return a && !b }},
+	}
+	counts := []struct {
+		name  string
+		count func(v *BitVector, o *BitVector) (int, error)
+		want  func(a bool, b bool) bool
+	}{
+		{"count and", (*BitVector).CountAnd, func(a, b bool) bool { return a && b }},
+		{"count and not", (*BitVector).CountAndNot, func(a, b bool) bool { return a && !b }},
+		{"count xor", (*BitVector).CountXor, func(a, b bool) bool { return a != b }},
+	}
+
+	for _, n := range bitVectorTestLengths {
+		a, b := randomBools(r, n), randomBools(r, n)
+		va, vb := BitVectorFromBools(a), BitVectorFromBools(b)
+		short := NewBitVector(n - 1)
+
+		for _, tt := range ops {
+			want := make([]bool, n)
+			for i := range want {
+				want[i] = tt.want(a[i], b[i])
+			}
+			v := va.Clone()
+			if err := tt.op(v, vb); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v.Bools(), want) {
+				t.Errorf("%d: %s gave %v, want %v", n, tt.name, v.Bools(), want)
+			}
+			if err := tt.op(va.Clone(), short); err == nil {
+				t.Errorf("%d: %s of vectors of different lengths", n, tt.name)
+			}
+		}
+
+		for _, tt := range counts {
+			want := 0
+			for i := range a {
+				if tt.want(a[i], b[i]) {
+					want++
+				}
+			}
+			if got, err := tt.count(va, vb); err != nil || got != want {
+				t.Errorf("%d: %s = %d, %v, want %d", n, tt.name, got, err, want)
+			}
+			if _, err := tt.count(va, short); err == nil {
+				t.Errorf("%d: %s of vectors of different lengths", n, tt.name)
+			}
+		}
+
+		covered, _ := CountCoveredRegions(a)
+		if va.Count() != covered {
+			t.Errorf("%d: count %d, want %d", n, va.Count(), covered)
+		}
+		not := va.Clone()
+		not.Not()
+		if not.Count() != n-covered {
+			t.Errorf("%d: inverse has %d bits set, want %d", n, not.Count(), n-covered)
+		}
+		not.Not()
+		if !not.Equal(va) {
+			t.Errorf("%d: inverting twice changed the vector", n)
+		}
+	}
+}
+
+func TestBitVectorIteration(t *testing.T) {
+	r := rand.New(rand.NewSource(19))
+	for _, n := range bitVectorTestLengths {
+		for _, bv := range [][]bool{randomBools(r, n), make([]bool, n), BitVectorFromBools(make([]bool, n)).Bools()} {
+			var want []int
+			for i, x := range bv {
+				if x {
+					want = append(want, i)
+				}
+			}
+			v := BitVectorFromBools(bv)
+
+			var each []int
+			v.ForEach(func(i int) {
+				each = append(each, i)
+			})
+			var next []int
+			for i := v.NextSet(-1); i >= 0; i = v.NextSet(i + 1) {
+				next = append(next, i)
+			}
+			if !reflect.DeepEqual(each, want) {
+				t.Errorf("%d: ForEach visited %v, want %v", n, each, want)
+			}
+			if !reflect.DeepEqual(next, want) {
+				t.Errorf("%d: NextSet visited %v, want %v", n, next, want)
+			}
+			if v.NextSet(n) != -1 {
+				t.Errorf("%d: found a bit past the end", n)
+			}
+		}
+	}
+}
+
+func TestBitVectorRanges(t *testing.T) {
+	r := rand.New(rand.NewSource(32))
+	for _, n := range []int{0, 1, 63, 64, 65, 130, 200} {
+		bv := randomBools(r, n)
+		v := BitVectorFromBools(bv)
+		for start := -1; start <= n+1; start++ {
+			for end := start - 1; end <= n+1; end++ {
+				want := 0
+				for i := start; i < end; i++ {
+					if i >= 0 && i < n && bv[i] {
+						want++
+					}
+				}
+				if got := v.CountRange(start, end); got != want {
+					t.Fatalf("%d: CountRange(%d, %d) = %d, want %d", n, start, end, got, want)
+				}
+				if got := v.AnyInRange(start, end); got != (want > 0) {
+					t.Fatalf("%d: AnyInRange(%d, %d) = %v, want %v", n, start, end, got, want > 0)
+				}
+			}
+		}
+	}
+}
+
+// Each packed function must agree with the []bool function it replaces
+func TestBitVectorMatchesBools(t *testing.T) {
+	r := rand.New(rand.NewSource(20))
+	for _, n := range bitVectorTestLengths[2:] {
+		a, b, exclude := randomBools(r, n), randomBools(r, n), randomBools(r, n)
+		va, vb, vexclude := BitVectorFromBools(a), BitVectorFromBools(b), BitVectorFromBools(exclude)
+
+		diff, _ := DiffTwoBVs(a, b)
+		if got, err := DiffTwoBitVectors(va, vb); err != nil || got != diff {
+			t.Errorf("%d: diff %d, %v, want %d", n, got, err, diff)
+		}
+		diff, total, _ := DiffBVsWithExclude(a, b, exclude)
+		if got, gotTotal, err := DiffBitVectorsWithExclude(va, vb, vexclude); err != nil || got != diff ||
+			gotTotal != total {
+			t.Errorf("%d: diff with exclude %d, %d, %v, want %d, %d", n, got, gotTotal, err, diff, total)
+		}
+		covered, total, _ := CountCoveredRegionsWithExclude(a, exclude)
+		if got, gotTotal, err := CountCoveredBitVectorWithExclude(va, vexclude); err != nil || got != covered ||
+			gotTotal != total {
+			t.Errorf("%d: covered with exclude %d, %d, %v, want %d, %d", n, got, gotTotal, err, covered, total)
+		}
+		covered, total = CountCoveredRegions(a)
+		if got, gotTotal := CountCoveredBitVector(va); got != covered || gotTotal != total {
+			t.Errorf("%d: covered %d, %d, want %d, %d", n, got, gotTotal, covered, total)
+		}
+
+		combined, blocks, _ := CombineBVs([][]bool{a, b, exclude})
+		v, gotBlocks, err := CombineBitVectors([]*BitVector{va, nil, vb, vexclude})
+		if err != nil || !reflect.DeepEqual(v.Bools(), combined) || gotBlocks != blocks {
+			t.Errorf("%d: combined %v, %d, %v, want %v, %d", n, v, gotBlocks, err, combined, blocks)
+		}
+
+		vectors := [][]bool{a, b, exclude, randomBools(r, n)}
+		packed := []*BitVector{va, vb, vexclude, BitVectorFromBools(vectors[3])}
+		for _, k := range []int{1, 2, 3, 4} {
+			median, _ := GetMedianBV(vectors[:k])
+			if v, err := GetMedianBitVector(packed[:k]); err != nil || !reflect.DeepEqual(v.Bools(), median) {
+				t.Errorf("%d: median of %d vectors differs", n, k)
+			}
+			for _, threshold := range []float64{0, 0.25, 0.5, 0.9, 1} {
+				want, _ := GetThresholdBV(vectors[:k], threshold)
+				v, err := GetThresholdBitVector(packed[:k], threshold)
+				if err != nil || !reflect.DeepEqual(v.Bools(), want) {
+					t.Errorf("%d: threshold %v of %d vectors differs", n, threshold, k)
+				}
+			}
+		}
+
+		short := NewBitVector(n - 1)
+		if _, _, err := DiffBitVectorsWithExclude(va, vb, short); err == nil {
+			t.Errorf("%d: diffed with an exclude vector of the wrong length", n)
+		}
+		if _, _, err := CountCoveredBitVectorWithExclude(va, short); err == nil {
+			t.Errorf("%d: counted with an exclude vector of the wrong length", n)
+		}
+		if _, _, err := CombineBitVectors([]*BitVector{va, short}); err == nil {
+			t.Errorf("%d: combined vectors of different lengths", n)
+		}
+		if _, err := GetMedianBitVector([]*BitVector{va, short}); err == nil {
+			t.Errorf("%d: took the median of vectors of different lengths", n)
+		}
+	}
+
+	if _, _, err := CombineBitVectors(nil); err == nil {
+		t.Error("combined no vectors")
+	}
+	if _, err := GetMedianBitVector(nil); err == nil {
+		t.Error("took the median of no vectors")
+	}
+	if _, err := GetThresholdBitVector([]*BitVector{NewBitVector(0)}, 0.5); err == nil {
+		t.Error("thresholded an empty vector")
+	}
+}
+
+func TestBitVectorCovMap(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	bv := []bool{true, false, false, true}
+	covMap, err := l.CovMap(bv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ConvertCovMapToBitVector(covMap); !reflect.DeepEqual(v.Bools(), bv) {
+		t.Errorf("converted to %v, want %v", v.Bools(), bv)
+	}
+	got, err := ConvertBitVectorToCovMap(BitVectorFromBools(bv), l.Structure())
+	if err != nil || !reflect.DeepEqual(got, covMap) {
+		t.Errorf("converted to %v, %v, want %v", got, err, covMap)
+	}
+	packed, err := l.CovMapFromBitVector(BitVectorFromBools(bv))
+	if err != nil || !reflect.DeepEqual(packed, covMap) {
+		t.Errorf("layout converted to %v, %v, want %v", packed, err, covMap)
+	}
+
+	metadata := l.Metadata()
+	if v := GenerateExcludeBitVector(metadata, CountedRegions); !reflect.DeepEqual(v.Bools(),
+		GenerateExcludeBV(metadata, CountedRegions)) {
+		t.Error("exclude vectors differ")
+	}
+}
+
+func TestBitVectorFileRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(21))
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "coverage.bv")
+	for _, n := range bitVectorTestLengths {
+		for _, e := range []BVEncoding{PackedEncoding, CompressedEncoding} {
+			bv := randomBools(r, n)
+			v := BitVectorFromBools(bv)
+			h := BVHeader{Encoding: e, Site: "a.com"}
+			if err := WriteBitVectorFile(fName, v, h); err != nil {
+				t.Fatal(err)
+			}
+			got, gotHeader, err := ReadBVFile(fName)
+			if err != nil || !reflect.DeepEqual(got, bv) {
+				t.Errorf("%d/%v: read %v, %v, want %v", n, e, got, err, bv)
+			}
+			h.Version = bvFileVersion
+			h.NumBits = n
+			if gotHeader != h {
+				t.Errorf("%d/%v: header %+v, want %+v", n, e, gotHeader, h)
+			}
+
+			if err = WriteBVFile(fName, bv, BVHeader{Encoding: e}); err != nil {
+				t.Fatal(err)
+			}
+			packed, _, err := ReadBitVectorFile(fName)
+			if err != nil || !packed.Equal(v) {
+				t.Errorf("%d/%v: read packed %v, %v", n, e, packed, err)
+			}
+		}
+
+		bv := randomBools(r, n)
+		if err := WriteFileFromBV(fName, bv); err != nil {
+			t.Fatal(err)
+		}
+		v, h, err := ReadBitVectorFile(fName)
+		if err != nil || !reflect.DeepEqual(v.Bools(), bv) || h != (BVHeader{Version: 1, NumBits: n}) {
+			t.Errorf("%d: read version 1 file as %v, %+v, %v", n, v, h, err)
+		}
+	}
+}
+
+// Both parsers must reject the same files
+func TestParseBitVectorFileInvalid(t *testing.T) {
+	bv := randomBools(rand.New(rand.NewSource(22)), 100)
+	fName := filepath.Join(t.TempDir(), "coverage.bv")
+	if err := WriteBVFile(fName, bv, BVHeader{Encoding: CompressedEncoding}); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := ioutil.ReadFile(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short version 1 file", []byte{1, 0}},
+		{"truncated version 1 file", []byte{100, 0, 0, 0, 1}},
+		{"long version 1 file", []byte{1, 0, 0, 0, 0x80, 0}},
+		{"truncated compressed payload", compressed[:len(compressed)-1]},
+		{"corrupt compressed payload", append(append([]byte{}, compressed[:len(compressed)-1]...),
+			compressed[len(compressed)-1]^0x80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseBVFile(tt.data); err == nil {
+				t.Error("ParseBVFile accepted the file")
+			}
+			if _, _, err := ParseBitVectorFile(tt.data); err == nil {
+				t.Error("ParseBitVectorFile accepted the file")
+			}
+		})
+	}
+}
+
+func TestReadBitVectorFileWithLayout(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	p, err := NewProjectedLayout(l, FunctionGranularity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	bv := []bool{true, false, true, false}
+	regions := filepath.Join(dir, "coverage.bv")
+	if err = WriteBVFile(regions, bv, BVHeader{Layout: l.Fingerprint()}); err != nil {
+		t.Fatal(err)
+	}
+	functions := filepath.Join(dir, "function.bv")
+	if err = p.ProjectBVFile(regions, functions); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ReadBitVectorFileWithLayout(regions, l)
+	if err != nil || !reflect.DeepEqual(v.Bools(), bv) {
+		t.Errorf("read %v, %v, want %v", v, err, bv)
+	}
+	want, err := ReadBVFileWithProjection(functions, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = ReadBitVectorFileWithProjection(functions, p)
+	if err != nil || !reflect.DeepEqual(v.Bools(), want) {
+		t.Errorf("read projection %v, %v, want %v", v, err, want)
+	}
+
+	other := mustParseLayout(t, layoutFileTestReport)
+	if _, err = ReadBitVectorFileWithLayout(regions, other); err == nil {
+		t.Error("read a vector with the wrong layout")
+	}
+	if _, err = ReadBitVectorFileWithLayout(functions, l); err == nil {
+		t.Error("read a function vector as a region vector")
+	}
+	if _, err = ReadBitVectorFileWithProjection(regions, p); err == nil {
+		t.Error("read a region vector as a function vector")
+	}
+}
@@ -0,0 +1,364 @@
+package profparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BranchCoverage records which directions of a branch were taken
+type BranchCoverage struct {
+	Taken    bool // The condition was true at least once
+	NotTaken bool // The condition was false at least once
+}
+
+// Covered returns true if both directions of the branch were taken
+func (b BranchCoverage) Covered() bool {
+	return b.Taken && b.NotTaken
+}
+
+type BranchMapDiff struct {
+	TotalBranches          int
+	FirstFullyCovered      int
+	SecondFullyCovered     int
+	FirstOnlyFullyCovered  int
+	SecondOnlyFullyCovered int
+	Same                   int // Both maps took exactly the same directions
+	Different              int
+
+	// Diff of the individual directions, treating each one as a region
+	Directions CovMapDiff
+}
+
+// ReadFileToBranchMap reads the branches in a coverage report, recording which directions of each
+// branch were taken
+func ReadFileToBranchMap(fName string) (map[string]map[string][]BranchCoverage, CovMapProperties, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return ParseBranchMap(f)
+}
+
+// ParseBranchMap is ReadFileToBranchMap for an arbitrary io.Reader
+func ParseBranchMap(r io.Reader) (map[string]map[string][]BranchCoverage, CovMapProperties, error) {
+	return BranchMapFromRecords(NewParser(r))
+}
+
+// BranchMapFromRecords builds a branch map from the records produced by src. Every function is
+// present, even if it has no branches.
+func BranchMapFromRecords(src RecordSource) (map[string]map[string][]BranchCoverage, CovMapProperties, error) {
+	branchMap := make(map[string]map[string][]BranchCoverage)
+
+	totalBranches := 0
+	totalFiles := 0
+	totalFuncs := 0
+
+	err := src.Walk(func(rec Record) error {
+		switch rec.Kind {
+		case FileRecord:
+			if _, ok := branchMap[rec.File]; !ok {
+				branchMap[rec.File] = make(map[string][]BranchCoverage)
+			}
+			totalFiles += 1
+		case FunctionRecord:
+			if _, ok := branchMap[rec.File][rec.Function]; !ok {
+				branchMap[rec.File][rec.Function] = make([]BranchCoverage, 0)
+			}
+			totalFuncs += 1
+		case BranchRecord:
+			branchMap[rec.File][rec.Function] = append(branchMap[rec.File][rec.Function], BranchCoverage{
+				Taken:    rec.Executions != 0,
+				NotTaken: rec.FalseExecutions != 0,
+			})
+			totalBranches += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+
+	props := CovMapProperties{
+		NumFiles:     totalFiles,
+		NumFunctions: totalFuncs,
+		NumBranches:  totalBranches,
+	}
+
+	return branchMap, props, nil
+}
+
+// ReadBranchMetadata is ReadCovMetadata for the branches in a coverage report
+func ReadBranchMetadata(fname string) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return BranchMetadataFromRecords(NormalizePaths(NewParser(f), DefaultPathNormalizer()))
+}
+
+// BranchMetadataFromRecords builds a metadata map for the branches produced by src. Together with
+// ConvertBranchMapToStructure, it can be passed to GenerateBVIndexToCodeRegionMap to look up the
+// branch behind each pair of bits in a branch vector.
+func BranchMetadataFromRecords(src RecordSource) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
+	metaMap := make(map[string]map[string][]CodeRegion)
+	totalFiles := 0
+	totalFuncs := 0
+	totalBranches := 0
+
+	err := src.Walk(func(rec Record) error {
+		currentFile := rec.File
+		switch rec.Kind {
+		case FileRecord:
+			if _, ok := metaMap[currentFile]; !ok {
+				metaMap[currentFile] = make(map[string][]CodeRegion)
+				totalFiles += 1
+			}
+		case FunctionRecord:
+			if _, ok := metaMap[currentFile][rec.Function]; !ok {
+				metaMap[currentFile][rec.Function] = make([]CodeRegion, 0)
+				totalFuncs += 1
+			}
+		case BranchRecord:
+			metaMap[currentFile][rec.Function] = append(metaMap[currentFile][rec.Function], recordCodeRegion(rec))
+			totalBranches += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+
+	props := CovMapProperties{
+		NumFiles:     totalFiles,
+		NumFunctions: totalFuncs,
+		NumBranches:  totalBranches,
+	}
+
+	return metaMap, props, nil
+}
+
+func ConvertBranchMapToStructure(branchMap map[string]map[string][]BranchCoverage) map[string]map[string]int {
+	structure := make(map[string]map[string]int)
+
+	for fileName := range branchMap {
+		structure[fileName] = make(map[string]int)
+		for funcName := range branchMap[fileName] {
+			structure[fileName][funcName] = len(branchMap[fileName][funcName])
+		}
+	}
+
+	return structure
+}
+
+// ConvertBranchMapToBools flattens a branch map into a branch vector. Files and functions are
+// ordered as in ConvertCovMapToBools, and each branch takes two bits: taken, then not taken.
+func ConvertBranchMapToBools(branchMap map[string]map[string][]BranchCoverage) []bool {
+	bools := make([]bool, 0)
+	fileNames := make([]string, 0, len(branchMap))
+	for k := range branchMap {
+		fileNames = append(fileNames, k)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		funcNames := make([]string, 0, len(branchMap[fileName]))
+		for k := range branchMap[fileName] {
+			funcNames = append(funcNames, k)
+		}
+
+		sort.Strings(funcNames)
+
+		for _, funcName := range funcNames {
+			for _, branch := range branchMap[fileName][funcName] {
+				bools = append(bools, branch.Taken, branch.NotTaken)
+			}
+		}
+	}
+
+	return bools
+}
+
+// ConvertBoolsToBranchMap is the inverse of ConvertBranchMapToBools. The structure holds the number
+// of branches in each function.
+func ConvertBoolsToBranchMap(bools []bool, structure map[string]map[string]int) (map[string]map[string][]BranchCoverage, error) {
+	branchMap := make(map[string]map[string][]BranchCoverage)
+
+	fileNames := make([]string, 0, len(structure))
+	total := 0
+	for k := range structure {
+		fileNames = append(fileNames, k)
+		for _, n := range structure[k] {
+			total += n
+		}
+	}
+	sort.Strings(fileNames)
+
+	if 2*total != len(bools) {
+		return nil, errors.New("branch vector length does not match structure")
+	}
+
+	currentIndex := 0
+
+	for _, fileName := range fileNames {
+		branchMap[fileName] = make(map[string][]BranchCoverage)
+
+		funcNames := make([]string, 0, len(structure[fileName]))
+		for k := range structure[fileName] {
+			funcNames = append(funcNames, k)
+		}
+
+		sort.Strings(funcNames)
+
+		for _, funcName := range funcNames {
+			branches := make([]BranchCoverage, structure[fileName][funcName])
+			for i := range branches {
+				branches[i].Taken = bools[currentIndex]
+				branches[i].NotTaken = bools[currentIndex+1]
+				currentIndex += 2
+			}
+			branchMap[fileName][funcName] = branches
+		}
+	}
+
+	return branchMap, nil
+}
+
+// GetBranchPathCrawl returns the path to the branch vector file for a crawl
+func GetBranchPathCrawl(crawlPath string) (string, error) {
+	branchPath := path.Join(crawlPath, "coverage", "coverage.brv")
+	if _, err := os.Stat(branchPath); os.IsNotExist(err) {
+		return "", errors.New("branch data does not exist")
+	}
+
+	return branchPath, nil
+}
+
+// BranchPathForCovPath given the path to a coverage.bv file, returns the path of the companion
+// branch vector file
+func BranchPathForCovPath(covPath string) string {
+	return strings.TrimSuffix(covPath, ".bv") + ".brv"
+}
+
+// WriteFileFromBranchBV writes a branch vector to disk. The format is the same as for a .bv file,
+// holding two bits per branch.
+func WriteFileFromBranchBV(fName string, bv []bool) error {
+	if len(bv)%2 != 0 {
+		return errors.New("branch vector has an odd number of bits")
+	}
+
+	return WriteFileFromBV(fName, bv)
+}
+
+func ReadBranchBVFileToBV(fName string) ([]bool, error) {
+	bv, err := ReadBVFileToBV(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bv)%2 != 0 {
+		return nil, errors.New("branch vector has an odd number of bits")
+	}
+
+	return bv, nil
+}
+
+// CountCoveredBranches returns the number of branches with both directions taken, the number of
+// directions taken, and the total number of branches in a branch vector
+func CountCoveredBranches(bv []bool) (int, int, int) {
+	covered := 0
+	directions := 0
+	for i := 0; i+1 < len(bv); i += 2 {
+		if bv[i] && bv[i+1] {
+			covered += 1
+		}
+		if bv[i] {
+			directions += 1
+		}
+		if bv[i+1] {
+			directions += 1
+		}
+	}
+	return covered, directions, len(bv) / 2
+}
+
+func DiffTwoBranchMaps(b1 map[string]map[string][]BranchCoverage, b2 map[string]map[string][]BranchCoverage, filePrefix string) (BranchMapDiff, error) {
+	var d BranchMapDiff
+
+	for fileName := range b1 {
+		if !strings.HasPrefix(fileName, filePrefix) {
+			continue
+		}
+
+		if _, ok := b2[fileName]; !ok {
+			return d, errors.New("mismatched branch maps")
+		}
+
+		for funcName := range b1[fileName] {
+			branches2, ok := b2[fileName][funcName]
+			if !ok || len(branches2) != len(b1[fileName][funcName]) {
+				return d, errors.New("mismatched branch maps")
+			}
+
+			for i, br1 := range b1[fileName][funcName] {
+				br2 := branches2[i]
+				d.TotalBranches += 1
+
+				if br1.Covered() {
+					d.FirstFullyCovered += 1
+				}
+				if br2.Covered() {
+					d.SecondFullyCovered += 1
+				}
+				if br1.Covered() && !br2.Covered() {
+					d.FirstOnlyFullyCovered += 1
+				} else if !br1.Covered() && br2.Covered() {
+					d.SecondOnlyFullyCovered += 1
+				}
+
+				if br1 == br2 {
+					d.Same += 1
+				} else {
+					d.Different += 1
+				}
+
+				diffDirection(&d.Directions, br1.Taken, br2.Taken)
+				diffDirection(&d.Directions, br1.NotTaken, br2.NotTaken)
+			}
+		}
+	}
+
+	return d, nil
+}
+
+func diffDirection(d *CovMapDiff, val1 bool, val2 bool) {
+	d.TotalRegions += 1
+	if val1 {
+		d.FirstCovered += 1
+	}
+	if val2 {
+		d.SecondCovered += 1
+	}
+	if val1 || val2 {
+		d.TotalCovered += 1
+	}
+
+	if val1 == val2 {
+		d.Same += 1
+		return
+	}
+
+	d.Different += 1
+	if val1 {
+		d.FirstOnlyCovered += 1
+	} else {
+		d.SecondOnlyCovered += 1
+	}
+}
@@ -0,0 +1,192 @@
+package profparse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const branchTestReport = "[FILE] ../../a/x.cc\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 5\n" +
+	"[BRANCH] 0 2,3,2,9 5 0\n[BRANCH] 0 4,3,4,9 2 3\n" +
+	"[FILE] ../../a/y.cc\n[FUNCTION] g\n[BLOCK] 0 0 1,2,3,4 0\n[BRANCH] 0 2,1,2,5 0 0\n[FUNCTION] h\n"
+
+func TestParseBranchMap(t *testing.T) {
+	branchMap, props, err := ParseBranchMap(strings.NewReader(branchTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string][]BranchCoverage{
+		"../../a/x.cc": {"f": {{Taken: true}, {Taken: true, NotTaken: true}}},
+		"../../a/y.cc": {"g": {{}}, "h": {}},
+	}
+	if !reflect.DeepEqual(branchMap, want) {
+		t.Errorf("branch map %v, want %v", branchMap, want)
+	}
+	if props.NumBranches != 3 || props.NumFunctions != 3 || props.NumFiles != 2 {
+		t.Errorf("properties %+v", props)
+	}
+
+	// Branches are not regions
+	covMap, _, err := ParseCovMap(strings.NewReader(branchTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bv := ConvertCovMapToBools(covMap); len(bv) != 2 {
+		t.Errorf("%d regions, want 2", len(bv))
+	}
+
+	metadata, _, err := BranchMetadataFromRecords(NewParser(strings.NewReader(branchTestReport)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := metadata["../../a/x.cc"]["f"][1]
+	if second.LineStart != 4 || second.ColumnEnd != 9 || second.Kind != RegionBranch {
+		t.Errorf("second branch of f is %+v", second)
+	}
+}
+
+func TestBranchesMatchExport(t *testing.T) {
+	mappings, err := ReadCoverageMapping(filepath.Join("testdata", "covmap", "small.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadProfdata(filepath.Join("testdata", "covmap", "small.profdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "covmap", "small.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	branchMap, props, err := BranchMapFromRecords(MappingRecords(mappings, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBranchMap, wantProps, err := BranchMapFromRecords(NewExportReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(branchMap, wantBranchMap) || props != wantProps {
+		t.Errorf("branch map %v (%+v), want %v (%+v)", branchMap, props, wantBranchMap, wantProps)
+	}
+	if props.NumBranches != 1 || !branchMap["/src/out/../../a.cc"]["main"][0].Covered() {
+		t.Errorf("main's branch is not covered in %v", branchMap)
+	}
+}
+
+func TestBranchVectorFile(t *testing.T) {
+	branchMap, _, err := ParseBranchMap(strings.NewReader(branchTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bv := ConvertBranchMapToBools(branchMap)
+	if !reflect.DeepEqual(bv, []bool{true, false, true, true, false, false}) {
+		t.Fatalf("branch vector %v", bv)
+	}
+
+	fName := BranchPathForCovPath(filepath.Join(t.TempDir(), "coverage.bv"))
+	if err = WriteFileFromBranchBV(fName, bv); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBranchBVFileToBV(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	structure := ConvertBranchMapToStructure(branchMap)
+	roundTrip, err := ConvertBoolsToBranchMap(read, structure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, branchMap) {
+		t.Errorf("read back %v, want %v", roundTrip, branchMap)
+	}
+
+	if _, err = ConvertBoolsToBranchMap(read[:4], structure); err == nil {
+		t.Error("expected an error for a vector that does not match the structure")
+	}
+	if err = WriteFileFromBranchBV(fName, bv[:5]); err == nil {
+		t.Error("expected an error for an odd number of bits")
+	}
+	if err = WriteFileFromBV(fName, bv[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadBranchBVFileToBV(fName); err == nil {
+		t.Error("read a branch vector with an odd number of bits")
+	}
+}
+
+func TestCountCoveredBranches(t *testing.T) {
+	tests := []struct {
+		bv         []bool
+		covered    int
+		directions int
+		total      int
+	}{
+		{nil, 0, 0, 0},
+		{[]bool{false, false}, 0, 0, 1},
+		{[]bool{true, false, false, true}, 0, 2, 2},
+		{[]bool{true, true, true, false}, 1, 3, 2},
+	}
+	for _, tt := range tests {
+		covered, directions, total := CountCoveredBranches(tt.bv)
+		if covered != tt.covered || directions != tt.directions || total != tt.total {
+			t.Errorf("CountCoveredBranches(%v) = %d, %d, %d, want %d, %d, %d", tt.bv, covered, directions,
+				total, tt.covered, tt.directions, tt.total)
+		}
+	}
+}
+
+func TestBranchTreeSummary(t *testing.T) {
+	branchMap, _, err := ParseBranchMap(strings.NewReader(branchTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := GetBranchTreeSummary(branchMap, -1, DefaultPathNormalizer())
+	a := tree["a"]
+	if a.TotalBranches != 3 || a.CoveredBranches != 1 || a.CoveredDirections != 3 || a.PercentCovered != 0.5 {
+		t.Errorf("summary of a is %+v", a)
+	}
+}
+
+func TestDiffTwoBranchMaps(t *testing.T) {
+	first := map[string]map[string][]BranchCoverage{
+		"a.cc": {"f": {{Taken: true, NotTaken: true}, {Taken: true}, {}}},
+		"b.cc": {"g": {{NotTaken: true}}},
+	}
+	second := map[string]map[string][]BranchCoverage{
+		"a.cc": {"f": {{Taken: true}, {Taken: true, NotTaken: true}, {}}},
+		"b.cc": {"g": {{NotTaken: true}}},
+	}
+
+	d, err := DiffTwoBranchMaps(first, second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BranchMapDiff{TotalBranches: 4, FirstFullyCovered: 1, SecondFullyCovered: 1, FirstOnlyFullyCovered: 1,
+		SecondOnlyFullyCovered: 1, Same: 2, Different: 2}
+	directions := d.Directions
+	d.Directions = CovMapDiff{}
+	if d != want {
+		t.Errorf("diff %+v, want %+v", d, want)
+	}
+	if directions.TotalRegions != 8 || directions.FirstOnlyCovered != 1 || directions.SecondOnlyCovered != 1 {
+		t.Errorf("direction diff %+v", directions)
+	}
+
+	d, err = DiffTwoBranchMaps(first, second, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TotalBranches != 1 || d.Same != 1 {
+		t.Errorf("diff of b.cc %+v", d)
+	}
+
+	second["a.cc"]["f"] = second["a.cc"]["f"][:2]
+	if _, err = DiffTwoBranchMaps(first, second, ""); err == nil {
+		t.Error("expected an error for functions with different numbers of branches")
+	}
+}
@@ -0,0 +1,643 @@
+package profparse
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BVExpr is a parsed bit vector expression, which combines .bv files with set algebra, e.g.
+//
+//	(union("results/*/*/coverage/coverage.bv") - baseline) & ~exclude
+//	count(majority("results/a.com/*/coverage/coverage.bv") ^ majority("results/b.com/*/coverage/coverage.bv"))
+//
+// Operands are names bound to files when the expression is evaluated, or quoted paths. From lowest
+// to highest precedence the operators are:
+//
+//	|       union
+//	^       symmetric difference
+//	& -     intersection and difference (a & ~b)
+//	~       complement
+//
+// The functions are:
+//
+//	union(v...)              regions covered by any of the vectors
+//	intersection(v...)       regions covered by all of the vectors
+//	majority(v...)           regions covered by at least half of the vectors, as GetMedianBV
+//	threshold(frac, v...)    regions covered by at least frac of the vectors, as GetThresholdBV
+//	count(v)                 number of regions covered by v
+//
+// The arguments of the first four may be expressions or quoted globs, which match .bv files in
+// directories or packs. Globs are read one vector at a time, so they may match any number of files.
+type BVExpr struct {
+	root bvNode
+}
+
+// BVExprResult is the value of a bit vector expression. Expressions yield either a vector or,
+// through count(), a number.
+type BVExprResult struct {
+	Vector  []bool
+	Header  BVHeader // Layout and granularity shared by the inputs, if they record one
+	Count   int
+	IsCount bool
+	Inputs  int // Number of files read
+}
+
+type bvNode interface {
+	pos() int
+}
+
+type bvName struct {
+	at   int
+	name string
+}
+
+type bvPath struct {
+	at   int
+	path string
+}
+
+type bvNumber struct {
+	at    int
+	value float64
+}
+
+type bvUnary struct {
+	at int
+	op byte
+	x  bvNode
+}
+
+type bvBinary struct {
+	at int
+	op byte
+	x  bvNode
+	y  bvNode
+}
+
+type bvCall struct {
+	at   int
+	fn   string
+	args []bvNode
+}
+
+func (n bvName) pos() int   { return n.at }
+func (n bvPath) pos() int   { return n.at }
+func (n bvNumber) pos() int { return n.at }
+func (n bvUnary) pos() int  { return n.at }
+func (n bvBinary) pos() int { return n.at }
+func (n bvCall) pos() int   { return n.at }
+
+// ParseBVExpr parses a bit vector expression
+func ParseBVExpr(src string) (*BVExpr, error) {
+	p := bvParser{src: src}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseUnion()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != bvTokEOF {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	if _, ok := root.(bvNumber); ok {
+		return nil, fmt.Errorf("bv expression: expected a vector, found a number at offset %d", root.pos())
+	}
+
+	return &BVExpr{root: root}, nil
+}
+
+// Names returns the names the expression expects to be bound to files, in order of first use
+func (e *BVExpr) Names() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+
+	var walk func(n bvNode)
+	walk = func(n bvNode) {
+		switch n := n.(type) {
+		case bvName:
+			if !seen[n.name] {
+				seen[n.name] = true
+				names = append(names, n.name)
+			}
+		case bvUnary:
+			walk(n.x)
+		case bvBinary:
+			walk(n.x)
+			walk(n.y)
+		case bvCall:
+			for _, a := range n.args {
+				walk(a)
+			}
+		}
+	}
+	walk(e.root)
+
+	return names
+}
+
+// Eval evaluates the expression, reading the file bound to each name in inputs. All of the vectors
+// must have the same length, and the same layout if they record one.
+func (e *BVExpr) Eval(inputs map[string]string) (BVExprResult, error) {
+	ev := bvEvaluator{
+		inputs: inputs,
+		cache:  make(map[string][]bool),
+	}
+
+	v, err := ev.eval(e.root)
+	if err != nil {
+		return BVExprResult{}, err
+	}
+
+	res := BVExprResult{
+		Header: ev.header,
+		Inputs: ev.reads,
+	}
+	if v.isNum {
+		res.Count = int(v.num)
+		res.IsCount = true
+	} else {
+		res.Vector = v.bv
+		res.Header.NumBits = len(v.bv)
+	}
+
+	return res, nil
+}
+
+// Lexer
+
+type bvTokKind int
+
+const (
+	bvTokEOF bvTokKind = iota
+	bvTokOp
+	bvTokName
+	bvTokString
+	bvTokNumber
+)
+
+type bvParser struct {
+	src string
+	off int
+
+	tok  bvTokKind
+	at   int
+	op   byte
+	text string
+}
+
+func (p *bvParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bv expression: "+format+" at offset %d", append(args, p.at)...)
+}
+
+func (p *bvParser) describe() string {
+	switch p.tok {
+	case bvTokEOF:
+		return "end of expression"
+	case bvTokOp:
+		return "'" + string(p.op) + "'"
+	case bvTokString:
+		return "string " + strconv.Quote(p.text)
+	}
+	return p.text
+}
+
+func (p *bvParser) next() error {
+	for p.off < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.off]) >= 0 {
+		p.off++
+	}
+	p.at = p.off
+	if p.off >= len(p.src) {
+		p.tok = bvTokEOF
+		return nil
+	}
+
+	c := p.src[p.off]
+	switch {
+	case strings.IndexByte("|&^~-(),", c) >= 0:
+		p.tok = bvTokOp
+		p.op = c
+		p.off++
+
+	case c == '"' || c == '\'':
+		end := p.off + 1
+		for end < len(p.src) && p.src[end] != c {
+			if c == '"' && p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		p.tok = bvTokString
+		p.text = p.src[p.off+1 : end]
+		if c == '"' {
+			s, err := strconv.Unquote(p.src[p.off : end+1])
+			if err != nil {
+				return p.errorf("invalid string")
+			}
+			p.text = s
+		}
+		p.off = end + 1
+
+	case c >= '0' && c <= '9' || c == '.':
+		end := p.off
+		for end < len(p.src) && (p.src[end] >= '0' && p.src[end] <= '9' || p.src[end] == '.') {
+			end++
+		}
+		p.tok = bvTokNumber
+		p.text = p.src[p.off:end]
+		p.off = end
+
+	case isBVNameChar(c, true):
+		end := p.off
+		for end < len(p.src) && isBVNameChar(p.src[end], false) {
+			end++
+		}
+		p.tok = bvTokName
+		p.text = p.src[p.off:end]
+		p.off = end
+
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+
+	return nil
+}
+
+func isBVNameChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func (p *bvParser) isOp(op byte) bool {
+	return p.tok == bvTokOp && p.op == op
+}
+
+func (p *bvParser) expect(op byte) error {
+	if !p.isOp(op) {
+		return p.errorf("expected '%c', found %s", op, p.describe())
+	}
+	return p.next()
+}
+
+// Parser, one function per precedence level
+
+func (p *bvParser) parseBinary(ops string, operand func() (bvNode, error)) (bvNode, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok == bvTokOp && strings.IndexByte(ops, p.op) >= 0 {
+		op, at := p.op, p.at
+		err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = bvBinary{at: at, op: op, x: x, y: y}
+	}
+
+	return x, nil
+}
+
+func (p *bvParser) parseUnion() (bvNode, error) {
+	return p.parseBinary("|", p.parseXor)
+}
+
+func (p *bvParser) parseXor() (bvNode, error) {
+	return p.parseBinary("^", p.parseAnd)
+}
+
+func (p *bvParser) parseAnd() (bvNode, error) {
+	return p.parseBinary("&-", p.parseUnary)
+}
+
+func (p *bvParser) parseUnary() (bvNode, error) {
+	if p.isOp('~') {
+		at := p.at
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return bvUnary{at: at, op: '~', x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *bvParser) parsePrimary() (bvNode, error) {
+	at := p.at
+
+	switch p.tok {
+	case bvTokString:
+		n := bvPath{at: at, path: p.text}
+		return n, p.next()
+
+	case bvTokNumber:
+		v, err := strconv.ParseFloat(p.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.text)
+		}
+		return bvNumber{at: at, value: v}, p.next()
+
+	case bvTokName:
+		name := p.text
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp('(') {
+			return bvName{at: at, name: name}, nil
+		}
+		return p.parseCall(at, name)
+
+	case bvTokOp:
+		if p.op == '(' {
+			err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			x, err := p.parseUnion()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(')')
+		}
+	}
+
+	return nil, p.errorf("unexpected %s", p.describe())
+}
+
+func (p *bvParser) parseCall(at int, fn string) (bvNode, error) {
+	switch fn {
+	case "union", "intersection", "majority", "threshold", "count":
+	default:
+		return nil, fmt.Errorf("bv expression: unknown function %s at offset %d", fn, at)
+	}
+
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	call := bvCall{at: at, fn: fn}
+	for !p.isOp(')') {
+		if len(call.args) > 0 {
+			err = p.expect(',')
+			if err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, a)
+	}
+
+	switch {
+	case fn == "count" && len(call.args) != 1:
+		return nil, fmt.Errorf("bv expression: count takes one argument at offset %d", at)
+	case fn == "threshold" && len(call.args) < 2:
+		return nil, fmt.Errorf("bv expression: threshold takes a fraction and at least one vector at offset %d", at)
+	case len(call.args) == 0:
+		return nil, fmt.Errorf("bv expression: %s takes at least one vector at offset %d", fn, at)
+	}
+
+	return call, p.next()
+}
+
+// Evaluation
+
+type bvValue struct {
+	bv    []bool
+	num   float64
+	isNum bool
+}
+
+type bvEvaluator struct {
+	inputs map[string]string
+	cache  map[string][]bool // Vectors bound to names, which may be used more than once
+
+	header BVHeader // First header that records a layout
+	length int
+	reads  int
+}
+
+func bvEvalError(n bvNode, err error) error {
+	return fmt.Errorf("bv expression: %v at offset %d", err, n.pos())
+}
+
+// read reads a vector, checking it against the ones read before
+func (ev *bvEvaluator) read(fName string) ([]bool, error) {
+	bv, h, err := ReadBVFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	ev.reads++
+
+	err = CheckSameLayout(ev.header, h)
+	if err != nil {
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+	if ev.reads > 1 && len(bv) != ev.length {
+		return nil, errors.New(fName + ": bit vector length does not match other vectors")
+	}
+	ev.length = len(bv)
+	if !ev.header.HasLayout() && h.HasLayout() {
+		ev.header = BVHeader{Granularity: h.Granularity, Layout: h.Layout}
+	}
+
+	return bv, nil
+}
+
+func (ev *bvEvaluator) eval(n bvNode) (bvValue, error) {
+	switch n := n.(type) {
+	case bvName:
+		if bv, ok := ev.cache[n.name]; ok {
+			return bvValue{bv: bv}, nil
+		}
+		fName, ok := ev.inputs[n.name]
+		if !ok {
+			return bvValue{}, bvEvalError(n, errors.New("no file for "+n.name))
+		}
+		bv, err := ev.read(fName)
+		if err != nil {
+			return bvValue{}, bvEvalError(n, err)
+		}
+		ev.cache[n.name] = bv
+		return bvValue{bv: bv}, nil
+
+	case bvPath:
+		bv, err := ev.read(n.path)
+		if err != nil {
+			return bvValue{}, bvEvalError(n, err)
+		}
+		return bvValue{bv: bv}, nil
+
+	case bvNumber:
+		return bvValue{num: n.value, isNum: true}, nil
+
+	case bvUnary:
+		x, err := ev.evalVector(n.x)
+		if err != nil {
+			return bvValue{}, err
+		}
+		res := make([]bool, len(x))
+		for i := range x {
+			res[i] = !x[i]
+		}
+		return bvValue{bv: res}, nil
+
+	case bvBinary:
+		return ev.evalBinary(n)
+
+	case bvCall:
+		return ev.evalCall(n)
+	}
+
+	return bvValue{}, errors.New("bv expression: unknown node")
+}
+
+func (ev *bvEvaluator) evalVector(n bvNode) ([]bool, error) {
+	v, err := ev.eval(n)
+	if err != nil {
+		return nil, err
+	}
+	if v.isNum {
+		return nil, bvEvalError(n, errors.New("expected a vector, found a number"))
+	}
+	return v.bv, nil
+}
+
+func (ev *bvEvaluator) evalBinary(n bvBinary) (bvValue, error) {
+	x, err := ev.evalVector(n.x)
+	if err != nil {
+		return bvValue{}, err
+	}
+	y, err := ev.evalVector(n.y)
+	if err != nil {
+		return bvValue{}, err
+	}
+	if len(x) != len(y) {
+		return bvValue{}, bvEvalError(n, errors.New("bit vector lengths do not match"))
+	}
+
+	res := make([]bool, len(x))
+	for i := range x {
+		switch n.op {
+		case '|':
+			res[i] = x[i] || y[i]
+		case '&':
+			res[i] = x[i] && y[i]
+		case '^':
+			res[i] = x[i] != y[i]
+		case '-':
+			res[i] = x[i] && !y[i]
+		}
+	}
+	return bvValue{bv: res}, nil
+}
+
+func (ev *bvEvaluator) evalCall(n bvCall) (bvValue, error) {
+	if n.fn == "count" {
+		bv, err := ev.evalVector(n.args[0])
+		if err != nil {
+			return bvValue{}, err
+		}
+		covered, _ := CountCoveredRegions(bv)
+		return bvValue{num: float64(covered), isNum: true}, nil
+	}
+
+	args := n.args
+	var threshold float64
+	switch n.fn {
+	case "intersection":
+		threshold = 1
+	case "majority":
+		threshold = 0.5
+	case "threshold":
+		t, err := ev.eval(args[0])
+		if err != nil {
+			return bvValue{}, err
+		}
+		if !t.isNum || t.num < 0 || t.num > 1 {
+			return bvValue{}, bvEvalError(args[0], errors.New("threshold must be a number between 0 and 1"))
+		}
+		threshold = t.num
+		args = args[1:]
+	}
+
+	// Count how many vectors cover each region rather than holding every vector, so globs can
+	// match whole results sets
+	var counts []uint32
+	numVectors := 0
+	add := func(bv []bool) error {
+		if counts == nil {
+			counts = make([]uint32, len(bv))
+		} else if len(bv) != len(counts) {
+			return errors.New("bit vector lengths do not match")
+		}
+		for i, b := range bv {
+			if b {
+				counts[i]++
+			}
+		}
+		numVectors++
+		return nil
+	}
+
+	for _, a := range args {
+		if p, ok := a.(bvPath); ok {
+			matches, err := GlobBVFiles(p.path)
+			if err != nil {
+				return bvValue{}, bvEvalError(a, err)
+			}
+			if len(matches) == 0 {
+				return bvValue{}, bvEvalError(a, errors.New("no files match "+p.path))
+			}
+			for _, m := range matches {
+				bv, err := ev.read(m)
+				if err == nil {
+					err = add(bv)
+				}
+				if err != nil {
+					return bvValue{}, bvEvalError(a, err)
+				}
+			}
+			continue
+		}
+
+		bv, err := ev.evalVector(a)
+		if err != nil {
+			return bvValue{}, err
+		}
+		err = add(bv)
+		if err != nil {
+			return bvValue{}, bvEvalError(a, err)
+		}
+	}
+
+	// Same rule as GetThresholdBV
+	res := make([]bool, len(counts))
+	for i, c := range counts {
+		if n.fn == "union" {
+			res[i] = c > 0
+		} else {
+			res[i] = float64(c) >= float64(numVectors)*threshold
+		}
+	}
+	return bvValue{bv: res}, nil
+}
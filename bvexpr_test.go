@@ -0,0 +1,310 @@
+package profparse
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestInputs writes a vector to dir for each name, returning the vectors and the file bound to
+// each name. c is compressed, and only b and c record a layout.
+func writeTestInputs(t *testing.T, dir string, r *rand.Rand, n int) (map[string][]bool, map[string]string) {
+	t.Helper()
+	vectors := make(map[string][]bool)
+	inputs := make(map[string]string)
+	headers := map[string]BVHeader{
+		"a": {},
+		"b": {Layout: LayoutFingerprint{7}},
+		"c": {Layout: LayoutFingerprint{7}, Encoding: CompressedEncoding},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		h := headers[name]
+		vectors[name] = randomBools(r, n)
+		inputs[name] = filepath.Join(dir, name+".bv")
+		if err := WriteBVFile(inputs[name], vectors[name], h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vectors, inputs
+}
+
+func TestParseBVExpr(t *testing.T) {
+	tests := []struct {
+		src   string
+		names []string
+	}{
+		{"a", []string{"a"}},
+		{"a | b & ~c", []string{"a", "b", "c"}},
+		{" ( b_2 - a1 ) ^ b_2 ", []string{"b_2", "a1"}},
+		{`union("x/*.bv", 'y.bv', a) & count(c) | threshold(.5, b, b)`, []string{"a", "c", "b"}},
+		{"~~a", []string{"a"}},
+		{`"a\".bv"`, []string{}},
+	}
+	for _, tt := range tests {
+		e, err := ParseBVExpr(tt.src)
+		if err != nil {
+			t.Errorf("ParseBVExpr(%s): %v", tt.src, err)
+			continue
+		}
+		if names := e.Names(); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("ParseBVExpr(%s) has names %v, want %v", tt.src, names, tt.names)
+		}
+	}
+
+	invalid := []struct {
+		src    string
+		offset string
+	}{
+		{"", "offset 0"},
+		{"a |", "offset 3"},
+		{"(a", "offset 2"},
+		{"a b", "offset 2"},
+		{"a $ b", "offset 2"},
+		{"a)", "offset 1"},
+		{"a & ()", "offset 5"},
+		{"'abc", "offset 0"},
+		{`"\q"`, "offset 0"},
+		{"1.2.3", "offset 0"},
+		{"foo(a)", "offset 0"},
+		{"count(a, b)", "offset 0"},
+		{"count()", "offset 0"},
+		{"union()", "offset 0"},
+		{"a | threshold(a)", "offset 4"},
+		{"union(a,)", "offset 8"},
+		{"union(a b)", "offset 8"},
+		{"0.5", "offset 0"},
+	}
+	for _, tt := range invalid {
+		_, err := ParseBVExpr(tt.src)
+		if err == nil {
+			t.Errorf("ParseBVExpr(%s) succeeded", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.offset) {
+			t.Errorf("ParseBVExpr(%s) failed with %v, want an error at %s", tt.src, err, tt.offset)
+		}
+	}
+}
+
+func TestBVExprOperators(t *testing.T) {
+	r := rand.New(rand.NewSource(27))
+	dir := t.TempDir()
+	for _, n := range []int{1, 2, 9, 200} {
+		vectors, inputs := writeTestInputs(t, dir, r, n)
+		a, b, c := vectors["a"], vectors["b"], vectors["c"]
+		tests := []struct {
+			src  string
+			want func(i int) bool
+		}{
+			{"a", func(i int) bool { return a[i] }},
+			{"a | b", func(i int) bool { return a[i] || b[i] }},
+			{"a & b", func(i int) bool { return a[i] && b[i] }},
+			{"a ^ b", func(i int) bool { return a[i] != b[i] }},
+			{"a - b", func(i int) bool { return a[i] && !b[i] }},
+			{"~a", func(i int) bool { return !a[i] }},
+			{"~~a", func(i int) bool { return a[i] }},
+			{"a - b - c", func(i int) bool { return a[i] && !b[i] && !c[i] }},
+			{"a - (b - c)", func(i int) bool { return a[i] && !(b[i] && !c[i]) }},
+			{"a | b & c", func(i int) bool { return a[i] || (b[i] && c[i]) }},
+			{"a ^ b & c", func(i int) bool { return a[i] != (b[i] && c[i]) }},
+			{"a | b ^ c", func(i int) bool { return a[i] || (b[i] != c[i]) }},
+			{"~a & b", func(i int) bool { return !a[i] && b[i] }},
+			{"~(a & b)", func(i int) bool { return !(a[i] && b[i]) }},
+			{"a | b - c ^ ~a & c", func(i int) bool { return a[i] || ((b[i] && !c[i]) != (!a[i] && c[i])) }},
+			{"(a | b) & a", func(i int) bool { return a[i] }},
+			{`a & "` + inputs["b"] + `"`, func(i int) bool { return a[i] && b[i] }},
+		}
+		for _, tt := range tests {
+			e, err := ParseBVExpr(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.Eval(inputs)
+			if err != nil {
+				t.Errorf("%d bits: %s: %v", n, tt.src, err)
+				continue
+			}
+			want := make([]bool, n)
+			for i := range want {
+				want[i] = tt.want(i)
+			}
+			if !reflect.DeepEqual(got.Vector, want) || got.IsCount {
+				t.Errorf("%d bits: %s = %v, want %v", n, tt.src, got.Vector, want)
+			}
+			if got.Header.NumBits != n {
+				t.Errorf("%d bits: %s has %d bits in its header", n, tt.src, got.Header.NumBits)
+			}
+
+			counted, err := ParseBVExpr("count(" + tt.src + ")")
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := counted.Eval(inputs)
+			covered, _ := CountCoveredRegions(want)
+			if err != nil || !count.IsCount || count.Count != covered || count.Vector != nil {
+				t.Errorf("%d bits: count(%s) = %+v, %v, want %d", n, tt.src, count, err, covered)
+			}
+		}
+	}
+}
+
+func TestBVExprFunctions(t *testing.T) {
+	r := rand.New(rand.NewSource(28))
+	dir := t.TempDir()
+	results := filepath.Join(dir, "results")
+	n := 300
+	written := writeTestResults(t, results, []string{"a.com", "b.com"}, []string{"c1", "c2", "c3"}, n)
+	var all [][]bool
+	for _, site := range []string{"a.com", "b.com"} {
+		for _, crawl := range []string{"c1", "c2", "c3"} {
+			all = append(all, written[site+"/"+crawl])
+		}
+	}
+	vectors, inputs := writeTestInputs(t, dir, r, n)
+
+	crawlPaths, err := GetPathsMidaResults(results, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packPath := filepath.Join(dir, "results.pack")
+	w, err := CreatePack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	union, _, _ := CombineBVs(all)
+	median, _ := GetMedianBV(all)
+	intersection, _ := GetThresholdBV(all, 1)
+	withA := append(append([][]bool{}, all...), vectors["a"])
+	threshold, _ := GetThresholdBV(withA, 0.75)
+	aCom, _ := GetMedianBV(all[:3])
+	everything := make([]bool, n)
+	for i := range everything {
+		everything[i] = true
+	}
+
+	for _, root := range []string{results, packPath} {
+		glob := `"` + root + `/*/*/coverage/coverage.bv"`
+		tests := []struct {
+			src    string
+			want   []bool
+			inputs int
+		}{
+			{"union(" + glob + ")", union, 6},
+			{"majority(" + glob + ")", median, 6},
+			{"intersection('" + root + "/*/*/coverage/coverage.bv')", intersection, 6},
+			{"threshold(0.75, " + glob + ", a)", threshold, 7},
+			{"threshold(0, a)", everything, 1},
+			{"majority(\"" + root + "/a.com/*/coverage/coverage.bv\")", aCom, 3},
+			{"union(a)", vectors["a"], 1},
+			{"intersection(a, a)", vectors["a"], 1},
+		}
+		for _, tt := range tests {
+			e, err := ParseBVExpr(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.Eval(inputs)
+			if err != nil {
+				t.Errorf("%s: %v", tt.src, err)
+				continue
+			}
+			if !reflect.DeepEqual(got.Vector, tt.want) {
+				t.Errorf("%s differs", tt.src)
+			}
+			if got.Inputs != tt.inputs {
+				t.Errorf("%s read %d files, want %d", tt.src, got.Inputs, tt.inputs)
+			}
+		}
+	}
+
+	matches, err := GlobBVFiles(packPath + "/a.com/c[12]/coverage/*.bv")
+	if err != nil || len(matches) != 2 {
+		t.Errorf("matched %v, %v in the pack", matches, err)
+	}
+}
+
+func TestBVExprHeader(t *testing.T) {
+	r := rand.New(rand.NewSource(29))
+	dir := t.TempDir()
+	vectors, inputs := writeTestInputs(t, dir, r, 50)
+	inputs["other"] = filepath.Join(dir, "other.bv")
+	if err := WriteBVFile(inputs["other"], vectors["a"], BVHeader{Layout: LayoutFingerprint{9}}); err != nil {
+		t.Fatal(err)
+	}
+	inputs["short"] = filepath.Join(dir, "short.bv")
+	if err := WriteFileFromBV(inputs["short"], vectors["a"][1:]); err != nil {
+		t.Fatal(err)
+	}
+	inputs["functions"] = filepath.Join(dir, "functions.bv")
+	err := WriteBVFile(inputs["functions"], vectors["a"], BVHeader{Layout: LayoutFingerprint{7},
+		Granularity: FunctionGranularity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src    string
+		header BVHeader
+		ok     bool
+	}{
+		{"a", BVHeader{NumBits: 50}, true},
+		{"a | b", BVHeader{Layout: LayoutFingerprint{7}, NumBits: 50}, true},
+		{"c - a", BVHeader{Layout: LayoutFingerprint{7}, NumBits: 50}, true},
+		{"a | functions", BVHeader{Layout: LayoutFingerprint{7}, Granularity: FunctionGranularity, NumBits: 50}, true},
+		{"count(a)", BVHeader{}, true},
+		{"b | other", BVHeader{}, false},
+		{"b | functions", BVHeader{}, false},
+		{"a | short", BVHeader{}, false},
+		{"union(a, short)", BVHeader{}, false},
+		{"d", BVHeader{}, false},
+		{"a | count(a)", BVHeader{}, false},
+		{"union(0.5)", BVHeader{}, false},
+		{"threshold(2, a)", BVHeader{}, false},
+		{"threshold(a, a)", BVHeader{}, false},
+		{`union("` + dir + `/missing/*.bv")`, BVHeader{}, false},
+		{`"` + dir + `/missing.bv"`, BVHeader{}, false},
+	}
+	for _, tt := range tests {
+		e, err := ParseBVExpr(tt.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := e.Eval(inputs)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got.Header != tt.header {
+			t.Errorf("%s has header %+v, want %+v", tt.src, got.Header, tt.header)
+		}
+	}
+
+	// Names used more than once are read once
+	e, err := ParseBVExpr("a | a & ~a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.Eval(inputs); err != nil || got.Inputs != 1 {
+		t.Errorf("read %+v, %v, want one file", got, err)
+	}
+	if err = os.Remove(inputs["a"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = e.Eval(inputs); err == nil {
+		t.Error("evaluated an expression with a missing file")
+	}
+}
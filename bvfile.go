@@ -0,0 +1,364 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	bvFileMagic   = "PPBV"
+	bvFileVersion = 3
+
+	// Magic, version, encoding, granularity, layout fingerprint and length. The crawl identifiers
+	// and the checksum follow. Version 2 files have no granularity.
+	bvFileFixedHeaderSize = 4 + 2 + 2 + 2 + 16 + 8
+)
+
+// BVGranularity is what each bit of a vector stands for
+type BVGranularity int
+
+const (
+	RegionGranularity        BVGranularity = iota
+	FunctionGranularity                    // Set if any region of the function is covered
+	FunctionEntryGranularity               // Set if the entry region of the function is covered
+	FileGranularity                        // Set if any region of the file is covered
+)
+
+func (g BVGranularity) String() string {
+	switch g {
+	case RegionGranularity:
+		return "region"
+	case FunctionGranularity:
+		return "function"
+	case FunctionEntryGranularity:
+		return "function-entry"
+	case FileGranularity:
+		return "file"
+	}
+	return strconv.Itoa(int(g))
+}
+
+// ParseBVGranularity parses the name of a granularity, as returned by String
+func ParseBVGranularity(s string) (BVGranularity, error) {
+	for _, g := range []BVGranularity{RegionGranularity, FunctionGranularity, FunctionEntryGranularity, FileGranularity} {
+		if s == g.String() {
+			return g, nil
+		}
+	}
+	return RegionGranularity, errors.New("unknown granularity: " + s)
+}
+
+// BVEncoding is how the bits of a versioned file are stored
+type BVEncoding int
+
+const (
+	PackedEncoding     BVEncoding = iota // Bits packed most significant first, as in version 1 files
+	CompressedEncoding                   // Array, run and bitmap containers, see CompressedBitVector
+)
+
+func (e BVEncoding) String() string {
+	switch e {
+	case PackedEncoding:
+		return "packed"
+	case CompressedEncoding:
+		return "compressed"
+	}
+	return strconv.Itoa(int(e))
+}
+
+// ParseBVEncoding parses the name of an encoding, as returned by String
+func ParseBVEncoding(s string) (BVEncoding, error) {
+	for _, e := range []BVEncoding{PackedEncoding, CompressedEncoding} {
+		if s == e.String() {
+			return e, nil
+		}
+	}
+	return PackedEncoding, errors.New("unknown encoding: " + s)
+}
+
+// BVHeader describes a bit vector file. Version 1 files only record the length of the vector.
+type BVHeader struct {
+	Version     int
+	Encoding    BVEncoding
+	Granularity BVGranularity
+	Layout      LayoutFingerprint // Zero if the layout is unknown
+	NumBits     int
+
+	// Optional identifiers of the crawl the vector was collected from
+	Site  string
+	Crawl string
+}
+
+// HasLayout returns true if the file records the layout of its vector
+func (h BVHeader) HasLayout() bool {
+	return h.Layout != LayoutFingerprint{}
+}
+
+// BVHeaderForCovPath returns a header for a vector with the given layout, taking the crawl
+// identifiers from a MIDA results path (<site>/<crawl>/coverage/coverage.bv) when covPath is one
+func BVHeaderForCovPath(covPath string, l *CoverageLayout) BVHeader {
+	h := BVHeader{
+		Layout: l.Fingerprint(),
+	}
+	h.Site, h.Crawl = CrawlForCovPath(covPath)
+
+	return h
+}
+
+// CrawlForCovPath returns the site and crawl of a vector in a MIDA results set, such as
+// <site>/<crawl>/coverage/coverage.bv or a projection next to it
+func CrawlForCovPath(covPath string) (string, string) {
+	parts := strings.Split(covPath, "/")
+	if len(parts) >= 4 && parts[len(parts)-2] == "coverage" && strings.HasSuffix(parts[len(parts)-1], ".bv") {
+		return parts[len(parts)-4], parts[len(parts)-3]
+	}
+	return "", ""
+}
+
+// CheckSameLayout returns an error if any two of the headers record different layouts. Headers
+// without a layout are assumed to match.
+func CheckSameLayout(headers ...BVHeader) error {
+	var first BVHeader
+	for _, h := range headers {
+		if !h.HasLayout() {
+			continue
+		}
+		if !first.HasLayout() {
+			first = h
+		} else if h.Granularity != first.Granularity {
+			return errors.New("bit vectors have different granularities")
+		} else if h.Layout != first.Layout {
+			return errors.New("bit vectors have different layouts")
+		}
+	}
+	return nil
+}
+
+// WriteBVFile writes a bit vector to disk in the versioned format, which records the layout of
+// the vector, its crawl and a checksum. The bits are stored with the encoding in h. The version and
+// length in h are ignored.
+func WriteBVFile(fName string, bv []bool, h BVHeader) error {
+	if h.Encoding == CompressedEncoding {
+		return WriteCompressedBitVectorFile(fName, CompressBools(bv), h)
+	}
+	return writeBVFile(fName, len(bv), packBools(bv), h)
+}
+
+// writeBVFile writes a versioned file whose payload is already encoded with h.Encoding
+func writeBVFile(fName string, numBits int, payload []byte, h BVHeader) error {
+	header, err := bvFileHeader(numBits, payload, h)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fName)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range [][]byte{header, payload} {
+		_, err = f.Write(b)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Wrote %d bytes to file %s", len(header)+len(payload), fName)
+
+	return nil
+}
+
+// bvFileHeader returns everything in a versioned file that precedes the payload, including the
+// checksum
+func bvFileHeader(numBits int, payload []byte, h BVHeader) ([]byte, error) {
+	if len(h.Site) > 0xffff || len(h.Crawl) > 0xffff {
+		return nil, errors.New("crawl identifier too long")
+	}
+	if h.Encoding != PackedEncoding && h.Encoding != CompressedEncoding {
+		return nil, errors.New("unsupported bit vector encoding")
+	}
+
+	header := make([]byte, bvFileFixedHeaderSize, bvFileFixedHeaderSize+4+len(h.Site)+len(h.Crawl)+4)
+	copy(header, bvFileMagic)
+	binary.LittleEndian.PutUint16(header[4:], bvFileVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(h.Encoding))
+	binary.LittleEndian.PutUint16(header[8:], uint16(h.Granularity))
+	copy(header[10:], h.Layout[:])
+	binary.LittleEndian.PutUint64(header[26:], uint64(numBits))
+	header = appendBVString(header, h.Site)
+	header = appendBVString(header, h.Crawl)
+
+	crc := crc32.Update(crc32.Checksum(header, crcTable), crcTable, payload)
+	var crcBytes [4]byte
+	binary.LittleEndian.PutUint32(crcBytes[:], crc)
+
+	return append(header, crcBytes[:]...), nil
+}
+
+// ReadBVFile reads a bit vector file in either format, along with its header
+func ReadBVFile(fName string) ([]bool, BVHeader, error) {
+	content, err := readBVFileData(fName)
+	if err != nil {
+		return nil, BVHeader{}, err
+	}
+
+	return ParseBVFile(content)
+}
+
+// ReadBVFileWithLayout reads a bit vector file, returning an error if the vector does not have
+// the given layout
+func ReadBVFileWithLayout(fName string, l *CoverageLayout) ([]bool, error) {
+	bv, h, err := ReadBVFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.HasLayout() && h.Layout != l.Fingerprint() {
+		return nil, errors.New(fName + ": bit vector was built for a different layout")
+	}
+	if h.Granularity != RegionGranularity {
+		return nil, errors.New(fName + ": bit vector has " + h.Granularity.String() + " granularity")
+	}
+	if len(bv) != l.NumRegions() {
+		return nil, errors.New(fName + ": bit vector length does not match layout")
+	}
+
+	return bv, nil
+}
+
+// ParseBVFile is ReadBVFile for the contents of a file
+func ParseBVFile(data []byte) ([]bool, BVHeader, error) {
+	if !isVersionedBVFile(data) {
+		bv, err := bytesToBools(data)
+		if err != nil {
+			return nil, BVHeader{}, err
+		}
+		return bv, BVHeader{Version: 1, NumBits: len(bv)}, nil
+	}
+
+	payload, h, err := parseVersionedBVFile(data)
+	if err != nil {
+		return nil, h, err
+	}
+	if h.Encoding == CompressedEncoding {
+		c, err := parseCompressedPayload(payload, h.NumBits)
+		if err != nil {
+			return nil, h, err
+		}
+		return c.Bools(), h, nil
+	}
+
+	return unpackBools(payload, h.NumBits), h, nil
+}
+
+// parseVersionedBVFile checks the header of a versioned file and returns its payload, which is
+// only known to have the right length for the packed encoding
+func parseVersionedBVFile(data []byte) ([]byte, BVHeader, error) {
+	var h BVHeader
+	h.Version = int(binary.LittleEndian.Uint16(data[4:]))
+	if h.Version != 2 && h.Version != bvFileVersion {
+		return nil, h, errors.New("unsupported bit vector file version")
+	}
+	h.Encoding = BVEncoding(binary.LittleEndian.Uint16(data[6:]))
+
+	pos := 8
+	if h.Version >= 3 {
+		h.Granularity = BVGranularity(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+	}
+	if len(data)-pos < 16+8 {
+		return nil, h, errors.New("truncated bit vector file")
+	}
+	copy(h.Layout[:], data[pos:])
+	numBits := binary.LittleEndian.Uint64(data[pos+16:])
+	pos += 16 + 8
+
+	var ok bool
+	h.Site, pos, ok = readBVString(data, pos)
+	if ok {
+		h.Crawl, pos, ok = readBVString(data, pos)
+	}
+	if !ok || len(data)-pos < 4 {
+		return nil, h, errors.New("truncated bit vector file")
+	}
+
+	crc := binary.LittleEndian.Uint32(data[pos:])
+	payload := data[pos+4:]
+	if crc32.Update(crc32.Checksum(data[:pos], crcTable), crcTable, payload) != crc {
+		return nil, h, errors.New("corrupt bit vector file")
+	}
+
+	switch h.Encoding {
+	case PackedEncoding:
+		if numBits > uint64(len(payload))*8 || uint64(len(payload)) != (numBits+7)/8 {
+			return nil, h, errors.New("bit vector length does not match file size")
+		}
+	case CompressedEncoding:
+		if numBits > 1<<40 {
+			return nil, h, errors.New("bit vector too long")
+		}
+	default:
+		return nil, h, errors.New("unsupported bit vector encoding")
+	}
+	h.NumBits = int(numBits)
+
+	return payload, h, nil
+}
+
+// isVersionedBVFile distinguishes versioned files from version 1 files, whose length field could
+// happen to spell out the magic number
+func isVersionedBVFile(data []byte) bool {
+	if len(data) < 8 || string(data[:4]) != bvFileMagic {
+		return false
+	}
+	numBits := uint64(binary.LittleEndian.Uint32(data))
+	return uint64(len(data)) != 4+(numBits+7)/8
+}
+
+func packBools(t []bool) []byte {
+	b := make([]byte, (len(t)+7)/8)
+	for i, x := range t {
+		if x {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+func unpackBools(b []byte, numBits int) []bool {
+	t := make([]bool, numBits)
+	for i := range t {
+		t[i] = b[i/8]&(0x80>>uint(i%8)) != 0
+	}
+	return t
+}
+
+func appendBVString(buf []byte, s string) []byte {
+	var n [2]byte
+	binary.LittleEndian.PutUint16(n[:], uint16(len(s)))
+	buf = append(buf, n[:]...)
+	return append(buf, s...)
+}
+
+func readBVString(data []byte, pos int) (string, int, bool) {
+	if len(data)-pos < 2 {
+		return "", pos, false
+	}
+	n := int(binary.LittleEndian.Uint16(data[pos:]))
+	pos += 2
+	if len(data)-pos < n {
+		return "", pos, false
+	}
+	return string(data[pos : pos+n]), pos + n, true
+}
@@ -0,0 +1,269 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBVFileRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(14))
+	dir := t.TempDir()
+	for _, numBits := range []int{0, 1, 7, 8, 9, 1000, 70000} {
+		for _, h := range []BVHeader{
+			{},
+			{Encoding: CompressedEncoding, Layout: LayoutFingerprint{1, 2}},
+			{Granularity: FunctionEntryGranularity, Site: "a.com", Crawl: "c1"},
+			{Encoding: CompressedEncoding, Granularity: FileGranularity, Site: strings.Repeat("s", 300)},
+		} {
+			t.Run(fmt.Sprintf("%d/%v/%v", numBits, h.Encoding, h.Granularity), func(t *testing.T) {
+				bv := randomBools(r, numBits)
+				fName := filepath.Join(dir, "coverage.bv")
+				if err := WriteBVFile(fName, bv, h); err != nil {
+					t.Fatal(err)
+				}
+				got, gotHeader, err := ReadBVFile(fName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h.Version = bvFileVersion
+				h.NumBits = numBits
+				if gotHeader != h {
+					t.Errorf("header %+v, want %+v", gotHeader, h)
+				}
+				if !reflect.DeepEqual(got, bv) && numBits > 0 {
+					t.Error("vector differs")
+				}
+
+				// Version 1 files hold the same vector
+				if err = WriteFileFromBV(fName, bv); err != nil {
+					t.Fatal(err)
+				}
+				got, gotHeader, err = ReadBVFile(fName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gotHeader != (BVHeader{Version: 1, NumBits: numBits}) {
+					t.Errorf("version 1 header %+v", gotHeader)
+				}
+				if !reflect.DeepEqual(got, bv) && numBits > 0 {
+					t.Error("version 1 vector differs")
+				}
+			})
+		}
+	}
+}
+
+// bvFileV2 rewrites a packed version 3 file in version 2 of the format, which had no granularity
+func bvFileV2(t *testing.T, data []byte) []byte {
+	t.Helper()
+	v2 := append([]byte{}, data[:8]...)
+	v2 = append(v2, data[10:]...)
+	binary.LittleEndian.PutUint16(v2[4:], 2)
+
+	// The checksum follows the site and crawl, and covers everything else
+	pos := bvFileFixedHeaderSize - 2
+	pos += 2 + int(binary.LittleEndian.Uint16(v2[pos:]))
+	pos += 2 + int(binary.LittleEndian.Uint16(v2[pos:]))
+	crc := crc32.Update(crc32.Checksum(v2[:pos], crcTable), crcTable, v2[pos+4:])
+	binary.LittleEndian.PutUint32(v2[pos:], crc)
+	return v2
+}
+
+func TestParseBVFileVersion2(t *testing.T) {
+	bv := []bool{true, false, true, true, false, false, false, true, true}
+	h := BVHeader{Layout: LayoutFingerprint{3}, Site: "a.com", Crawl: "c"}
+	fName := filepath.Join(t.TempDir(), "coverage.bv")
+	if err := WriteBVFile(fName, bv, h); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, gotHeader, err := ParseBVFile(bvFileV2(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Version = 2
+	h.NumBits = len(bv)
+	if !reflect.DeepEqual(got, bv) || gotHeader != h {
+		t.Errorf("read %v with header %+v, want %v with %+v", got, gotHeader, bv, h)
+	}
+}
+
+func TestParseBVFileInvalid(t *testing.T) {
+	bv := randomBools(rand.New(rand.NewSource(15)), 100)
+	dir := t.TempDir()
+	read := func(h BVHeader) []byte {
+		fName := filepath.Join(dir, "coverage.bv")
+		if err := WriteBVFile(fName, bv, h); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(fName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	packed := read(BVHeader{Site: "a.com"})
+	compressed := read(BVHeader{Encoding: CompressedEncoding})
+	modified := func(data []byte, f func(d []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short version 1 file", []byte{1, 0}},
+		{"truncated version 1 file", []byte{100, 0, 0, 0, 1}},
+		{"long version 1 file", []byte{1, 0, 0, 0, 0x80, 0}},
+		{"text", []byte("garbage")},
+		{"future version", modified(packed, func(d []byte) []byte { d[4] = 9; return d })},
+		{"unknown encoding", modified(packed, func(d []byte) []byte { d[6] = 9; return d })},
+		{"truncated header", packed[:bvFileFixedHeaderSize-4]},
+		{"truncated site", packed[:bvFileFixedHeaderSize+3]},
+		{"corrupt payload", modified(packed, func(d []byte) []byte { d[len(d)-1] ^= 0x80; return d })},
+		{"corrupt header", modified(packed, func(d []byte) []byte { d[10] ^= 1; return d })},
+		{"extra payload", append(append([]byte{}, packed...), 0)},
+		{"truncated compressed payload", compressed[:len(compressed)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseBVFile(tt.data); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	fName := filepath.Join(dir, "invalid.bv")
+	if err := WriteBVFile(fName, bv, BVHeader{Encoding: 9}); err == nil {
+		t.Error("wrote a vector with an unknown encoding")
+	}
+	if err := WriteBVFile(fName, bv, BVHeader{Crawl: strings.Repeat("c", 0x10000)}); err == nil {
+		t.Error("wrote a vector with a crawl identifier that does not fit")
+	}
+}
+
+func TestReadBVFileWithLayout(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	other := mustParseLayout(t, strings.Replace(layoutTestReport, "4,1,4,1", "5,1,5,1", 1))
+	bv := []bool{true, false, true, false}
+	dir := t.TempDir()
+
+	tests := []struct {
+		name  string
+		write func(fName string) error
+		ok    bool
+	}{
+		{"same layout", func(fName string) error {
+			return WriteBVFile(fName, bv, BVHeader{Layout: l.Fingerprint()})
+		}, true},
+		{"version 1", func(fName string) error { return WriteFileFromBV(fName, bv) }, true},
+		{"other layout", func(fName string) error {
+			return WriteBVFile(fName, bv, BVHeader{Layout: other.Fingerprint()})
+		}, false},
+		{"function granularity", func(fName string) error {
+			return WriteBVFile(fName, bv, BVHeader{Layout: l.Fingerprint(), Granularity: FunctionGranularity})
+		}, false},
+		{"wrong length", func(fName string) error { return WriteFileFromBV(fName, bv[1:]) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(dir, "coverage.bv")
+			if err := tt.write(fName); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadBVFileWithLayout(fName, l)
+			if !tt.ok {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, bv) {
+				t.Errorf("read %v, want %v", got, bv)
+			}
+		})
+	}
+}
+
+func TestBVHeaderForCovPath(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	covPath := filepath.Join(t.TempDir(), "site.com", "abc", "coverage", "coverage.bv")
+	if err := os.MkdirAll(filepath.Dir(covPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := BVHeaderForCovPath(covPath, l)
+	if h.Site != "site.com" || h.Crawl != "abc" || h.Layout != l.Fingerprint() {
+		t.Errorf("header %+v", h)
+	}
+
+	tests := []struct {
+		covPath string
+		site    string
+		crawl   string
+	}{
+		{"/r/site.com/abc/coverage/coverage.bv", "site.com", "abc"},
+		{"site.com/abc/coverage/function.bv", "site.com", "abc"},
+		{"abc/coverage/coverage.bv", "", ""},
+		{"/r/site.com/abc/other/coverage.bv", "", ""},
+		{"/r/site.com/abc/coverage/coverage.brv", "", ""},
+	}
+	for _, tt := range tests {
+		if site, crawl := CrawlForCovPath(tt.covPath); site != tt.site || crawl != tt.crawl {
+			t.Errorf("CrawlForCovPath(%s) = %s, %s, want %s, %s", tt.covPath, site, crawl, tt.site, tt.crawl)
+		}
+	}
+}
+
+func TestCheckSameLayout(t *testing.T) {
+	a := BVHeader{Layout: LayoutFingerprint{1}}
+	b := BVHeader{Layout: LayoutFingerprint{2}}
+	tests := []struct {
+		headers []BVHeader
+		ok      bool
+	}{
+		{nil, true},
+		{[]BVHeader{a, a}, true},
+		{[]BVHeader{{}, a, {Version: 1}, a}, true},
+		{[]BVHeader{a, {}, b}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckSameLayout(tt.headers...); (err == nil) != tt.ok {
+			t.Errorf("CheckSameLayout(%v) = %v", tt.headers, err)
+		}
+	}
+}
+
+func TestParseBVNames(t *testing.T) {
+	for _, g := range []BVGranularity{RegionGranularity, FunctionGranularity, FunctionEntryGranularity, FileGranularity} {
+		if parsed, err := ParseBVGranularity(g.String()); err != nil || parsed != g {
+			t.Errorf("ParseBVGranularity(%s) = %v, %v", g, parsed, err)
+		}
+	}
+	for _, e := range []BVEncoding{PackedEncoding, CompressedEncoding} {
+		if parsed, err := ParseBVEncoding(e.String()); err != nil || parsed != e {
+			t.Errorf("ParseBVEncoding(%s) = %v, %v", e, parsed, err)
+		}
+	}
+	if _, err := ParseBVGranularity("line"); err == nil {
+		t.Error("parsed an unknown granularity")
+	}
+	if _, err := ParseBVEncoding("gzip"); err == nil {
+		t.Error("parsed an unknown encoding")
+	}
+}
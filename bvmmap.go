@@ -0,0 +1,209 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// MappedBitVector is a read-only bit vector backed directly by the payload of a .bv file. On Linux
+// the file is mapped into memory instead of being read, so opening a vector neither copies nor
+// unpacks it. Compressed files are decoded into memory instead, as are files opened once the
+// process already has many vectors mapped. Any number of goroutines may read a vector at once, but
+// none may use it after Close.
+type MappedBitVector struct {
+	Header BVHeader
+
+	data    []byte // The whole file
+	payload []byte // Packed bits in .bv file order
+	n       int
+	mapped  bool
+}
+
+// OpenMappedBVFile maps a bit vector file in either format. The lengths in the header are checked
+// against the size of the file before the vector is returned.
+func OpenMappedBVFile(fName string) (*MappedBitVector, error) {
+	data, mapped, err := mapBVFile(fName)
+	if isNotDirError(err) {
+		// Vectors within a pack are read instead
+		data, err = readBVFileData(fName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := &MappedBitVector{data: data, mapped: mapped}
+	if !isVersionedBVFile(data) {
+		if len(data) < 4 {
+			v.Close()
+			return nil, errors.New(fName + ": invalid bit vector file")
+		}
+		v.n = int(binary.LittleEndian.Uint32(data))
+		v.payload = data[4:]
+		v.Header = BVHeader{Version: 1, NumBits: v.n}
+		if len(v.payload) != (v.n+7)/8 {
+			v.Close()
+			return nil, errors.New(fName + ": bit vector length does not match file size")
+		}
+		return v, nil
+	}
+
+	v.payload, v.Header, err = parseVersionedBVFile(data)
+	if err != nil {
+		v.Close()
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+	v.n = v.Header.NumBits
+
+	// Compressed vectors have to be decoded, so there is nothing to gain from keeping them mapped
+	if v.Header.Encoding == CompressedEncoding {
+		c, err := parseCompressedPayload(v.payload, v.n)
+		v.Close()
+		if err != nil {
+			return nil, errors.New(fName + ": " + err.Error())
+		}
+		v.payload = c.BitVector().Bytes()
+	}
+
+	return v, nil
+}
+
+// OpenMappedBVFileWithLayout is ReadBVFileWithLayout for mapped vectors
+func OpenMappedBVFileWithLayout(fName string, l *CoverageLayout) (*MappedBitVector, error) {
+	v, err := OpenMappedBVFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	h := v.Header
+	if h.HasLayout() && h.Layout != l.Fingerprint() {
+		err = errors.New(fName + ": bit vector was built for a different layout")
+	} else if h.Granularity != RegionGranularity {
+		err = errors.New(fName + ": bit vector has " + h.Granularity.String() + " granularity")
+	} else if v.Len() != l.NumRegions() {
+		err = errors.New(fName + ": bit vector length does not match layout")
+	}
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Close releases the memory backing the vector
+func (v *MappedBitVector) Close() error {
+	data, mapped := v.data, v.mapped
+	v.data, v.payload, v.mapped = nil, nil, false
+	if !mapped {
+		return nil
+	}
+	return unmapBVFile(data)
+}
+
+// Len returns the number of bits in the vector
+func (v *MappedBitVector) Len() int {
+	return v.n
+}
+
+// Bytes returns the packed bits in .bv file order. They must not be modified.
+func (v *MappedBitVector) Bytes() []byte {
+	return v.payload
+}
+
+// Get returns bit i
+func (v *MappedBitVector) Get(i int) bool {
+	return v.payload[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// word returns the bits of word i as BitVector stores them, with any bits past the length clear
+func (v *MappedBitVector) word(i int) uint64 {
+	var w uint64
+	if len(v.payload)-i*8 >= 8 {
+		w = binary.BigEndian.Uint64(v.payload[i*8:])
+	} else {
+		var last [8]byte
+		copy(last[:], v.payload[i*8:])
+		w = binary.BigEndian.Uint64(last[:])
+	}
+
+	if rest := v.n - i*64; rest < 64 {
+		w &= ^uint64(0) << uint(64-rest)
+	}
+	return w
+}
+
+func (v *MappedBitVector) numWords() int {
+	return (v.n + 63) / 64
+}
+
+// Count returns the number of set bits
+func (v *MappedBitVector) Count() int {
+	count := 0
+	for i := 0; i < v.numWords(); i++ {
+		count += bits.OnesCount64(v.word(i))
+	}
+	return count
+}
+
+// CountAnd returns the number of bits set in both v and o
+func (v *MappedBitVector) CountAnd(o *MappedBitVector) (int, error) {
+	if v.n != o.n {
+		return 0, errors.New("bv lengths do not match")
+	}
+	count := 0
+	for i := 0; i < v.numWords(); i++ {
+		count += bits.OnesCount64(v.word(i) & o.word(i))
+	}
+	return count, nil
+}
+
+// CountXor returns the number of bits that differ between v and o
+func (v *MappedBitVector) CountXor(o *MappedBitVector) (int, error) {
+	if v.n != o.n {
+		return 0, errors.New("bv lengths do not match")
+	}
+	count := 0
+	for i := 0; i < v.numWords(); i++ {
+		count += bits.OnesCount64(v.word(i) ^ o.word(i))
+	}
+	return count, nil
+}
+
+// CountXorWithExclude is DiffBVsWithExclude for mapped vectors
+func (v *MappedBitVector) CountXorWithExclude(o *MappedBitVector, excludeBV *BitVector) (int, int, error) {
+	if v.n != o.n {
+		return 0, 0, errors.New("bv lengths do not match")
+	}
+	if v.n != excludeBV.Len() {
+		return 0, 0, errors.New("bv lengths do not match exclude vector length")
+	}
+
+	diff := 0
+	for i, ex := range excludeBV.words {
+		diff += bits.OnesCount64((v.word(i) ^ o.word(i)) &^ ex)
+	}
+	return diff, v.n - excludeBV.Count(), nil
+}
+
+// ForEach calls fn with the index of every set bit, in order
+func (v *MappedBitVector) ForEach(fn func(i int)) {
+	for w := 0; w < v.numWords(); w++ {
+		word := v.word(w)
+		for word != 0 {
+			j := bits.LeadingZeros64(word)
+			fn(w*64 + j)
+			word &^= 1 << uint(63-j)
+		}
+	}
+}
+
+// BitVector copies the vector into a BitVector, which remains valid after Close
+func (v *MappedBitVector) BitVector() *BitVector {
+	return BitVectorFromBytes(v.payload, v.n)
+}
+
+// Bools unpacks the vector into a []bool vector
+func (v *MappedBitVector) Bools() []bool {
+	return unpackBools(v.payload, v.n)
+}
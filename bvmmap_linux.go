@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package profparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// Each mapping counts against vm.max_map_count, 65530 by default, as do those of the runtime and of
+// any libraries. Past this many mapped vectors, files are read instead.
+var maxMappedBVFiles int64 = 32768
+
+var mappedBVFiles int64
+
+// mapBVFile maps a file read-only, returning whether it was mapped
+func mapBVFile(fName string) ([]byte, bool, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		// Empty files cannot be mapped
+		return []byte{}, false, nil
+	}
+	if int64(int(size)) != size {
+		return nil, false, errors.New(fName + ": file too large to map")
+	}
+
+	if atomic.AddInt64(&mappedBVFiles, 1) <= maxMappedBVFiles {
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err == nil {
+			return data, true, nil
+		}
+		atomic.AddInt64(&mappedBVFiles, -1)
+		// ENOMEM means the process is out of mappings, possibly to other code
+		if err != syscall.ENOMEM {
+			return nil, false, err
+		}
+	} else {
+		atomic.AddInt64(&mappedBVFiles, -1)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(f, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+func unmapBVFile(data []byte) error {
+	atomic.AddInt64(&mappedBVFiles, -1)
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package profparse
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMappedBitVectorLimit(t *testing.T) {
+	defer func(max int64) { maxMappedBVFiles = max }(maxMappedBVFiles)
+	maxMappedBVFiles = atomic.LoadInt64(&mappedBVFiles) + 2
+
+	r := rand.New(rand.NewSource(3))
+	dir := t.TempDir()
+	var vectors []*MappedBitVector
+	for i := 0; i < 4; i++ {
+		bv := randomBools(r, 1000)
+		fName := filepath.Join(dir, "coverage.bv")
+		if err := WriteBVFile(fName, bv, BVHeader{}); err != nil {
+			t.Fatal(err)
+		}
+		v, err := OpenMappedBVFile(fName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		// Past the limit, files are read instead
+		if v.mapped != (i < 2) {
+			t.Errorf("vector %d: mapped = %v", i, v.mapped)
+		}
+		if !reflect.DeepEqual(v.Bools(), bv) {
+			t.Errorf("vector %d differs from the one written", i)
+		}
+		vectors = append(vectors, v)
+	}
+
+	// Closing a mapped vector makes room for another
+	vectors[0].Close()
+	v, err := OpenMappedBVFile(filepath.Join(dir, "coverage.bv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if !v.mapped {
+		t.Error("vector was not mapped after another was closed")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package profparse
+
+import "io/ioutil"
+
+// mapBVFile reads a file, since mapping is only supported on Linux
+func mapBVFile(fName string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(fName)
+	return data, false, err
+}
+
+func unmapBVFile(data []byte) error {
+	return nil
+}
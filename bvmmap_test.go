@@ -0,0 +1,96 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMappedBitVector(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	dir := t.TempDir()
+
+	for _, n := range []int{1, 9, 64, 65, 200, 4097} {
+		a, b := randomBools(r, n), randomBools(r, n)
+		exclude := randomBools(r, n)
+		fa, fb := filepath.Join(dir, "a.bv"), filepath.Join(dir, "b.bv")
+		if err := WriteBVFile(fa, a, BVHeader{Site: "s"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteFileFromBV(fb, b); err != nil {
+			t.Fatal(err)
+		}
+
+		ma, err := OpenMappedBVFile(fa)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mb, err := OpenMappedBVFile(fb)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(ma.Bools(), a) || !reflect.DeepEqual(mb.BitVector().Bools(), b) {
+			t.Errorf("%d bits: vectors differ from those written", n)
+		}
+		if ma.Header.Site != "s" || mb.Header.Version != 1 {
+			t.Errorf("%d bits: headers %+v and %+v", n, ma.Header, mb.Header)
+		}
+
+		wantDiff, _ := DiffTwoBVs(a, b)
+		if diff, _ := ma.CountXor(mb); diff != wantDiff {
+			t.Errorf("%d bits: CountXor = %d, want %d", n, diff, wantDiff)
+		}
+		wantCovered, _ := CountCoveredRegions(a)
+		if ma.Count() != wantCovered {
+			t.Errorf("%d bits: Count = %d, want %d", n, ma.Count(), wantCovered)
+		}
+		wantDiff, wantTotal, _ := DiffBVsWithExclude(a, b, exclude)
+		diff, total, _ := ma.CountXorWithExclude(mb, BitVectorFromBools(exclude))
+		if diff != wantDiff || total != wantTotal {
+			t.Errorf("%d bits: CountXorWithExclude = %d, %d, want %d, %d", n, diff, total, wantDiff, wantTotal)
+		}
+
+		var set []int
+		ma.ForEach(func(i int) { set = append(set, i) })
+		var wantSet []int
+		for i, v := range a {
+			if v {
+				wantSet = append(wantSet, i)
+			}
+		}
+		if !reflect.DeepEqual(set, wantSet) {
+			t.Errorf("%d bits: ForEach visited %v, want %v", n, set, wantSet)
+		}
+
+		ma.Close()
+		mb.Close()
+	}
+}
+
+func TestOpenMappedBVFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte{10, 0, 0, 0, 1, 2, 3}},
+		{"truncated header", []byte("PPBV\x03")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(dir, tt.name+".bv")
+			if err := ioutil.WriteFile(fName, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := OpenMappedBVFile(fName); err == nil {
+				v.Close()
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	pp "github.com/teamnsrg/profparse"
 	"io"
 	"os"
-	"sort"
 	"strconv"
 	"sync"
 )
@@ -41,11 +40,6 @@ type Result struct {
 	PercentDirBlocksCovered      map[string]float64
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 type CloudflareContentCategory struct {
 	ID              int    `json:"id,omitempty"`
 	SuperCategoryId int    `json:"super_category_id,omitempty"`
@@ -62,10 +56,11 @@ type CloudflareCategoryEntry struct {
 	Application       CloudflareApplication       `json:"application"`
 }
 
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var DenominatorFileCoverageMap map[string]int
@@ -89,6 +84,7 @@ func main() {
 	var inputFile string
 	var outputFile string
 	var excludeBVFile string
+	var nameStyle string
 
 	flag.StringVar(&covFile, "coverage-file", "coverage.txt",
 		"Path to sample text coverage file for metadata generation")
@@ -96,41 +92,42 @@ func main() {
 		"Path to MIDA results for analysis")
 	flag.StringVar(&outputFile, "output-file", "output/with_region_data_added.csv",
 		"Path to output file csv")
+	flag.StringVar(&nameStyle, "names", "mangled",
+		"How to write function names: mangled, demangled, qualified or both")
 
 	flag.Parse()
 
-	var err error
+	style, err := pp.ParseNameStyle(nameStyle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := pp.NewFunctionNameFormatter(style)
 
 	CompleteCounter = 0
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	var metaProps pp.CovMapProperties
-	MetaMap, metaProps, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+	metaProps := Layout.Properties
+
 	log.Infof("MetaMap Files: %d, Funcs: %d, Regions: %d", metaProps.NumFiles, metaProps.NumFunctions, metaProps.NumRegions)
 
 	FileCovCounts = make(map[string]int)
 
-	sampleCovMap, props, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Infof("CovMap Files: %d, Funcs: %d, Regions: %d", props.NumFiles, props.NumFunctions, props.NumRegions)
-
 	files := 0
 	functions := 0
 	regions := 0
 
-	sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
+	sampleBV := make([]bool, Layout.NumRegions())
 
 	log.Info("Reading BV to exclude")
 	if excludeBVFile != "" {
-		ExcludeVector, err = pp.ReadBVFileToBV(excludeBVFile)
+		ExcludeVector, err = pp.ReadBVFileWithLayout(excludeBVFile, Layout)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -140,7 +137,7 @@ func main() {
 		log.Infof("Created empty exclude vector (length: %d)", len(ExcludeVector))
 	}
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -148,39 +145,11 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 	log.Infof("BVIndexToCodeRegionMap Length: %d", len(BVIndexToCodeRegionMap))
 
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	totalRegions := 0
-
-	fileNames := make([]string, 0)
-	for fileName := range Structure {
-		fileNames = append(fileNames, fileName)
-	}
-	sort.Strings(fileNames)
-
-	for _, fileName := range fileNames {
-		start = currentIndex
-		funcNames := make([]string, 0)
-		for funcName := range Structure[fileName] {
-			funcNames = append(funcNames, funcName)
-		}
-
-		for _, funcName := range funcNames {
-			currentIndex += Structure[fileName][funcName]
-		}
-		end = currentIndex
-		FilenameToBVIndices[fileName] = BVRange{
-			Start: start,
-			End:   end,
-		}
-		totalRegions += end - start
-	}
+	FilenameToBVIndices = Layout.FileRanges()
+	totalRegions := Layout.NumRegions()
 
 	log.Infof("Total Files, Regions for FilenameToBVIndices: %d, %d", len(FilenameToBVIndices), totalRegions)
 
@@ -212,7 +181,7 @@ func main() {
 		}
 
 		if header {
-			writer.Write(append(record, []string{"File", "Function"}...))
+			writer.Write(append(append(record, "File"), names.Header("Function")...))
 			header = false
 			continue
 		}
@@ -223,10 +192,7 @@ func main() {
 		}
 
 		region := BVIndexToCodeRegionMap[regionNum]
-		writer.Write(append(record, []string{
-			region.FileName,
-			region.FuncName,
-		}...))
+		writer.Write(append(append(record, region.FileName), names.Format(region.FuncName)...))
 	}
 
 	writer.Flush()
@@ -7,6 +7,7 @@ import (
 	pp "github.com/teamnsrg/profparse"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -18,11 +19,7 @@ type Result struct {
 	Path  string
 	Same  int
 	Total int
-}
-
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
+	Score float64
 }
 
 /**
@@ -31,10 +28,6 @@ type BVRange struct {
  * and one showing how many regions each site visit covered.
  */
 
-var MetaMap map[string]map[string][]pp.CodeRegion
-var Structure map[string]map[string]int
-var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
 var CompleteCounter int
 var SortedFiles []string
 var FileCoverage map[string][]float64
@@ -47,42 +40,33 @@ var FuncCovCountLock sync.Mutex
 var regionCoverage []int
 var regionCoverageLock sync.Mutex
 
-var CompareMaskCovered []bool
-var CompareMaskExclude []bool
+var CompareMaskCovered *pp.BitVector
+var CompareMaskExclude *pp.BitVector
+var CompareMaskHeader pp.BVHeader
+var Metric pp.Metric
 var Excluded int
 var Total int
 
 func main() {
 	var resultsPath string
 	var outfile string
+	var metricName string
+	var weightsFile string
 
 	flag.StringVar(&resultsPath, "results-path", "results",
 		"Path to MIDA results for analysis")
 	flag.StringVar(&outfile, "out", "output/compare_mask_similarities.csv",
 		"Path to output file csv")
+	flag.StringVar(&metricName, "metric", "normalized-hamming",
+		"Similarity metric to score each crawl against the mask with: "+strings.Join(pp.MetricNames(), ", "))
+	flag.StringVar(&weightsFile, "weights", "",
+		"Path to csv of region weights (Region Number, Weight) for weighted-jaccard")
 
 	flag.Parse()
 
 	var err error
 	CompleteCounter = 0
 
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	for k, v := range Structure {
-		start = currentIndex
-		for _, numBlocks := range v {
-			currentIndex += numBlocks
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
-
 	FileCoverage = make(map[string][]float64)
 
 	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, true)
@@ -90,17 +74,35 @@ func main() {
 		log.Fatal(err)
 	}
 
-	CompareMaskCovered, err = pp.ReadBVFileToBV("output/compareMaskCovered.bv")
+	CompareMaskCovered, CompareMaskHeader, err = pp.ReadBitVectorFile("output/compareMaskCovered.bv")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var excludeHeader pp.BVHeader
+	CompareMaskExclude, excludeHeader, err = pp.ReadBitVectorFile("output/compareMaskExclude.bv")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	CompareMaskExclude, err = pp.ReadBVFileToBV("output/compareMaskExclude.bv")
+	err = pp.CheckSameLayout(CompareMaskHeader, excludeHeader)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	Excluded, Total = pp.CountCoveredRegions(CompareMaskCovered)
+	Excluded, Total = pp.CountCoveredBitVector(CompareMaskCovered)
+
+	var weights []float64
+	if weightsFile != "" {
+		weights, err = pp.ReadRegionWeights(weightsFile, Total)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	Metric, err = pp.ParseMetric(metricName, weights)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	taskChan := make(chan Task, 10000)
 	resultChan := make(chan Result, 10000)
@@ -134,23 +136,28 @@ func main() {
 
 func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 	for task := range taskChan {
-		bv, err := pp.ReadBVFileToBV(task.Path)
+		bv, header, err := pp.ReadBitVectorFile(task.Path)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
 
-		same := 0
-		total := 0
-		for i := range bv {
-			if CompareMaskExclude[i] {
-				continue
-			}
-
-			total += 1
-			if bv[i] == CompareMaskCovered[i] {
-				same += 1
-			}
+		err = pp.CheckSameLayout(CompareMaskHeader, header)
+		if err != nil {
+			log.Errorf("%s: %v", task.Path, err)
+			continue
+		}
+
+		overlap, err := pp.CompareBitVectors(bv, CompareMaskCovered, CompareMaskExclude)
+		if err != nil {
+			log.Errorf("%s: %v", task.Path, err)
+			continue
+		}
+
+		score, err := Metric.Compare(bv, CompareMaskCovered, CompareMaskExclude)
+		if err != nil {
+			log.Errorf("%s: %v", task.Path, err)
+			continue
 		}
 
 		CompleteCounter += 1
@@ -158,8 +165,9 @@ func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 
 		var r Result
 		r.Path = task.Path
-		r.Same = same
-		r.Total = total
+		r.Same = overlap.Compared - overlap.OnlyOne - overlap.OnlyTwo
+		r.Total = overlap.Compared
+		r.Score = score
 		resultsChan <- r
 	}
 	wg.Done()
@@ -178,6 +186,8 @@ func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string) {
 		"Same",
 		"Total",
 		"Percent",
+		"Metric",
+		"Score",
 	})
 
 	for result := range resultChan {
@@ -188,6 +198,8 @@ func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string) {
 			strconv.Itoa(result.Same),
 			strconv.Itoa(result.Total),
 			strconv.FormatFloat(float64(result.Same)/float64(result.Total), 'f', 8, 64),
+			Metric.Name(),
+			strconv.FormatFloat(result.Score, 'f', 8, 64),
 		})
 		writer.Flush()
 	}
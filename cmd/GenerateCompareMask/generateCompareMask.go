@@ -18,15 +18,11 @@ type Result struct {
 	FinalTree map[string]int
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var SortedFuncs map[string][]string
@@ -91,24 +87,21 @@ func main() {
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, _, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+	MetaMap = Layout.Metadata()
 
 	files := 0
 	functions := 0
 	regions := 0
 
-	sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
+	sampleBV := make([]bool, Layout.NumRegions())
 	RegionCovCounts = make([]int, len(sampleBV))
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -116,41 +109,13 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
-
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-
-	fileNames := make([]string, 0)
-	for k := range Structure {
-		fileNames = append(fileNames, k)
-	}
-	sort.Strings(fileNames)
-
-	for _, k := range fileNames {
-		start = currentIndex
-		funcNames := make([]string, 0)
-		for funcName := range Structure[k] {
-			funcNames = append(funcNames, funcName)
-		}
-		sort.Strings(funcNames)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 
-		for _, funcName := range funcNames {
-			currentIndex += Structure[k][funcName]
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	FilenameToBVIndices = Layout.FileRanges()
 
 	excludeBV := make([]bool, len(sampleBV))
 	if excludeBVPath != "" {
-		excludeBV, err = pp.ReadBVFileToBV(excludeBVPath)
+		excludeBV, err = pp.ReadBVFileWithLayout(excludeBVPath, Layout)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -202,7 +167,7 @@ func main() {
 
 	bvs := make([][]bool, 0)
 	for _, covPath := range siteCovPaths {
-		bv, err := pp.ReadBVFileToBV(covPath)
+		bv, err := pp.ReadBVFileWithLayout(covPath, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -230,7 +195,7 @@ func main() {
 
 	bvs = make([][]bool, 0)
 	for _, covPath := range siteControlCovPaths {
-		bv, err := pp.ReadBVFileToBV(covPath)
+		bv, err := pp.ReadBVFileWithLayout(covPath, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -260,11 +225,12 @@ func main() {
 	}
 	log.Infof("Compared Regions: %d", comparedRegions)
 
-	err = pp.WriteFileFromBV(path.Join(outfiledir, "compareMaskExclude.bv"), compareMaskExclude)
+	header := pp.BVHeader{Layout: Layout.Fingerprint()}
+	err = pp.WriteBVFile(path.Join(outfiledir, "compareMaskExclude.bv"), compareMaskExclude, header)
 	if err != nil {
 		log.Error(err)
 	}
-	err = pp.WriteFileFromBV(path.Join(outfiledir, "compareMaskCovered.bv"), medianBV)
+	err = pp.WriteBVFile(path.Join(outfiledir, "compareMaskCovered.bv"), medianBV, header)
 	if err != nil {
 		log.Error(err)
 	}
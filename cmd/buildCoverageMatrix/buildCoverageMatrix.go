@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"path"
+)
+
+/**
+ * This transposes the vectors of a results set into a region-major coverage matrix, which
+ * regionCoverage and getBlockFrequencyForCrawlList can read with -matrix instead of reading every
+ * vector.
+ */
+
+func main() {
+	var resultsPath string
+	var outfile string
+	var bvName string
+	var memoryMB int64
+	var onePerSite bool
+
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results (or a pack) to transpose")
+	flag.StringVar(&outfile, "out", "output/coverage.matrix",
+		"Path to coverage matrix file")
+	flag.StringVar(&bvName, "bv-name", "coverage.bv",
+		"Name of the vector to transpose in each coverage directory")
+	flag.Int64Var(&memoryMB, "memory-mb", 4096,
+		"Memory budget for transposition, in megabytes")
+	flag.BoolVar(&onePerSite, "one-per-site", false,
+		"If true, only one crawl per site will be included")
+	flag.Parse()
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, onePerSite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, covPath := range covPaths {
+		covPaths[i] = path.Join(path.Dir(covPath), bvName)
+	}
+	log.Infof("Building coverage matrix from %d vectors", len(covPaths))
+
+	WORKERS := 28
+	skipped, err := pp.BuildCoverageMatrix(outfile, covPaths, memoryMB<<20, WORKERS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		log.Warnf("Left %d unreadable or mismatched vectors out of the matrix", len(skipped))
+	}
+	log.Info("Finished")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"path"
+	"sort"
+	"strings"
+)
+
+/**
+ * This compares every pair of crawls in a results set, writing a binary distance matrix that
+ * listDistances can export or filter. It replaces getdiff's csv of every pair. Run it again with
+ * the same arguments to resume an interrupted build.
+ */
+
+func main() {
+	var resultsPath string
+	var outfile string
+	var bvName string
+	var metricName string
+	var weightsFile string
+	var excludeBVFile string
+	var memoryMB int64
+	var workers int
+	var onePerSite bool
+
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results (or a pack) to compare")
+	flag.StringVar(&outfile, "out", "output/distances.matrix",
+		"Path to distance matrix file")
+	flag.StringVar(&bvName, "bv-name", "coverage.bv",
+		"Name of the vector to compare in each coverage directory")
+	flag.StringVar(&metricName, "metric", "hamming",
+		"Symmetric metric to compare crawls with: "+strings.Join(pp.MetricNames(), ", ")+
+			" (not containment)")
+	flag.StringVar(&weightsFile, "weights", "",
+		"Path to csv of region weights (Region Number, Weight) for weighted-jaccard")
+	flag.StringVar(&excludeBVFile, "exclude-bv", "",
+		"Path to exclude bit vector")
+	flag.Int64Var(&memoryMB, "memory-mb", 4096,
+		"Memory budget for vectors and values, in megabytes")
+	flag.IntVar(&workers, "workers", 28,
+		"Number of workers comparing vectors")
+	flag.BoolVar(&onePerSite, "one-per-site", true,
+		"If true, only one crawl per site will be included")
+	flag.Parse()
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, onePerSite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The order of the crawls must not change if the build is resumed
+	sort.Strings(covPaths)
+	for i, covPath := range covPaths {
+		covPaths[i] = path.Join(path.Dir(covPath), bvName)
+	}
+	if len(covPaths) == 0 {
+		log.Fatal("no vectors found")
+	}
+
+	var exclude *pp.BitVector
+	if excludeBVFile != "" {
+		exclude, _, err = pp.ReadBitVectorFile(excludeBVFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var weights []float64
+	if weightsFile != "" {
+		first, _, err := pp.ReadBitVectorFile(covPaths[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		weights, err = pp.ReadRegionWeights(weightsFile, first.Len())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	metric, err := pp.ParseMetric(metricName, weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !metric.Symmetric() {
+		log.Fatalf("%s is not symmetric, use a symmetric metric for a distance matrix", metric.Name())
+	}
+
+	log.Infof("Comparing %d vectors with %s", len(covPaths), metric.Name())
+	skipped, err := pp.BuildDistanceMatrix(outfile, covPaths, metric, exclude, memoryMB<<20, workers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		log.Warnf("Left %d unreadable or mismatched vectors out of the matrix", len(skipped))
+	}
+	log.Info("Finished")
+}
@@ -25,15 +25,12 @@ type Result struct {
 	FinalTree map[string]int
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
+var Layout *pp.CoverageLayout
+var FileLayout *pp.ProjectedLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var DenominatorFileCoverageMap map[string]int
@@ -43,6 +40,8 @@ var FileCoverage map[string][]float64
 var FileCovCounts map[string]int
 var FileCovCountLock sync.Mutex
 
+var Normalizer *pp.PathNormalizer
+
 func main() {
 	var covFile string
 	var resultsPath string
@@ -54,33 +53,38 @@ func main() {
 		"Path to MIDA results for analysis")
 	flag.StringVar(&outfile, "out", "file_coverage.csv",
 		"Path to output file csv")
+	newNormalizer := pp.NormalizerFlags()
 
 	flag.Parse()
 
+	Normalizer = newNormalizer()
+
 	var err error
 	CompleteCounter = 0
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, _, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	FileCovCounts = make(map[string]int)
-
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
+	FileLayout, err = pp.NewProjectedLayout(Layout, pp.FileGranularity)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+
+	FileCovCounts = make(map[string]int)
+
 	files := 0
 	functions := 0
 	regions := 0
 
 	// sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -88,24 +92,9 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
-
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	for k, v := range Structure {
-		start = currentIndex
-		for _, numBlocks := range v {
-			currentIndex += numBlocks
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
+
+	FilenameToBVIndices = Layout.FileRanges()
 
 	FileCoverage = make(map[string][]float64)
 
@@ -215,29 +204,25 @@ func main() {
 
 func fileWorker(taskChan chan Task, wg *sync.WaitGroup) {
 	for task := range taskChan {
-		bv, err := pp.ReadBVFileToBV(task.Path)
+		bv, err := pp.ReadBVFileWithLayout(task.Path, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
 
-		for _, fname := range SortedFiles {
-			indices := FilenameToBVIndices[fname]
-			fileCov := 0
-			for i := indices.Start; i < indices.End; i++ {
-				if bv[i] {
-					fileCov += 1
-				}
-			}
-
-			FileCovCountLock.Lock()
-			if _, ok := FileCoverage[fname]; !ok {
-				FileCoverage[fname] = make([]float64, 0)
-			}
-			FileCoverage[fname] = append(FileCoverage[fname], float64(fileCov)/float64(indices.End-indices.Start))
+		fileCov, err := FileLayout.CoveredRegions(bv)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
 
-			FileCovCountLock.Unlock()
+		FileCovCountLock.Lock()
+		for i, covered := range fileCov {
+			fname, _, _ := FileLayout.Name(i)
+			indices, _ := FileLayout.Range(i)
+			FileCoverage[fname] = append(FileCoverage[fname], float64(covered)/float64(indices.Len()))
 		}
+		FileCovCountLock.Unlock()
 
 		CompleteCounter += 1
 		log.Info(CompleteCounter)
@@ -248,12 +233,7 @@ func fileWorker(taskChan chan Task, wg *sync.WaitGroup) {
 func ConvertFileCoverageToTree(fc map[string]int) map[string]int {
 	tree := make(map[string]int)
 	for k, v := range fc {
-		parts := strings.Split(k, "/")
-		if parts[0] == ".." && parts[1] == ".." {
-			parts = parts[2:]
-		} else if parts[0] == "gen" {
-			parts = parts[1:]
-		}
+		parts := Normalizer.TreeParts(k)
 
 		for i := 0; i < len(parts); i++ {
 			seg := strings.Join(parts[:i+1], "/")
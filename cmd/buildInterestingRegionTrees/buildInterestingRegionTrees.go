@@ -22,15 +22,11 @@ type Result struct {
 	FinalTree map[string]int
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var SortedFuncs map[string][]string
@@ -40,6 +36,8 @@ var TotalBVs int
 var RegionCovCounts []int
 var RegionCountLock sync.Mutex
 
+var Normalizer *pp.PathNormalizer
+
 func main() {
 	var covFile string
 	var resultsPath string
@@ -54,32 +52,32 @@ func main() {
 		"Path to BV file to use for region exclusion")
 	flag.StringVar(&outfiledir, "out", "file_coverage",
 		"Path to output file directory")
+	newNormalizer := pp.NormalizerFlags()
 
 	flag.Parse()
 
+	Normalizer = newNormalizer()
+
 	var err error
 	CompleteCounter = 0
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, _, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+	MetaMap = Layout.Metadata()
 
 	files := 0
 	functions := 0
 	regions := 0
 
-	sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
+	sampleBV := make([]bool, Layout.NumRegions())
 	RegionCovCounts = make([]int, len(sampleBV))
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -87,46 +85,24 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-
-	fileNames := make([]string, 0)
-	for k := range Structure {
-		fileNames = append(fileNames, k)
-	}
-	sort.Strings(fileNames)
-
-	for _, k := range fileNames {
-		start = currentIndex
-		funcNames := make([]string, 0)
-		for funcName := range Structure[k] {
-			funcNames = append(funcNames, funcName)
-		}
-		sort.Strings(funcNames)
-
-		for _, funcName := range funcNames {
-			currentIndex += Structure[k][funcName]
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	FilenameToBVIndices = Layout.FileRanges()
 
 	excludeBV := make([]bool, len(sampleBV))
 	if excludeBVPath != "" {
-		excludeBV, err = pp.ReadBVFileToBV(excludeBVPath)
+		excludeBV, err = pp.ReadBVFileWithLayout(excludeBVPath, Layout)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	// Gap and skipped regions are never counted, so they stay out of the denominators
+	excludeBV, _, err = pp.CombineBVs([][]bool{excludeBV, Layout.ExcludeBV(pp.CountedRegions)})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	excludedRegions, _ := pp.CountCoveredRegions(excludeBV)
 	log.Infof("Excluding %d regions from '%s'", excludedRegions, excludeBVPath)
 
@@ -247,7 +223,7 @@ func main() {
 
 func regionCounterWorker(taskChan chan Task, wg *sync.WaitGroup) {
 	for task := range taskChan {
-		bv, err := pp.ReadBVFileToBV(task.Path)
+		bv, err := pp.ReadBVFileWithLayout(task.Path, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -388,12 +364,7 @@ func writer(writerChan chan Result, outfiledir string, wwg *sync.WaitGroup) {
 func ConvertFileCoverageToTree(fc map[string]int) map[string]int {
 	tree := make(map[string]int)
 	for k, v := range fc {
-		parts := strings.Split(k, "/")
-		if parts[0] == ".." && parts[1] == ".." {
-			parts = parts[2:]
-		} else if parts[0] == "gen" {
-			parts = parts[1:]
-		}
+		parts := Normalizer.TreeParts(k)
 
 		for i := 0; i < len(parts); i++ {
 			seg := strings.Join(parts[:i+1], "/")
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"path"
+)
+
+/**
+ * This computes a MinHash signature for every crawl in a results set and saves them as an LSH
+ * index, which queryLSH searches for crawls that look like a given one without comparing every
+ * pair.
+ */
+
+func main() {
+	var resultsPath string
+	var outfile string
+	var bvName string
+	var excludeBVFile string
+	var numHashes int
+	var bands int
+	var seed uint64
+	var onePerSite bool
+
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results (or a pack) to index")
+	flag.StringVar(&outfile, "out", "output/crawls.lsh",
+		"Path to LSH index file")
+	flag.StringVar(&bvName, "bv-name", "coverage.bv",
+		"Name of the vector to index in each coverage directory")
+	flag.StringVar(&excludeBVFile, "exclude-bv", "",
+		"Path to exclude bit vector")
+	flag.IntVar(&numHashes, "hashes", 128,
+		"Number of MinHash values per signature")
+	flag.IntVar(&bands, "bands", 32,
+		"Number of LSH bands, which must divide -hashes. More bands find less similar crawls.")
+	flag.Uint64Var(&seed, "seed", 1,
+		"MinHash seed")
+	flag.BoolVar(&onePerSite, "one-per-site", false,
+		"If true, only one crawl per site will be included")
+	flag.Parse()
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, onePerSite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, covPath := range covPaths {
+		covPaths[i] = path.Join(path.Dir(covPath), bvName)
+	}
+
+	var exclude *pp.BitVector
+	if excludeBVFile != "" {
+		exclude, _, err = pp.ReadBitVectorFile(excludeBVFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Infof("Computing signatures of %d vectors", len(covPaths))
+	WORKERS := 28
+	index, skipped, err := pp.BuildLSHIndex(covPaths, pp.MinHasher{NumHashes: numHashes, Seed: seed}, bands, exclude,
+		WORKERS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		log.Warnf("Left %d unreadable or mismatched vectors out of the index", len(skipped))
+	}
+
+	err = pp.WriteLSHIndex(outfile, index)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Wrote index of %d crawls to %s", len(index.Crawls), outfile)
+}
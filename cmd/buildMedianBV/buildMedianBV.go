@@ -71,6 +71,6 @@ func main() {
 
 	bv, err := pp.ReadBVFileToBV("output/100k_median.bv")
 	coveredRegions, totalRegions := pp.CountCoveredRegions(bv)
-	log.Infof("Median BV covers %d out of %d regions (%f percent)", coveredRegions, totalRegions, float64(coveredRegions)*100.0/float64(totalRegions))
+	log.Infof("Median BV covers %d out of %d regions, including gap and skipped regions (%f percent)", coveredRegions, totalRegions, float64(coveredRegions)*100.0/float64(totalRegions))
 	f.Close()
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+type Task struct {
+	Path string
+}
+
+var Pack *pp.PackWriter
+var BVNames []string
+var FileNames []string
+
+/**
+ * This collects the bit vectors of a MIDA results set into a single pack file, along with the
+ * metadata files of each crawl. Every command that takes a results path also accepts a pack, and
+ * reads vectors and metadata from it without touching the original tree.
+ */
+
+func main() {
+	var resultsPath string
+	var outfile string
+	var bvNames string
+	var fileNames string
+	var appendToPack bool
+
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results to pack")
+	flag.StringVar(&outfile, "out", "output/coverage.pack",
+		"Path to pack file")
+	flag.StringVar(&bvNames, "bv-names", "coverage.bv",
+		"Comma separated names of the vectors to pack from each coverage directory")
+	flag.StringVar(&fileNames, "files", "metadata.json,resource_metadata.json",
+		"Comma separated names of the files to pack from each crawl directory")
+	flag.BoolVar(&appendToPack, "append", false,
+		"Add to an existing pack instead of replacing it")
+	flag.Parse()
+
+	BVNames = strings.Split(bvNames, ",")
+	if fileNames != "" {
+		FileNames = strings.Split(fileNames, ",")
+	}
+
+	var err error
+	if appendToPack {
+		Pack, err = pp.AppendPack(outfile)
+	} else {
+		Pack, err = pp.CreatePack(outfile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	crawlPaths, err := pp.GetPathsMidaResults(resultsPath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Packing vectors of %d crawls", len(crawlPaths))
+
+	taskChan := make(chan Task, 10000)
+	var wg sync.WaitGroup
+
+	WORKERS := 28
+	for i := 0; i < WORKERS; i++ {
+		wg.Add(1)
+		go worker(taskChan, &wg)
+	}
+
+	for _, crawlPath := range crawlPaths {
+		var t Task
+		t.Path = crawlPath
+		taskChan <- t
+	}
+
+	close(taskChan)
+	wg.Wait()
+
+	numEntries := Pack.Len()
+	err = Pack.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Wrote %d vectors to %s (%d shared with identical vectors or files)", numEntries, outfile,
+		Pack.Deduplicated)
+}
+
+func worker(taskChan chan Task, wg *sync.WaitGroup) {
+	for task := range taskChan {
+		site := path.Base(path.Dir(task.Path))
+		crawl := path.Base(task.Path)
+
+		for _, name := range BVNames {
+			bvPath := path.Join(task.Path, "coverage", name)
+			if _, err := os.Stat(bvPath); os.IsNotExist(err) {
+				continue
+			}
+
+			err := Pack.AddBVFile(site, crawl, name, bvPath)
+			if err != nil {
+				log.Errorf("%s: %v", bvPath, err)
+			}
+		}
+
+		for _, name := range FileNames {
+			data, err := os.ReadFile(path.Join(task.Path, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err == nil {
+				err = Pack.AddFile(site, crawl, name, data)
+			}
+			if err != nil {
+				log.Errorf("%s: %v", path.Join(task.Path, name), err)
+			}
+		}
+	}
+	wg.Done()
+}
@@ -15,9 +15,12 @@ type Task struct {
 
 var CompleteCounter int
 
-var Accumulator []bool
+var Accumulator *pp.BitVector
+var AccumHeader pp.BVHeader
 var AccumLock sync.Mutex
 
+var BVName string
+
 func main() {
 	var initVectorFile string
 	var resultsPath string
@@ -29,12 +32,14 @@ func main() {
 		"Path to MIDA results for analysis")
 	flag.StringVar(&outfile, "out", "file_coverage.csv",
 		"Path to output file csv")
+	flag.StringVar(&BVName, "bv-name", "coverage.bv",
+		"Name of the vector to combine in each coverage directory, e.g. coverage.function.bv for projected vectors")
 	flag.Parse()
 
 	var err error
 
 	if initVectorFile != "" {
-		Accumulator, err = pp.ReadBVFileToBV(initVectorFile)
+		Accumulator, AccumHeader, err = pp.ReadBitVectorFile(initVectorFile)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -70,8 +75,12 @@ func main() {
 	wg.Wait()
 	log.Info("Workers finished")
 
-	log.Infof("Length of accumulator to write: %d", len(Accumulator))
-	err = pp.WriteFileFromBV(outfile, Accumulator)
+	if Accumulator == nil {
+		log.Fatal("no bit vectors to combine")
+	}
+
+	log.Infof("Length of accumulator to write: %d", Accumulator.Len())
+	err = pp.WriteBitVectorFile(outfile, Accumulator, pp.BVHeader{Granularity: AccumHeader.Granularity, Layout: AccumHeader.Layout})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -82,27 +91,35 @@ func worker(taskChan chan Task, wg *sync.WaitGroup) {
 
 		log.Infof("Processing task: %s", task.Path)
 
-		bv, err := pp.ReadBVFileToBV(path.Join(task.Path, "coverage", "coverage.bv"))
+		bv, header, err := pp.ReadBitVectorFile(path.Join(task.Path, "coverage", BVName))
 		if err != nil {
 			log.Error(err)
 			continue
 		}
 
 		AccumLock.Lock()
-		if len(Accumulator) == 0 {
-			Accumulator = make([]bool, len(bv))
+		err = pp.CheckSameLayout(AccumHeader, header)
+		if err != nil {
+			AccumLock.Unlock()
+			log.Errorf("%s: %v", task.Path, err)
+			continue
+		}
+		if !AccumHeader.HasLayout() {
+			AccumHeader.Layout = header.Layout
+			AccumHeader.Granularity = header.Granularity
+		}
+		if Accumulator == nil {
+			Accumulator = pp.NewBitVector(bv.Len())
 		}
 
-		log.Infof("Accumulator length: %d", len(Accumulator))
-		log.Infof("bv length: %d", len(bv))
-
-		var totalSoFar = 0
-		Accumulator, totalSoFar, err = pp.CombineBVs([][]bool{Accumulator, bv})
-		log.Infof("Accumulator length: %d", len(Accumulator))
+		log.Infof("Accumulator length: %d", Accumulator.Len())
+		log.Infof("bv length: %d", bv.Len())
 
+		err = Accumulator.Or(bv)
 		if err != nil {
 			log.Fatal(err)
 		}
+		totalSoFar := Accumulator.Count()
 		AccumLock.Unlock()
 
 		CompleteCounter += 1
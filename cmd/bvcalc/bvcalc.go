@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This evaluates a bit vector expression (see pp.BVExpr) and writes the resulting vector and
+// statistics about it. It replaces the one-off mains for combining vectors, e.g.
+//
+//   bvcalc -expr 'union("results/*/*/coverage/coverage.bv")' -out union.bv
+//   bvcalc -expr 'majority("results/*/*/coverage/coverage.bv")' -out median.bv
+//   bvcalc -in a=a.bv -in b=b.bv -in exclude=exclude.bv -expr 'count((a ^ b) - exclude)'
+//
+// Given -coverage-file, gap and skipped regions are left out of the totals of vector results, as
+// llvm-cov does. count() always counts every region, including gap and skipped regions; subtract
+// an exclude vector inside it to leave them out.
+
+// Inputs binds names in the expression to files, from repeated -in name=path flags
+type Inputs map[string]string
+
+func (in Inputs) String() string {
+	pairs := make([]string, 0)
+	for name, fName := range in {
+		pairs = append(pairs, name+"="+fName)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (in Inputs) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("inputs must be given as name=path")
+	}
+	in[parts[0]] = parts[1]
+	return nil
+}
+
+func main() {
+	var exprString string
+	var outfile string
+	var statsFile string
+	var encoding string
+	var covFile string
+	inputs := make(Inputs)
+
+	flag.StringVar(&exprString, "expr", "",
+		"Expression to evaluate, e.g. '(a | b) & ~exclude'")
+	flag.Var(inputs, "in",
+		"Vector file bound to a name in the expression, as name=path (may be repeated)")
+	flag.StringVar(&outfile, "out", "",
+		"Path to write the resulting bit vector to, if any")
+	flag.StringVar(&statsFile, "stats", "",
+		"Path to output statistics csv, if any")
+	flag.StringVar(&encoding, "encoding", "packed",
+		"Encoding to write the vector with: packed or compressed")
+	flag.StringVar(&covFile, "coverage-file", "",
+		"Text coverage file of the binary, to leave gap and skipped regions out of the totals of vector results")
+	flag.Parse()
+
+	if exprString == "" {
+		exprString = strings.Join(flag.Args(), " ")
+	}
+	if exprString == "" {
+		log.Fatal("no expression given")
+	}
+
+	expr, err := pp.ParseBVExpr(exprString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range expr.Names() {
+		if _, ok := inputs[name]; !ok {
+			log.Fatalf("no file given for %s, use -in %s=<path>", name, name)
+		}
+	}
+
+	e, err := pp.ParseBVEncoding(encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := expr.Eval(inputs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Read %d vectors", res.Inputs)
+
+	record := []string{exprString, strconv.Itoa(res.Inputs)}
+	if res.IsCount {
+		log.Infof("Count: %d (including gap and skipped regions)", res.Count)
+		if covFile != "" {
+			log.Warn("-coverage-file does not apply to count()")
+		}
+		record = append(record, strconv.Itoa(res.Count), "", "")
+	} else {
+		covered, total := pp.CountCoveredRegions(res.Vector)
+		regions := "regions, including gap and skipped regions"
+		if covFile != "" {
+			regions = "counted regions"
+			layout, err := pp.LoadCoverageLayout(covFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if layout.NumRegions() != len(res.Vector) {
+				log.Fatalf("%s has %d regions, but the result has %d", covFile, layout.NumRegions(), len(res.Vector))
+			}
+			covered, total, err = pp.CountCoveredRegionsWithExclude(res.Vector, layout.ExcludeBV(pp.CountedRegions))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		percent := 0.0
+		if total > 0 {
+			percent = float64(covered) / float64(total)
+		}
+		log.Infof("Result covers %d out of %d %s (%f percent)", covered, total, regions, percent*100.0)
+		record = append(record, strconv.Itoa(covered), strconv.Itoa(total), strconv.FormatFloat(percent, 'f', 4, 64))
+
+		if outfile != "" {
+			h := res.Header
+			h.Encoding = e
+			err = pp.WriteBVFile(outfile, res.Vector, h)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Wrote %s", outfile)
+		}
+	}
+
+	if statsFile != "" {
+		f, err := os.Create(statsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writer := csv.NewWriter(f)
+		err = writer.Write([]string{"Expression", "Vectors Read", "Covered", "Total Regions", "Percent Covered"})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writer.Write(record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writer.Flush()
+		err = writer.Error()
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+}
@@ -45,11 +45,6 @@ type Result struct {
 	PercentDirBlocksCovered      map[string]float64
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 type CloudflareContentCategory struct {
 	ID              int    `json:"id,omitempty"`
 	SuperCategoryId int    `json:"super_category_id,omitempty"`
@@ -66,10 +61,11 @@ type CloudflareCategoryEntry struct {
 	Application       CloudflareApplication       `json:"application"`
 }
 
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var DenominatorFileCoverageMap map[string]int
@@ -118,32 +114,27 @@ func main() {
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	var metaProps pp.CovMapProperties
-	MetaMap, metaProps, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+	metaProps := Layout.Properties
+
 	log.Infof("MetaMap Files: %d, Funcs: %d, Regions: %d", metaProps.NumFiles, metaProps.NumFunctions, metaProps.NumRegions)
 
 	FileCovCounts = make(map[string]int)
 
-	sampleCovMap, props, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Infof("CovMap Files: %d, Funcs: %d, Regions: %d", props.NumFiles, props.NumFunctions, props.NumRegions)
-
 	files := 0
 	functions := 0
 	regions := 0
 
-	sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
+	sampleBV := make([]bool, Layout.NumRegions())
 
 	log.Info("Reading BV to exclude")
 	if excludeBVFile != "" {
-		ExcludeVector, err = pp.ReadBVFileToBV(excludeBVFile)
+		ExcludeVector, err = pp.ReadBVFileWithLayout(excludeBVFile, Layout)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -153,7 +144,7 @@ func main() {
 		log.Infof("Created empty exclude vector (length: %d)", len(ExcludeVector))
 	}
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -161,39 +152,11 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 	log.Infof("BVIndexToCodeRegionMap Length: %d", len(BVIndexToCodeRegionMap))
 
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	totalRegions := 0
-
-	fileNames := make([]string, 0)
-	for fileName := range Structure {
-		fileNames = append(fileNames, fileName)
-	}
-	sort.Strings(fileNames)
-
-	for _, fileName := range fileNames {
-		start = currentIndex
-		funcNames := make([]string, 0)
-		for funcName := range Structure[fileName] {
-			funcNames = append(funcNames, funcName)
-		}
-
-		for _, funcName := range funcNames {
-			currentIndex += Structure[fileName][funcName]
-		}
-		end = currentIndex
-		FilenameToBVIndices[fileName] = BVRange{
-			Start: start,
-			End:   end,
-		}
-		totalRegions += end - start
-	}
+	FilenameToBVIndices = Layout.FileRanges()
+	totalRegions := Layout.NumRegions()
 
 	log.Infof("Total Files, Regions for FilenameToBVIndices: %d, %d", len(FilenameToBVIndices), totalRegions)
 
@@ -262,7 +225,7 @@ func worker(taskChan chan Task, resultChan chan Result, wg *sync.WaitGroup) {
 		pathsParts := strings.Split(task.Path, "/")
 		domain := pathsParts[len(pathsParts)-3]
 
-		bv, err := pp.ReadBVFileToBV(path.Join(task.Path, "coverage", "coverage.bv"))
+		bv, err := pp.ReadBVFileWithLayout(path.Join(task.Path, "coverage", "coverage.bv"), Layout)
 		if err != nil {
 			log.Error(err)
 			continue
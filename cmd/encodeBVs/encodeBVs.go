@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"os"
+	"path"
+	"sync"
+)
+
+type Task struct {
+	Path string
+}
+
+var Encoding pp.BVEncoding
+var BVName string
+
+var SizeLock sync.Mutex
+var BytesBefore int64
+var BytesAfter int64
+
+/**
+ * This rewrites the bit vectors in a results set with the given encoding, in place. Compressed
+ * vectors are read by every tool that reads packed ones, so an archive can be compressed once
+ * and analyzed as before.
+ */
+
+func main() {
+	var resultsPath string
+	var encoding string
+
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results to rewrite")
+	flag.StringVar(&encoding, "encoding", "compressed",
+		"Encoding to rewrite vectors with: packed or compressed")
+	flag.StringVar(&BVName, "bv-name", "coverage.bv",
+		"Name of the vector to rewrite in each coverage directory")
+	flag.Parse()
+
+	var err error
+	Encoding, err = pp.ParseBVEncoding(encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Rewriting %d vectors", len(covPaths))
+
+	taskChan := make(chan Task, 10000)
+	var wg sync.WaitGroup
+
+	WORKERS := 28
+	for i := 0; i < WORKERS; i++ {
+		wg.Add(1)
+		go worker(taskChan, &wg)
+	}
+
+	for _, covPath := range covPaths {
+		var t Task
+		t.Path = path.Join(path.Dir(covPath), BVName)
+		taskChan <- t
+	}
+
+	close(taskChan)
+	wg.Wait()
+	log.Infof("Finished: %d bytes before, %d bytes after", BytesBefore, BytesAfter)
+}
+
+func worker(taskChan chan Task, wg *sync.WaitGroup) {
+	for task := range taskChan {
+		before, err := os.Stat(task.Path)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		// Write to a temporary file so that a failure never leaves a truncated vector behind
+		tmpPath := task.Path + ".tmp"
+		err = pp.ReencodeBVFile(task.Path, tmpPath, Encoding)
+		if err != nil {
+			log.Error(err)
+			os.Remove(tmpPath)
+			continue
+		}
+
+		after, err := os.Stat(tmpPath)
+		if err == nil {
+			err = os.Rename(tmpPath, task.Path)
+		}
+		if err != nil {
+			log.Error(err)
+			os.Remove(tmpPath)
+			continue
+		}
+
+		SizeLock.Lock()
+		BytesBefore += before.Size()
+		BytesAfter += after.Size()
+		SizeLock.Unlock()
+	}
+	wg.Done()
+}
@@ -62,7 +62,7 @@ func main() {
 
 	var err error
 
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
+	layout, err := pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -71,7 +71,7 @@ func main() {
 	functions := 0
 	regions := 0
 
-	Structure := pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure := layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -115,15 +115,16 @@ func main() {
 
 	log.Infof("Total Excluded: %d", totalExcluded)
 
-	pp.WriteFileFromBV(outfile, excludeVector)
+	header := pp.BVHeader{Layout: layout.Fingerprint()}
+	pp.WriteBVFile(outfile, excludeVector, header)
 	alwaysCovered, _ := pp.CountCoveredRegions(alwaysSoFar)
 	log.Infof("Always covered: %d", alwaysCovered)
 	neverCovered, _ := pp.CountCoveredRegions(neverSoFar)
 	log.Infof("Never covered: %d", neverCovered)
 
-	pp.WriteFileFromBV("output/alwaysCovered.bv", alwaysSoFar)
-	pp.WriteFileFromBV("output/neverCovered.bv", neverSoFar)
-	pp.WriteFileFromBV("output/aboutBlankCovered.bv", coveredSoFar)
+	pp.WriteBVFile("output/alwaysCovered.bv", alwaysSoFar, header)
+	pp.WriteBVFile("output/neverCovered.bv", neverSoFar, header)
+	pp.WriteBVFile("output/aboutBlankCovered.bv", coveredSoFar, header)
 
 	totalExcludedRegions, totalRegions := pp.CountCoveredRegions(excludeVector)
 	log.Infof("Excluding a total of %d out of %d regions", totalExcludedRegions, totalRegions)
@@ -134,7 +135,8 @@ func main() {
 		log.Fatal(err)
 	}
 
-	treeSummary := pp.GetTreeSummary(covMap, -1)
+	treeSummary, err := pp.GetTreeSummaryWithFilter(covMap, layout.Metadata(), -1, pp.CountedRegions,
+		pp.DefaultPathNormalizer())
 	if err != nil {
 		log.Fatal(err)
 	}
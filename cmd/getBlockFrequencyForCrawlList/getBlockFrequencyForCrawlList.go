@@ -44,11 +44,6 @@ type Result struct {
 	PercentDirBlocksCovered      map[string]float64
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 type CloudflareContentCategory struct {
 	ID              int    `json:"id,omitempty"`
 	SuperCategoryId int    `json:"super_category_id,omitempty"`
@@ -65,10 +60,11 @@ type CloudflareCategoryEntry struct {
 	Application       CloudflareApplication       `json:"application"`
 }
 
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var DenominatorFileCoverageMap map[string]int
@@ -95,6 +91,8 @@ func main() {
 	var inputList string
 	var outfile string
 	var excludeBVFile string
+	var nameStyle string
+	var matrixFile string
 
 	flag.StringVar(&covFile, "coverage-file", "coverage.txt",
 		"Path to sample text coverage file for metadata generation")
@@ -104,42 +102,50 @@ func main() {
 		"Path to output file csv")
 	flag.StringVar(&excludeBVFile, "excludeBV", "",
 		"BV file to exclude set regions from analysis")
+	flag.StringVar(&nameStyle, "names", "",
+		"If set, add the file and function of each region, writing function names as mangled, demangled, qualified or both")
+	flag.StringVar(&matrixFile, "matrix", "",
+		"If set, count coverage from this coverage matrix instead of reading each crawl's vector")
 
 	flag.Parse()
 
 	var err error
+	var names *pp.FunctionNameFormatter
+	if nameStyle != "" {
+		style, err := pp.ParseNameStyle(nameStyle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names = pp.NewFunctionNameFormatter(style)
+	}
+
 	BVIndexCoveredTimes = make(map[int]int)
 
 	CompleteCounter = 0
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	var metaProps pp.CovMapProperties
-	MetaMap, metaProps, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+	metaProps := Layout.Properties
+
 	log.Infof("MetaMap Files: %d, Funcs: %d, Regions: %d", metaProps.NumFiles, metaProps.NumFunctions, metaProps.NumRegions)
 
 	FileCovCounts = make(map[string]int)
 
-	sampleCovMap, props, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Infof("CovMap Files: %d, Funcs: %d, Regions: %d", props.NumFiles, props.NumFunctions, props.NumRegions)
-
 	files := 0
 	functions := 0
 	regions := 0
 
-	sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
+	sampleBV := make([]bool, Layout.NumRegions())
 
 	log.Info("Reading BV to exclude")
 	if excludeBVFile != "" {
-		ExcludeVector, err = pp.ReadBVFileToBV(excludeBVFile)
+		ExcludeVector, err = pp.ReadBVFileWithLayout(excludeBVFile, Layout)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -149,7 +155,7 @@ func main() {
 		log.Infof("Created empty exclude vector (length: %d)", len(ExcludeVector))
 	}
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -157,39 +163,11 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 	log.Infof("BVIndexToCodeRegionMap Length: %d", len(BVIndexToCodeRegionMap))
 
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	totalRegions := 0
-
-	fileNames := make([]string, 0)
-	for fileName := range Structure {
-		fileNames = append(fileNames, fileName)
-	}
-	sort.Strings(fileNames)
-
-	for _, fileName := range fileNames {
-		start = currentIndex
-		funcNames := make([]string, 0)
-		for funcName := range Structure[fileName] {
-			funcNames = append(funcNames, funcName)
-		}
-
-		for _, funcName := range funcNames {
-			currentIndex += Structure[fileName][funcName]
-		}
-		end = currentIndex
-		FilenameToBVIndices[fileName] = BVRange{
-			Start: start,
-			End:   end,
-		}
-		totalRegions += end - start
-	}
+	FilenameToBVIndices = Layout.FileRanges()
+	totalRegions := Layout.NumRegions()
 
 	log.Infof("Total Files, Regions for FilenameToBVIndices: %d, %d", len(FilenameToBVIndices), totalRegions)
 
@@ -222,24 +200,28 @@ func main() {
 
 	numTrials := len(inputData)
 
-	taskChan := make(chan Task, 10000)
-	var wg sync.WaitGroup
+	if matrixFile != "" {
+		countFromMatrix(matrixFile, inputData)
+	} else {
+		taskChan := make(chan Task, 10000)
+		var wg sync.WaitGroup
 
-	WORKERS := 28
-	for i := 0; i < WORKERS; i++ {
-		wg.Add(1)
-		go worker(taskChan, &wg)
-	}
+		WORKERS := 28
+		for i := 0; i < WORKERS; i++ {
+			wg.Add(1)
+			go worker(taskChan, &wg)
+		}
 
-	for _, resultsPath := range inputData {
-		var t Task
-		t.Path = string(resultsPath)
-		taskChan <- t
-	}
+		for _, resultsPath := range inputData {
+			var t Task
+			t.Path = string(resultsPath)
+			taskChan <- t
+		}
 
-	close(taskChan)
-	wg.Wait()
-	log.Info("Workers finished")
+		close(taskChan)
+		wg.Wait()
+		log.Info("Workers finished")
+	}
 
 	regionIndices := make([]int, 0)
 	log.Infof("BVIndexCoveredTimes length: %d", len(BVIndexCoveredTimes))
@@ -257,15 +239,23 @@ func main() {
 		"Total Trials",
 		"Percent Covered",
 	}
+	if names != nil {
+		header = append(append(header, "File"), names.Header("Function")...)
+	}
 	writer.Write(header)
 
 	for _, index := range regionIndices {
-		writer.Write([]string{
+		record := []string{
 			strconv.Itoa(index),
 			strconv.Itoa(BVIndexCoveredTimes[index]),
 			strconv.Itoa(numTrials),
 			strconv.FormatFloat(float64(BVIndexCoveredTimes[index])/float64(numTrials), 'f', 8, 64),
-		})
+		}
+		if names != nil {
+			fileName, funcName, _, _ := Layout.Locate(index)
+			record = append(append(record, fileName), names.Format(funcName)...)
+		}
+		writer.Write(record)
 	}
 
 	writer.Flush()
@@ -279,26 +269,25 @@ func worker(taskChan chan Task, wg *sync.WaitGroup) {
 
 		log.Infof("Processing task: %s", task.Path)
 
-		bv, err := pp.ReadBVFileToBV(task.Path)
+		bv, err := pp.OpenMappedBVFileWithLayout(task.Path, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
 
-		for i := 0; i < len(bv); i++ {
+		bv.ForEach(func(i int) {
 			if ExcludeVector[i] {
-				continue
+				return
 			}
 
-			if bv[i] {
-				BVIndexCoveredTimesLock.Lock()
-				if _, ok := BVIndexCoveredTimes[i]; !ok {
-					BVIndexCoveredTimes[i] = 0
-				}
-				BVIndexCoveredTimes[i] = BVIndexCoveredTimes[i] + 1
-				BVIndexCoveredTimesLock.Unlock()
+			BVIndexCoveredTimesLock.Lock()
+			if _, ok := BVIndexCoveredTimes[i]; !ok {
+				BVIndexCoveredTimes[i] = 0
 			}
-		}
+			BVIndexCoveredTimes[i] = BVIndexCoveredTimes[i] + 1
+			BVIndexCoveredTimesLock.Unlock()
+		})
+		bv.Close()
 
 		CompleteCounter += 1
 		log.Info(CompleteCounter)
@@ -306,6 +295,44 @@ func worker(taskChan chan Task, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
+// countFromMatrix fills BVIndexCoveredTimes from the columns of a coverage matrix that belong to
+// the crawls in the input list
+func countFromMatrix(matrixFile string, inputData []string) {
+	m, err := pp.OpenCoverageMatrix(matrixFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	if m.Layout != (pp.LayoutFingerprint{}) && m.Layout != Layout.Fingerprint() {
+		log.Fatal("coverage matrix was built for a different layout")
+	}
+	if m.NumRegions() != Layout.NumRegions() {
+		log.Fatal("coverage matrix does not match layout")
+	}
+
+	mask := pp.NewBitVector(m.NumCrawls())
+	for _, covPath := range inputData {
+		site, crawl := pp.CrawlForCovPath(covPath)
+		c, ok := m.CrawlIndex(site, crawl)
+		if !ok {
+			log.Errorf("%s: crawl not in coverage matrix", covPath)
+			continue
+		}
+		mask.Set(c)
+	}
+
+	counts, err := m.CountsWithMask(mask)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, count := range counts {
+		if count > 0 && !ExcludeVector[i] {
+			BVIndexCoveredTimes[i] = count
+		}
+	}
+}
+
 func DirSize(path string) (int64, error) {
 	var size int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"math"
+	"os"
+	"strconv"
+)
+
+/**
+ * This writes the pairs of crawls in a distance matrix to a csv, one line per pair. With -max or
+ * -min only the pairs within those bounds are written, e.g. -metric jaccard with -min 0.99 lists
+ * near-duplicate crawls.
+ */
+
+func main() {
+	var matrixFile string
+	var outfile string
+	var maxValue float64
+	var minValue float64
+
+	flag.StringVar(&matrixFile, "matrix", "output/distances.matrix",
+		"Path to distance matrix file")
+	flag.StringVar(&outfile, "out", "output/distances.csv",
+		"Path to output file csv")
+	flag.Float64Var(&maxValue, "max", math.Inf(1),
+		"Only write pairs with at most this value")
+	flag.Float64Var(&minValue, "min", math.Inf(-1),
+		"Only write pairs with at least this value")
+	flag.Parse()
+
+	d, err := pp.OpenDistanceMatrix(matrixFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer d.Close()
+
+	f, err := os.Create(outfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer := csv.NewWriter(f)
+
+	writer.Write([]string{
+		"Site One",
+		"Crawl One",
+		"Site Two",
+		"Crawl Two",
+		d.Metric,
+	})
+
+	written := 0
+	err = d.ForEachPair(func(i int, j int, v float64) {
+		if v > maxValue || v < minValue {
+			return
+		}
+		writer.Write([]string{
+			d.Crawls[i].Site,
+			d.Crawls[i].Crawl,
+			d.Crawls[j].Site,
+			d.Crawls[j].Crawl,
+			strconv.FormatFloat(v, 'f', -1, 32),
+		})
+
+		written += 1
+		if written%1000000 == 0 {
+			log.Infof("Written %d lines", written)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer.Flush()
+	err = writer.Error()
+	if err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
+	log.Infof("Wrote %d pairs of %d crawls", written, d.NumCrawls())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"os"
+	"path"
+	"strconv"
+)
+
+/**
+ * This iterates over the vectors in a pack, writing one line per vector with its crawl, layout
+ * and number of covered entries. With -extract, the vectors and crawl files are also written back
+ * out as a MIDA results tree.
+ */
+
+func main() {
+	var packFile string
+	var outfile string
+	var extractPath string
+
+	flag.StringVar(&packFile, "pack", "output/coverage.pack",
+		"Path to pack file")
+	flag.StringVar(&outfile, "out", "output/pack_contents.csv",
+		"Path to output file csv")
+	flag.StringVar(&extractPath, "extract", "",
+		"If set, write every vector to <extract>/<site>/<crawl>/coverage/<name>, and every crawl "+
+			"file to <extract>/<site>/<crawl>/<name>")
+	flag.Parse()
+
+	pack, err := pp.OpenPack(packFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pack.Close()
+
+	f, err := os.Create(outfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer := csv.NewWriter(f)
+
+	writer.Write([]string{
+		"Site",
+		"Crawl",
+		"Name",
+		"Granularity",
+		"Layout",
+		"Covered",
+		"Total",
+	})
+
+	for _, e := range pack.Entries {
+		data, err := pack.ReadData(e)
+		if err != nil {
+			log.Errorf("%s: %v", e.Path(), err)
+			continue
+		}
+
+		bv, _, err := pp.ParseBitVectorFile(data)
+		if err != nil {
+			log.Errorf("%s: %v", e.Path(), err)
+			continue
+		}
+
+		writer.Write([]string{
+			e.Site,
+			e.Crawl,
+			e.Name,
+			e.Granularity.String(),
+			e.Layout.String(),
+			strconv.Itoa(bv.Count()),
+			strconv.Itoa(bv.Len()),
+		})
+
+		if extractPath != "" {
+			outPath := path.Join(extractPath, e.Path())
+			err = os.MkdirAll(path.Dir(outPath), 0755)
+			if err == nil {
+				err = os.WriteFile(outPath, data, 0644)
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	writer.Flush()
+	f.Close()
+	log.Infof("Listed %d vectors", len(pack.Entries))
+
+	if extractPath != "" {
+		for _, e := range pack.Files {
+			outPath := path.Join(extractPath, e.Path())
+			data, err := pack.ReadFile(e)
+			if err == nil {
+				err = os.MkdirAll(path.Dir(outPath), 0755)
+			}
+			if err == nil {
+				err = os.WriteFile(outPath, data, 0644)
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		log.Infof("Extracted %d crawl files", len(pack.Files))
+	}
+}
@@ -36,11 +36,6 @@ type Result struct {
 	PercentDirBlocksCovered      map[string]float64
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 type CloudflareContentCategory struct {
 	ID              int    `json:"id,omitempty"`
 	SuperCategoryId int    `json:"super_category_id,omitempty"`
@@ -63,6 +58,9 @@ var SiteCats map[string]CloudflareCategoryEntry
 
 var ExcludeVector []bool
 
+// Packs hold crawl metadata but not the resources directory of each crawl
+var ReadingPack bool
+
 var DirectoriesOfInterest = []string{
 	"third_party/blink",
 	"android_webview",
@@ -142,6 +140,11 @@ func main() {
 
 	var err error
 
+	ReadingPack = pp.IsPackFile(resultsPath)
+	if ReadingPack {
+		log.Warn("Resources are not stored in packs, so resource bytes downloaded will be 0")
+	}
+
 	log.Info("Loading cloudflare categories...")
 	SiteCats, err = LoadCloudflareCategories("/home/pmurley/top1mplusVVNN_categories.json")
 	if err != nil {
@@ -229,10 +232,13 @@ func worker(taskChan chan Task, resultChan chan Result, wg *sync.WaitGroup) {
 			continue
 		}
 
-		resourceDir := path.Join(task.Path, "resources")
-		dirSize, err := DirSize(resourceDir)
-		if err != nil {
-			log.Error(err)
+		var dirSize int64
+		if !ReadingPack {
+			resourceDir := path.Join(task.Path, "resources")
+			dirSize, err = DirSize(resourceDir)
+			if err != nil {
+				log.Error(err)
+			}
 		}
 
 		var r Result
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"path"
+	"sync"
+)
+
+type Task struct {
+	Path string
+}
+
+var Projection *pp.ProjectedLayout
+var OutName string
+
+/**
+ * This projects the region bit vectors in a results set down to one bit per function or per file,
+ * writing each projected vector next to the coverage.bv it came from. Projected vectors can be
+ * combined, compared and diffed like region vectors, with a much smaller working set.
+ */
+
+func main() {
+	var covFile string
+	var resultsPath string
+	var granularity string
+	var excludeBVFile string
+	var excludeOutfile string
+
+	flag.StringVar(&covFile, "coverage-file", "coverage.txt",
+		"Path to sample text coverage file for metadata generation")
+	flag.StringVar(&resultsPath, "results-path", "results",
+		"Path to MIDA results to project")
+	flag.StringVar(&granularity, "granularity", "function",
+		"Granularity to project to: function, function-entry or file")
+	flag.StringVar(&OutName, "out-name", "",
+		"Name of the projected vector written next to each coverage.bv (default coverage.<granularity>.bv)")
+	flag.StringVar(&excludeBVFile, "excludeBV", "",
+		"Region exclude vector to project as well (optional)")
+	flag.StringVar(&excludeOutfile, "exclude-out", "output/projected_exclude.bv",
+		"Path to projected exclude vector")
+	flag.Parse()
+
+	g, err := pp.ParseBVGranularity(granularity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if OutName == "" {
+		OutName = "coverage." + g.String() + ".bv"
+	}
+
+	layout, err := pp.LoadCoverageLayout(covFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Projection, err = pp.NewProjectedLayout(layout, g)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Projecting %d regions to %d entries", layout.NumRegions(), Projection.Len())
+
+	if excludeBVFile != "" {
+		excludeBV, err := pp.ReadBVFileWithLayout(excludeBVFile, layout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		projected, err := Projection.ProjectExclude(excludeBV)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = pp.WriteBVFile(excludeOutfile, projected, Projection.Header(""))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Projecting %d vectors", len(covPaths))
+
+	taskChan := make(chan Task, 10000)
+	var wg sync.WaitGroup
+
+	WORKERS := 28
+	for i := 0; i < WORKERS; i++ {
+		wg.Add(1)
+		go worker(taskChan, &wg)
+	}
+
+	for _, covPath := range covPaths {
+		var t Task
+		t.Path = covPath
+		taskChan <- t
+	}
+
+	close(taskChan)
+	wg.Wait()
+	log.Info("Finished")
+}
+
+func worker(taskChan chan Task, wg *sync.WaitGroup) {
+	for task := range taskChan {
+		err := Projection.ProjectBVFile(task.Path, path.Join(path.Dir(task.Path), OutName))
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	wg.Done()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type Task struct {
+	Site  string
+	Crawl string
+	Path  string
+	Index int // Position in the index, or -1 for a vector outside it
+}
+
+type Neighbor struct {
+	Crawl    pp.LSHCrawl
+	Estimate float64
+	Exact    float64
+}
+
+type Result struct {
+	Query     Task
+	Neighbors []Neighbor
+}
+
+/**
+ * This searches an LSH index built by buildLSHIndex for crawls that look like a given one, writing
+ * each candidate with its estimated and exact Jaccard index. Query a vector with -query, a crawl in
+ * the index with -site and -crawl, or every crawl in the index against the others with -all.
+ */
+
+var Index *pp.LSHIndex
+var ExcludeBV *pp.BitVector
+var MinEstimate float64
+var MaxResults int
+var Exact bool
+
+func main() {
+	var indexFile string
+	var queryFile string
+	var site string
+	var crawl string
+	var all bool
+	var excludeBVFile string
+	var outfile string
+
+	flag.StringVar(&indexFile, "index", "output/crawls.lsh",
+		"Path to LSH index file")
+	flag.StringVar(&queryFile, "query", "",
+		"Path to a bit vector to find neighbors of")
+	flag.StringVar(&site, "site", "",
+		"Site of an indexed crawl to find neighbors of")
+	flag.StringVar(&crawl, "crawl", "",
+		"Indexed crawl to find neighbors of, with -site")
+	flag.BoolVar(&all, "all", false,
+		"Find the neighbors of every indexed crawl, writing each pair once")
+	flag.StringVar(&excludeBVFile, "exclude-bv", "",
+		"Path to the exclude bit vector the index was built with")
+	flag.Float64Var(&MinEstimate, "min-estimate", 0.5,
+		"Only write candidates with at least this estimated Jaccard index")
+	flag.IntVar(&MaxResults, "max-results", 0,
+		"Maximum number of candidates to write per query, 0 for all")
+	flag.BoolVar(&Exact, "exact", true,
+		"If true, read each candidate's vector to compute its exact Jaccard index")
+	flag.StringVar(&outfile, "out", "output/neighbors.csv",
+		"Path to output file csv")
+	flag.Parse()
+
+	var err error
+	Index, err = pp.ReadLSHIndex(indexFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if excludeBVFile != "" {
+		ExcludeBV, _, err = pp.ReadBitVectorFile(excludeBVFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = Index.CheckExclude(ExcludeBV)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tasks := make([]Task, 0)
+	switch {
+	case all:
+		for i, c := range Index.Crawls {
+			tasks = append(tasks, Task{Site: c.Site, Crawl: c.Crawl, Path: c.Path, Index: i})
+		}
+	case queryFile != "":
+		s, c := pp.CrawlForCovPath(queryFile)
+		tasks = append(tasks, Task{Site: s, Crawl: c, Path: queryFile, Index: -1})
+	case site != "":
+		for i, c := range Index.Crawls {
+			if c.Site == site && (crawl == "" || c.Crawl == crawl) {
+				tasks = append(tasks, Task{Site: c.Site, Crawl: c.Crawl, Path: c.Path, Index: i})
+			}
+		}
+		if len(tasks) == 0 {
+			log.Fatalf("no crawl of %s in the index", site)
+		}
+	default:
+		log.Fatal("nothing to query: use -query, -site or -all")
+	}
+
+	taskChan := make(chan Task, 10000)
+	resultChan := make(chan Result, 10000)
+	var wg sync.WaitGroup
+	var owg sync.WaitGroup
+
+	owg.Add(1)
+	go writer(resultChan, &owg, outfile, all)
+
+	WORKERS := 28
+	for i := 0; i < WORKERS; i++ {
+		wg.Add(1)
+		go worker(taskChan, resultChan, &wg, all)
+	}
+
+	for _, t := range tasks {
+		taskChan <- t
+	}
+
+	close(taskChan)
+	wg.Wait()
+	close(resultChan)
+	owg.Wait()
+
+	log.Info("Finished")
+}
+
+func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup, all bool) {
+	for task := range taskChan {
+		var bv *pp.BitVector
+		var sig pp.MinHashSignature
+		var err error
+		if task.Index >= 0 && !Exact {
+			sig = Index.Crawls[task.Index].Signature
+		} else {
+			var h pp.BVHeader
+			bv, h, err = pp.ReadBitVectorFile(task.Path)
+			if err == nil {
+				err = Index.CheckVector(bv, h)
+			}
+			if err == nil {
+				sig, err = Index.Hasher.Signature(bv, ExcludeBV)
+			}
+		}
+		if err != nil {
+			log.Errorf("%s: %v", task.Path, err)
+			continue
+		}
+
+		candidates, err := Index.Query(sig)
+		if err != nil {
+			log.Errorf("%s: %v", task.Path, err)
+			continue
+		}
+
+		var r Result
+		r.Query = task
+		r.Neighbors = make([]Neighbor, 0)
+		for _, c := range candidates {
+			// Every pair is written once with -all
+			if c.Index == task.Index || (all && c.Index < task.Index) {
+				continue
+			}
+			if c.Estimate < MinEstimate || (MaxResults > 0 && len(r.Neighbors) >= MaxResults) {
+				break
+			}
+
+			n := Neighbor{Crawl: Index.Crawls[c.Index], Estimate: c.Estimate, Exact: -1}
+			if Exact {
+				other, h, err := pp.ReadBitVectorFile(n.Crawl.Path)
+				if err == nil {
+					err = Index.CheckVector(other, h)
+				}
+				if err != nil {
+					log.Errorf("%s: %v", n.Crawl.Path, err)
+					continue
+				}
+				overlap, err := pp.CompareBitVectors(bv, other, ExcludeBV)
+				if err != nil {
+					log.Errorf("%s: %v", n.Crawl.Path, err)
+					continue
+				}
+				n.Exact = overlap.Jaccard()
+			}
+			r.Neighbors = append(r.Neighbors, n)
+		}
+
+		resultsChan <- r
+	}
+	wg.Done()
+}
+
+func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string, all bool) {
+	f, err := os.Create(outfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer := csv.NewWriter(f)
+	writer.Write([]string{
+		"Query Site",
+		"Query Crawl",
+		"Query Path",
+		"Site",
+		"Crawl",
+		"Path",
+		"Estimated Jaccard",
+		"Exact Jaccard",
+	})
+
+	completed := 0
+	for result := range resultChan {
+		for _, n := range result.Neighbors {
+			exact := ""
+			if n.Exact >= 0 {
+				exact = strconv.FormatFloat(n.Exact, 'f', 8, 64)
+			}
+			writer.Write([]string{
+				result.Query.Site,
+				result.Query.Crawl,
+				result.Query.Path,
+				n.Crawl.Site,
+				n.Crawl.Crawl,
+				n.Crawl.Path,
+				strconv.FormatFloat(n.Estimate, 'f', 8, 64),
+				exact,
+			})
+		}
+		writer.Flush()
+
+		completed += 1
+		if all && completed%1000 == 0 {
+			log.Infof("Queries completed: %d", completed)
+		}
+	}
+
+	f.Close()
+	wg.Done()
+}
@@ -22,21 +22,17 @@ type Result struct {
 	RegionsCovered   int
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 /**
  * This analyzes region coverage across a results set.\
  * It produces two output files: one showing how many times each region was covered,
  * and one showing how many regions each site visit covered.
  */
 
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var FileCoverage map[string][]float64
@@ -55,6 +51,8 @@ func main() {
 	var outfile string
 	var crawlRegionCoverageOutfile string
 	var onePerSite bool
+	var nameStyle string
+	var matrixFile string
 
 	flag.StringVar(&covFile, "coverage-file", "coverage.txt",
 		"Path to sample text coverage file for metadata generation")
@@ -66,32 +64,38 @@ func main() {
 		"Path to output file csv")
 	flag.BoolVar(&onePerSite, "one-per-site", false,
 		"If true, only one crawl per site will be counted")
+	flag.StringVar(&nameStyle, "names", "mangled",
+		"How to write function names: mangled, demangled, qualified or both")
+	flag.StringVar(&matrixFile, "matrix", "",
+		"If set, count the coverage of the crawls in results-path from this coverage matrix instead of reading their vectors")
 
 	flag.Parse()
 
-	var err error
+	style, err := pp.ParseNameStyle(nameStyle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := pp.NewFunctionNameFormatter(style)
+
 	CompleteCounter = 0
 	// log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, _, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+
 	FileCovCounts = make(map[string]int)
 	FuncCovCounts = make(map[string]int)
 
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	files := 0
 	functions := 0
 	regions := 0
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -99,24 +103,9 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
-
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	for k, v := range Structure {
-		start = currentIndex
-		for _, numBlocks := range v {
-			currentIndex += numBlocks
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
+
+	FilenameToBVIndices = Layout.FileRanges()
 
 	FileCoverage = make(map[string][]float64)
 
@@ -125,14 +114,8 @@ func main() {
 	log.Infof("  - Total Functions: %d", functions)
 	log.Infof("  - Total Code Regions: %d\n", regions)
 
-	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, onePerSite)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	regionCoverage = make([]int, regions)
 
-	sort.Strings(covPaths)
 	SortedFiles = make([]string, 0)
 	for k := range Structure {
 		SortedFiles = append(SortedFiles, k)
@@ -147,25 +130,36 @@ func main() {
 	owg.Add(1)
 	go writer(resultChan, &owg, crawlRegionCoverageOutfile)
 
-	WORKERS := 28
-	for i := 0; i < WORKERS; i++ {
-		wg.Add(1)
-		go worker(taskChan, resultChan, &wg)
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, onePerSite)
+	if err != nil {
+		log.Fatal(err)
 	}
+	sort.Strings(covPaths)
 
-	for _, path := range covPaths {
-		var t Task
-		t.Path = path
-		taskChan <- t
-	}
+	var numTrials int
+	if matrixFile != "" {
+		numTrials = countFromMatrix(matrixFile, covPaths, resultChan)
+	} else {
+		WORKERS := 28
+		for i := 0; i < WORKERS; i++ {
+			wg.Add(1)
+			go worker(taskChan, resultChan, &wg)
+		}
 
-	close(taskChan)
-	wg.Wait()
+		for _, path := range covPaths {
+			var t Task
+			t.Path = path
+			taskChan <- t
+		}
+
+		close(taskChan)
+		wg.Wait()
+		numTrials = len(covPaths)
+	}
 	close(resultChan)
 	owg.Wait()
 
-	numTrials := len(covPaths)
-	log.Infof("numTrials: %s", numTrials)
+	log.Infof("numTrials: %d", numTrials)
 
 	outfileName := outfile
 
@@ -175,11 +169,12 @@ func main() {
 		log.Fatal(err)
 	}
 	writer := csv.NewWriter(f)
-	writer.Write([]string{"File", "Function", "Region Number",
+	header := append([]string{"File"}, names.Header("Function")...)
+	writer.Write(append(header, "Region Number",
 		"Functions in File", "Regions in File", "Regions in Function",
 		"Times File Covered", "Percent Times File Covered",
 		"Times Function Covered", "Percent Times Function Covered",
-		"Times Region Covered", "Percent Times Region Covered"})
+		"Times Region Covered", "Percent Times Region Covered"))
 
 	curFile := ""
 	for i, val := range regionCoverage {
@@ -191,9 +186,8 @@ func main() {
 			}
 		}
 
-		writer.Write([]string{
-			codeRegion.FileName,
-			codeRegion.FuncName,
+		record := append([]string{codeRegion.FileName}, names.Format(codeRegion.FuncName)...)
+		writer.Write(append(record,
 			strconv.Itoa(i),
 
 			strconv.Itoa(len(Structure[codeRegion.FileName])),
@@ -208,7 +202,7 @@ func main() {
 
 			strconv.Itoa(val),
 			strconv.FormatFloat(float64(val)/float64(numTrials), 'f', 4, 64),
-		})
+		))
 
 	}
 
@@ -219,7 +213,7 @@ func main() {
 
 func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 	for task := range taskChan {
-		bv, err := pp.ReadBVFileToBV(task.Path)
+		bv, err := pp.ReadBVFileWithLayout(task.Path, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -283,6 +277,73 @@ func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
+// countFromMatrix fills the coverage counts from the columns of a coverage matrix that belong to
+// the crawls in covPaths, and returns the number of crawls counted
+func countFromMatrix(matrixFile string, covPaths []string, resultsChan chan Result) int {
+	m, err := pp.OpenCoverageMatrix(matrixFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	if m.Layout != (pp.LayoutFingerprint{}) && m.Layout != Layout.Fingerprint() {
+		log.Fatal("coverage matrix was built for a different layout")
+	}
+	if m.NumRegions() != Layout.NumRegions() {
+		log.Fatal("coverage matrix does not match layout")
+	}
+
+	mask := pp.NewBitVector(m.NumCrawls())
+	columns := make([]int, len(covPaths))
+	for i, covPath := range covPaths {
+		site, crawl := pp.CrawlForCovPath(covPath)
+		c, ok := m.CrawlIndex(site, crawl)
+		if !ok {
+			log.Errorf("%s: crawl not in coverage matrix", covPath)
+			columns[i] = -1
+			continue
+		}
+		mask.Set(c)
+		columns[i] = c
+	}
+
+	regionCoverage, err = m.CountsWithMask(mask)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, fileName := range SortedFiles {
+		fileRange, _ := Layout.FileRange(fileName)
+		crawls, err := m.RangeRow(fileRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+		FileCovCounts[fileName], _ = crawls.CountAnd(mask)
+
+		for _, funcName := range Layout.Functions(fileName) {
+			funcRange, _ := Layout.FunctionRange(fileName, funcName)
+			crawls, err := m.RangeRow(funcRange)
+			if err != nil {
+				log.Fatal(err)
+			}
+			count, _ := crawls.CountAnd(mask)
+			FuncCovCounts[funcName] += count
+		}
+	}
+
+	for i, covPath := range covPaths {
+		if columns[i] < 0 {
+			continue
+		}
+		var r Result
+		r.Path = covPath
+		r.RegionsCovered = m.Crawls[columns[i]].Covered
+		resultsChan <- r
+	}
+
+	return mask.Count()
+}
+
 func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string) {
 
 	f, err := os.Create(outfile)
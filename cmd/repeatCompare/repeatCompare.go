@@ -23,6 +23,7 @@ type CoverageComparison struct {
 	DomainTwo       string
 	RegionsCompared int
 	RegionsDiff     int
+	Score           float64
 }
 
 type Result struct {
@@ -30,21 +31,17 @@ type Result struct {
 	Comparisons []CoverageComparison
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
 /**
  * This analyzes region coverage across a results set.\
  * It produces two output files: one showing how many times each region was covered,
  * and one showing how many regions each site visit covered.
  */
 
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var FileCoverage map[string][]float64
@@ -57,13 +54,16 @@ var FuncCovCountLock sync.Mutex
 var regionCoverage []int
 var regionCoverageLock sync.Mutex
 
-var ExcludeBV []bool
+var ExcludeBV *pp.BitVector
+var Metric pp.Metric
 
 func main() {
 	var covFile string
 	var resultsPath string
 	var excludeBVFile string
 	var outfile string
+	var metricName string
+	var weightsFile string
 
 	flag.StringVar(&covFile, "coverage-file", "coverage.txt",
 		"Path to sample text coverage file for metadata generation")
@@ -73,6 +73,10 @@ func main() {
 		"Path to exclude bit vector")
 	flag.StringVar(&outfile, "outfile", "output/same_compare.csv",
 		"Path to output file")
+	flag.StringVar(&metricName, "metric", "normalized-hamming",
+		"Similarity metric to score each comparison with: "+strings.Join(pp.MetricNames(), ", "))
+	flag.StringVar(&weightsFile, "weights", "",
+		"Path to csv of region weights (Region Number, Weight) for weighted-jaccard")
 
 	flag.Parse()
 
@@ -81,24 +85,21 @@ func main() {
 	// log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, _, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	MetaMap = Layout.Metadata()
+
 	FileCovCounts = make(map[string]int)
 	FuncCovCounts = make(map[string]int)
 
-	sampleCovMap, _, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	files := 0
 	functions := 0
 	regions := 0
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -106,16 +107,28 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
 
 	if excludeBVFile == "" {
-		ExcludeBV = make([]bool, regions)
+		ExcludeBV = pp.NewBitVector(regions)
 	} else {
-		ExcludeBV, err = pp.ReadBVFileToBV(excludeBVFile)
+		ExcludeBV, err = pp.ReadBitVectorFileWithLayout(excludeBVFile, Layout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var weights []float64
+	if weightsFile != "" {
+		weights, err = pp.ReadRegionWeights(weightsFile, regions)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	Metric, err = pp.ParseMetric(metricName, weights)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	FileCoverage = make(map[string][]float64)
 
@@ -181,9 +194,9 @@ func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 		r.Domain = parts[len(parts)-1]
 		r.Comparisons = make([]CoverageComparison, 0)
 
-		bvMap := make(map[string][]bool)
+		bvMap := make(map[string]*pp.BitVector)
 		for _, covPath := range covPaths {
-			bv, err := pp.ReadBVFileToBV(covPath)
+			bv, err := pp.ReadBitVectorFileWithLayout(covPath, Layout)
 			if err != nil {
 				log.Error(err)
 				continue
@@ -198,7 +211,13 @@ func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 					continue
 				}
 
-				diff, total, err := pp.DiffBVsWithExclude(bvOne, bvTwo, ExcludeBV)
+				diff, total, err := pp.DiffBitVectorsWithExclude(bvOne, bvTwo, ExcludeBV)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+
+				score, err := Metric.Compare(bvOne, bvTwo, ExcludeBV)
 				if err != nil {
 					log.Error(err)
 					continue
@@ -211,6 +230,7 @@ func worker(taskChan chan Task, resultsChan chan Result, wg *sync.WaitGroup) {
 				cc.CovPathTwo = covPathTwo
 				cc.RegionsDiff = diff
 				cc.RegionsCompared = total
+				cc.Score = score
 
 				r.Comparisons = append(r.Comparisons, cc)
 			}
@@ -241,6 +261,8 @@ func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string) {
 		"Different Regions",
 		"Regions Compared",
 		"Percent Difference",
+		"Metric",
+		"Score",
 	})
 
 	for result := range resultChan {
@@ -254,6 +276,8 @@ func writer(resultChan chan Result, wg *sync.WaitGroup, outfile string) {
 				strconv.Itoa(comp.RegionsDiff),
 				strconv.Itoa(comp.RegionsCompared),
 				strconv.FormatFloat(float64(comp.RegionsDiff)/float64(comp.RegionsCompared), 'f', 8, 64),
+				Metric.Name(),
+				strconv.FormatFloat(comp.Score, 'f', 8, 64),
 			})
 			writer.Flush()
 		}
@@ -17,15 +17,11 @@ type Result struct {
 	Path string
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 var SortedFiles []string
 var DenominatorFileCoverageMap map[string]int
@@ -54,17 +50,14 @@ func main() {
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	FileCovCounts = make(map[string]int)
+	MetaMap = Layout.Metadata()
 
-	sampleCovMap, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+	FileCovCounts = make(map[string]int)
 
 	files := 0
 	functions := 0
@@ -72,7 +65,7 @@ func main() {
 
 	// sampleBV := pp.ConvertCovMapToBools(sampleCovMap)
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -80,24 +73,9 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
-
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	for k, v := range Structure {
-		start = currentIndex
-		for _, numBlocks := range v {
-			currentIndex += numBlocks
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
+
+	FilenameToBVIndices = Layout.FileRanges()
 
 	FileCoverage = make(map[string][]float64)
 
@@ -152,7 +130,7 @@ func worker(taskChan chan Task, wg *sync.WaitGroup) {
 
 		log.Infof("Processing task: %s", task.Path)
 
-		//bv, err := pp.ReadBVFileToBV(task.Path)
+		//bv, err := pp.ReadBVFileWithLayout(task.Path, Layout)
 		//if err != nil {
 		//	log.Error(err)
 		//	continue
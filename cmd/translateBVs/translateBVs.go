@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	pp "github.com/teamnsrg/profparse"
+	"path"
+	"sync"
+)
+
+type Task struct {
+	Path string
+}
+
+var Mapping *pp.LayoutMapping
+var OutName string
+
+/**
+ * This translates the bit vectors in a results set from the layout of one build to the layout
+ * of another, so that crawls from before and after a browser upgrade can be compared.
+ * It also writes a report of the functions that changed between the builds, and an exclude
+ * vector for the regions of the new build that have no counterpart in the old one.
+ */
+
+func main() {
+	var fromCovFile string
+	var toCovFile string
+	var resultsPath string
+	var diffOutfile string
+	var unmappedOutfile string
+	var excludeOutfile string
+	var nameStyle string
+
+	flag.StringVar(&fromCovFile, "from-coverage-file", "",
+		"Path to sample text coverage file from the build the vectors were collected with")
+	flag.StringVar(&toCovFile, "to-coverage-file", "coverage.txt",
+		"Path to sample text coverage file from the build to translate the vectors to")
+	flag.StringVar(&resultsPath, "results-path", "",
+		"Path to MIDA results to translate (optional)")
+	flag.StringVar(&OutName, "out-name", "coverage.translated.bv",
+		"Name of the translated vector written next to each coverage.bv")
+	flag.StringVar(&diffOutfile, "diff-out", "output/layout_diff.csv",
+		"Path to layout diff output file")
+	flag.StringVar(&unmappedOutfile, "unmapped-out", "output/unmapped_regions.csv",
+		"Path to output file listing regions that could not be mapped")
+	flag.StringVar(&excludeOutfile, "exclude-out", "output/unmapped_exclude.bv",
+		"Path to exclude vector for regions of the new build with no match in the old one")
+	flag.StringVar(&nameStyle, "names", "mangled",
+		"How to write function names: mangled, demangled, qualified or both")
+	flag.Parse()
+
+	names, err := pp.ParseNameStyle(nameStyle)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	from, err := pp.LoadCoverageLayout(fromCovFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := pp.LoadCoverageLayout(toCovFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Mapping = pp.NewLayoutMapping(from, to)
+	log.Infof("Mapped %d out of %d regions", Mapping.NumMapped(), from.NumRegions())
+
+	diff := Mapping.Diff()
+	log.Infof("Files added: %d, removed: %d", len(diff.AddedFiles), len(diff.RemovedFiles))
+	log.Infof("Functions changed: %d, unchanged: %d", len(diff.Functions), diff.UnchangedFunctions)
+
+	err = pp.WriteLayoutDiffToFileWithNames(diff, diffOutfile, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = pp.WriteUnmappedRegionsToFileWithNames(Mapping, unmappedOutfile, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exclude := Mapping.MappedBV()
+	for i := range exclude {
+		exclude[i] = !exclude[i]
+	}
+	err = pp.WriteBVFile(excludeOutfile, exclude, pp.BVHeader{Layout: to.Fingerprint()})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if resultsPath == "" {
+		return
+	}
+
+	covPaths, err := pp.GetCovPathsMIDAResults(resultsPath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Translating %d vectors", len(covPaths))
+
+	taskChan := make(chan Task, 10000)
+	var wg sync.WaitGroup
+
+	WORKERS := 28
+	for i := 0; i < WORKERS; i++ {
+		wg.Add(1)
+		go worker(taskChan, &wg)
+	}
+
+	for _, covPath := range covPaths {
+		var t Task
+		t.Path = covPath
+		taskChan <- t
+	}
+
+	close(taskChan)
+	wg.Wait()
+	log.Info("Finished")
+}
+
+func worker(taskChan chan Task, wg *sync.WaitGroup) {
+	for task := range taskChan {
+		err := Mapping.TranslateBVFile(task.Path, path.Join(path.Dir(task.Path), OutName))
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	wg.Done()
+}
@@ -0,0 +1,693 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// CompressedBitVector is an immutable bit vector split into chunks of 65536 bits, each stored in
+// whichever of three containers is smallest: a sorted array of set bits, a list of runs of set bits
+// or a raw bitmap. Chunks with no set bits are not stored at all. Coverage vectors are clustered,
+// so most chunks are either empty or a handful of runs.
+type CompressedBitVector struct {
+	n          int
+	containers []bvContainer // Sorted by key
+}
+
+const (
+	bvChunkBits  = 1 << 16
+	bvChunkWords = bvChunkBits / 64
+
+	// Largest array container, beyond which a bitmap is smaller
+	bvMaxArrayLen = bvChunkBits / 16
+
+	bvArrayContainer  = 0
+	bvBitmapContainer = 1
+	bvRunContainer    = 2
+)
+
+// bvContainer holds the set bits of one chunk, at offsets from the start of the chunk. Containers
+// are never modified once built, so vectors may share them.
+type bvContainer struct {
+	key    int // Index of the chunk
+	kind   int
+	card   int
+	array  []uint16
+	bitmap []uint64 // bvChunkWords words, in BitVector bit order
+	runs   []bvRun
+}
+
+// bvRun is a run of set bits, inclusive of both ends
+type bvRun struct {
+	start uint16
+	last  uint16
+}
+
+// CompressBitVector builds the compressed form of a packed vector
+func CompressBitVector(v *BitVector) *CompressedBitVector {
+	c := &CompressedBitVector{n: v.n}
+	for key := 0; key*bvChunkWords < len(v.words); key++ {
+		end := (key + 1) * bvChunkWords
+		if end > len(v.words) {
+			end = len(v.words)
+		}
+		if ct, ok := containerFromWords(key, v.words[key*bvChunkWords:end]); ok {
+			c.containers = append(c.containers, ct)
+		}
+	}
+	return c
+}
+
+// CompressBools builds the compressed form of a []bool vector
+func CompressBools(bv []bool) *CompressedBitVector {
+	return CompressBitVector(BitVectorFromBools(bv))
+}
+
+// Len returns the number of bits in the vector
+func (c *CompressedBitVector) Len() int {
+	return c.n
+}
+
+// Count returns the number of set bits
+func (c *CompressedBitVector) Count() int {
+	count := 0
+	for i := range c.containers {
+		count += c.containers[i].card
+	}
+	return count
+}
+
+// Get returns bit i
+func (c *CompressedBitVector) Get(i int) bool {
+	key := i / bvChunkBits
+	j := sort.Search(len(c.containers), func(j int) bool {
+		return c.containers[j].key >= key
+	})
+	if j == len(c.containers) || c.containers[j].key != key {
+		return false
+	}
+	return c.containers[j].contains(uint16(i % bvChunkBits))
+}
+
+// ForEach calls fn with the index of every set bit, in order
+func (c *CompressedBitVector) ForEach(fn func(i int)) {
+	for _, ct := range c.containers {
+		base := ct.key * bvChunkBits
+		ct.forEach(func(x uint16) {
+			fn(base + int(x))
+		})
+	}
+}
+
+// BitVector decompresses the vector
+func (c *CompressedBitVector) BitVector() *BitVector {
+	v := NewBitVector(c.n)
+	for _, ct := range c.containers {
+		copy(v.words[ct.key*bvChunkWords:], ct.words())
+	}
+	v.clearTail()
+	return v
+}
+
+// Bools decompresses the vector into a []bool vector
+func (c *CompressedBitVector) Bools() []bool {
+	bv := make([]bool, c.n)
+	c.ForEach(func(i int) {
+		bv[i] = true
+	})
+	return bv
+}
+
+// Equal returns whether two vectors have the same length and bits
+func (c *CompressedBitVector) Equal(o *CompressedBitVector) bool {
+	if c.n != o.n || len(c.containers) != len(o.containers) {
+		return false
+	}
+	for i := range c.containers {
+		a, b := &c.containers[i], &o.containers[i]
+		if a.key != b.key || a.card != b.card {
+			return false
+		}
+		aw, bw := a.words(), b.words()
+		for j := range aw {
+			if aw[j] != bw[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// And returns the bits set in both c and o
+func (c *CompressedBitVector) And(o *CompressedBitVector) (*CompressedBitVector, error) {
+	return c.combine(o, andContainers, false, false)
+}
+
+// Or returns the bits set in either c or o
+func (c *CompressedBitVector) Or(o *CompressedBitVector) (*CompressedBitVector, error) {
+	return c.combine(o, orContainers, true, true)
+}
+
+// Xor returns the bits set in exactly one of c and o
+func (c *CompressedBitVector) Xor(o *CompressedBitVector) (*CompressedBitVector, error) {
+	return c.combine(o, xorContainers, true, true)
+}
+
+// AndNot returns the bits set in c and clear in o
+func (c *CompressedBitVector) AndNot(o *CompressedBitVector) (*CompressedBitVector, error) {
+	return c.combine(o, andNotContainers, true, false)
+}
+
+// combine applies op to the chunks present in both vectors. Chunks present in only one of them
+// are kept if keepLeft or keepRight is set.
+func (c *CompressedBitVector) combine(o *CompressedBitVector, op func(a *bvContainer, b *bvContainer) (bvContainer, bool),
+	keepLeft bool, keepRight bool) (*CompressedBitVector, error) {
+	if c.n != o.n {
+		return nil, errors.New("bv lengths do not match")
+	}
+
+	result := &CompressedBitVector{n: c.n}
+	i, j := 0, 0
+	for i < len(c.containers) || j < len(o.containers) {
+		switch {
+		case j == len(o.containers) || (i < len(c.containers) && c.containers[i].key < o.containers[j].key):
+			if keepLeft {
+				result.containers = append(result.containers, c.containers[i])
+			}
+			i++
+		case i == len(c.containers) || o.containers[j].key < c.containers[i].key:
+			if keepRight {
+				result.containers = append(result.containers, o.containers[j])
+			}
+			j++
+		default:
+			if ct, ok := op(&c.containers[i], &o.containers[j]); ok {
+				result.containers = append(result.containers, ct)
+			}
+			i++
+			j++
+		}
+	}
+
+	return result, nil
+}
+
+func (ct *bvContainer) contains(x uint16) bool {
+	switch ct.kind {
+	case bvArrayContainer:
+		i := sort.Search(len(ct.array), func(i int) bool {
+			return ct.array[i] >= x
+		})
+		return i < len(ct.array) && ct.array[i] == x
+	case bvRunContainer:
+		i := sort.Search(len(ct.runs), func(i int) bool {
+			return ct.runs[i].last >= x
+		})
+		return i < len(ct.runs) && ct.runs[i].start <= x
+	}
+	return ct.bitmap[x/64]&(1<<(63-x%64)) != 0
+}
+
+func (ct *bvContainer) forEach(fn func(x uint16)) {
+	switch ct.kind {
+	case bvArrayContainer:
+		for _, x := range ct.array {
+			fn(x)
+		}
+	case bvRunContainer:
+		for _, r := range ct.runs {
+			for x := int(r.start); x <= int(r.last); x++ {
+				fn(uint16(x))
+			}
+		}
+	default:
+		for w, word := range ct.bitmap {
+			for word != 0 {
+				j := bits.LeadingZeros64(word)
+				fn(uint16(w*64 + j))
+				word &^= 1 << uint(63-j)
+			}
+		}
+	}
+}
+
+// words returns the bits of the container as a bitmap, which must not be modified
+func (ct *bvContainer) words() []uint64 {
+	if ct.kind == bvBitmapContainer {
+		return ct.bitmap
+	}
+
+	w := make([]uint64, bvChunkWords)
+	ct.forEachRun(func(start int, end int) {
+		setWordRange(w, start, end)
+	})
+	return w
+}
+
+// forEachRun calls fn with the bounds of runs of set bits, end exclusive. Adjacent runs may be
+// reported separately.
+func (ct *bvContainer) forEachRun(fn func(start int, end int)) {
+	switch ct.kind {
+	case bvRunContainer:
+		for _, r := range ct.runs {
+			fn(int(r.start), int(r.last)+1)
+		}
+	default:
+		ct.forEach(func(x uint16) {
+			fn(int(x), int(x)+1)
+		})
+	}
+}
+
+// setWordRange sets bits [start, end) of a bitmap
+func setWordRange(w []uint64, start int, end int) {
+	for start < end {
+		n := 64 - start%64
+		if end-start < n {
+			n = end - start
+		}
+		mask := ^uint64(0)
+		if n < 64 {
+			mask = (uint64(1)<<uint(n) - 1) << uint(64-start%64-n)
+		}
+		w[start/64] |= mask
+		start += n
+	}
+}
+
+// containerFromWords builds the smallest container holding the bits of a chunk. It returns false
+// if no bits are set.
+func containerFromWords(key int, w []uint64) (bvContainer, bool) {
+	card := 0
+	numRuns := 0
+	var prev uint64 // Last word, to find runs crossing word boundaries
+	for _, word := range w {
+		card += bits.OnesCount64(word)
+		// A run starts at every set bit whose predecessor is clear
+		numRuns += bits.OnesCount64(word &^ (word>>1 | prev<<63))
+		prev = word
+	}
+	if card == 0 {
+		return bvContainer{}, false
+	}
+
+	ct := bvContainer{key: key, card: card}
+	switch {
+	case 4*numRuns <= 2*card && 4*numRuns < 8*bvChunkWords:
+		ct.kind = bvRunContainer
+		ct.runs = make([]bvRun, 0, numRuns)
+		start := -1
+		for x := 0; x <= len(w)*64; x++ {
+			set := x < len(w)*64 && w[x/64]&(1<<uint(63-x%64)) != 0
+			if set && start < 0 {
+				start = x
+			} else if !set && start >= 0 {
+				ct.runs = append(ct.runs, bvRun{uint16(start), uint16(x - 1)})
+				start = -1
+			}
+		}
+	case card <= bvMaxArrayLen:
+		ct.kind = bvArrayContainer
+		ct.array = make([]uint16, 0, card)
+		for i, word := range w {
+			for word != 0 {
+				j := bits.LeadingZeros64(word)
+				ct.array = append(ct.array, uint16(i*64+j))
+				word &^= 1 << uint(63-j)
+			}
+		}
+	default:
+		ct.kind = bvBitmapContainer
+		ct.bitmap = make([]uint64, bvChunkWords)
+		copy(ct.bitmap, w)
+	}
+
+	return ct, true
+}
+
+// containerFromArray builds a container from sorted offsets, converting large arrays
+func containerFromArray(key int, array []uint16) (bvContainer, bool) {
+	if len(array) == 0 {
+		return bvContainer{}, false
+	}
+	if len(array) > bvMaxArrayLen {
+		w := make([]uint64, bvChunkWords)
+		for _, x := range array {
+			w[x/64] |= 1 << (63 - x%64)
+		}
+		return containerFromWords(key, w)
+	}
+	return bvContainer{key: key, kind: bvArrayContainer, card: len(array), array: array}, true
+}
+
+// containerFromRuns builds a container from sorted, non-overlapping runs, converting them if
+// another container would be smaller
+func containerFromRuns(key int, runs []bvRun) (bvContainer, bool) {
+	if len(runs) == 0 {
+		return bvContainer{}, false
+	}
+
+	// Merge adjacent runs
+	merged := runs[:1]
+	for _, r := range runs[1:] {
+		last := &merged[len(merged)-1]
+		if int(r.start) == int(last.last)+1 {
+			last.last = r.last
+		} else {
+			merged = append(merged, r)
+		}
+	}
+
+	card := 0
+	for _, r := range merged {
+		card += int(r.last) - int(r.start) + 1
+	}
+	ct := bvContainer{key: key, kind: bvRunContainer, card: card, runs: merged}
+	if 4*len(merged) > 2*card || 4*len(merged) >= 8*bvChunkWords {
+		return containerFromWords(key, ct.words())
+	}
+	return ct, true
+}
+
+func andContainers(a *bvContainer, b *bvContainer) (bvContainer, bool) {
+	if a.kind == bvArrayContainer || b.kind == bvArrayContainer {
+		if b.kind == bvArrayContainer {
+			a, b = b, a
+		}
+		array := make([]uint16, 0, len(a.array))
+		for _, x := range a.array {
+			if b.contains(x) {
+				array = append(array, x)
+			}
+		}
+		return containerFromArray(a.key, array)
+	}
+
+	if a.kind == bvRunContainer && b.kind == bvRunContainer {
+		runs := make([]bvRun, 0)
+		i, j := 0, 0
+		for i < len(a.runs) && j < len(b.runs) {
+			ra, rb := a.runs[i], b.runs[j]
+			start, last := ra.start, ra.last
+			if rb.start > start {
+				start = rb.start
+			}
+			if rb.last < last {
+				last = rb.last
+			}
+			if start <= last {
+				runs = append(runs, bvRun{start, last})
+			}
+			if ra.last < rb.last {
+				i++
+			} else {
+				j++
+			}
+		}
+		return containerFromRuns(a.key, runs)
+	}
+
+	return wordsOp(a, b, func(x uint64, y uint64) uint64 { return x & y })
+}
+
+func orContainers(a *bvContainer, b *bvContainer) (bvContainer, bool) {
+	if a.kind == bvArrayContainer && b.kind == bvArrayContainer {
+		return containerFromArray(a.key, mergeArrays(a.array, b.array, true, true, true))
+	}
+
+	if a.kind == bvRunContainer && b.kind == bvRunContainer {
+		all := make([]bvRun, 0, len(a.runs)+len(b.runs))
+		all = append(append(all, a.runs...), b.runs...)
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].start < all[j].start
+		})
+		runs := all[:1]
+		for _, r := range all[1:] {
+			last := &runs[len(runs)-1]
+			if r.start <= last.last {
+				if r.last > last.last {
+					last.last = r.last
+				}
+			} else {
+				runs = append(runs, r)
+			}
+		}
+		return containerFromRuns(a.key, runs)
+	}
+
+	return wordsOp(a, b, func(x uint64, y uint64) uint64 { return x | y })
+}
+
+func xorContainers(a *bvContainer, b *bvContainer) (bvContainer, bool) {
+	if a.kind == bvArrayContainer && b.kind == bvArrayContainer {
+		return containerFromArray(a.key, mergeArrays(a.array, b.array, true, false, true))
+	}
+	return wordsOp(a, b, func(x uint64, y uint64) uint64 { return x ^ y })
+}
+
+func andNotContainers(a *bvContainer, b *bvContainer) (bvContainer, bool) {
+	if a.kind == bvArrayContainer {
+		array := make([]uint16, 0, len(a.array))
+		for _, x := range a.array {
+			if !b.contains(x) {
+				array = append(array, x)
+			}
+		}
+		return containerFromArray(a.key, array)
+	}
+	return wordsOp(a, b, func(x uint64, y uint64) uint64 { return x &^ y })
+}
+
+// mergeArrays merges two sorted arrays, keeping offsets only in a, in both or only in b as asked
+func mergeArrays(a []uint16, b []uint16, onlyA bool, both bool, onlyB bool) []uint16 {
+	merged := make([]uint16, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			if onlyA {
+				merged = append(merged, a[i])
+			}
+			i++
+		case i == len(a) || b[j] < a[i]:
+			if onlyB {
+				merged = append(merged, b[j])
+			}
+			j++
+		default:
+			if both {
+				merged = append(merged, a[i])
+			}
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+func wordsOp(a *bvContainer, b *bvContainer, op func(x uint64, y uint64) uint64) (bvContainer, bool) {
+	aw, bw := a.words(), b.words()
+	w := make([]uint64, bvChunkWords)
+	for i := range w {
+		w[i] = op(aw[i], bw[i])
+	}
+	return containerFromWords(a.key, w)
+}
+
+// appendCompressedPayload serializes the containers of a vector. All integers are little endian:
+//
+//	u32 number of containers, then for each container
+//	u32 key, u8 kind, u32 count
+//	count u16 offsets (array), count pairs of u16 start and last (run) or count u64 words (bitmap)
+//
+// Bitmaps only store the words covered by the length of the vector.
+func appendCompressedPayload(buf []byte, c *CompressedBitVector) []byte {
+	var scratch [8]byte
+	put32 := func(x int) {
+		binary.LittleEndian.PutUint32(scratch[:], uint32(x))
+		buf = append(buf, scratch[:4]...)
+	}
+	put16 := func(x uint16) {
+		binary.LittleEndian.PutUint16(scratch[:], x)
+		buf = append(buf, scratch[:2]...)
+	}
+
+	put32(len(c.containers))
+	for _, ct := range c.containers {
+		put32(ct.key)
+		buf = append(buf, byte(ct.kind))
+		switch ct.kind {
+		case bvArrayContainer:
+			put32(len(ct.array))
+			for _, x := range ct.array {
+				put16(x)
+			}
+		case bvRunContainer:
+			put32(len(ct.runs))
+			for _, r := range ct.runs {
+				put16(r.start)
+				put16(r.last)
+			}
+		default:
+			numWords := c.chunkWords(ct.key)
+			put32(numWords)
+			for _, w := range ct.bitmap[:numWords] {
+				binary.LittleEndian.PutUint64(scratch[:], w)
+				buf = append(buf, scratch[:]...)
+			}
+		}
+	}
+	return buf
+}
+
+// chunkWords returns the number of words of chunk key covered by the length of the vector
+func (c *CompressedBitVector) chunkWords(key int) int {
+	numWords := (c.n - key*bvChunkBits + 63) / 64
+	if numWords > bvChunkWords {
+		numWords = bvChunkWords
+	}
+	return numWords
+}
+
+// parseCompressedPayload is the inverse of appendCompressedPayload. It rejects payloads that
+// would not have been written for a vector of n bits.
+func parseCompressedPayload(data []byte, n int) (*CompressedBitVector, error) {
+	errCorrupt := errors.New("corrupt compressed bit vector")
+	c := &CompressedBitVector{n: n}
+	pos := 0
+	get32 := func() (int, bool) {
+		if len(data)-pos < 4 {
+			return 0, false
+		}
+		x := binary.LittleEndian.Uint32(data[pos:])
+		pos += 4
+		return int(x), true
+	}
+
+	numContainers, ok := get32()
+	if !ok || numContainers > (n+bvChunkBits-1)/bvChunkBits {
+		return nil, errCorrupt
+	}
+
+	c.containers = make([]bvContainer, 0, numContainers)
+	for i := 0; i < numContainers; i++ {
+		key, ok := get32()
+		if !ok || len(data) == pos || key*bvChunkBits >= n || (i > 0 && key <= c.containers[i-1].key) {
+			return nil, errCorrupt
+		}
+		kind := int(data[pos])
+		pos++
+		count, ok := get32()
+		if !ok {
+			return nil, errCorrupt
+		}
+
+		// Offsets past the end of the vector are invalid
+		limit := n - key*bvChunkBits
+		if limit > bvChunkBits {
+			limit = bvChunkBits
+		}
+
+		ct := bvContainer{key: key, kind: kind}
+		switch kind {
+		case bvArrayContainer:
+			if count == 0 || count > bvMaxArrayLen || len(data)-pos < 2*count {
+				return nil, errCorrupt
+			}
+			ct.array = make([]uint16, count)
+			for j := range ct.array {
+				ct.array[j] = binary.LittleEndian.Uint16(data[pos+2*j:])
+				if (j > 0 && ct.array[j] <= ct.array[j-1]) || int(ct.array[j]) >= limit {
+					return nil, errCorrupt
+				}
+			}
+			ct.card = count
+			pos += 2 * count
+		case bvRunContainer:
+			if count == 0 || len(data)-pos < 4*count {
+				return nil, errCorrupt
+			}
+			ct.runs = make([]bvRun, count)
+			for j := range ct.runs {
+				r := bvRun{binary.LittleEndian.Uint16(data[pos+4*j:]), binary.LittleEndian.Uint16(data[pos+4*j+2:])}
+				if r.last < r.start || int(r.last) >= limit || (j > 0 && int(r.start) <= int(ct.runs[j-1].last)+1) {
+					return nil, errCorrupt
+				}
+				ct.runs[j] = r
+				ct.card += int(r.last) - int(r.start) + 1
+			}
+			pos += 4 * count
+		case bvBitmapContainer:
+			if count != c.chunkWords(key) || len(data)-pos < 8*count {
+				return nil, errCorrupt
+			}
+			ct.bitmap = make([]uint64, bvChunkWords)
+			for j := 0; j < count; j++ {
+				ct.bitmap[j] = binary.LittleEndian.Uint64(data[pos+8*j:])
+				ct.card += bits.OnesCount64(ct.bitmap[j])
+			}
+			if limit%64 != 0 && ct.bitmap[count-1]<<uint(limit%64) != 0 {
+				return nil, errCorrupt
+			}
+			if ct.card == 0 {
+				return nil, errCorrupt
+			}
+			pos += 8 * count
+		default:
+			return nil, errCorrupt
+		}
+		c.containers = append(c.containers, ct)
+	}
+
+	if pos != len(data) {
+		return nil, errCorrupt
+	}
+	return c, nil
+}
+
+// WriteCompressedBitVectorFile is WriteBVFile for compressed vectors. The file is always written
+// with the compressed encoding.
+func WriteCompressedBitVectorFile(fName string, c *CompressedBitVector, h BVHeader) error {
+	h.Encoding = CompressedEncoding
+	return writeBVFile(fName, c.Len(), appendCompressedPayload(nil, c), h)
+}
+
+// ReadCompressedBitVectorFile reads a bit vector file in any format and encoding as a compressed
+// vector
+func ReadCompressedBitVectorFile(fName string) (*CompressedBitVector, BVHeader, error) {
+	content, err := readBVFileData(fName)
+	if err != nil {
+		return nil, BVHeader{}, err
+	}
+
+	if isVersionedBVFile(content) {
+		payload, h, err := parseVersionedBVFile(content)
+		if err != nil {
+			return nil, h, err
+		}
+		if h.Encoding == CompressedEncoding {
+			c, err := parseCompressedPayload(payload, h.NumBits)
+			return c, h, err
+		}
+	}
+
+	bv, h, err := ParseBitVectorFile(content)
+	if err != nil {
+		return nil, h, err
+	}
+	return CompressBitVector(bv), h, nil
+}
+
+// ReencodeBVFile rewrites a bit vector file in any format as a versioned file with encoding e,
+// keeping its header
+func ReencodeBVFile(inFile string, outFile string, e BVEncoding) error {
+	bv, h, err := ReadBitVectorFile(inFile)
+	if err != nil {
+		return err
+	}
+
+	h.Encoding = e
+	return WriteBitVectorFile(outFile, bv, h)
+}
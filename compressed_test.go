@@ -0,0 +1,356 @@
+package profparse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Chunk patterns, each compressing to a different container
+const (
+	emptyChunk = iota
+	sparseChunk
+	runChunk
+	denseChunk
+	numChunkPatterns
+)
+
+// fillChunk sets bits [start, end) of bv in the given pattern
+func fillChunk(r *rand.Rand, bv []bool, start int, end int, pattern int) {
+	for i := start; i < end; {
+		switch pattern {
+		case sparseChunk:
+			bv[i] = r.Intn(200) == 0
+			i++
+		case runChunk:
+			// Runs of a few hundred bits, like the regions of a function
+			run := r.Intn(500) + 1
+			set := r.Intn(2) == 0
+			for ; run > 0 && i < end; run-- {
+				bv[i] = set
+				i++
+			}
+		case denseChunk:
+			bv[i] = r.Intn(2) == 0
+			i++
+		default:
+			i = end
+		}
+	}
+}
+
+// patternBools returns a vector of n bits whose chunk k follows pattern(k)
+func patternBools(r *rand.Rand, n int, pattern func(k int) int) []bool {
+	bv := make([]bool, n)
+	for k := 0; k*bvChunkBits < n; k++ {
+		end := (k + 1) * bvChunkBits
+		if end > n {
+			end = n
+		}
+		fillChunk(r, bv, k*bvChunkBits, end, pattern(k))
+	}
+	return bv
+}
+
+// compressedTestPairs returns pairs of vectors between them combining every kind of container
+// with every other, in full chunks and in a partial last chunk
+func compressedTestPairs(r *rand.Rand) [][2][]bool {
+	pairs := make([][2][]bool, 0)
+	n := numChunkPatterns*numChunkPatterns*bvChunkBits + 1000
+	pairs = append(pairs, [2][]bool{
+		patternBools(r, n, func(k int) int { return k % numChunkPatterns }),
+		patternBools(r, n, func(k int) int { return k / numChunkPatterns % numChunkPatterns }),
+	})
+	for _, n := range []int{1, 63, 64, 1000, bvChunkBits - 1, bvChunkBits, bvChunkBits + 1} {
+		for p := 0; p < numChunkPatterns*numChunkPatterns; p++ {
+			pairs = append(pairs, [2][]bool{
+				patternBools(r, n, func(k int) int { return p % numChunkPatterns }),
+				patternBools(r, n, func(k int) int { return p / numChunkPatterns }),
+			})
+		}
+	}
+
+	// Vectors with every bit set, and vectors sharing runs
+	all := make([]bool, 3*bvChunkBits+5)
+	for i := range all {
+		all[i] = true
+	}
+	shared := patternBools(r, len(all), func(k int) int { return runChunk })
+	pairs = append(pairs, [2][]bool{all, shared}, [2][]bool{shared, shared})
+	return pairs
+}
+
+func TestCompressBitVector(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	kinds := make(map[int]bool)
+	for _, pair := range compressedTestPairs(r) {
+		bv := pair[0]
+		n := len(bv)
+		c := CompressBools(bv)
+		v := BitVectorFromBools(bv)
+		for _, ct := range c.containers {
+			kinds[ct.kind] = true
+		}
+
+		if c.Len() != n || c.Count() != v.Count() {
+			t.Errorf("%d: length %d and count %d, want %d and %d", n, c.Len(), c.Count(), n, v.Count())
+		}
+		if !reflect.DeepEqual(c.Bools(), bv) {
+			t.Fatalf("%d: decompressed vector differs", n)
+		}
+		if !c.BitVector().Equal(v) {
+			t.Fatalf("%d: decompressed bit vector differs", n)
+		}
+		if !CompressBitVector(v).Equal(c) {
+			t.Errorf("%d: compressing the bit vector gave another vector", n)
+		}
+		for i := 0; i < n; i += 1 + r.Intn(97) {
+			if c.Get(i) != bv[i] {
+				t.Fatalf("%d: bit %d is %v, want %v", n, i, c.Get(i), bv[i])
+			}
+		}
+
+		var each []int
+		c.ForEach(func(i int) {
+			each = append(each, i)
+		})
+		var want []int
+		v.ForEach(func(i int) {
+			want = append(want, i)
+		})
+		if !reflect.DeepEqual(each, want) {
+			t.Errorf("%d: ForEach visited %d bits, want %d", n, len(each), len(want))
+		}
+	}
+	if len(kinds) != 3 {
+		t.Errorf("only containers of kinds %v were built", kinds)
+	}
+}
+
+func TestCompressedBitVectorOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(24))
+	ops := []struct {
+		name string
+		c    func(c *CompressedBitVector, o *CompressedBitVector) (*CompressedBitVector, error)
+		v    func(v *BitVector, o *BitVector) error
+	}{
+		{"and", (*CompressedBitVector).And, (*BitVector).And},
+		{"or", (*CompressedBitVector).Or, (*BitVector).Or},
+		{"xor", (*CompressedBitVector).Xor, (*BitVector).Xor},
+		{"and not", (*CompressedBitVector).AndNot, (*BitVector).AndNot},
+	}
+
+	for _, pair := range compressedTestPairs(r) {
+		n := len(pair[0])
+		for _, pair := range [][2][]bool{pair, {pair[1], pair[0]}} {
+			ca, cb := CompressBools(pair[0]), CompressBools(pair[1])
+			va, vb := BitVectorFromBools(pair[0]), BitVectorFromBools(pair[1])
+			for _, tt := range ops {
+				got, err := tt.c(ca, cb)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := va.Clone()
+				if err = tt.v(want, vb); err != nil {
+					t.Fatal(err)
+				}
+				if !got.BitVector().Equal(want) {
+					t.Fatalf("%d: %s differs from the bit vector", n, tt.name)
+				}
+				if got.Count() != want.Count() {
+					t.Errorf("%d: %s has count %d, want %d", n, tt.name, got.Count(), want.Count())
+				}
+				if !got.Equal(CompressBitVector(want)) {
+					t.Errorf("%d: %s is not equal to the compressed bit vector", n, tt.name)
+				}
+
+				// The result must serialize to a payload the parser accepts
+				parsed, err := parseCompressedPayload(appendCompressedPayload(nil, got), n)
+				if err != nil || !parsed.Equal(got) {
+					t.Errorf("%d: %s did not survive serialization: %v", n, tt.name, err)
+				}
+			}
+
+			// The operands are unchanged
+			if !reflect.DeepEqual(ca.Bools(), pair[0]) || !reflect.DeepEqual(cb.Bools(), pair[1]) {
+				t.Fatalf("%d: operations changed their operands", n)
+			}
+		}
+
+		other := CompressBitVector(NewBitVector(n + 1))
+		for _, tt := range ops {
+			if _, err := tt.c(CompressBools(pair[0]), other); err == nil {
+				t.Errorf("%d: %s of vectors of different lengths", n, tt.name)
+			}
+		}
+	}
+}
+
+func TestCompressedPayloadRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(25))
+	dir := t.TempDir()
+	for _, pair := range compressedTestPairs(r) {
+		bv := pair[0]
+		n := len(bv)
+		c := CompressBools(bv)
+		payload := appendCompressedPayload(nil, c)
+		parsed, err := parseCompressedPayload(payload, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(c) || !reflect.DeepEqual(parsed.Bools(), bv) {
+			t.Fatalf("%d: parsed payload differs", n)
+		}
+		if !bytes.Equal(appendCompressedPayload(nil, parsed), payload) {
+			t.Errorf("%d: payload changed when written again", n)
+		}
+
+		fName := filepath.Join(dir, "coverage.bv")
+		h := BVHeader{Site: "a.com", Crawl: "c"}
+		if err = WriteCompressedBitVectorFile(fName, c, h); err != nil {
+			t.Fatal(err)
+		}
+		got, gotHeader, err := ReadCompressedBitVectorFile(fName)
+		if err != nil || !got.Equal(c) {
+			t.Fatalf("%d: read %v, want the vector written", n, err)
+		}
+		if gotHeader.Encoding != CompressedEncoding || gotHeader.Site != "a.com" || gotHeader.NumBits != n {
+			t.Errorf("%d: header %+v", n, gotHeader)
+		}
+
+		// Files in other encodings read as the same vector, and reencoding keeps the header
+		packed := filepath.Join(dir, "packed.bv")
+		if err = ReencodeBVFile(fName, packed, PackedEncoding); err != nil {
+			t.Fatal(err)
+		}
+		got, packedHeader, err := ReadCompressedBitVectorFile(packed)
+		if err != nil || !got.Equal(c) {
+			t.Fatalf("%d: read packed file as %v", n, err)
+		}
+		gotHeader.Encoding = PackedEncoding
+		if packedHeader != gotHeader {
+			t.Errorf("%d: reencoded header %+v, want %+v", n, packedHeader, gotHeader)
+		}
+		if err = WriteFileFromBV(packed, bv); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, err = ReadCompressedBitVectorFile(packed); err != nil || !got.Equal(c) {
+			t.Fatalf("%d: read version 1 file as %v", n, err)
+		}
+	}
+}
+
+func TestParseCompressedPayloadInvalid(t *testing.T) {
+	put := func(b []byte, size int, x uint64) []byte {
+		var scratch [8]byte
+		binary.LittleEndian.PutUint64(scratch[:], x)
+		return append(b, scratch[:size]...)
+	}
+	container := func(key uint32, kind byte, count uint32, data ...uint16) []byte {
+		b := put(nil, 4, uint64(key))
+		b = append(b, kind)
+		b = put(b, 4, uint64(count))
+		for _, x := range data {
+			b = put(b, 2, uint64(x))
+		}
+		return b
+	}
+	payload := func(containers ...[]byte) []byte {
+		b := put(nil, 4, uint64(len(containers)))
+		for _, ct := range containers {
+			b = append(b, ct...)
+		}
+		return b
+	}
+	bitmap := func(key uint32, words ...uint64) []byte {
+		b := container(key, bvBitmapContainer, uint32(len(words)))
+		for _, w := range words {
+			b = put(b, 8, w)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		data []byte
+		ok   bool
+	}{
+		{"no containers", 10, payload(), true},
+		{"array", 10, payload(container(0, bvArrayContainer, 2, 1, 9)), true},
+		{"run", 10, payload(container(0, bvRunContainer, 2, 0, 2, 4, 9)), true},
+		{"bitmap", 70, payload(bitmap(0, 1, 0xc000000000000000)), true},
+		{"second chunk", bvChunkBits + 1, payload(container(1, bvArrayContainer, 1, 0)), true},
+
+		{"empty", 10, nil, false},
+		{"too many containers", 10, payload(container(0, bvArrayContainer, 1, 1),
+			container(1, bvArrayContainer, 1, 1)), false},
+		{"key past the end", bvChunkBits, payload(container(1, bvArrayContainer, 1, 0)), false},
+		{"keys out of order", 2 * bvChunkBits, payload(container(1, bvArrayContainer, 1, 0),
+			container(0, bvArrayContainer, 1, 0)), false},
+		{"repeated key", 2 * bvChunkBits, payload(container(0, bvArrayContainer, 1, 0),
+			container(0, bvArrayContainer, 1, 1)), false},
+		{"unknown kind", 10, payload(container(0, 3, 1, 1)), false},
+		{"empty array", 10, payload(container(0, bvArrayContainer, 0)), false},
+		{"unsorted array", 10, payload(container(0, bvArrayContainer, 2, 5, 1)), false},
+		{"repeated offset", 10, payload(container(0, bvArrayContainer, 2, 1, 1)), false},
+		{"offset past the end", 10, payload(container(0, bvArrayContainer, 1, 10)), false},
+		{"long array", bvChunkBits, payload(container(0, bvArrayContainer, bvMaxArrayLen+1)), false},
+		{"truncated array", 10, payload(container(0, bvArrayContainer, 2, 1)), false},
+		{"empty runs", 10, payload(container(0, bvRunContainer, 0)), false},
+		{"reversed run", 10, payload(container(0, bvRunContainer, 1, 5, 2)), false},
+		{"overlapping runs", 10, payload(container(0, bvRunContainer, 2, 0, 4, 4, 6)), false},
+		{"adjacent runs", 10, payload(container(0, bvRunContainer, 2, 0, 4, 5, 6)), false},
+		{"run past the end", 10, payload(container(0, bvRunContainer, 1, 5, 10)), false},
+		{"truncated runs", 10, payload(container(0, bvRunContainer, 1, 5)), false},
+		{"short bitmap", 70, payload(bitmap(0, 1)), false},
+		{"long bitmap", 70, payload(bitmap(0, 1, 0, 0)), false},
+		{"empty bitmap", 70, payload(bitmap(0, 0, 0)), false},
+		{"bitmap past the end", 70, payload(bitmap(0, 1, 0x0200000000000000)), false},
+		{"truncated bitmap", 70, payload(bitmap(0, 1, 1))[:20], false},
+		{"truncated container", 10, payload(container(0, bvArrayContainer, 1, 1))[:8], false},
+		{"trailing data", 10, append(payload(container(0, bvArrayContainer, 1, 1)), 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCompressedPayload(tt.data, tt.n)
+			if !tt.ok {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(appendCompressedPayload(nil, c), tt.data) {
+				t.Error("payload changed when written again")
+			}
+		})
+	}
+}
+
+func TestParseCompressedPayloadCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(26))
+	n := numChunkPatterns*bvChunkBits + 100
+	c := CompressBools(patternBools(r, n, func(k int) int { return k % numChunkPatterns }))
+	payload := appendCompressedPayload(nil, c)
+	for i := 0; i < 2000; i++ {
+		corrupt := append([]byte{}, payload...)
+		corrupt[r.Intn(len(corrupt))] ^= byte(1 << uint(r.Intn(8)))
+		for _, data := range [][]byte{corrupt, corrupt[:r.Intn(len(corrupt))]} {
+			parsed, err := parseCompressedPayload(data, n)
+			if err != nil {
+				continue
+			}
+			// Anything accepted must be a valid vector
+			v := parsed.BitVector()
+			if parsed.Count() != v.Count() || !CompressBitVector(v).Equal(parsed) {
+				t.Fatalf("accepted an inconsistent payload after %d corruptions", i)
+			}
+		}
+	}
+}
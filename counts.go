@@ -0,0 +1,417 @@
+package profparse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ReadFileToCountMap is ReadFileToCovMap, but keeps the execution count for each region
+func ReadFileToCountMap(fName string) (map[string]map[string][]uint64, CovMapProperties, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return ParseCountMap(f)
+}
+
+// ParseCountMap reads a coverage report from r, returning a map containing the number of times
+// each region was executed
+func ParseCountMap(r io.Reader) (map[string]map[string][]uint64, CovMapProperties, error) {
+	return CountMapFromRecords(NewParser(r))
+}
+
+// CountMapFromRecords builds a count map from the records produced by src
+func CountMapFromRecords(src RecordSource) (map[string]map[string][]uint64, CovMapProperties, error) {
+	countMap := make(map[string]map[string][]uint64)
+
+	totalRegions := 0
+	totalFiles := 0
+	totalFuncs := 0
+
+	err := src.Walk(func(rec Record) error {
+		switch rec.Kind {
+		case FileRecord:
+			if _, ok := countMap[rec.File]; !ok {
+				countMap[rec.File] = make(map[string][]uint64)
+			}
+			totalFiles += 1
+		case FunctionRecord:
+			if _, ok := countMap[rec.File][rec.Function]; !ok {
+				countMap[rec.File][rec.Function] = make([]uint64, 0)
+			}
+			totalFuncs += 1
+		case RegionRecord:
+			countMap[rec.File][rec.Function] = append(countMap[rec.File][rec.Function], rec.Executions)
+			totalRegions += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+
+	props := CovMapProperties{
+		NumFiles:     totalFiles,
+		NumFunctions: totalFuncs,
+		NumRegions:   totalRegions,
+	}
+
+	return countMap, props, nil
+}
+
+// ConvertCountMapToCovMap collapses each execution count to whether or not the region was covered
+func ConvertCountMapToCovMap(countMap map[string]map[string][]uint64) map[string]map[string][]bool {
+	covMap := make(map[string]map[string][]bool)
+	for fileName := range countMap {
+		covMap[fileName] = make(map[string][]bool)
+		for funcName, counts := range countMap[fileName] {
+			covered := make([]bool, len(counts))
+			for i, c := range counts {
+				covered[i] = c != 0
+			}
+			covMap[fileName][funcName] = covered
+		}
+	}
+
+	return covMap
+}
+
+func ConvertCountMapToStructure(countMap map[string]map[string][]uint64) map[string]map[string]int {
+	structure := make(map[string]map[string]int)
+
+	for fileName := range countMap {
+		structure[fileName] = make(map[string]int)
+		for funcName := range countMap[fileName] {
+			structure[fileName][funcName] = len(countMap[fileName][funcName])
+		}
+	}
+
+	return structure
+}
+
+// ConvertCountMapToCounts flattens a count map into a count vector, using the same ordering
+// as ConvertCovMapToBools
+func ConvertCountMapToCounts(countMap map[string]map[string][]uint64) []uint64 {
+	counts := make([]uint64, 0)
+	fileNames := make([]string, 0, len(countMap))
+	for k := range countMap {
+		fileNames = append(fileNames, k)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		funcNames := make([]string, 0, len(countMap[fileName]))
+		for k := range countMap[fileName] {
+			funcNames = append(funcNames, k)
+		}
+
+		sort.Strings(funcNames)
+
+		for _, funcName := range funcNames {
+			counts = append(counts, countMap[fileName][funcName]...)
+		}
+	}
+
+	return counts
+}
+
+func ConvertCountsToCountMap(counts []uint64, structure map[string]map[string]int) (map[string]map[string][]uint64, error) {
+	countMap := make(map[string]map[string][]uint64)
+
+	fileNames := make([]string, 0, len(structure))
+	for k := range structure {
+		fileNames = append(fileNames, k)
+	}
+	sort.Strings(fileNames)
+
+	currentIndex := 0
+
+	for _, fileName := range fileNames {
+		countMap[fileName] = make(map[string][]uint64)
+
+		funcNames := make([]string, 0)
+		for k := range structure[fileName] {
+			funcNames = append(funcNames, k)
+		}
+
+		sort.Strings(funcNames)
+
+		for _, funcName := range funcNames {
+			numRegions := structure[fileName][funcName]
+			if currentIndex+numRegions > len(counts) {
+				return nil, errors.New("count vector too short for structure")
+			}
+			countMap[fileName][funcName] = append([]uint64(nil), counts[currentIndex:currentIndex+numRegions]...)
+			currentIndex += numRegions
+		}
+	}
+
+	return countMap, nil
+}
+
+// ConvertCountsToBools collapses a count vector into a bit vector
+func ConvertCountsToBools(counts []uint64) []bool {
+	bools := make([]bool, len(counts))
+	for i, c := range counts {
+		bools[i] = c != 0
+	}
+	return bools
+}
+
+// GetCountPathCrawl returns the path to the count vector stored next to coverage.bv for a crawl
+func GetCountPathCrawl(crawlPath string) (string, error) {
+	countPath := path.Join(crawlPath, "coverage", "coverage.cv")
+	if _, err := os.Stat(countPath); os.IsNotExist(err) {
+		return "", errors.New("count data does not exist")
+	}
+
+	return countPath, nil
+}
+
+// CountPathForCovPath given the path to a coverage.bv file, returns the path of the companion
+// count vector file
+func CountPathForCovPath(covPath string) string {
+	return strings.TrimSuffix(covPath, ".bv") + ".cv"
+}
+
+// WriteFileFromCV writes a count vector to disk. The format is a little endian uint32 holding
+// the number of counts, followed by each count as an unsigned varint.
+func WriteFileFromCV(fName string, cv []uint64) error {
+	f, err := os.Create(fName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := bufio.NewWriter(f)
+
+	if uint64(len(cv)) > math.MaxUint32 {
+		return errors.New("count vector too long")
+	}
+
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(cv)))
+	_, err = writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, c := range cv {
+		n := binary.PutUvarint(buf, c)
+		_, err = writer.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Wrote %d counts to file %s", len(cv), fName)
+
+	return nil
+}
+
+func ReadCVFileToCV(fname string) ([]uint64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(f)
+
+	var header [4]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, errors.New("invalid count vector file")
+	}
+
+	// Each count takes at least a byte, so a larger count than the file holds is corrupt
+	numCounts := binary.LittleEndian.Uint32(header[:])
+	if int64(numCounts) > info.Size()-int64(len(header)) {
+		return nil, errors.New("invalid count vector file")
+	}
+	cv := make([]uint64, numCounts)
+	for i := range cv {
+		cv[i], err = binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, errors.New("invalid count vector file")
+		}
+	}
+
+	return cv, nil
+}
+
+// CombineCVs sums a set of count vectors. Sums saturate rather than overflow.
+// Also returns the number of regions covered by any of the vectors.
+func CombineCVs(vectors [][]uint64) ([]uint64, int, error) {
+	if len(vectors) == 0 {
+		return nil, 0, errors.New("no count vectors passed to CombineCVs()")
+	}
+
+	for _, v := range vectors {
+		if v != nil && len(v) != len(vectors[0]) {
+			return nil, 0, errors.New("cv lengths do not match")
+		}
+	}
+
+	cv := make([]uint64, len(vectors[0]))
+	for _, v := range vectors {
+		for i, c := range v {
+			cv[i] = addCounts(cv[i], c)
+		}
+	}
+
+	totalBlocks := 0
+	for _, c := range cv {
+		if c != 0 {
+			totalBlocks += 1
+		}
+	}
+
+	return cv, totalBlocks, nil
+}
+
+// GetMedianCV given a vector of count vectors, returns the median execution count of each region.
+// For an even number of vectors the upper median is used, which agrees with GetMedianBV.
+func GetMedianCV(vectors [][]uint64) ([]uint64, error) {
+	if len(vectors) <= 0 {
+		return nil, errors.New("no count vectors passed to GetMedianCV()")
+	}
+
+	expectedLength := len(vectors[0])
+	if expectedLength == 0 {
+		return nil, errors.New("zero length vector in GetMedianCV()")
+	}
+
+	for _, v := range vectors {
+		if len(v) != expectedLength {
+			return nil, errors.New("cv lengths do not match")
+		}
+	}
+
+	finalCV := make([]uint64, expectedLength)
+	column := make([]uint64, len(vectors))
+	for i := range finalCV {
+		for j := range vectors {
+			column[j] = vectors[j][i]
+		}
+		sort.Slice(column, func(a, b int) bool { return column[a] < column[b] })
+		finalCV[i] = column[len(column)/2]
+	}
+
+	return finalCV, nil
+}
+
+type CountMapDiff struct {
+	CovMapDiff
+	FirstExecutions  uint64
+	SecondExecutions uint64
+
+	// Deltas holds, for each region, the second execution count minus the first
+	Deltas map[string]map[string][]int64
+}
+
+// DiffTwoCountMaps is DiffTwoCovMaps for count maps, additionally recording how the execution
+// count of each region changed
+func DiffTwoCountMaps(c1 map[string]map[string][]uint64, c2 map[string]map[string][]uint64, filePrefix string) (CountMapDiff, error) {
+	var d CountMapDiff
+	d.Deltas = make(map[string]map[string][]int64)
+
+	for fileName := range c1 {
+		if !strings.HasPrefix(fileName, filePrefix) {
+			continue
+		}
+
+		if _, ok := c2[fileName]; !ok {
+			return d, errors.New("mismatched countmaps")
+		}
+
+		d.Deltas[fileName] = make(map[string][]int64)
+
+		for funcName := range c1[fileName] {
+			if _, ok := c2[fileName][funcName]; !ok {
+				return d, errors.New("mismatched countmaps")
+			}
+			if len(c1[fileName][funcName]) != len(c2[fileName][funcName]) {
+				return d, errors.New("mismatched countmaps")
+			}
+
+			d.TotalRegions += len(c1[fileName][funcName])
+			deltas := make([]int64, len(c1[fileName][funcName]))
+
+			for i, count1 := range c1[fileName][funcName] {
+				count2 := c2[fileName][funcName][i]
+				d.FirstExecutions = addCounts(d.FirstExecutions, count1)
+				d.SecondExecutions = addCounts(d.SecondExecutions, count2)
+				deltas[i] = countDelta(count1, count2)
+
+				val1 := count1 != 0
+				val2 := count2 != 0
+				if val1 && val2 {
+					d.FirstCovered += 1
+					d.SecondCovered += 1
+					d.Same += 1
+					d.TotalCovered += 1
+				} else if val1 && !val2 {
+					d.FirstCovered += 1
+					d.FirstOnlyCovered += 1
+					d.Different += 1
+					d.TotalCovered += 1
+				} else if !val1 && val2 {
+					d.SecondCovered += 1
+					d.SecondOnlyCovered += 1
+					d.Different += 1
+					d.TotalCovered += 1
+				} else {
+					d.Same += 1
+				}
+			}
+
+			d.Deltas[fileName][funcName] = deltas
+		}
+	}
+
+	return d, nil
+}
+
+// addCounts returns a + b, saturating at the largest count rather than overflowing
+func addCounts(a uint64, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// countDelta returns b - a, clamped to the range of an int64
+func countDelta(a uint64, b uint64) int64 {
+	if b >= a {
+		if b-a > math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return int64(b - a)
+	}
+	if a-b > math.MaxInt64 {
+		return math.MinInt64
+	}
+	return -int64(a - b)
+}
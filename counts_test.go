@@ -0,0 +1,148 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const countsTestReport = "[FILE] a.cc\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 5\n[BLOCK] 0 0 1,2,3,4 0\n" +
+	"[FILE] b.cc\n[FUNCTION] g\n[BLOCK] 0 0 1,2,3,4 3000000\n"
+
+func TestCVFileRoundTrip(t *testing.T) {
+	cm, _, err := ParseCountMap(strings.NewReader(countsTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cv   []uint64
+	}{
+		{"report", ConvertCountMapToCounts(cm)},
+		{"empty", []uint64{}},
+		{"large counts", []uint64{math.MaxUint64, 0, 1 << 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "coverage.cv")
+			if err := WriteFileFromCV(fName, tt.cv); err != nil {
+				t.Fatal(err)
+			}
+			cv, err := ReadCVFileToCV(fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cv, tt.cv) {
+				t.Errorf("read %v, want %v", cv, tt.cv)
+			}
+		})
+	}
+}
+
+func TestReadCVFileInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"short header", []byte{1, 0}},
+		{"truncated counts", []byte{3, 0, 0, 0, 1, 2}},
+		{"huge count", []byte{0xff, 0xff, 0xff, 0xff, 1}},
+		{"truncated varint", []byte{1, 0, 0, 0, 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "coverage.cv")
+			if err := ioutil.WriteFile(fName, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadCVFileToCV(fName); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestCombineCVs(t *testing.T) {
+	tests := []struct {
+		name    string
+		vectors [][]uint64
+		want    []uint64
+		covered int
+	}{
+		{"sum", [][]uint64{{1, 0, 5}, {3, 0, 2}}, []uint64{4, 0, 7}, 2},
+		{"saturates", [][]uint64{{math.MaxUint64 - 1, 1}, {5, 0}}, []uint64{math.MaxUint64, 1}, 2},
+		{"skips missing", [][]uint64{{1, 0}, nil}, []uint64{1, 0}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cv, covered, err := CombineCVs(tt.vectors)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cv, tt.want) || covered != tt.covered {
+				t.Errorf("got %v covering %d, want %v covering %d", cv, covered, tt.want, tt.covered)
+			}
+		})
+	}
+	if _, _, err := CombineCVs([][]uint64{{1, 2}, {1}}); err == nil {
+		t.Error("expected an error for mismatched lengths")
+	}
+}
+
+func TestGetMedianCV(t *testing.T) {
+	tests := []struct {
+		name    string
+		vectors [][]uint64
+		want    []uint64
+	}{
+		{"odd", [][]uint64{{1, 0, 5}, {3, 0, 2}, {2, 1, 9}}, []uint64{2, 0, 5}},
+		{"even uses upper median", [][]uint64{{1, 0}, {3, 4}}, []uint64{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cv, err := GetMedianCV(tt.vectors)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cv, tt.want) {
+				t.Errorf("median = %v, want %v", cv, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffTwoCountMaps(t *testing.T) {
+	first := map[string]map[string][]uint64{"a.cc": {"f": {5, 0, math.MaxUint64}}, "b.cc": {"g": {3}}}
+	second := map[string]map[string][]uint64{"a.cc": {"f": {2, 1, math.MaxUint64}}, "b.cc": {"g": {3}}}
+
+	d, err := DiffTwoCountMaps(first, second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.Deltas["a.cc"]["f"], []int64{-3, 1, 0}) {
+		t.Errorf("deltas = %v", d.Deltas["a.cc"]["f"])
+	}
+	if d.Different != 1 || d.TotalRegions != 4 {
+		t.Errorf("%d regions differ out of %d", d.Different, d.TotalRegions)
+	}
+	// Execution totals saturate, as in CombineCVs
+	if d.FirstExecutions != math.MaxUint64 || d.SecondExecutions != math.MaxUint64 {
+		t.Errorf("executions = %d and %d, want both saturated", d.FirstExecutions, d.SecondExecutions)
+	}
+
+	d, err = DiffTwoCountMaps(first, second, "b.cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TotalRegions != 1 || d.FirstExecutions != 3 {
+		t.Errorf("with a prefix: %d regions, %d executions", d.TotalRegions, d.FirstExecutions)
+	}
+
+	if _, err = DiffTwoCountMaps(first, map[string]map[string][]uint64{"a.cc": {"f": {1}}}, ""); err == nil {
+		t.Error("expected an error for mismatched count maps")
+	}
+}
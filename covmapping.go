@@ -0,0 +1,417 @@
+package profparse
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	covMapSection   = "__llvm_covmap"
+	covFunSection   = "__llvm_covfun"
+	profNameSection = "__llvm_prf_names"
+
+	// Coverage mapping format versions are stored zero based, so these are LLVM's Version4
+	// and Version7
+	minCovMapVersion = 3
+	maxCovMapVersion = 6
+
+	// Version6 and on store filenames relative to the compilation directory
+	covMapVersionRelativePaths = 5
+
+	covMapHeaderSize       = 16
+	covFunRecordHeaderSize = 28
+)
+
+// ReadCoverageMapping reads the coverage mapping of every function in an instrumented ELF binary
+// from its __llvm_covmap and __llvm_covfun sections. Function names are recovered from the
+// __llvm_prf_names section where possible.
+func ReadCoverageMapping(fname string) ([]FunctionMapping, error) {
+	f, err := elf.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sectionData := func(name string, required bool) ([]byte, error) {
+		s := f.Section(name)
+		if s == nil {
+			if required {
+				return nil, errors.New("binary has no " + name + " section")
+			}
+			return nil, nil
+		}
+		return s.Data()
+	}
+
+	covMap, err := sectionData(covMapSection, true)
+	if err != nil {
+		return nil, err
+	}
+	covFun, err := sectionData(covFunSection, true)
+	if err != nil {
+		return nil, err
+	}
+	names, err := sectionData(profNameSection, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCoverageMapping(covMap, covFun, names, f.ByteOrder)
+}
+
+// ReadBinaryCovMetadata builds the same metadata and structure as ReadCovMetadata and
+// ConvertCovMapToStructure would for a coverage report, straight from an instrumented binary
+func ReadBinaryCovMetadata(fname string) (map[string]map[string][]CodeRegion, map[string]map[string]int, CovMapProperties, error) {
+	mappings, err := ReadCoverageMapping(fname)
+	if err != nil {
+		return nil, nil, CovMapProperties{}, err
+	}
+
+	metadata, props, err := CovMetadataFromRecords(NormalizePaths(MappingRecords(mappings, NewProfile()), DefaultPathNormalizer()))
+	if err != nil {
+		return nil, nil, CovMapProperties{}, err
+	}
+
+	covMap, _, err := CovMapFromRecords(MappingRecords(mappings, NewProfile()))
+	if err != nil {
+		return nil, nil, CovMapProperties{}, err
+	}
+
+	return metadata, ConvertCovMapToStructure(covMap), props, nil
+}
+
+// ParseCoverageMapping decodes the contents of the coverage mapping sections of a binary. names
+// holds the contents of the profile names section, and may be nil.
+func ParseCoverageMapping(covMap []byte, covFun []byte, names []byte, order binary.ByteOrder) ([]FunctionMapping, error) {
+	var funcNames map[uint64]string
+	if names != nil {
+		var err error
+		funcNames, err = ReadProfNames(names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each translation unit has a header and list of filenames in __llvm_covmap, which function
+	// records refer to by the hash of the encoded list
+	filenames := make(map[uint64][]string)
+	pos := 0
+	for pos+covMapHeaderSize <= len(covMap) {
+		filenamesSize := int(order.Uint32(covMap[pos+4:]))
+		version := order.Uint32(covMap[pos+12:])
+		pos += covMapHeaderSize
+
+		if version < minCovMapVersion || version > maxCovMapVersion {
+			return nil, fmt.Errorf("unsupported coverage mapping version %d", version+1)
+		}
+		if filenamesSize > len(covMap)-pos {
+			return nil, errors.New("truncated coverage mapping header")
+		}
+
+		encoded := covMap[pos : pos+filenamesSize]
+		tuFilenames, err := decodeCovMapFilenames(encoded, version)
+		if err != nil {
+			return nil, err
+		}
+		ref := FunctionNameRef(string(encoded))
+		filenames[ref] = tuFilenames
+
+		pos = int(alignTo8(uint64(pos + filenamesSize)))
+	}
+
+	mappings := make([]FunctionMapping, 0)
+	seen := make(map[uint64]int)
+	pos = 0
+	for pos+covFunRecordHeaderSize <= len(covFun) {
+		nameRef := order.Uint64(covFun[pos:])
+		dataSize := int(order.Uint32(covFun[pos+8:]))
+		funcHash := order.Uint64(covFun[pos+12:])
+		filenamesRef := order.Uint64(covFun[pos+20:])
+		pos += covFunRecordHeaderSize
+
+		if dataSize > len(covFun)-pos {
+			return nil, errors.New("truncated coverage function record")
+		}
+		data := covFun[pos : pos+dataSize]
+		pos = int(alignTo8(uint64(pos + dataSize)))
+
+		tuFilenames, ok := filenames[filenamesRef]
+		if !ok {
+			return nil, fmt.Errorf("function %016x refers to unknown filenames", nameRef)
+		}
+
+		fm, err := decodeFunctionMapping(data, tuFilenames)
+		if err != nil {
+			return nil, fmt.Errorf("function %016x: %v", nameRef, err)
+		}
+		fm.Name = funcNames[nameRef]
+		fm.NameRef = nameRef
+		fm.Hash = funcHash
+
+		// As in llvm-cov, only the first record for a name is kept, unless it is a dummy
+		// record for an unused inline function and a real one comes along later
+		if i, ok := seen[nameRef]; ok {
+			if mappings[i].isDummy() && !fm.isDummy() {
+				mappings[i] = fm
+			}
+			continue
+		}
+		seen[nameRef] = len(mappings)
+		mappings = append(mappings, fm)
+	}
+
+	return mappings, nil
+}
+
+// isDummy reports whether fm is the placeholder clang emits for an unused function. As in
+// llvm-cov, that is a zero hash and a single uncounted region in a single file.
+func (fm *FunctionMapping) isDummy() bool {
+	if fm.Hash != 0 || len(fm.Filenames) != 1 || len(fm.Expressions) != 0 || len(fm.Regions) != 1 {
+		return false
+	}
+	// Only code and gap regions carry a counter in their tag
+	r := fm.Regions[0]
+	return (r.Kind != RegionCode && r.Kind != RegionGap) || r.Count.Kind == CounterZero
+}
+
+// covMapReader reads the LEB128 encoded values used throughout the coverage mapping format
+type covMapReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *covMapReader) uleb() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = errors.New("malformed coverage mapping")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// size reads a length or count, checking that it is plausible given the data remaining
+func (r *covMapReader) size() int {
+	v := r.uleb()
+	if v > uint64(len(r.data)-r.pos) {
+		r.err = errors.New("malformed coverage mapping")
+		return 0
+	}
+	return int(v)
+}
+
+func (r *covMapReader) uint32() int {
+	v := r.uleb()
+	if v > 0xffffffff {
+		r.err = errors.New("malformed coverage mapping")
+		return 0
+	}
+	return int(v)
+}
+
+func (r *covMapReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func decodeCovMapFilenames(encoded []byte, version uint32) ([]string, error) {
+	r := &covMapReader{data: encoded}
+	numFilenames := r.uleb()
+	uncompressedLen := r.uleb()
+	compressedLen := r.size()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var raw []byte
+	if compressedLen != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(r.bytes(compressedLen)))
+		if err != nil {
+			return nil, err
+		}
+		raw, err = ioutil.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(raw)) != uncompressedLen {
+			return nil, errors.New("invalid compressed filenames")
+		}
+	} else {
+		raw = r.data[r.pos:]
+	}
+
+	r = &covMapReader{data: raw}
+	if numFilenames > uint64(len(raw)) {
+		return nil, errors.New("malformed coverage mapping filenames")
+	}
+	filenames := make([]string, 0, numFilenames)
+	for i := uint64(0); i < numFilenames; i++ {
+		filenames = append(filenames, string(r.bytes(r.size())))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// The first filename is the compilation directory, which relative paths are based on
+	if version >= covMapVersionRelativePaths && len(filenames) > 0 {
+		compDir := filenames[0]
+		for i := 1; i < len(filenames); i++ {
+			if compDir != "" && compDir != "." && !strings.HasPrefix(filenames[i], "/") {
+				filenames[i] = strings.TrimSuffix(compDir, "/") + "/" + filenames[i]
+			}
+		}
+	}
+
+	return filenames, nil
+}
+
+func decodeFunctionMapping(data []byte, tuFilenames []string) (FunctionMapping, error) {
+	var fm FunctionMapping
+	r := &covMapReader{data: data}
+
+	numFiles := r.size()
+	for i := 0; i < numFiles && r.err == nil; i++ {
+		index := r.uleb()
+		if index >= uint64(len(tuFilenames)) {
+			return fm, errors.New("invalid filename index")
+		}
+		fm.Filenames = append(fm.Filenames, tuFilenames[index])
+	}
+
+	numExpressions := r.size()
+	if r.err != nil {
+		return fm, r.err
+	}
+	fm.Expressions = make([]CounterExpression, numExpressions)
+	for i := range fm.Expressions {
+		fm.Expressions[i].Kind = CounterSubtract
+	}
+	for i := range fm.Expressions {
+		var err error
+		fm.Expressions[i].LHS, err = fm.decodeCounter(r.uleb())
+		if err != nil {
+			return fm, err
+		}
+		fm.Expressions[i].RHS, err = fm.decodeCounter(r.uleb())
+		if err != nil {
+			return fm, err
+		}
+	}
+
+	for fileID := 0; fileID < numFiles; fileID++ {
+		err := fm.decodeRegions(r, fileID, numFiles)
+		if err != nil {
+			return fm, err
+		}
+	}
+
+	return fm, r.err
+}
+
+// decodeCounter decodes a counter, recording the kind of any expression it refers to
+func (fm *FunctionMapping) decodeCounter(v uint64) (Counter, error) {
+	c := Counter{Kind: CounterKind(v & 0x3), ID: int(v >> 2)}
+	if c.Kind == CounterZero {
+		return Counter{}, nil
+	}
+	if c.Kind == CounterSubtract || c.Kind == CounterAdd {
+		if c.ID >= len(fm.Expressions) {
+			return c, errors.New("invalid counter expression")
+		}
+		fm.Expressions[c.ID].Kind = c.Kind
+	}
+	return c, nil
+}
+
+func (fm *FunctionMapping) decodeRegions(r *covMapReader, fileID int, numFiles int) error {
+	numRegions := r.size()
+	lineStart := 0
+
+	for i := 0; i < numRegions && r.err == nil; i++ {
+		mr := MappingRegion{Kind: RegionCode, FileID: fileID}
+
+		encoded := r.uleb()
+		if encoded&0x3 != 0 {
+			var err error
+			mr.Count, err = fm.decodeCounter(encoded)
+			if err != nil {
+				return err
+			}
+		} else if encoded&0x4 != 0 {
+			mr.Kind = RegionExpansion
+			mr.ExpandedFileID = int(encoded >> 3)
+			if mr.ExpandedFileID >= numFiles {
+				return errors.New("invalid expansion file ID")
+			}
+		} else {
+			switch RegionKind(encoded >> 3) {
+			case RegionCode:
+			case RegionSkipped:
+				mr.Kind = RegionSkipped
+			case RegionBranch, RegionMCDCBranch:
+				mr.Kind = RegionKind(encoded >> 3)
+				var err error
+				mr.Count, err = fm.decodeCounter(r.uleb())
+				if err != nil {
+					return err
+				}
+				mr.FalseCount, err = fm.decodeCounter(r.uleb())
+				if err != nil {
+					return err
+				}
+				if mr.Kind == RegionMCDCBranch {
+					r.uleb() // Condition ID
+					r.uleb() // True condition ID
+					r.uleb() // False condition ID
+				}
+			case RegionMCDCDecision:
+				mr.Kind = RegionMCDCDecision
+				r.uleb() // Bitmap index
+				r.uleb() // Number of conditions
+			default:
+				return errors.New("invalid region kind")
+			}
+		}
+
+		lineStartDelta := r.uint32()
+		columnStart := r.uint32()
+		numLines := r.uint32()
+		columnEnd := r.uint32()
+		lineStart += lineStartDelta
+
+		// The high bit of the end column marks gap regions
+		if columnEnd&(1<<31) != 0 {
+			mr.Kind = RegionGap
+			columnEnd &^= 1 << 31
+		}
+
+		// Regions covering whole lines are stored with both columns zero
+		if columnStart == 0 && columnEnd == 0 {
+			columnStart = 1
+			columnEnd = 0xffffffff
+		}
+
+		mr.LineStart = lineStart
+		mr.ColumnStart = columnStart
+		mr.LineEnd = lineStart + numLines
+		mr.ColumnEnd = columnEnd
+		fm.Regions = append(fm.Regions, mr)
+	}
+
+	return r.err
+}
@@ -0,0 +1,173 @@
+package profparse
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/covmap/small.o holds hand encoded coverage mapping sections, and small.json is what
+// llvm-cov 14 makes of them:
+//
+//	yaml2obj -o small.o small.yaml
+//	llvm-profdata merge -o small.profdata small.proftext
+//	llvm-cov export -instr-profile small.profdata small.o > small.json
+//
+// main has a placeholder record ahead of its real one and a later duplicate, and bar only has a
+// placeholder. The filenames of baz's translation unit are compressed.
+
+// testCovSections returns the coverage mapping sections of testdata/covmap/small.o
+func testCovSections(t *testing.T) ([]byte, []byte, []byte) {
+	t.Helper()
+	f, err := elf.Open(filepath.Join("testdata", "covmap", "small.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var sections [][]byte
+	for _, name := range []string{covMapSection, covFunSection, profNameSection} {
+		data, err := f.Section(name).Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections = append(sections, data)
+	}
+	return sections[0], sections[1], sections[2]
+}
+
+func TestReadCoverageMapping(t *testing.T) {
+	mappings, err := ReadCoverageMapping(filepath.Join("testdata", "covmap", "small.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fm := range mappings {
+		names = append(names, fm.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"main", "foo", "bar", "baz"}) {
+		t.Fatalf("functions %v", names)
+	}
+	if mappings[0].Hash != 77 {
+		t.Errorf("main has hash %d, want the real record's 77", mappings[0].Hash)
+	}
+
+	p, err := ReadProfdata(filepath.Join("testdata", "covmap", "small.profdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := filepath.Join("testdata", "covmap", "small.json")
+
+	counts, countProps, err := CountMapFromRecords(MappingRecords(mappings, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts, wantCountProps, err := ReadExportToCountMap(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, wantCounts) || countProps != wantCountProps {
+		t.Errorf("counts %v (%+v), want %v (%+v)", counts, countProps, wantCounts, wantCountProps)
+	}
+
+	metadata, structure, props, err := ReadBinaryCovMetadata(filepath.Join("testdata", "covmap", "small.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMetadata, wantProps, err := ReadExportCovMetadata(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The export has no counters to compare
+	for _, funcs := range metadata {
+		for _, regions := range funcs {
+			for i := range regions {
+				regions[i].Counter = Counter{}
+			}
+		}
+	}
+	if !reflect.DeepEqual(metadata, wantMetadata) || props != wantProps {
+		t.Errorf("metadata %v (%+v), want %v (%+v)", metadata, props, wantMetadata, wantProps)
+	}
+	if wantStructure := ConvertCountMapToStructure(wantCounts); !reflect.DeepEqual(structure, wantStructure) {
+		t.Errorf("structure %v, want %v", structure, wantStructure)
+	}
+}
+
+func TestParseCoverageMappingInvalid(t *testing.T) {
+	covMap, covFun, names := testCovSections(t)
+	if _, err := ParseCoverageMapping(covMap, covFun, names, binary.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	modified := func(section []byte, f func(d []byte)) []byte {
+		d := append([]byte{}, section...)
+		f(d)
+		return d
+	}
+
+	// The first function record is main's placeholder; its data starts with the number of files
+	tests := []struct {
+		name   string
+		covMap []byte
+		covFun []byte
+		names  []byte
+	}{
+		{"old version", modified(covMap, func(d []byte) { d[12] = 2 }), covFun, names},
+		{"future version", modified(covMap, func(d []byte) { d[12] = 7 }), covFun, names},
+		{"filenames past end", modified(covMap, func(d []byte) { d[5] = 1 }), covFun, names},
+		{"unknown filenames", covMap, modified(covFun, func(d []byte) { d[20] ^= 1 }), names},
+		{"function past end", covMap, modified(covFun, func(d []byte) { d[11] = 1 }), names},
+		{"filename index", covMap, modified(covFun, func(d []byte) { d[covFunRecordHeaderSize+1] = 9 }), names},
+		{"truncated function", covMap, modified(covFun, func(d []byte) { d[covFunRecordHeaderSize] = 9 }), names},
+		{"bad names", covMap, covFun, []byte{0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCoverageMapping(tt.covMap, tt.covFun, tt.names, binary.LittleEndian); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodeFunctionMapping(t *testing.T) {
+	files := []string{"a.cc", "b.h"}
+	tests := []struct {
+		name    string
+		data    []byte
+		regions []MappingRegion
+		ok      bool
+	}{
+		{"code region", []byte{1, 0, 0, 1, 5, 2, 3, 1, 4}, []MappingRegion{
+			{Kind: RegionCode, Count: Counter{CounterReference, 1}, LineStart: 2, ColumnStart: 3, LineEnd: 3,
+				ColumnEnd: 4},
+		}, true},
+		{"whole lines", []byte{1, 0, 0, 1, 1, 2, 0, 2, 0}, []MappingRegion{
+			{Kind: RegionCode, Count: Counter{CounterReference, 0}, LineStart: 2, ColumnStart: 1, LineEnd: 4,
+				ColumnEnd: 0xffffffff},
+		}, true},
+		{"expansion into a missing file", []byte{1, 0, 0, 1, 0x0c, 1, 1, 0, 2}, nil, false},
+		{"undefined expression", []byte{1, 0, 0, 1, 2, 1, 1, 0, 2}, nil, false},
+		{"unknown region kind", []byte{1, 0, 0, 1, 7 << 3, 1, 1, 0, 2}, nil, false},
+		{"truncated", []byte{1, 0, 0, 2, 1, 1, 1, 0, 2}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm, err := decodeFunctionMapping(tt.data, files)
+			if !tt.ok {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fm.Regions, tt.regions) {
+				t.Errorf("regions %+v, want %+v", fm.Regions, tt.regions)
+			}
+		})
+	}
+}
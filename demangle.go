@@ -0,0 +1,1491 @@
+package profparse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Demangle demangles a symbol mangled according to the Itanium C++ ABI, as used by clang and gcc.
+// The output follows llvm-cxxfilt. Function names from coverage reports may be prefixed with the
+// file they were defined in, which is dropped.
+func Demangle(name string) (string, error) {
+	full, _, err := demangle(name)
+	return full, err
+}
+
+// DemangleQualified is Demangle, but leaves out the return type, parameters and qualifiers of
+// functions, giving only their qualified name
+func DemangleQualified(name string) (string, error) {
+	_, qualified, err := demangle(name)
+	return qualified, err
+}
+
+// NameStyle selects how function names are written to reports
+type NameStyle int
+
+const (
+	NameMangled   NameStyle = iota // As they appear in the coverage report
+	NameDemangled                  // Demangled, with parameters
+	NameQualified                  // Demangled, without return type or parameters
+	NameBoth                       // Demangled and qualified names, in separate columns
+)
+
+func (s NameStyle) String() string {
+	switch s {
+	case NameMangled:
+		return "mangled"
+	case NameDemangled:
+		return "demangled"
+	case NameQualified:
+		return "qualified"
+	case NameBoth:
+		return "both"
+	}
+	return strconv.Itoa(int(s))
+}
+
+// ParseNameStyle parses the name of a style, as used by the -names flag of the commands
+func ParseNameStyle(s string) (NameStyle, error) {
+	for _, style := range []NameStyle{NameMangled, NameDemangled, NameQualified, NameBoth} {
+		if s == style.String() {
+			return style, nil
+		}
+	}
+	return NameMangled, errors.New("unknown name style: " + s)
+}
+
+// FunctionNameFormatter formats function names for reports in a given style. Names that cannot
+// be demangled, such as those of C functions, are written as they are. It is safe for concurrent
+// use, and caches demangled names since reports repeat them once per region.
+type FunctionNameFormatter struct {
+	Style NameStyle
+
+	lock  sync.Mutex
+	cache map[string][]string
+}
+
+func NewFunctionNameFormatter(style NameStyle) *FunctionNameFormatter {
+	return &FunctionNameFormatter{
+		Style: style,
+		cache: make(map[string][]string),
+	}
+}
+
+// Header returns the header of the column or columns holding a function name
+func (f *FunctionNameFormatter) Header(column string) []string {
+	if f.Style == NameBoth {
+		return []string{column, column + " (Qualified)"}
+	}
+	return []string{column}
+}
+
+// Format returns the columns for a function name, matching Header
+func (f *FunctionNameFormatter) Format(name string) []string {
+	if f.Style == NameMangled {
+		return []string{name}
+	}
+	if name == "" {
+		return make([]string, len(f.Header("")))
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if columns, ok := f.cache[name]; ok {
+		return columns
+	}
+
+	full, qualified, err := demangle(name)
+	if err != nil {
+		full, qualified = name, name
+	}
+
+	var columns []string
+	switch f.Style {
+	case NameDemangled:
+		columns = []string{full}
+	case NameQualified:
+		columns = []string{qualified}
+	default:
+		columns = []string{full, qualified}
+	}
+	f.cache[name] = columns
+
+	return columns
+}
+
+var errNotMangled = errors.New("not a mangled name")
+
+type demangleError struct {
+	msg string
+}
+
+func demangle(name string) (full string, qualified string, err error) {
+	// Internal linkage functions are named <file>:<name> or <file>;<name> in profiles
+	if i := strings.LastIndexAny(name, ":;"); i >= 0 && strings.HasPrefix(name[i+1:], "_Z") {
+		name = name[i+1:]
+	}
+	if !strings.HasPrefix(name, "_Z") {
+		return "", "", errNotMangled
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			de, ok := r.(demangleError)
+			if !ok {
+				panic(r)
+			}
+			full, qualified, err = "", "", errors.New(de.msg)
+		}
+	}()
+
+	d := &demangler{s: name, pos: 2, packIndex: -1}
+	enc := d.encoding()
+	if d.pos < len(d.s) {
+		if d.s[d.pos] != '.' {
+			d.fail("unexpected characters after name")
+		}
+		suffix := " (" + d.s[d.pos:] + ")"
+		return enc.full + suffix, enc.qualified, nil
+	}
+
+	return enc.full, enc.qualified, nil
+}
+
+type dmKind int
+
+const (
+	dmPlain dmKind = iota
+	dmFunction
+	dmArray
+)
+
+// dmType is a demangled type, split around the point where a declarator would go so that
+// pointers to functions and arrays can be printed
+type dmType struct {
+	left  string
+	right string
+	kind  dmKind
+
+	// For references, the referenced type, so that references to references can be collapsed
+	ref      string
+	refInner *dmType
+
+	isPack bool
+	pack   []dmType
+}
+
+func plainType(s string) dmType {
+	return dmType{left: s}
+}
+
+func (t dmType) String() string {
+	if t.isPack {
+		return joinTypes(t.pack)
+	}
+	return t.left + t.right
+}
+
+func joinTypes(types []dmType) string {
+	parts := make([]string, 0, len(types))
+	for _, t := range types {
+		if t.isPack {
+			if s := joinTypes(t.pack); s != "" {
+				parts = append(parts, s)
+			}
+			continue
+		}
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// dmName describes a demangled name, along with what the encoding needs to know about it
+type dmName struct {
+	name     string
+	cv       string
+	ref      string
+	template bool // Ends with template arguments, so a function has its return type mangled
+	noReturn bool // Constructor, destructor or conversion operator
+	base     string
+}
+
+type dmEncoding struct {
+	full      string
+	qualified string
+}
+
+type demangler struct {
+	s   string
+	pos int
+
+	subs         []dmType
+	templateArgs []dmType
+
+	// Index of the pack element being printed during a pack expansion, or -1
+	packIndex int
+	packSize  int
+
+	// Inside the signature of a generic lambda, where template parameters are auto
+	inLambda bool
+}
+
+func (d *demangler) fail(msg string) {
+	panic(demangleError{msg: msg + " at offset " + strconv.Itoa(d.pos)})
+}
+
+func (d *demangler) peek() byte {
+	if d.pos >= len(d.s) {
+		return 0
+	}
+	return d.s[d.pos]
+}
+
+func (d *demangler) peekAt(i int) byte {
+	if d.pos+i >= len(d.s) {
+		return 0
+	}
+	return d.s[d.pos+i]
+}
+
+func (d *demangler) consume(prefix string) bool {
+	if strings.HasPrefix(d.s[d.pos:], prefix) {
+		d.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (d *demangler) expect(c byte) {
+	if d.peek() != c {
+		d.fail("expected " + string(c))
+	}
+	d.pos += 1
+}
+
+func (d *demangler) number() int {
+	start := d.pos
+	for d.peek() >= '0' && d.peek() <= '9' {
+		d.pos += 1
+	}
+	if d.pos == start {
+		d.fail("expected number")
+	}
+	n, err := strconv.Atoi(d.s[start:d.pos])
+	if err != nil {
+		d.fail("invalid number")
+	}
+	return n
+}
+
+// seqID parses the base 36 number in a substitution, returning -1 if there is none
+func (d *demangler) seqID() int {
+	if d.peek() == '_' {
+		d.pos += 1
+		return 0
+	}
+	n := 0
+	for {
+		c := d.peek()
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*36 + int(c-'0')
+		case c >= 'A' && c <= 'Z':
+			n = n*36 + int(c-'A') + 10
+		case c == '_':
+			d.pos += 1
+			return n + 1
+		default:
+			d.fail("invalid sequence id")
+		}
+		d.pos += 1
+	}
+}
+
+// discriminator skips the discriminator of a local entity, which is never printed
+func (d *demangler) discriminator() {
+	if d.peek() != '_' {
+		return
+	}
+	if d.peekAt(1) >= '0' && d.peekAt(1) <= '9' {
+		d.pos += 2
+	} else if d.peekAt(1) == '_' {
+		d.pos += 2
+		d.number()
+		d.expect('_')
+	}
+}
+
+func (d *demangler) atEnd() bool {
+	return d.pos >= len(d.s) || d.peek() == 'E' || d.peek() == '.'
+}
+
+func (d *demangler) encoding() dmEncoding {
+	switch {
+	case d.peek() == 'T' || (d.peek() == 'G' && d.peekAt(1) != 0):
+		return d.specialName()
+	}
+
+	savedArgs := d.templateArgs
+	n := d.name(true)
+	if d.atEnd() {
+		return dmEncoding{full: n.name, qualified: n.name}
+	}
+
+	var ret *dmType
+	if n.template && !n.noReturn {
+		t := d.typ()
+		ret = &t
+	}
+	params := d.bareFunctionType()
+	d.templateArgs = savedArgs
+
+	var b strings.Builder
+	if ret != nil {
+		b.WriteString(ret.left)
+		if ret.right == "" {
+			b.WriteString(" ")
+		}
+	}
+	b.WriteString(n.name)
+	b.WriteString("(")
+	b.WriteString(params)
+	b.WriteString(")")
+	if ret != nil {
+		b.WriteString(ret.right)
+	}
+	b.WriteString(n.cv)
+	b.WriteString(n.ref)
+
+	return dmEncoding{full: b.String(), qualified: n.name}
+}
+
+func (d *demangler) bareFunctionType() string {
+	params := make([]dmType, 0)
+	for !d.atEnd() {
+		params = append(params, d.typ())
+	}
+	if len(params) == 1 && !params[0].isPack && params[0].String() == "void" {
+		return ""
+	}
+	return joinTypes(params)
+}
+
+func (d *demangler) callOffset() {
+	switch {
+	case d.consume("h"):
+		d.consume("n")
+		d.number()
+		d.expect('_')
+	case d.consume("v"):
+		d.consume("n")
+		d.number()
+		d.expect('_')
+		d.consume("n")
+		d.number()
+		d.expect('_')
+	default:
+		d.fail("invalid call offset")
+	}
+}
+
+func (d *demangler) specialName() dmEncoding {
+	special := func(prefix string, s string) dmEncoding {
+		return dmEncoding{full: prefix + s, qualified: prefix + s}
+	}
+
+	switch {
+	case d.consume("TV"):
+		return special("vtable for ", d.typ().String())
+	case d.consume("TT"):
+		return special("VTT for ", d.typ().String())
+	case d.consume("TI"):
+		return special("typeinfo for ", d.typ().String())
+	case d.consume("TS"):
+		return special("typeinfo name for ", d.typ().String())
+	case d.consume("TW"):
+		return special("thread-local wrapper routine for ", d.name(false).name)
+	case d.consume("TH"):
+		return special("thread-local initialization routine for ", d.name(false).name)
+	case d.consume("TC"):
+		derived := d.typ().String()
+		d.number()
+		d.expect('_')
+		base := d.typ().String()
+		return special("construction vtable for ", base+"-in-"+derived)
+	case d.consume("Tc"):
+		d.callOffset()
+		d.callOffset()
+		enc := d.encoding()
+		return dmEncoding{full: "covariant return thunk to " + enc.full, qualified: enc.qualified}
+	case d.consume("Th"):
+		d.pos -= 1
+		d.callOffset()
+		enc := d.encoding()
+		return dmEncoding{full: "non-virtual thunk to " + enc.full, qualified: enc.qualified}
+	case d.consume("Tv"):
+		d.pos -= 1
+		d.callOffset()
+		enc := d.encoding()
+		return dmEncoding{full: "virtual thunk to " + enc.full, qualified: enc.qualified}
+	case d.consume("GV"):
+		return special("guard variable for ", d.name(false).name)
+	case d.consume("GR"):
+		n := d.name(false).name
+		if !d.atEnd() {
+			d.seqID()
+		}
+		return special("reference temporary for ", n)
+	case d.consume("GA"):
+		enc := d.encoding()
+		return dmEncoding{full: "hidden alias for " + enc.full, qualified: enc.qualified}
+	case d.consume("GTt"), d.consume("GTn"):
+		enc := d.encoding()
+		return dmEncoding{full: "transaction clone for " + enc.full, qualified: enc.qualified}
+	}
+
+	d.fail("unknown special name")
+	return dmEncoding{}
+}
+
+// name parses a name. At the top level of an encoding, its template arguments become the ones
+// template parameters refer to.
+func (d *demangler) name(top bool) dmName {
+	switch {
+	case d.peek() == 'N':
+		return d.nestedName(top)
+	case d.peek() == 'Z':
+		return d.localName(top)
+	case d.peek() == 'S' && d.peekAt(1) == 't':
+		d.pos += 2
+		n := d.unqualifiedName("")
+		n.name = "std::" + n.name
+		if d.peek() == 'I' {
+			d.subs = append(d.subs, plainType(n.name))
+			d.templateArgsInName(&n, top)
+		}
+		return n
+	case d.peek() == 'S':
+		sub := d.substitution()
+		n := dmName{name: sub.String(), base: sub.String()}
+		if d.peek() != 'I' {
+			d.fail("substitution used as a name")
+		}
+		d.templateArgsInName(&n, top)
+		return n
+	}
+
+	n := d.unqualifiedName("")
+	if d.peek() == 'I' {
+		d.subs = append(d.subs, plainType(n.name))
+		d.templateArgsInName(&n, top)
+	}
+	return n
+}
+
+func (d *demangler) templateArgsInName(n *dmName, top bool) {
+	args := d.templateArgList()
+	n.name += templateArgsString(args)
+	n.template = true
+	if top {
+		d.templateArgs = args
+	}
+}
+
+func templateArgsString(args []dmType) string {
+	s := joinTypes(args)
+	if strings.HasSuffix(s, ">") {
+		s += " "
+	}
+	return "<" + s + ">"
+}
+
+func (d *demangler) nestedName(top bool) dmName {
+	d.expect('N')
+
+	var n dmName
+	for {
+		switch {
+		case d.consume("r"):
+			n.cv += " restrict"
+			continue
+		case d.consume("V"):
+			n.cv = " volatile" + n.cv
+			continue
+		case d.consume("K"):
+			n.cv = " const" + n.cv
+			continue
+		}
+		break
+	}
+	if d.consume("R") {
+		n.ref = " &"
+	} else if d.consume("O") {
+		n.ref = " &&"
+	}
+
+	soFar := ""
+	pushed := 0
+	for !d.consume("E") {
+		d.consume("L")
+		component := ""
+		switch {
+		case d.peek() == 'S' && d.peekAt(1) == 't':
+			d.pos += 2
+			component = "std"
+			n.template = false
+			soFar = ""
+		case d.peek() == 'S':
+			if soFar != "" {
+				d.fail("substitution inside a nested name")
+			}
+			sub := d.substitution()
+			soFar = sub.String()
+			if expanded, ok := expandedAbbreviations[soFar]; ok && d.isCtorDtor() {
+				soFar = expanded
+			}
+			n.base = soFar
+			n.template = false
+			continue
+		case d.peek() == 'T':
+			soFar = d.joinScope(soFar, d.templateParam().String())
+			n.template = false
+		case d.peek() == 'I':
+			if soFar == "" {
+				d.fail("template arguments without a name")
+			}
+			args := d.templateArgList()
+			soFar += templateArgsString(args)
+			n.template = true
+			if top {
+				d.templateArgs = args
+			}
+		case d.peek() == 'D' && (d.peekAt(1) == 't' || d.peekAt(1) == 'T'):
+			soFar = d.joinScope(soFar, d.decltype())
+			n.template = false
+		case d.peek() == 'M':
+			// The closure type of a lambda in a data member initializer
+			d.pos += 1
+			continue
+		default:
+			un := d.unqualifiedName(n.base)
+			component = un.name
+			n.noReturn = un.noReturn
+			n.base = un.base
+			n.template = false
+		}
+
+		if component != "" {
+			soFar = d.joinScope(soFar, component)
+			if component == "std" {
+				// St is not a substitution candidate on its own
+				n.base = component
+				continue
+			}
+		}
+
+		d.subs = append(d.subs, plainType(soFar))
+		pushed += 1
+	}
+	if pushed == 0 {
+		d.fail("empty nested name")
+	}
+	d.subs = d.subs[:len(d.subs)-1]
+
+	n.name = soFar
+	return n
+}
+
+func (d *demangler) isCtorDtor() bool {
+	c, next := d.peek(), d.peekAt(1)
+	return (c == 'C' && next != 'v') || (c == 'D' && next >= '0' && next <= '5')
+}
+
+func (d *demangler) joinScope(scope string, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "::" + name
+}
+
+func (d *demangler) localName(top bool) dmName {
+	d.expect('Z')
+	enc := d.encoding()
+	d.expect('E')
+
+	if d.consume("s") {
+		d.discriminator()
+		return dmName{name: enc.full + "::string literal"}
+	}
+	if d.consume("d") {
+		if d.peek() != '_' {
+			d.number()
+		}
+		d.expect('_')
+	}
+
+	n := d.name(top)
+	d.discriminator()
+	n.name = enc.full + "::" + n.name
+	return n
+}
+
+// unqualifiedName parses a single component of a name. The base of the enclosing scope is used for
+// the names of constructors and destructors.
+func (d *demangler) unqualifiedName(scopeBase string) dmName {
+	var n dmName
+	c := d.peek()
+	switch {
+	case c >= '0' && c <= '9':
+		n.name = d.sourceName()
+		n.base = n.name
+	case c == 'L':
+		d.pos += 1
+		return d.unqualifiedName(scopeBase)
+	case c == 'C' && d.peekAt(1) != 'v':
+		d.pos += 1
+		d.consume("I")
+		if d.peek() < '1' || d.peek() > '5' {
+			d.fail("invalid constructor")
+		}
+		d.pos += 1
+		if d.s[d.pos-2] == 'I' {
+			d.typ()
+		}
+		n.name = baseName(scopeBase)
+		n.base = n.name
+		n.noReturn = true
+	case c == 'D' && d.peekAt(1) >= '0' && d.peekAt(1) <= '5':
+		d.pos += 2
+		n.name = "~" + baseName(scopeBase)
+		n.base = n.name
+		n.noReturn = true
+	case c == 'U':
+		n.name = d.unnamedTypeName()
+		n.base = n.name
+	case c >= 'a' && c <= 'z':
+		n = d.operatorName()
+	default:
+		d.fail("invalid name")
+	}
+
+	for d.peek() == 'B' {
+		d.pos += 1
+		n.name += "[abi:" + d.sourceName() + "]"
+	}
+	return n
+}
+
+// baseName strips the scope and template arguments from a name, leaving what a constructor
+// would be called
+func baseName(s string) string {
+	depth := 0
+	end := len(s)
+	for i := len(s) - 1; i >= 0; i-- {
+		switch s[i] {
+		case '>':
+			if depth == 0 {
+				end = i
+			}
+			depth += 1
+		case '<':
+			depth -= 1
+			if depth == 0 {
+				end = i
+			}
+		case ':':
+			if depth == 0 && i > 0 && s[i-1] == ':' {
+				return strings.TrimSpace(s[i+1 : end])
+			}
+		}
+	}
+	return strings.TrimSpace(s[:end])
+}
+
+func (d *demangler) sourceName() string {
+	n := d.number()
+	if n > len(d.s)-d.pos {
+		d.fail("source name too long")
+	}
+	s := d.s[d.pos : d.pos+n]
+	d.pos += n
+	if strings.HasPrefix(s, "_GLOBAL__N") {
+		return "(anonymous namespace)"
+	}
+	return s
+}
+
+func (d *demangler) unnamedTypeName() string {
+	switch {
+	case d.consume("Ut"):
+		count := ""
+		if d.peek() != '_' {
+			count = strconv.Itoa(d.number())
+		}
+		d.expect('_')
+		return "'unnamed" + count + "'"
+	case d.consume("Ul"):
+		savedLambda := d.inLambda
+		d.inLambda = true
+		params := d.bareFunctionType()
+		d.inLambda = savedLambda
+		d.expect('E')
+		count := ""
+		if d.peek() != '_' {
+			count = strconv.Itoa(d.number())
+		}
+		d.expect('_')
+		return "'lambda" + count + "'(" + params + ")"
+	}
+	d.fail("invalid unnamed type")
+	return ""
+}
+
+type dmOperator struct {
+	code  string
+	name  string
+	arity int
+}
+
+var dmOperators = []dmOperator{
+	{"nw", "new", 1}, {"na", "new[]", 1}, {"dl", "delete", 1}, {"da", "delete[]", 1},
+	{"ps", "+", 1}, {"ng", "-", 1}, {"ad", "&", 1}, {"de", "*", 1}, {"co", "~", 1},
+	{"pl", "+", 2}, {"mi", "-", 2}, {"ml", "*", 2}, {"dv", "/", 2}, {"rm", "%", 2},
+	{"an", "&", 2}, {"or", "|", 2}, {"eo", "^", 2}, {"aS", "=", 2}, {"pL", "+=", 2},
+	{"mI", "-=", 2}, {"mL", "*=", 2}, {"dV", "/=", 2}, {"rM", "%=", 2}, {"aN", "&=", 2},
+	{"oR", "|=", 2}, {"eO", "^=", 2}, {"ls", "<<", 2}, {"rs", ">>", 2}, {"lS", "<<=", 2},
+	{"rS", ">>=", 2}, {"eq", "==", 2}, {"ne", "!=", 2}, {"lt", "<", 2}, {"gt", ">", 2},
+	{"le", "<=", 2}, {"ge", ">=", 2}, {"ss", "<=>", 2}, {"nt", "!", 1}, {"aa", "&&", 2},
+	{"oo", "||", 2}, {"pp", "++", 1}, {"mm", "--", 1}, {"cm", ",", 2}, {"pm", "->*", 2},
+	{"pt", "->", 2}, {"cl", "()", 2}, {"ix", "[]", 2}, {"qu", "?", 3}, {"aw", "co_await", 1},
+}
+
+func lookupOperator(code string) (dmOperator, bool) {
+	for _, op := range dmOperators {
+		if op.code == code {
+			return op, true
+		}
+	}
+	return dmOperator{}, false
+}
+
+func (d *demangler) operatorName() dmName {
+	if d.pos+2 > len(d.s) {
+		d.fail("truncated operator")
+	}
+	code := d.s[d.pos : d.pos+2]
+
+	switch {
+	case code == "cv":
+		d.pos += 2
+		t := d.typ()
+		return dmName{name: "operator " + t.String(), noReturn: true}
+	case code == "li":
+		d.pos += 2
+		return dmName{name: "operator\"\" " + d.sourceName()}
+	case code[0] == 'v' && code[1] >= '0' && code[1] <= '9':
+		d.pos += 2
+		return dmName{name: "operator " + d.sourceName()}
+	}
+
+	op, ok := lookupOperator(code)
+	if !ok {
+		d.fail("unknown operator " + code)
+	}
+	d.pos += 2
+
+	name := "operator" + op.name
+	if op.name[0] >= 'a' && op.name[0] <= 'z' {
+		name = "operator " + op.name
+	}
+	return dmName{name: name, base: name}
+}
+
+func (d *demangler) substitution() dmType {
+	d.expect('S')
+
+	abbreviations := map[byte]string{
+		'a': "std::allocator",
+		'b': "std::basic_string",
+		's': "std::string",
+		'i': "std::istream",
+		'o': "std::ostream",
+		'd': "std::iostream",
+	}
+	if s, ok := abbreviations[d.peek()]; ok {
+		d.pos += 1
+		return plainType(s)
+	}
+
+	i := d.seqID()
+	if i >= len(d.subs) {
+		d.fail("invalid substitution")
+	}
+	return d.packElement(d.subs[i])
+}
+
+// expandedAbbreviations are the names used for the standard abbreviations when they are the
+// scope of a constructor or destructor
+var expandedAbbreviations = map[string]string{
+	"std::string":   "std::basic_string<char, std::char_traits<char>, std::allocator<char> >",
+	"std::istream":  "std::basic_istream<char, std::char_traits<char> >",
+	"std::ostream":  "std::basic_ostream<char, std::char_traits<char> >",
+	"std::iostream": "std::basic_iostream<char, std::char_traits<char> >",
+}
+
+func (d *demangler) templateParam() dmType {
+	return d.packElement(d.unexpandedTemplateParam())
+}
+
+// unexpandedTemplateParam is templateParam, but returns packs whole even inside a pack expansion
+func (d *demangler) unexpandedTemplateParam() dmType {
+	d.expect('T')
+	if d.consume("L") {
+		d.number()
+		d.expect('_')
+	}
+	i := 0
+	if !d.consume("_") {
+		i = d.number() + 1
+		d.expect('_')
+	}
+
+	if d.inLambda {
+		return plainType("auto")
+	}
+	if i >= len(d.templateArgs) {
+		d.fail("invalid template parameter")
+	}
+
+	return d.templateArgs[i]
+}
+
+// packElement picks the element of a pack being printed by a pack expansion
+func (d *demangler) packElement(t dmType) dmType {
+	if !t.isPack || d.packIndex < 0 {
+		return t
+	}
+	if d.packSize < 0 {
+		d.packSize = len(t.pack)
+	}
+	if d.packIndex < len(t.pack) {
+		return t.pack[d.packIndex]
+	}
+	return plainType("")
+}
+
+func (d *demangler) templateArgList() []dmType {
+	d.expect('I')
+	args := make([]dmType, 0)
+	for !d.consume("E") {
+		if d.pos >= len(d.s) {
+			d.fail("unterminated template arguments")
+		}
+		args = append(args, d.templateArg())
+	}
+	return args
+}
+
+func (d *demangler) templateArg() dmType {
+	switch d.peek() {
+	case 'X':
+		d.pos += 1
+		if d.consume("sp") {
+			pack := d.expressionPackExpansion()
+			d.expect('E')
+			return pack
+		}
+		e := d.expression()
+		d.expect('E')
+		return plainType(e)
+	case 'L':
+		return plainType(d.exprPrimary())
+	case 'J':
+		d.pos += 1
+		pack := make([]dmType, 0)
+		for !d.consume("E") {
+			if d.pos >= len(d.s) {
+				d.fail("unterminated argument pack")
+			}
+			pack = append(pack, d.templateArg())
+		}
+		return dmType{isPack: true, pack: pack}
+	}
+	return d.typ()
+}
+
+var dmBuiltinTypes = map[byte]string{
+	'v': "void", 'w': "wchar_t", 'b': "bool", 'c': "char", 'a': "signed char",
+	'h': "unsigned char", 's': "short", 't': "unsigned short", 'i': "int", 'j': "unsigned int",
+	'l': "long", 'm': "unsigned long", 'x': "long long", 'y': "unsigned long long",
+	'n': "__int128", 'o': "unsigned __int128", 'f': "float", 'd': "double", 'e': "long double",
+	'g': "__float128", 'z': "...",
+}
+
+var dmBuiltinDTypes = map[byte]string{
+	'd': "decimal64", 'e': "decimal128", 'f': "decimal32", 'h': "half", 'i': "char32_t",
+	's': "char16_t", 'u': "char8_t", 'a': "auto", 'c': "decltype(auto)", 'n': "std::nullptr_t",
+}
+
+func (d *demangler) typ() dmType {
+	c := d.peek()
+
+	if s, ok := dmBuiltinTypes[c]; ok {
+		d.pos += 1
+		return plainType(s)
+	}
+
+	var t dmType
+	switch c {
+	case 'u':
+		d.pos += 1
+		return plainType(d.sourceName())
+	case 'r', 'V', 'K':
+		quals := ""
+		for {
+			if d.consume("r") {
+				quals = " restrict" + quals
+			} else if d.consume("V") {
+				quals = " volatile" + quals
+			} else if d.consume("K") {
+				quals = " const" + quals
+			} else {
+				break
+			}
+		}
+		// Order the qualifiers as const volatile restrict
+		ordered := ""
+		for _, q := range []string{" const", " volatile", " restrict"} {
+			if strings.Contains(quals, q) {
+				ordered += q
+			}
+		}
+		if d.peek() == 'F' {
+			// A qualified function type is a single substitution
+			t = d.functionType()
+			t.right += ordered
+			break
+		}
+		t = d.typ()
+		t.left += ordered
+	case 'P':
+		d.pos += 1
+		t = pointerTo(d.typ(), "*")
+	case 'R':
+		d.pos += 1
+		t = pointerTo(d.typ(), "&")
+	case 'O':
+		d.pos += 1
+		t = pointerTo(d.typ(), "&&")
+	case 'C':
+		d.pos += 1
+		inner := d.typ()
+		t = plainType(inner.String() + " _Complex")
+	case 'G':
+		d.pos += 1
+		inner := d.typ()
+		t = plainType(inner.String() + " _Imaginary")
+	case 'F':
+		t = d.functionType()
+	case 'A':
+		t = d.arrayType()
+	case 'M':
+		d.pos += 1
+		class := d.typ().String()
+		member := d.typ()
+		t = member
+		if member.kind == dmFunction || member.kind == dmArray {
+			t.left = member.left + "(" + class + "::*"
+			t.right = ")" + member.right
+		} else {
+			t.left = member.left + " " + class + "::*"
+		}
+		t.kind = dmPlain
+	case 'T':
+		if d.peekAt(1) == 's' || d.peekAt(1) == 'u' || d.peekAt(1) == 'e' {
+			d.pos += 2
+			t = plainType(d.name(false).name)
+			break
+		}
+		param := d.unexpandedTemplateParam()
+		d.subs = append(d.subs, param)
+		t = d.packElement(param)
+		if d.peek() != 'I' {
+			return t
+		}
+		t = plainType(t.String() + templateArgsString(d.templateArgList()))
+	case 'S':
+		if d.peekAt(1) == 't' {
+			t = plainType(d.name(false).name)
+			break
+		}
+		t = d.substitution()
+		if d.peek() != 'I' {
+			return t
+		}
+		t = plainType(t.String() + templateArgsString(d.templateArgList()))
+	case 'D':
+		// Builtin types are not substitution candidates
+		if s, ok := dmBuiltinDTypes[d.peekAt(1)]; ok {
+			d.pos += 2
+			return plainType(s)
+		}
+		if d.peekAt(1) == 'F' {
+			return d.dType()
+		}
+		t = d.dType()
+	case 'U':
+		d.pos += 1
+		qual := d.sourceName()
+		if d.peek() == 'I' {
+			qual += templateArgsString(d.templateArgList())
+		}
+		inner := d.typ()
+		t = inner
+		t.left += " " + qual
+	case 'N', 'Z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		t = plainType(d.name(false).name)
+	default:
+		d.fail("unknown type")
+	}
+
+	d.subs = append(d.subs, t)
+	return t
+}
+
+func pointerTo(inner dmType, op string) dmType {
+	if inner.isPack {
+		pack := make([]dmType, len(inner.pack))
+		for i, e := range inner.pack {
+			pack[i] = pointerTo(e, op)
+		}
+		return dmType{isPack: true, pack: pack}
+	}
+
+	if inner.ref != "" && (op == "&" || op == "&&") {
+		if inner.ref == "&" {
+			op = "&"
+		}
+		return pointerTo(*inner.refInner, op)
+	}
+
+	t := dmType{}
+	if op == "&" || op == "&&" {
+		t.ref = op
+		t.refInner = &inner
+	}
+	switch inner.kind {
+	case dmFunction:
+		t.left = inner.left + "(" + op
+		t.right = ")" + inner.right
+	case dmArray:
+		t.left = inner.left + " (" + op
+		t.right = ")" + inner.right
+	default:
+		t.left = inner.left + op
+		t.right = inner.right
+	}
+	return t
+}
+
+func (d *demangler) functionType() dmType {
+	d.expect('F')
+	d.consume("Y")
+	ret := d.typ()
+
+	params := make([]dmType, 0)
+	ref := ""
+	for !d.consume("E") {
+		if d.pos >= len(d.s) {
+			d.fail("unterminated function type")
+		}
+		if d.peek() == 'R' && d.peekAt(1) == 'E' {
+			d.pos += 1
+			ref = " &"
+			continue
+		}
+		if d.peek() == 'O' && d.peekAt(1) == 'E' {
+			d.pos += 1
+			ref = " &&"
+			continue
+		}
+		params = append(params, d.typ())
+	}
+
+	paramStr := joinTypes(params)
+	if len(params) == 1 && paramStr == "void" {
+		paramStr = ""
+	}
+
+	return dmType{
+		left:  ret.left + " ",
+		right: "(" + paramStr + ")" + ret.right + ref,
+		kind:  dmFunction,
+	}
+}
+
+func (d *demangler) arrayType() dmType {
+	d.expect('A')
+	dim := ""
+	switch {
+	case d.peek() >= '0' && d.peek() <= '9':
+		dim = strconv.Itoa(d.number())
+	case d.peek() != '_':
+		dim = d.expression()
+	}
+	d.expect('_')
+
+	elem := d.typ()
+	right := elem.right
+	if elem.kind == dmArray {
+		right = strings.TrimPrefix(right, " ")
+	}
+	return dmType{
+		left:  elem.left,
+		right: " [" + dim + "]" + right,
+		kind:  dmArray,
+	}
+}
+
+func (d *demangler) dType() dmType {
+	d.expect('D')
+
+	switch d.peek() {
+	case 'p':
+		d.pos += 1
+		return d.packExpansion()
+	case 't', 'T':
+		d.pos -= 1
+		return plainType(d.decltype())
+	case 'F':
+		d.pos += 1
+		n := d.number()
+		d.expect('_')
+		return plainType("_Float" + strconv.Itoa(n))
+	case 'v':
+		d.pos += 1
+		dim := ""
+		if d.peek() >= '0' && d.peek() <= '9' {
+			dim = strconv.Itoa(d.number())
+		} else {
+			d.expect('_')
+			dim = d.expression()
+		}
+		d.consume("_")
+		elem := d.typ()
+		return plainType(elem.String() + " vector[" + dim + "]")
+	}
+
+	d.fail("unknown type")
+	return dmType{}
+}
+
+// packExpansion expands a pack expansion by parsing its pattern once for each element of the pack
+func (d *demangler) packExpansion() dmType {
+	start := d.pos
+	savedIndex := d.packIndex
+	savedSize := d.packSize
+	savedSubs := len(d.subs)
+
+	d.packIndex = 0
+	d.packSize = -1
+	first := d.typ()
+	end := d.pos
+	size := d.packSize
+
+	var t dmType
+	if size < 0 {
+		// Not a pack of known size
+		t = plainType(first.String() + "...")
+	} else {
+		t = dmType{isPack: true}
+		if size > 0 {
+			t.pack = append(t.pack, first)
+		}
+		subs := d.subs
+		for i := 1; i < size; i++ {
+			d.pos = start
+			d.subs = d.subs[:savedSubs]
+			d.packIndex = i
+			t.pack = append(t.pack, d.typ())
+		}
+		d.subs = subs
+		d.pos = end
+	}
+
+	d.packIndex = savedIndex
+	d.packSize = savedSize
+	return t
+}
+
+// expressionPackExpansion is packExpansion for expressions
+func (d *demangler) expressionPackExpansion() dmType {
+	start := d.pos
+	savedIndex := d.packIndex
+	savedSize := d.packSize
+
+	d.packIndex = 0
+	d.packSize = -1
+	first := d.expression()
+	end := d.pos
+	size := d.packSize
+
+	var t dmType
+	if size < 0 {
+		t = plainType(first + "...")
+	} else {
+		t = dmType{isPack: true}
+		if size > 0 {
+			t.pack = append(t.pack, plainType(first))
+		}
+		for i := 1; i < size; i++ {
+			d.pos = start
+			d.packIndex = i
+			t.pack = append(t.pack, plainType(d.expression()))
+		}
+		d.pos = end
+	}
+
+	d.packIndex = savedIndex
+	d.packSize = savedSize
+	return t
+}
+
+func (d *demangler) decltype() string {
+	d.expect('D')
+	if !d.consume("t") && !d.consume("T") {
+		d.fail("expected decltype")
+	}
+	e := d.expression()
+	d.expect('E')
+	return "decltype(" + e + ")"
+}
+
+func (d *demangler) exprPrimary() string {
+	d.expect('L')
+
+	if d.consume("_Z") {
+		enc := d.encoding()
+		d.expect('E')
+		return enc.full
+	}
+	if d.peek() == 'Z' {
+		d.pos += 1
+		enc := d.encoding()
+		d.expect('E')
+		return enc.full
+	}
+	if d.consume("DnE") {
+		return "nullptr"
+	}
+
+	t := d.typ()
+	neg := d.consume("n")
+	start := d.pos
+	for d.peek() != 'E' {
+		if d.pos >= len(d.s) {
+			d.fail("unterminated literal")
+		}
+		d.pos += 1
+	}
+	value := d.s[start:d.pos]
+	d.expect('E')
+	if neg {
+		value = "-" + value
+	}
+
+	switch t.String() {
+	case "bool":
+		if value == "0" {
+			return "false"
+		} else if value == "1" {
+			return "true"
+		}
+	case "int":
+		return value
+	case "unsigned int":
+		return value + "u"
+	case "long":
+		return value + "l"
+	case "unsigned long":
+		return value + "ul"
+	case "long long":
+		return value + "ll"
+	case "unsigned long long":
+		return value + "ull"
+	}
+	return "(" + t.String() + ")" + value
+}
+
+func (d *demangler) expression() string {
+	switch {
+	case d.peek() == 'L':
+		return d.exprPrimary()
+	case d.peek() == 'T':
+		return d.templateParam().String()
+	case d.consume("fp"):
+		d.consume("K")
+		if d.consume("_") {
+			return "fp"
+		}
+		n := d.number()
+		d.expect('_')
+		return "fp" + strconv.Itoa(n)
+	case d.consume("fL"):
+		d.number()
+		d.expect('p')
+		d.consume("K")
+		if d.consume("_") {
+			return "fp"
+		}
+		n := d.number()
+		d.expect('_')
+		return "fp" + strconv.Itoa(n)
+	case d.consume("gs"):
+		return "::" + d.expression()
+	case d.consume("sr"):
+		return d.unresolvedScope() + "::" + d.baseUnresolvedName()
+	case d.consume("st"):
+		return "sizeof (" + d.typ().String() + ")"
+	case d.consume("sz"):
+		return "sizeof (" + d.expression() + ")"
+	case d.consume("at"):
+		return "alignof (" + d.typ().String() + ")"
+	case d.consume("az"):
+		return "alignof (" + d.expression() + ")"
+	case d.consume("sZ"):
+		return "sizeof...(" + d.templateParam().String() + ")"
+	case d.consume("sp"):
+		return d.expressionPackExpansion().String()
+	case d.consume("tw"):
+		return "throw " + d.expression()
+	case d.consume("tr"):
+		return "throw"
+	case d.consume("nx"):
+		return "noexcept (" + d.expression() + ")"
+	case d.consume("cv"):
+		t := d.typ().String()
+		if d.consume("_") {
+			args := make([]string, 0)
+			for !d.consume("E") {
+				args = append(args, d.expression())
+			}
+			return "(" + t + ")(" + strings.Join(args, ", ") + ")"
+		}
+		return "(" + t + ")(" + d.expression() + ")"
+	case d.consume("cl"):
+		callee := d.expression()
+		args := make([]string, 0)
+		for !d.consume("E") {
+			if d.pos >= len(d.s) {
+				d.fail("unterminated call")
+			}
+			args = append(args, d.expression())
+		}
+		return callee + "(" + strings.Join(args, ", ") + ")"
+	case d.consume("dt"):
+		e := d.expression()
+		return e + "." + d.unresolvedName()
+	case d.consume("pt"):
+		e := d.expression()
+		return e + "->" + d.unresolvedName()
+	case (d.peek() >= '0' && d.peek() <= '9') || d.peek() == 'o' && d.peekAt(1) == 'n' || d.peek() == 'd' && d.peekAt(1) == 'n':
+		return d.baseUnresolvedName()
+	}
+
+	if d.pos+2 <= len(d.s) {
+		if op, ok := lookupOperator(d.s[d.pos : d.pos+2]); ok {
+			d.pos += 2
+			switch op.arity {
+			case 1:
+				return op.name + "(" + d.expression() + ")"
+			case 2:
+				lhs := d.expression()
+				rhs := d.expression()
+				return "(" + lhs + ") " + op.name + " (" + rhs + ")"
+			case 3:
+				cond := d.expression()
+				lhs := d.expression()
+				rhs := d.expression()
+				return "(" + cond + ") ? (" + lhs + ") : (" + rhs + ")"
+			}
+		}
+	}
+
+	d.fail("unsupported expression")
+	return ""
+}
+
+// unresolvedScope parses the qualifiers of a dependent name in an expression
+func (d *demangler) unresolvedScope() string {
+	if d.peek() >= '0' && d.peek() <= '9' {
+		scope := d.simpleID()
+		for !d.consume("E") {
+			scope += "::" + d.simpleID()
+		}
+		return scope
+	}
+
+	nested := d.consume("N")
+	var scope string
+	switch d.peek() {
+	case 'T':
+		t := d.templateParam()
+		d.subs = append(d.subs, t)
+		scope = t.String()
+	case 'D':
+		scope = d.decltype()
+		d.subs = append(d.subs, plainType(scope))
+	case 'S':
+		scope = d.substitution().String()
+	default:
+		d.fail("invalid unresolved type")
+	}
+	if d.peek() == 'I' {
+		scope += templateArgsString(d.templateArgList())
+		d.subs = append(d.subs, plainType(scope))
+	}
+	if nested {
+		for !d.consume("E") {
+			scope += "::" + d.simpleID()
+		}
+	}
+	return scope
+}
+
+func (d *demangler) simpleID() string {
+	if d.pos >= len(d.s) {
+		d.fail("truncated name")
+	}
+	name := d.sourceName()
+	if d.peek() == 'I' {
+		name += templateArgsString(d.templateArgList())
+	}
+	return name
+}
+
+func (d *demangler) baseUnresolvedName() string {
+	switch {
+	case d.consume("on"):
+		name := d.operatorName().name
+		if d.peek() == 'I' {
+			name += templateArgsString(d.templateArgList())
+		}
+		return name
+	case d.consume("dn"):
+		if d.peek() >= '0' && d.peek() <= '9' {
+			return "~" + d.simpleID()
+		}
+		return "~" + d.typ().String()
+	}
+	return d.simpleID()
+}
+
+func (d *demangler) unresolvedName() string {
+	if d.consume("sr") {
+		return d.unresolvedScope() + "::" + d.baseUnresolvedName()
+	}
+	return d.baseUnresolvedName()
+}
@@ -0,0 +1,161 @@
+package profparse
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testdata/demangle/symbols.txt samples the symbols of clang, LLVM and libstdc++, along with
+// hand written edge cases. symbols.cxxfilt is the output of llvm-cxxfilt 14 for them, which
+// leaves symbols it cannot demangle as they are.
+
+func readLines(t *testing.T, fName string) []string {
+	t.Helper()
+	f, err := os.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestDemangleMatchesCxxfilt(t *testing.T) {
+	symbols := readLines(t, filepath.Join("testdata", "demangle", "symbols.txt"))
+	want := readLines(t, filepath.Join("testdata", "demangle", "symbols.cxxfilt"))
+	if len(symbols) != len(want) {
+		t.Fatalf("%d symbols and %d demangled names", len(symbols), len(want))
+	}
+
+	mismatched := 0
+	for i, sym := range symbols {
+		got, err := Demangle(sym)
+		if err != nil {
+			got = sym
+		}
+		if got != want[i] {
+			mismatched++
+			if mismatched <= 10 {
+				t.Errorf("Demangle(%s) = %s, want %s", sym, got, want[i])
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		qualified, err := DemangleQualified(sym)
+		if err != nil || !strings.Contains(got, qualified) {
+			t.Errorf("DemangleQualified(%s) = %s, %v, which is not part of %s", sym, qualified, err, got)
+		}
+	}
+	if mismatched > 0 {
+		t.Errorf("%d of %d symbols differ from llvm-cxxfilt", mismatched, len(symbols))
+	}
+}
+
+func TestDemangle(t *testing.T) {
+	tests := []struct {
+		name      string
+		full      string
+		qualified string
+	}{
+		{"_ZN1A1fEv", "A::f()", "A::f"},
+		{"_Z1fv", "f()", "f"},
+		{"foo.cc:_ZN1A1fIiEEvT_", "void A::f<int>(int)", "A::f<int>"},
+		{"_ZNKSt6vectorIiSaIiEE4sizeEv", "std::vector<int, std::allocator<int> >::size() const",
+			"std::vector<int, std::allocator<int> >::size"},
+		{"_ZN1AC2Ev", "A::A()", "A::A"},
+		{"_ZN1AD0Ev", "A::~A()", "A::~A"},
+		{"_ZN1AplERKS_", "A::operator+(A const&)", "A::operator+"},
+		{"_ZZ4mainENK3$_0clEv", "main::$_0::operator()() const", "main::$_0::operator()"},
+
+		// llvm-cxxfilt 14 cannot demangle these, so they follow GNU c++filt
+		{"_ZGTtNKSt9exception4whatEv", "transaction clone for std::exception::what() const",
+			"std::exception::what"},
+		{"_ZNSt8ios_base7failureB5cxx11D1Ev", "std::ios_base::failure[abi:cxx11]::~failure()",
+			"std::ios_base::failure[abi:cxx11]::~failure"},
+		{"_ZNK4llvm5MachO6TargetcvSt6vectorIiSaIiEEEv",
+			"llvm::MachO::Target::operator std::vector<int, std::allocator<int> >() const",
+			"llvm::MachO::Target::operator std::vector<int, std::allocator<int> >"},
+	}
+	for _, tt := range tests {
+		full, err := Demangle(tt.name)
+		if err != nil || full != tt.full {
+			t.Errorf("Demangle(%s) = %s, %v, want %s", tt.name, full, err, tt.full)
+		}
+		qualified, err := DemangleQualified(tt.name)
+		if err != nil || qualified != tt.qualified {
+			t.Errorf("DemangleQualified(%s) = %s, %v, want %s", tt.name, qualified, err, tt.qualified)
+		}
+	}
+
+	for _, name := range []string{"", "main", "_Z", "_ZN1A", "_Z1fS_", "_ZN1A1fEvjunk", "a.cc:main"} {
+		if got, err := Demangle(name); err == nil {
+			t.Errorf("Demangle(%s) = %s, expected an error", name, got)
+		}
+	}
+}
+
+func TestDemangleTruncated(t *testing.T) {
+	symbols := readLines(t, filepath.Join("testdata", "demangle", "symbols.txt"))
+	for i := 0; i < len(symbols); i += 7 {
+		sym := symbols[i]
+		for n := 2; n < len(sym); n++ {
+			for _, suffix := range []string{"", "E", "S_", "T_", "I"} {
+				// Only a panic fails the test
+				Demangle(sym[:n] + suffix)
+			}
+		}
+	}
+}
+
+func TestFunctionNameFormatter(t *testing.T) {
+	tests := []struct {
+		style  NameStyle
+		name   string
+		header []string
+		want   []string
+	}{
+		{NameMangled, "a.cc:_ZN1A1fEi", []string{"Function"}, []string{"a.cc:_ZN1A1fEi"}},
+		{NameDemangled, "a.cc:_ZN1A1fEi", []string{"Function"}, []string{"A::f(int)"}},
+		{NameQualified, "_ZN1A1fEi", []string{"Function"}, []string{"A::f"}},
+		{NameBoth, "a.cc:_ZN1A1fEi", []string{"Function", "Function (Qualified)"}, []string{"A::f(int)", "A::f"}},
+		{NameBoth, "main", []string{"Function", "Function (Qualified)"}, []string{"main", "main"}},
+		{NameBoth, "", []string{"Function", "Function (Qualified)"}, []string{"", ""}},
+	}
+	for _, tt := range tests {
+		f := NewFunctionNameFormatter(tt.style)
+		if h := f.Header("Function"); !reflect.DeepEqual(h, tt.header) {
+			t.Errorf("%v header %v, want %v", tt.style, h, tt.header)
+		}
+		// The second call comes from the cache
+		for i := 0; i < 2; i++ {
+			if got := f.Format(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%v Format(%s) = %q, want %q", tt.style, tt.name, got, tt.want)
+			}
+		}
+	}
+
+	for _, s := range []NameStyle{NameMangled, NameDemangled, NameQualified, NameBoth} {
+		if parsed, err := ParseNameStyle(s.String()); err != nil || parsed != s {
+			t.Errorf("ParseNameStyle(%s) = %v, %v", s, parsed, err)
+		}
+	}
+	if _, err := ParseNameStyle("pretty"); err == nil {
+		t.Error("parsed an unknown name style")
+	}
+}
@@ -0,0 +1,732 @@
+package profparse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A distance matrix stores a metric for every pair of crawls, as the upper triangle of a matrix
+// without its diagonal:
+//
+//	header: "PPDM", u16 version, u16 flags (1 if the metric is a distance), u16 granularity,
+//	  u16 reserved, 16 byte layout fingerprint, u64 number of crawls, u64 offset of the values,
+//	  u32 crawls per band
+//	metric: u16-length name
+//	crawls: for each crawl, u16-length site and crawl
+//	values: float32 for each pair i < j, ordered by i then j
+//	trailer: u32 checksum of everything before the values, "PPDM"
+//
+// All integers are little endian. The matrix is computed a band of crawls at a time. Until it is
+// complete, it has no trailer and the pairs of bands done are listed in a progress file next to it,
+// so an interrupted build can be resumed.
+const (
+	distMagic       = "PPDM"
+	distVersion     = 1
+	distHeaderSize  = 48
+	distTrailerSize = 8
+
+	// Crawls compared together by a worker, and the words of each vector compared at once, so that
+	// the words of a tile stay in cache
+	distTileCrawls = 16
+	distChunkWords = 1024
+)
+
+// DistanceCrawl is a row and column of a distance matrix
+type DistanceCrawl struct {
+	Site  string
+	Crawl string
+}
+
+// DistanceMatrix reads a distance matrix file. It is safe for concurrent use.
+type DistanceMatrix struct {
+	Metric      string
+	Distance    bool // Whether identical crawls score 0, rather than 1
+	Granularity BVGranularity
+	Layout      LayoutFingerprint
+	Crawls      []DistanceCrawl
+
+	f            *os.File
+	valuesOffset int64
+	crawlIndex   map[packKey]int
+}
+
+// distPairIndex returns the position of pair i < j among the values of a matrix of n crawls
+func distPairIndex(n int, i int, j int) int64 {
+	return int64(i)*int64(n) - int64(i)*int64(i+1)/2 + int64(j-i-1)
+}
+
+// BuildDistanceMatrix compares every pair of the vectors at covPaths with m, ignoring the regions set
+// in exclude, which may be nil. Vectors are loaded a band at a time, with bands as large as
+// memoryBudget allows, and each pair of bands is split into tiles compared by workers. If outFile is
+// a partial matrix of the same vectors and metric, the build resumes where it stopped. Only one
+// direction of each pair is stored, so m must be symmetric.
+//
+// Every vector is read once before the build, and those that cannot be read, or whose layout or
+// length differs from the first readable vector, are logged and left out of the matrix. Their
+// paths are returned.
+func BuildDistanceMatrix(outFile string, covPaths []string, m Metric, exclude *BitVector, memoryBudget int64,
+	workers int) ([]string, error) {
+	if !m.Symmetric() {
+		return nil, errors.New(m.Name() + " is not symmetric, so it cannot be stored in a distance matrix")
+	}
+	if len(covPaths) < 2 {
+		return nil, errors.New("at least two vectors are needed for a distance matrix")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	start, first, h, skipped, err := readFirstVector(covPaths)
+	if err != nil {
+		return skipped, err
+	}
+	numBits := first.Len()
+	if exclude != nil && exclude.Len() != numBits {
+		return skipped, errors.New("bv lengths do not match exclude vector length")
+	}
+
+	covPaths, unreadable := checkDistanceVectors(covPaths[start:], h, numBits, workers)
+	skipped = append(skipped, unreadable...)
+	if len(covPaths) < 2 {
+		return skipped, errors.New("at least two readable vectors are needed for a distance matrix")
+	}
+	n := len(covPaths)
+
+	// Two bands of vectors and the values of a pair of bands: 4b^2 + 2vb <= budget
+	vectorBytes := float64(len(first.words)*8 + 64)
+	band := int((math.Sqrt(4*vectorBytes*vectorBytes+16*float64(memoryBudget)) - 2*vectorBytes) / 8)
+	if band < 1 {
+		band = 1
+	}
+	if band > n {
+		band = n
+	}
+
+	progressFile := outFile + ".progress"
+	runID := distanceRunID(m, exclude)
+	f, done, existingBand, err := resumeDistanceMatrix(outFile, progressFile, runID)
+	if err != nil {
+		return skipped, err
+	}
+	if f != nil {
+		band = existingBand
+	}
+
+	prefix := distanceMatrixPrefix(covPaths, m, h, band)
+	valuesOffset := int64(len(prefix))
+	valuesEnd := valuesOffset + 4*distPairIndex(n, n-1, n)
+
+	if f != nil {
+		existing := make([]byte, len(prefix))
+		_, err = f.ReadAt(existing, 0)
+		if err != nil || !bytes.Equal(existing, prefix) {
+			f.Close()
+			return skipped, errors.New(outFile + ": partial distance matrix is of other vectors or another metric")
+		}
+		log.Infof("Resuming distance matrix with %d pairs of bands done", len(done))
+	} else {
+		f, err = os.Create(outFile)
+		if err != nil {
+			return skipped, err
+		}
+		_, err = f.Write(prefix)
+		if err == nil {
+			err = f.Truncate(valuesEnd)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(progressFile, []byte(runID+"\n"), 0644)
+		}
+		if err != nil {
+			f.Close()
+			return skipped, err
+		}
+	}
+
+	progress, err := os.OpenFile(progressFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		f.Close()
+		return skipped, err
+	}
+
+	compared := numBits
+	if exclude != nil {
+		compared -= exclude.Count()
+	}
+
+	numBands := (n + band - 1) / band
+	log.Infof("Comparing %d vectors in %d bands of %d", n, numBands, band)
+	bandPaths := func(b int) []string {
+		end := (b + 1) * band
+		if end > n {
+			end = n
+		}
+		return covPaths[b*band : end]
+	}
+
+	for bi := 0; bi < numBands && err == nil; bi++ {
+		var rows []*BitVector
+		for bj := bi; bj < numBands; bj++ {
+			if done[[2]int{bi, bj}] {
+				continue
+			}
+
+			if rows == nil {
+				rows, err = loadDistanceBand(bandPaths(bi), h, numBits, workers)
+				if err != nil {
+					break
+				}
+			}
+			cols := rows
+			if bj != bi {
+				cols, err = loadDistanceBand(bandPaths(bj), h, numBits, workers)
+				if err != nil {
+					break
+				}
+			}
+
+			var values []float32
+			values, err = compareDistanceBands(rows, cols, bi == bj, m, exclude, compared, workers)
+			if err == nil {
+				err = writeDistanceBands(f, valuesOffset, n, bi*band, bj*band, len(cols), values, bi == bj)
+			}
+			if err == nil {
+				err = f.Sync()
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(progress, "%d %d\n", bi, bj)
+			}
+			if err != nil {
+				break
+			}
+			log.Infof("Compared bands %d and %d of %d", bi+1, bj+1, numBands)
+		}
+	}
+
+	if err == nil {
+		trailer := make([]byte, distTrailerSize)
+		binary.LittleEndian.PutUint32(trailer, crc32.Checksum(prefix, crcTable))
+		copy(trailer[4:], distMagic)
+		_, err = f.WriteAt(trailer, valuesEnd)
+	}
+	if err != nil {
+		f.Close()
+		progress.Close()
+		return skipped, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		progress.Close()
+		return skipped, err
+	}
+	progress.Close()
+	return skipped, os.Remove(progressFile)
+}
+
+// distanceRunID identifies the settings of a build that are not recorded in the matrix itself
+func distanceRunID(m Metric, exclude *BitVector) string {
+	crc := crc32.New(crcTable)
+	if exclude != nil {
+		crc.Write(exclude.Bytes())
+	}
+	if wj, ok := m.(WeightedJaccard); ok {
+		var b [8]byte
+		for _, w := range wj.Weights {
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(w))
+			crc.Write(b[:])
+		}
+	}
+	return distMagic + " " + strconv.FormatUint(uint64(crc.Sum32()), 16)
+}
+
+// resumeDistanceMatrix opens a partial matrix and reads the pairs of bands done from its progress
+// file. It returns a nil file if there is nothing to resume.
+func resumeDistanceMatrix(outFile string, progressFile string, runID string) (*os.File, map[[2]int]bool, int,
+	error) {
+	data, err := ioutil.ReadFile(progressFile)
+	if os.IsNotExist(err) {
+		return nil, nil, 0, nil
+	} else if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if !strings.HasPrefix(string(data), runID+"\n") {
+		return nil, nil, 0, errors.New(progressFile + ": partial distance matrix has another exclude vector " +
+			"or weights")
+	}
+
+	// A last line cut short by an interruption is ignored, and its bands compared again
+	lines := strings.Split(string(data), "\n")
+	done := make(map[[2]int]bool)
+	for _, line := range lines[1 : len(lines)-1] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		bi, err1 := strconv.Atoi(fields[0])
+		bj, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil {
+			done[[2]int{bi, bj}] = true
+		}
+	}
+
+	f, err := os.OpenFile(outFile, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	header := make([]byte, distHeaderSize)
+	_, err = f.ReadAt(header, 0)
+	if err != nil || string(header[:4]) != distMagic {
+		f.Close()
+		return nil, nil, 0, errors.New(outFile + ": not a distance matrix")
+	}
+
+	return f, done, int(binary.LittleEndian.Uint32(header[44:])), nil
+}
+
+// distanceMatrixPrefix returns everything in a distance matrix file that precedes the values
+func distanceMatrixPrefix(covPaths []string, m Metric, h BVHeader, band int) []byte {
+	prefix := make([]byte, distHeaderSize)
+	copy(prefix, distMagic)
+	binary.LittleEndian.PutUint16(prefix[4:], distVersion)
+	if m.Distance() {
+		binary.LittleEndian.PutUint16(prefix[6:], 1)
+	}
+	binary.LittleEndian.PutUint16(prefix[8:], uint16(h.Granularity))
+	copy(prefix[12:], h.Layout[:])
+	binary.LittleEndian.PutUint64(prefix[28:], uint64(len(covPaths)))
+	binary.LittleEndian.PutUint32(prefix[44:], uint32(band))
+
+	prefix = appendBVString(prefix, m.Name())
+	for _, covPath := range covPaths {
+		site, crawl := CrawlForCovPath(covPath)
+		prefix = appendBVString(prefix, site)
+		prefix = appendBVString(prefix, crawl)
+	}
+	binary.LittleEndian.PutUint64(prefix[36:], uint64(len(prefix)))
+
+	return prefix
+}
+
+// checkDistanceVectors reads every vector at covPaths, returning the paths of those with the layout
+// of h and numBits regions, and of the others, which are logged
+func checkDistanceVectors(covPaths []string, h BVHeader, numBits int, workers int) ([]string, []string) {
+	errs := make([]error, len(covPaths))
+	indices := make(chan int, len(covPaths))
+	for i := range covPaths {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				_, errs[i] = readMatchingVector(covPaths[i], h, numBits)
+			}
+		}()
+	}
+	wg.Wait()
+
+	kept := make([]string, 0, len(covPaths))
+	skipped := make([]string, 0)
+	for i, err := range errs {
+		if err != nil {
+			log.Warnf("Skipping %v", err)
+			skipped = append(skipped, covPaths[i])
+		} else {
+			kept = append(kept, covPaths[i])
+		}
+	}
+	return kept, skipped
+}
+
+// loadDistanceBand reads the vectors of a band, checking each against the first vector's header.
+// The vectors were checked before the build, so an error here means one changed during it.
+func loadDistanceBand(covPaths []string, h BVHeader, numBits int, workers int) ([]*BitVector, error) {
+	vectors := make([]*BitVector, len(covPaths))
+	errs := make([]error, len(covPaths))
+
+	indices := make(chan int, len(covPaths))
+	for i := range covPaths {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				vectors[i], errs[i] = readMatchingVector(covPaths[i], h, numBits)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vectors, nil
+}
+
+// compareDistanceBands compares every row vector with every column vector, returning the values
+// row by row. If same is true, rows and cols are the same band and only pairs above the diagonal
+// are compared.
+func compareDistanceBands(rows []*BitVector, cols []*BitVector, same bool, m Metric, exclude *BitVector,
+	compared int, workers int) ([]float32, error) {
+	values := make([]float32, len(rows)*len(cols))
+
+	type tile struct {
+		r0, c0 int
+	}
+	tiles := make(chan tile, 1024)
+	var compareErr error
+	var errLock sync.Mutex
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				err := compareDistanceTile(rows, cols, t.r0, t.c0, same, m, exclude, compared, values)
+				if err != nil {
+					errLock.Lock()
+					compareErr = err
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for r0 := 0; r0 < len(rows); r0 += distTileCrawls {
+		c0 := 0
+		if same {
+			c0 = r0
+		}
+		for ; c0 < len(cols); c0 += distTileCrawls {
+			tiles <- tile{r0, c0}
+		}
+	}
+	close(tiles)
+	wg.Wait()
+
+	return values, compareErr
+}
+
+// compareDistanceTile compares the rows and columns of a tile a chunk of words at a time,
+// accumulating the counts or weights the metric is computed from
+func compareDistanceTile(rows []*BitVector, cols []*BitVector, r0 int, c0 int, same bool, m Metric,
+	exclude *BitVector, compared int, values []float32) error {
+	r1 := r0 + distTileCrawls
+	if r1 > len(rows) {
+		r1 = len(rows)
+	}
+	c1 := c0 + distTileCrawls
+	if c1 > len(cols) {
+		c1 = len(cols)
+	}
+	numWords := len(rows[0].words)
+
+	// Calls fn for each pair of the tile with its index in the tile
+	forPairs := func(fn func(r int, c int, k int)) {
+		for r := r0; r < r1; r++ {
+			for c := c0; c < c1; c++ {
+				if !same || c > r {
+					fn(r, c, (r-r0)*distTileCrawls+c-c0)
+				}
+			}
+		}
+	}
+	chunks := func(fn func(w0 int, w1 int, ex []uint64)) {
+		for w0 := 0; w0 < numWords; w0 += distChunkWords {
+			w1 := w0 + distChunkWords
+			if w1 > numWords {
+				w1 = numWords
+			}
+			var ex []uint64
+			if exclude != nil {
+				ex = exclude.words[w0:w1]
+			}
+			fn(w0, w1, ex)
+		}
+	}
+
+	switch mm := m.(type) {
+	case overlapMetric:
+		overlaps := make([]VectorOverlap, distTileCrawls*distTileCrawls)
+		chunks(func(w0 int, w1 int, ex []uint64) {
+			forPairs(func(r int, c int, k int) {
+				overlaps[k].addWords(rows[r].words[w0:w1], cols[c].words[w0:w1], ex)
+			})
+		})
+		forPairs(func(r int, c int, k int) {
+			overlaps[k].Compared = compared
+			values[r*len(cols)+c] = float32(mm.score(overlaps[k]))
+		})
+
+	case WeightedJaccard:
+		if len(mm.Weights) != rows[0].Len() {
+			return errors.New("number of weights does not match bv length")
+		}
+		both := make([]float64, distTileCrawls*distTileCrawls)
+		either := make([]float64, distTileCrawls*distTileCrawls)
+		chunks(func(w0 int, w1 int, ex []uint64) {
+			forPairs(func(r int, c int, k int) {
+				mm.addWords(&both[k], &either[k], rows[r].words[w0:w1], cols[c].words[w0:w1], ex, w0)
+			})
+		})
+		forPairs(func(r int, c int, k int) {
+			v := 1.0
+			if either[k] != 0 {
+				v = both[k] / either[k]
+			}
+			values[r*len(cols)+c] = float32(v)
+		})
+
+	default:
+		var err error
+		forPairs(func(r int, c int, k int) {
+			v, cerr := m.Compare(rows[r], cols[c], exclude)
+			if cerr != nil {
+				err = cerr
+			}
+			values[r*len(cols)+c] = float32(v)
+		})
+		return err
+	}
+
+	return nil
+}
+
+// writeDistanceBands writes the values of a pair of bands starting at crawls rowStart and colStart
+func writeDistanceBands(f *os.File, valuesOffset int64, n int, rowStart int, colStart int, numCols int,
+	values []float32, same bool) error {
+	numRows := len(values) / numCols
+	buf := make([]byte, 4*numCols)
+	for r := 0; r < numRows; r++ {
+		i := rowStart + r
+		c0 := 0
+		if same {
+			c0 = r + 1
+		}
+		if c0 >= numCols {
+			continue
+		}
+
+		row := buf[:4*(numCols-c0)]
+		for c := c0; c < numCols; c++ {
+			binary.LittleEndian.PutUint32(row[4*(c-c0):], math.Float32bits(values[r*numCols+c]))
+		}
+		_, err := f.WriteAt(row, valuesOffset+4*distPairIndex(n, i, colStart+c0))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenDistanceMatrix opens a complete distance matrix file, reading its crawls
+func OpenDistanceMatrix(fName string) (*DistanceMatrix, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := readDistanceMatrix(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+	return d, nil
+}
+
+func readDistanceMatrix(f *os.File) (*DistanceMatrix, error) {
+	errCorrupt := errors.New("corrupt distance matrix")
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < distHeaderSize+distTrailerSize {
+		return nil, errCorrupt
+	}
+
+	header := make([]byte, distHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != distMagic {
+		return nil, errors.New("not a distance matrix")
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != distVersion {
+		return nil, errors.New("unsupported distance matrix version")
+	}
+
+	numCrawls := binary.LittleEndian.Uint64(header[28:])
+	valuesOffset := int64(binary.LittleEndian.Uint64(header[36:]))
+	if numCrawls > 1<<32 || valuesOffset < distHeaderSize || valuesOffset > size {
+		return nil, errCorrupt
+	}
+	n := int(numCrawls)
+	valuesEnd := valuesOffset + 4*distPairIndex(n, n-1, n)
+	if size != valuesEnd+distTrailerSize {
+		return nil, errors.New("incomplete distance matrix, resume building it first")
+	}
+
+	prefix := make([]byte, valuesOffset)
+	trailer := make([]byte, distTrailerSize)
+	if _, err = f.ReadAt(prefix, 0); err != nil {
+		return nil, err
+	}
+	if _, err = f.ReadAt(trailer, valuesEnd); err != nil {
+		return nil, err
+	}
+	if string(trailer[4:]) != distMagic {
+		return nil, errors.New("incomplete distance matrix, resume building it first")
+	}
+	if crc32.Checksum(prefix, crcTable) != binary.LittleEndian.Uint32(trailer) {
+		return nil, errCorrupt
+	}
+
+	d := &DistanceMatrix{
+		Distance:     binary.LittleEndian.Uint16(header[6:])&1 != 0,
+		Granularity:  BVGranularity(binary.LittleEndian.Uint16(header[8:])),
+		Crawls:       make([]DistanceCrawl, 0, n),
+		f:            f,
+		valuesOffset: valuesOffset,
+		crawlIndex:   make(map[packKey]int),
+	}
+	copy(d.Layout[:], header[12:])
+
+	var ok bool
+	pos := distHeaderSize
+	d.Metric, pos, ok = readBVString(prefix, pos)
+	for i := 0; ok && i < n; i++ {
+		var c DistanceCrawl
+		c.Site, pos, ok = readBVString(prefix, pos)
+		if ok {
+			c.Crawl, pos, ok = readBVString(prefix, pos)
+		}
+		d.crawlIndex[packKey{c.Site, c.Crawl, ""}] = len(d.Crawls)
+		d.Crawls = append(d.Crawls, c)
+	}
+	if !ok || pos != len(prefix) {
+		return nil, errCorrupt
+	}
+
+	return d, nil
+}
+
+// Close closes the matrix file
+func (d *DistanceMatrix) Close() error {
+	return d.f.Close()
+}
+
+// NumCrawls returns the number of rows and columns of the matrix
+func (d *DistanceMatrix) NumCrawls() int {
+	return len(d.Crawls)
+}
+
+// CrawlIndex returns the row and column of a crawl
+func (d *DistanceMatrix) CrawlIndex(site string, crawl string) (int, bool) {
+	i, ok := d.crawlIndex[packKey{site, crawl, ""}]
+	return i, ok
+}
+
+// identity returns the value of a crawl compared with itself
+func (d *DistanceMatrix) identity() float64 {
+	if d.Distance {
+		return 0
+	}
+	return 1
+}
+
+// Value returns the value for crawls i and j, in either order
+func (d *DistanceMatrix) Value(i int, j int) (float64, error) {
+	n := len(d.Crawls)
+	if i < 0 || j < 0 || i >= n || j >= n {
+		return 0, errors.New("crawl out of range")
+	}
+	if i == j {
+		return d.identity(), nil
+	}
+	if i > j {
+		i, j = j, i
+	}
+
+	var b [4]byte
+	_, err := d.f.ReadAt(b[:], d.valuesOffset+4*distPairIndex(n, i, j))
+	if err != nil {
+		return 0, err
+	}
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))), nil
+}
+
+// Row returns the values for crawl i and every crawl
+func (d *DistanceMatrix) Row(i int) ([]float64, error) {
+	n := len(d.Crawls)
+	if i < 0 || i >= n {
+		return nil, errors.New("crawl out of range")
+	}
+
+	row := make([]float64, n)
+	for j := 0; j < i; j++ {
+		v, err := d.Value(j, i)
+		if err != nil {
+			return nil, err
+		}
+		row[j] = v
+	}
+	row[i] = d.identity()
+
+	// The values after the diagonal are contiguous
+	if i < n-1 {
+		buf := make([]byte, 4*(n-i-1))
+		_, err := d.f.ReadAt(buf, d.valuesOffset+4*distPairIndex(n, i, i+1))
+		if err != nil {
+			return nil, err
+		}
+		for j := i + 1; j < n; j++ {
+			row[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*(j-i-1):])))
+		}
+	}
+
+	return row, nil
+}
+
+// ForEachPair calls fn with every pair i < j and its value, reading the matrix in order
+func (d *DistanceMatrix) ForEachPair(fn func(i int, j int, v float64)) error {
+	n := len(d.Crawls)
+	r := bufio.NewReaderSize(io.NewSectionReader(d.f, d.valuesOffset, 4*distPairIndex(n, n-1, n)), 1<<20)
+
+	var b [4]byte
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			_, err := io.ReadFull(r, b[:])
+			if err != nil {
+				return err
+			}
+			fn(i, j, float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// xorMetric is a metric the distance matrix knows nothing about, which ignores exclude vectors
+type xorMetric struct{}
+
+func (xorMetric) Name() string    { return "custom" }
+func (xorMetric) Distance() bool  { return true }
+func (xorMetric) Symmetric() bool { return true }
+func (xorMetric) Compare(a, b, exclude *BitVector) (float64, error) {
+	d, err := a.CountXor(b)
+	return float64(d), err
+}
+
+func readTestBitVectors(t *testing.T, paths []string) []*BitVector {
+	t.Helper()
+	vectors := make([]*BitVector, len(paths))
+	for i, covPath := range paths {
+		bv, _, err := ReadBitVectorFile(covPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors[i] = bv
+	}
+	return vectors
+}
+
+// checkDistanceMatrix compares every value of the matrix at fName with m applied to vectors
+func checkDistanceMatrix(t *testing.T, fName string, paths []string, vectors []*BitVector, m Metric,
+	exclude *BitVector) {
+	t.Helper()
+	d, err := OpenDistanceMatrix(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.Metric != m.Name() || d.Distance != m.Distance() || d.NumCrawls() != len(vectors) {
+		t.Fatalf("matrix of %s over %d crawls, want %s over %d", d.Metric, d.NumCrawls(), m.Name(), len(vectors))
+	}
+	for i, covPath := range paths {
+		site, crawl := CrawlForCovPath(covPath)
+		if c, ok := d.CrawlIndex(site, crawl); !ok || c != i {
+			t.Fatalf("%s/%s is crawl %d, want %d", site, crawl, c, i)
+		}
+	}
+
+	check := func(i int, j int, v float64) {
+		want, err := m.Compare(vectors[i], vectors[j], exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(v-float64(float32(want))) > 1e-6 {
+			t.Fatalf("value of (%d, %d) = %v, want %v", i, j, v, want)
+		}
+	}
+	pairs := 0
+	err = d.ForEachPair(func(i int, j int, v float64) {
+		check(i, j, v)
+		pairs++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs != len(vectors)*(len(vectors)-1)/2 {
+		t.Errorf("%d pairs, want %d", pairs, len(vectors)*(len(vectors)-1)/2)
+	}
+	row, err := d.Row(len(vectors) / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, v := range row {
+		if j != len(vectors)/2 {
+			check(len(vectors)/2, j, v)
+		}
+	}
+	v, err := d.Value(len(vectors)-1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(0, len(vectors)-1, v)
+}
+
+func TestDistanceMatrix(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	const numBits = 5000
+	paths, _ := writeTestVectors(t, t.TempDir(), r, 37, numBits)
+	vectors := readTestBitVectors(t, paths)
+	exclude := BitVectorFromBools(randomBools(r, numBits))
+	weights := make([]float64, numBits)
+	for i := range weights {
+		weights[i] = r.Float64()
+	}
+
+	metrics := []Metric{xorMetric{}}
+	for _, name := range []string{"hamming", "normalized-hamming", "jaccard", "weighted-jaccard"} {
+		m, err := ParseMetric(name, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, m)
+	}
+	for _, m := range metrics {
+		for _, budget := range []int64{1, 20000, 1 << 30} {
+			for _, e := range []*BitVector{nil, exclude} {
+				t.Run(fmt.Sprintf("%s/%d/%v", m.Name(), budget, e != nil), func(t *testing.T) {
+					out := filepath.Join(t.TempDir(), "distance.matrix")
+					skipped, err := BuildDistanceMatrix(out, paths, m, e, budget, 3)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(skipped) != 0 {
+						t.Errorf("skipped %v", skipped)
+					}
+					if _, err = os.Stat(out + ".progress"); !os.IsNotExist(err) {
+						t.Error("progress file left behind")
+					}
+					if _, ok := m.(xorMetric); ok {
+						e = nil
+					}
+					checkDistanceMatrix(t, out, paths, vectors, m, e)
+				})
+			}
+		}
+	}
+
+	containment, err := ParseMetric("containment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = BuildDistanceMatrix(filepath.Join(t.TempDir(), "distance.matrix"), paths, containment, nil, 1<<30, 1)
+	if err == nil {
+		t.Error("expected an error for an asymmetric metric")
+	}
+}
+
+// interruptDistanceMatrix turns a complete matrix into one interrupted after the first done pairs
+// of bands
+func interruptDistanceMatrix(t *testing.T, out string, complete []byte, m Metric, done int) {
+	t.Helper()
+	n := int(binary.LittleEndian.Uint64(complete[28:]))
+	band := int(binary.LittleEndian.Uint32(complete[44:]))
+	valuesOffset := int(binary.LittleEndian.Uint64(complete[36:]))
+	numBands := (n + band - 1) / band
+
+	partial := append([]byte{}, complete[:len(complete)-distTrailerSize]...)
+	for i := valuesOffset; i < len(partial); i++ {
+		partial[i] = 0
+	}
+	progress := distanceRunID(m, nil) + "\n"
+	for bi := 0; bi < numBands && done > 0; bi++ {
+		for bj := bi; bj < numBands && done > 0; bj++ {
+			progress += fmt.Sprintf("%d %d\n", bi, bj)
+			done--
+			for i := bi * band; i < (bi+1)*band && i < n; i++ {
+				for j := bj * band; j < (bj+1)*band && j < n; j++ {
+					if j > i {
+						o := valuesOffset + 4*int(distPairIndex(n, i, j))
+						copy(partial[o:o+4], complete[o:o+4])
+					}
+				}
+			}
+		}
+	}
+	// The last line was cut short
+	progress += "1"
+
+	if err := ioutil.WriteFile(out, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(out+".progress", []byte(progress), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDistanceMatrixResume(t *testing.T) {
+	r := rand.New(rand.NewSource(12))
+	paths, _ := writeTestVectors(t, t.TempDir(), r, 37, 5000)
+	m, err := ParseMetric("jaccard", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "distance.matrix")
+	if _, err = BuildDistanceMatrix(out, paths, m, nil, 20000, 2); err != nil {
+		t.Fatal(err)
+	}
+	complete, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		exclude *BitVector
+		ok      bool
+	}{
+		{"same vectors", paths, nil, true},
+		{"other exclude vector", paths, BitVectorFromBools(randomBools(r, 5000)), false},
+		{"other vectors", paths[1:], nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interruptDistanceMatrix(t, out, complete, m, 3)
+			if _, err := OpenDistanceMatrix(out); err == nil {
+				t.Fatal("opened a partial matrix")
+			}
+
+			// The band size of the partial matrix is kept whatever the budget
+			_, err := BuildDistanceMatrix(out, tt.paths, m, tt.exclude, 1<<30, 2)
+			if !tt.ok {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumed, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resumed, complete) {
+				t.Error("resumed matrix differs from one built in one go")
+			}
+		})
+	}
+}
+
+func TestDistanceMatrixSkipsBadVectors(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	paths, _ := writeTestVectors(t, t.TempDir(), r, 30, 2000)
+	vectors := readTestBitVectors(t, paths)
+
+	layout := BVHeader{Layout: LayoutFingerprint{1}}
+	otherLayout := BVHeader{Layout: LayoutFingerprint{2}}
+	bad := map[int]func(string) error{
+		0:  os.Remove,
+		7:  func(p string) error { return ioutil.WriteFile(p, []byte("garbage"), 0644) },
+		12: func(p string) error { return WriteBVFile(p, randomBools(r, 1999), layout) },
+		20: func(p string) error { return WriteBVFile(p, randomBools(r, 2000), otherLayout) },
+	}
+	var goodPaths, wantSkipped []string
+	var goodVectors []*BitVector
+	for i, covPath := range paths {
+		if breakVector, ok := bad[i]; ok {
+			if err := breakVector(covPath); err != nil {
+				t.Fatal(err)
+			}
+			wantSkipped = append(wantSkipped, covPath)
+			continue
+		}
+		goodPaths = append(goodPaths, covPath)
+		goodVectors = append(goodVectors, vectors[i])
+	}
+
+	m, err := ParseMetric("hamming", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "distance.matrix")
+	skipped, err := BuildDistanceMatrix(out, paths, m, nil, 20000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped %v, want %v", skipped, wantSkipped)
+	}
+	checkDistanceMatrix(t, out, goodPaths, goodVectors, m, nil)
+
+	// A resumed build skips the same vectors, so the crawls of the partial matrix still match
+	complete, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interruptDistanceMatrix(t, out, complete, m, 2)
+	if _, err = BuildDistanceMatrix(out, paths, m, nil, 20000, 3); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed, complete) {
+		t.Error("resumed matrix differs from one built in one go")
+	}
+
+	few := []string{paths[0], paths[7], paths[1]}
+	_, err = BuildDistanceMatrix(filepath.Join(t.TempDir(), "distance.matrix"), few, m, nil, 1<<30, 1)
+	if err == nil {
+		t.Error("expected an error when fewer than two vectors can be read")
+	}
+}
@@ -0,0 +1,313 @@
+package profparse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Indices into the region arrays of llvm-cov export output
+const (
+	exportLineStart = iota
+	exportColumnStart
+	exportLineEnd
+	exportColumnEnd
+	exportExecutionCount
+	exportFileID
+	exportExpandedFileID
+	exportKind
+	exportRegionLength
+)
+
+// Indices into the branch arrays of llvm-cov export output
+const (
+	exportBranchLineStart = iota
+	exportBranchColumnStart
+	exportBranchLineEnd
+	exportBranchColumnEnd
+	exportBranchExecutionCount
+	exportBranchFalseExecutionCount
+	exportBranchFileID
+	exportBranchExpandedFileID
+	exportBranchKind
+	exportBranchLength
+)
+
+type exportFile struct {
+	Filename string `json:"filename"`
+}
+
+type exportFunction struct {
+	Name      string     `json:"name"`
+	Regions   [][]uint64 `json:"regions"`
+	Branches  [][]uint64 `json:"branches"`
+	Filenames []string   `json:"filenames"`
+}
+
+// ExportReader reads the JSON produced by a stock `llvm-cov export -format=text`, producing
+// the same records as Parser does for our custom llvm-cov report. As in llvm-cov, functions are
+// attributed to the first file in their filenames list, and files are emitted in the order they
+// are first seen. Each region's own file, which differs for regions expanded from another file,
+// is kept in its FileName.
+type ExportReader struct {
+	dec *json.Decoder
+
+	fileOrder []string
+	functions map[string][]exportFunction
+}
+
+func NewExportReader(r io.Reader) *ExportReader {
+	return &ExportReader{
+		dec:       json.NewDecoder(r),
+		functions: make(map[string][]exportFunction),
+	}
+}
+
+// ReadExportToCovMap is ReadFileToCovMap for llvm-cov export JSON
+func ReadExportToCovMap(fName string) (map[string]map[string][]bool, CovMapProperties, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return CovMapFromRecords(NewExportReader(f))
+}
+
+// ReadExportToCountMap is ReadFileToCountMap for llvm-cov export JSON
+func ReadExportToCountMap(fName string) (map[string]map[string][]uint64, CovMapProperties, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return CountMapFromRecords(NewExportReader(f))
+}
+
+// ReadExportCovMetadata is ReadCovMetadata for llvm-cov export JSON
+func ReadExportCovMetadata(fName string) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return CovMetadataFromRecords(NormalizePaths(NewExportReader(f), DefaultPathNormalizer()))
+}
+
+// Walk decodes the whole export, then calls fn for each file, function and region in it
+func (e *ExportReader) Walk(fn func(Record) error) error {
+	err := e.decode()
+	if err != nil {
+		return fmt.Errorf("invalid llvm-cov export: %v", err)
+	}
+
+	for _, fileName := range e.fileOrder {
+		err = fn(Record{Kind: FileRecord, File: fileName})
+		if err != nil {
+			return err
+		}
+
+		for _, function := range e.functions[fileName] {
+			err = fn(Record{Kind: FunctionRecord, File: fileName, Function: function.Name})
+			if err != nil {
+				return err
+			}
+
+			for _, region := range function.Regions {
+				rec := Record{
+					Kind:       RegionRecord,
+					File:       fileName,
+					Function:   function.Name,
+					Executions: region[exportExecutionCount],
+				}
+				rec.Region.FileName = function.Filenames[region[exportFileID]]
+				rec.Region.FuncName = function.Name
+				rec.Region.LineStart = int(region[exportLineStart])
+				rec.Region.ColumnStart = int(region[exportColumnStart])
+				rec.Region.LineEnd = int(region[exportLineEnd])
+				rec.Region.ColumnEnd = int(region[exportColumnEnd])
+				rec.Region.FileID = int(region[exportFileID])
+				rec.Region.ExpandedFileID = int(region[exportExpandedFileID])
+				rec.Region.Kind = RegionKind(region[exportKind])
+
+				err = fn(rec)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, branch := range function.Branches {
+				rec := Record{
+					Kind:            BranchRecord,
+					File:            fileName,
+					Function:        function.Name,
+					Executions:      branch[exportBranchExecutionCount],
+					FalseExecutions: branch[exportBranchFalseExecutionCount],
+				}
+				rec.Region.FileName = function.Filenames[branch[exportBranchFileID]]
+				rec.Region.FuncName = function.Name
+				rec.Region.LineStart = int(branch[exportBranchLineStart])
+				rec.Region.ColumnStart = int(branch[exportBranchColumnStart])
+				rec.Region.LineEnd = int(branch[exportBranchLineEnd])
+				rec.Region.ColumnEnd = int(branch[exportBranchColumnEnd])
+				rec.Region.FileID = int(branch[exportBranchFileID])
+				rec.Region.ExpandedFileID = int(branch[exportBranchExpandedFileID])
+				rec.Region.Kind = RegionKind(branch[exportBranchKind])
+
+				err = fn(rec)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *ExportReader) decode() error {
+	err := expectDelim(e.dec, '{')
+	if err != nil {
+		return err
+	}
+
+	for e.dec.More() {
+		key, err := e.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if key != "data" {
+			err = skipValue(e.dec)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = expectDelim(e.dec, '[')
+		if err != nil {
+			return err
+		}
+		for e.dec.More() {
+			err = e.decodeExport()
+			if err != nil {
+				return err
+			}
+		}
+		err = expectDelim(e.dec, ']')
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(e.dec, '}')
+}
+
+// decodeExport decodes a single element of the top level data array
+func (e *ExportReader) decodeExport() error {
+	err := expectDelim(e.dec, '{')
+	if err != nil {
+		return err
+	}
+
+	for e.dec.More() {
+		key, err := e.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "files":
+			err = decodeArray(e.dec, func() error {
+				var file exportFile
+				err := e.dec.Decode(&file)
+				if err != nil {
+					return err
+				}
+				e.addFile(file.Filename)
+				return nil
+			})
+		case "functions":
+			err = decodeArray(e.dec, func() error {
+				var function exportFunction
+				err := e.dec.Decode(&function)
+				if err != nil {
+					return err
+				}
+				if len(function.Filenames) == 0 {
+					return errors.New("function " + function.Name + " has no filenames")
+				}
+				numFiles := uint64(len(function.Filenames))
+				for _, region := range function.Regions {
+					if len(region) < exportRegionLength {
+						return errors.New("function " + function.Name + " has a short region array")
+					}
+					if region[exportFileID] >= numFiles || region[exportExpandedFileID] >= numFiles {
+						return errors.New("function " + function.Name + " has a region in an unknown file")
+					}
+				}
+				for _, branch := range function.Branches {
+					if len(branch) < exportBranchLength {
+						return errors.New("function " + function.Name + " has a short branch array")
+					}
+					if branch[exportBranchFileID] >= numFiles || branch[exportBranchExpandedFileID] >= numFiles {
+						return errors.New("function " + function.Name + " has a branch in an unknown file")
+					}
+				}
+				fileName := function.Filenames[0]
+				e.addFile(fileName)
+				e.functions[fileName] = append(e.functions[fileName], function)
+				return nil
+			})
+		default:
+			err = skipValue(e.dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(e.dec, '}')
+}
+
+func (e *ExportReader) addFile(fileName string) {
+	if _, ok := e.functions[fileName]; !ok {
+		e.functions[fileName] = nil
+		e.fileOrder = append(e.fileOrder, fileName)
+	}
+}
+
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	err := expectDelim(dec, '[')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		err = fn()
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
@@ -0,0 +1,130 @@
+package profparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportTestJSON is the export of the functions in exportTestReport. f expands a macro from x.h.
+const exportTestJSON = `{"data":[{"files":[{"filename":"b.cc","segments":[[1,2,3,true,true,false]],"summary":{}},
+{"filename":"a.cc"}],"functions":[
+{"name":"g","count":1,"regions":[[1,2,3,4,7,0,0,0]],"branches":[[1,2,1,9,7,0,0,0,4]],"filenames":["b.cc"]},
+{"name":"f","count":1,"regions":[[1,2,3,4,5,0,0,0],[2,3,2,9,5,0,1,1],[5,6,7,8,0,1,0,0]],
+"filenames":["a.cc","x.h"]}],"totals":{}}],"type":"llvm.coverage.json.export","version":"2.0.1"}`
+
+const exportTestReport = "[FILE] a.cc\n[FUNCTION] f\n" +
+	"[BLOCK] 0 0 1,2,3,4 5\n[BLOCK] 0,1 1 2,3,2,9 5\n[BLOCK] 1 0 5,6,7,8 0\n" +
+	"[FILE] b.cc\n[FUNCTION] g\n[BLOCK] 0 0 1,2,3,4 7\n[BRANCH] 0 1,2,1,9 7 0\n"
+
+func TestExportMatchesReport(t *testing.T) {
+	covMap, props, err := CovMapFromRecords(NewExportReader(strings.NewReader(exportTestJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCovMap, wantProps, err := ParseCovMap(strings.NewReader(exportTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(covMap, wantCovMap) || props != wantProps {
+		t.Errorf("cov map %v (%v), want %v (%v)", covMap, props, wantCovMap, wantProps)
+	}
+
+	counts, _, err := CountMapFromRecords(NewExportReader(strings.NewReader(exportTestJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts, _, err := ParseCountMap(strings.NewReader(exportTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("count map %v, want %v", counts, wantCounts)
+	}
+
+	metadata, _, err := CovMetadataFromRecords(NormalizePaths(NewExportReader(strings.NewReader(exportTestJSON)),
+		DefaultPathNormalizer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMetadata, _, err := ParseCovMetadata(strings.NewReader(exportTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reports do not name the files regions are expanded from
+	wantMetadata["a.cc"]["f"][2].FileName = "x.h"
+	wantMetadata["a.cc"]["f"][2].NormalizedFileName = "out/Default/x.h"
+	if !reflect.DeepEqual(metadata, wantMetadata) {
+		t.Errorf("metadata %v, want %v", metadata, wantMetadata)
+	}
+	if NewCoverageLayout(metadata).Fingerprint() != NewCoverageLayout(wantMetadata).Fingerprint() {
+		t.Error("layouts from the export and the report differ")
+	}
+}
+
+func TestExportRegionFiles(t *testing.T) {
+	type regionFile struct {
+		File           string
+		FileName       string
+		FileID         int
+		ExpandedFileID int
+	}
+	var got []regionFile
+	err := NewExportReader(strings.NewReader(exportTestJSON)).Walk(func(rec Record) error {
+		if rec.Kind == RegionRecord || rec.Kind == BranchRecord {
+			got = append(got, regionFile{rec.File, rec.Region.FileName, rec.Region.FileID, rec.Region.ExpandedFileID})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Regions stay with their function's file, but know which file they are in
+	want := []regionFile{
+		{"b.cc", "b.cc", 0, 0},
+		{"b.cc", "b.cc", 0, 0},
+		{"a.cc", "a.cc", 0, 0},
+		{"a.cc", "a.cc", 0, 1},
+		{"a.cc", "x.h", 1, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("regions %v, want %v", got, want)
+	}
+
+	metadata, _, err := CovMetadataFromRecords(NewExportReader(strings.NewReader(exportTestJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, cr := range metadata["a.cc"]["f"] {
+		files = append(files, cr.FileName+" "+cr.NormalizedFileName)
+	}
+	if want := []string{"a.cc a.cc", "a.cc a.cc", "x.h x.h"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("metadata regions are in %v, want %v", files, want)
+	}
+}
+
+func TestExportInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"not json", `[FILE] a.cc`},
+		{"short region", `{"data":[{"functions":[{"name":"f","regions":[[1]],"filenames":["a"]}]}]}`},
+		{"short branch", `{"data":[{"functions":[{"name":"f","regions":[],"branches":[[1,2]],"filenames":["a"]}]}]}`},
+		{"no filenames", `{"data":[{"functions":[{"name":"f","regions":[]}]}]}`},
+		{"unknown file", `{"data":[{"functions":[{"name":"f","regions":[[1,2,3,4,5,1,0,0]],"filenames":["a"]}]}]}`},
+		{"unknown expanded file",
+			`{"data":[{"functions":[{"name":"f","regions":[[1,2,3,4,5,0,2,1]],"filenames":["a","b"]}]}]}`},
+		{"truncated", exportTestJSON[:len(exportTestJSON)/2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := CovMapFromRecords(NewExportReader(strings.NewReader(tt.json)))
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
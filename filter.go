@@ -0,0 +1,127 @@
+package profparse
+
+import (
+	"errors"
+)
+
+// RegionFilter decides whether a region should be included in an analysis
+type RegionFilter func(cr CodeRegion) bool
+
+// IncludeKinds keeps only regions of the given kinds
+func IncludeKinds(kinds ...RegionKind) RegionFilter {
+	return func(cr CodeRegion) bool {
+		for _, k := range kinds {
+			if cr.Kind == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ExcludeKinds keeps every region except those of the given kinds
+func ExcludeKinds(kinds ...RegionKind) RegionFilter {
+	include := IncludeKinds(kinds...)
+	return func(cr CodeRegion) bool {
+		return !include(cr)
+	}
+}
+
+// CountedRegions keeps the regions that llvm-cov counts towards its region totals. Gap and
+// skipped regions never have a meaningful execution count, so they are left out.
+func CountedRegions(cr CodeRegion) bool {
+	return cr.Kind != RegionGap && cr.Kind != RegionSkipped
+}
+
+// FilterCovMap returns a copy of covMap holding only the regions accepted by filter. Functions
+// left with no regions are dropped. The metadata must come from the same coverage report.
+func FilterCovMap(covMap map[string]map[string][]bool, metadata map[string]map[string][]CodeRegion,
+	filter RegionFilter) (map[string]map[string][]bool, error) {
+	filtered := make(map[string]map[string][]bool)
+	for fileName := range covMap {
+		for funcName, regions := range covMap[fileName] {
+			crs := metadata[fileName][funcName]
+			if len(crs) != len(regions) {
+				return nil, errors.New("metadata does not match coverage map for " + funcName)
+			}
+
+			var kept []bool
+			for i, covered := range regions {
+				if filter(crs[i]) {
+					kept = append(kept, covered)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+
+			if _, ok := filtered[fileName]; !ok {
+				filtered[fileName] = make(map[string][]bool)
+			}
+			filtered[fileName][funcName] = kept
+		}
+	}
+
+	return filtered, nil
+}
+
+// GenerateExcludeBV builds an exclude vector, in the same order as ConvertCovMapToBools, which
+// is set for every region rejected by filter. It can be passed to DiffBVsWithExclude and
+// CountCoveredRegionsWithExclude.
+func GenerateExcludeBV(metadata map[string]map[string][]CodeRegion, filter RegionFilter) []bool {
+	excludeMap := make(map[string]map[string][]bool)
+	for fileName := range metadata {
+		excludeMap[fileName] = make(map[string][]bool)
+		for funcName, crs := range metadata[fileName] {
+			exclude := make([]bool, len(crs))
+			for i, cr := range crs {
+				exclude[i] = !filter(cr)
+			}
+			excludeMap[fileName][funcName] = exclude
+		}
+	}
+
+	return ConvertCovMapToBools(excludeMap)
+}
+
+// ExcludeBV builds an exclude vector for the layout, which is set for every region rejected by
+// filter. Adding ExcludeBV(CountedRegions) to an exclude vector leaves gap and skipped regions out of
+// the totals, as llvm-cov does.
+func (l *CoverageLayout) ExcludeBV(filter RegionFilter) []bool {
+	exclude := make([]bool, len(l.regions))
+	for i, cr := range l.regions {
+		exclude[i] = !filter(cr)
+	}
+	return exclude
+}
+
+// CountCoveredRegionsWithExclude is CountCoveredRegions, ignoring regions set in excludeBV
+func CountCoveredRegionsWithExclude(bv []bool, excludeBV []bool) (int, int, error) {
+	if len(bv) != len(excludeBV) {
+		return 0, 0, errors.New("bv length does not match exclude vector length")
+	}
+
+	covered := 0
+	total := 0
+	for i, val := range bv {
+		if excludeBV[i] {
+			continue
+		}
+		total += 1
+		if val {
+			covered += 1
+		}
+	}
+	return covered, total, nil
+}
+
+// GetTreeSummaryWithFilter is GetTreeSummaryWithNormalizer, counting only the regions accepted by
+// filter. Use CountedRegions to match llvm-cov's own totals.
+func GetTreeSummaryWithFilter(covMap map[string]map[string][]bool, metadata map[string]map[string][]CodeRegion,
+	level int, filter RegionFilter, n *PathNormalizer) (map[string]CovSummary, error) {
+	filtered, err := FilterCovMap(covMap, metadata, filter)
+	if err != nil {
+		return nil, err
+	}
+	return GetTreeSummaryWithNormalizer(filtered, level, n), nil
+}
@@ -0,0 +1,97 @@
+package profparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const filterTestReport = "[FILE] a.cc\n[FUNCTION] f\n" +
+	"[BLOCK] 0 code 1,2,3,4 5\n[BLOCK] 0,1 1 1,2,3,4 0\n[BLOCK] 0 3 1,2,3,4 0\n" +
+	"[FILE] b.cc\n[FUNCTION] g\n[BLOCK] 2 skipped 1,2,3,4 0\n"
+
+func TestParseRegionKinds(t *testing.T) {
+	md, _, err := ParseCovMetadata(strings.NewReader(filterTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := md["a.cc"]["f"]
+	tests := []struct {
+		name   string
+		region CodeRegion
+		kind   RegionKind
+		fileID int
+	}{
+		{"code by name", f[0], RegionCode, 0},
+		{"expansion by number", f[1], RegionExpansion, 0},
+		{"gap by number", f[2], RegionGap, 0},
+		{"skipped by name", md["b.cc"]["g"][0], RegionSkipped, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.region.Kind != tt.kind || tt.region.FileID != tt.fileID {
+				t.Errorf("kind %v in file %d, want %v in file %d", tt.region.Kind, tt.region.FileID, tt.kind, tt.fileID)
+			}
+			// Text reports carry no counter
+			if tt.region.Counter != (Counter{}) {
+				t.Errorf("counter = %v, want the zero counter", tt.region.Counter)
+			}
+		})
+	}
+	if f[1].ExpandedFileID != 1 {
+		t.Errorf("expanded file = %d, want 1", f[1].ExpandedFileID)
+	}
+
+	_, _, err = ParseCovMetadata(strings.NewReader("[FILE] a\n[FUNCTION] f\n[BLOCK] 0 bogus 1,2,3,4 5\n"))
+	if err == nil {
+		t.Error("expected an error for an unknown region kind")
+	}
+}
+
+func TestCountedRegions(t *testing.T) {
+	md, _, err := ParseCovMetadata(strings.NewReader(filterTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	covMap, _, err := ParseCovMap(strings.NewReader(filterTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := mustParseLayout(t, filterTestReport)
+	bv := ConvertCovMapToBools(covMap)
+
+	// Only the code and expansion regions count
+	wantExclude := []bool{false, false, true, true}
+	tests := []struct {
+		name    string
+		exclude []bool
+	}{
+		{"metadata", GenerateExcludeBV(md, CountedRegions)},
+		{"layout", layout.ExcludeBV(CountedRegions)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.exclude, wantExclude) {
+				t.Errorf("exclude = %v, want %v", tt.exclude, wantExclude)
+			}
+			covered, total, err := CountCoveredRegionsWithExclude(bv, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if covered != 1 || total != 2 {
+				t.Errorf("covered %d out of %d, want 1 out of 2", covered, total)
+			}
+		})
+	}
+
+	if _, total := CountCoveredRegions(bv); total != 4 {
+		t.Errorf("CountCoveredRegions total = %d, want every region", total)
+	}
+	tree, err := GetTreeSummaryWithFilter(covMap, md, -1, CountedRegions, DefaultPathNormalizer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree["out/Default/a.cc"].TotalRegions != 2 {
+		t.Errorf("a.cc has %d regions, want 2", tree["out/Default/a.cc"].TotalRegions)
+	}
+}
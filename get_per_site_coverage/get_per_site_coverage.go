@@ -18,15 +18,11 @@ type Result struct {
 	FileCoverageMap map[string]int
 }
 
-type BVRange struct {
-	Start int //inclusive
-	End   int // exclusive
-}
-
+var Layout *pp.CoverageLayout
 var MetaMap map[string]map[string][]pp.CodeRegion
 var Structure map[string]map[string]int
 var BVIndexToCodeRegionMap map[int]pp.CodeRegion
-var FilenameToBVIndices map[string]BVRange
+var FilenameToBVIndices map[string]pp.BVRange
 var CompleteCounter int
 
 func main() {
@@ -48,21 +44,18 @@ func main() {
 	log.SetReportCaller(true)
 	log.Infof("Begin creating metadata structures by reading %s...", covFile)
 
-	MetaMap, err = pp.ReadCovMetadata(covFile)
+	Layout, err = pp.LoadCoverageLayout(covFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sampleCovMap, err := pp.ReadFileToCovMap(covFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+	MetaMap = Layout.Metadata()
 
 	files := 0
 	functions := 0
 	regions := 0
 
-	Structure = pp.ConvertCovMapToStructure(sampleCovMap)
+	Structure = Layout.Structure()
 	for _, v1 := range Structure {
 		files += 1
 		for _, v2 := range v1 {
@@ -70,24 +63,9 @@ func main() {
 			regions += v2
 		}
 	}
-	BVIndexToCodeRegionMap = pp.GenerateBVIndexToCodeRegionMap(Structure, MetaMap)
-
-	// Build FilenameToBVIndices Map
-	FilenameToBVIndices = make(map[string]BVRange)
-	currentIndex := 0
-	start := 0
-	end := 0
-	for k, v := range Structure {
-		start = currentIndex
-		for _, numBlocks := range v {
-			currentIndex += numBlocks
-		}
-		end = currentIndex
-		FilenameToBVIndices[k] = BVRange{
-			Start: start,
-			End:   end,
-		}
-	}
+	BVIndexToCodeRegionMap = Layout.CodeRegionMap()
+
+	FilenameToBVIndices = Layout.FileRanges()
 
 	log.Infof("Finished parsing metadata")
 	log.Infof("  - Total Files: %d", files)
@@ -129,7 +107,7 @@ func main() {
 
 func worker(taskChan chan Task, writerChan chan []string, wg *sync.WaitGroup) {
 	for task := range taskChan {
-		_, err := pp.ReadBVFileToBV(task.Path)
+		_, err := pp.ReadBVFileWithLayout(task.Path, Layout)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	pp "github.com/teamnsrg/profparse"
-	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
@@ -14,17 +13,24 @@ import (
 )
 
 type Task struct {
-	Path1 string
-	Path2 string
+	Index int // Position in CovPaths of the crawl compared with those of the band
 }
 
 type Metadata struct {
 	NumResources int `json:"num_resources"`
 }
 
-var bvMap map[string][]bool
+// Crawls mapped at once. Mapping every crawl of a large scan would exceed vm.max_map_count, so the
+// crawls are compared a band at a time with every later crawl, which is opened once per band.
+const BandSize = 16384
+
+var CovPaths []string
 var nrMap map[string]int
 
+// Vectors of the band being compared, and the position of the first in CovPaths
+var Band []*pp.MappedBitVector
+var BandStart int
+
 func main() {
 
 	resultsPath := "/home/pmurley/go/src/github.com/teamnsrg/profparse/91-100-of-10k"
@@ -37,18 +43,11 @@ func main() {
 
 	sort.Strings(covPaths)
 
-	bvMap = make(map[string][]bool)
 	nrMap = make(map[string]int)
 
 	for i, covPath := range covPaths {
-		bv, err := pp.ReadBVFileToBV(covPath)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-
 		metaPath := strings.Replace(covPath, "coverage/coverage.bv", "metadata.json", 1)
-		data, err := ioutil.ReadFile(metaPath)
+		data, err := pp.ReadCrawlFile(metaPath)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -61,35 +60,56 @@ func main() {
 		}
 
 		nrMap[covPath] = meta.NumResources
-		bvMap[covPath] = bv
+		CovPaths = append(CovPaths, covPath)
 
 		log.Infof("loaded %d", i)
 	}
 
-	taskChan := make(chan Task, 10000)
 	writerChan := make(chan []string, 10000)
-	var wg sync.WaitGroup
 	var wwg sync.WaitGroup
 
 	wwg.Add(1)
 	go writer(writerChan, &wwg)
 
-	WORKERS := 5
-	for i := 0; i < WORKERS; i++ {
-		wg.Add(1)
-		go worker(taskChan, writerChan, &wg)
-	}
+	for BandStart = 0; BandStart < len(CovPaths); BandStart += BandSize {
+		bandEnd := BandStart + BandSize
+		if bandEnd > len(CovPaths) {
+			bandEnd = len(CovPaths)
+		}
+
+		Band = make([]*pp.MappedBitVector, bandEnd-BandStart)
+		for i := range Band {
+			Band[i], err = pp.OpenMappedBVFile(CovPaths[BandStart+i])
+			if err != nil {
+				log.Error(err)
+			}
+		}
+
+		taskChan := make(chan Task, 10000)
+		var wg sync.WaitGroup
+
+		WORKERS := 5
+		for i := 0; i < WORKERS; i++ {
+			wg.Add(1)
+			go worker(taskChan, writerChan, &wg)
+		}
 
-	for i, path1 := range covPaths {
-		for _, path2 := range covPaths[i:] {
+		for j := BandStart; j < len(CovPaths); j++ {
 			var t Task
-			t.Path1 = path1
-			t.Path2 = path2
+			t.Index = j
 			taskChan <- t
 		}
+		close(taskChan)
+		wg.Wait()
+
+		for _, bv := range Band {
+			if bv != nil {
+				bv.Close()
+			}
+		}
+		log.Infof("compared crawls %d to %d", BandStart, bandEnd)
 	}
-	close(taskChan)
-	wg.Wait()
+
 	close(writerChan)
 	wwg.Wait()
 }
@@ -97,22 +117,52 @@ func main() {
 func worker(taskChan chan Task, writerChan chan []string, wg *sync.WaitGroup) {
 
 	for task := range taskChan {
-		diff, err := pp.DiffTwoBVs(bvMap[task.Path1], bvMap[task.Path2])
-		if err != nil {
-			log.Error(err)
+		path2 := CovPaths[task.Index]
+
+		// Crawls past the band are only mapped while they are compared with it
+		var bv2 *pp.MappedBitVector
+		last := task.Index
+		if task.Index < BandStart+len(Band) {
+			bv2 = Band[task.Index-BandStart]
+		} else {
+			var err error
+			bv2, err = pp.OpenMappedBVFile(path2)
+			if err != nil {
+				log.Error(err)
+			}
+			last = BandStart + len(Band) - 1
+		}
+		if bv2 == nil {
+			continue
 		}
 
-		parts := strings.Split(task.Path1, "/")
-		url1 := parts[9]
-		uuid1 := parts[10]
-
-		parts = strings.Split(task.Path2, "/")
+		parts := strings.Split(path2, "/")
 		url2 := parts[9]
 		uuid2 := parts[10]
 
-		result := []string{url1, uuid1, strconv.Itoa(nrMap[task.Path1]), url2, uuid2, strconv.Itoa(nrMap[task.Path2]), strconv.Itoa(diff)}
-		writerChan <- result
+		for i := BandStart; i <= last; i++ {
+			bv1 := Band[i-BandStart]
+			if bv1 == nil {
+				continue
+			}
+			path1 := CovPaths[i]
+
+			diff, err := bv1.CountXor(bv2)
+			if err != nil {
+				log.Error(err)
+			}
+
+			parts = strings.Split(path1, "/")
+			url1 := parts[9]
+			uuid1 := parts[10]
 
+			result := []string{url1, uuid1, strconv.Itoa(nrMap[path1]), url2, uuid2, strconv.Itoa(nrMap[path2]), strconv.Itoa(diff)}
+			writerChan <- result
+		}
+
+		if task.Index >= BandStart+len(Band) {
+			bv2.Close()
+		}
 	}
 	wg.Done()
 }
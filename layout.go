@@ -0,0 +1,263 @@
+package profparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// BVRange is a range of indices into a bit vector
+type BVRange struct {
+	Start int // Inclusive
+	End   int // Exclusive
+}
+
+// Len returns the number of indices in the range
+func (r BVRange) Len() int {
+	return r.End - r.Start
+}
+
+// CoverageLayout describes where every file, function and region of a coverage report lives in the
+// vectors built from it. Files are sorted by name, and functions by name within each file, so the
+// indices always match those used by ConvertCovMapToBools.
+type CoverageLayout struct {
+	Properties CovMapProperties
+
+	files           []string
+	normalizedFiles map[string]string
+	functions       map[string][]string
+	regions         []CodeRegion
+	fileRanges      map[string]BVRange
+	funcRanges      map[string]map[string]BVRange
+	fileStarts      []int
+
+	fingerprintOnce sync.Once
+	fingerprint     LayoutFingerprint
+}
+
+// ReadCoverageLayout builds a layout from a coverage report, reading it only once
+func ReadCoverageLayout(fName string) (*CoverageLayout, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseCoverageLayout(f)
+}
+
+// ParseCoverageLayout is ReadCoverageLayout for an arbitrary io.Reader
+func ParseCoverageLayout(r io.Reader) (*CoverageLayout, error) {
+	return CoverageLayoutFromRecords(NormalizePaths(NewParser(r), DefaultPathNormalizer()))
+}
+
+// CoverageLayoutFromRecords builds a layout from the records produced by src
+func CoverageLayoutFromRecords(src RecordSource) (*CoverageLayout, error) {
+	metadata, props, err := CovMetadataFromRecords(src)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := NewCoverageLayout(metadata)
+	layout.Properties = props
+	return layout, nil
+}
+
+// NewCoverageLayout builds a layout from a metadata map, as returned by ReadCovMetadata
+func NewCoverageLayout(metadata map[string]map[string][]CodeRegion) *CoverageLayout {
+	l := &CoverageLayout{
+		files:           make([]string, 0, len(metadata)),
+		normalizedFiles: make(map[string]string),
+		functions:       make(map[string][]string),
+		regions:         make([]CodeRegion, 0),
+		fileRanges:      make(map[string]BVRange),
+		funcRanges:      make(map[string]map[string]BVRange),
+		fileStarts:      make([]int, 0, len(metadata)),
+	}
+
+	for fileName := range metadata {
+		l.files = append(l.files, fileName)
+	}
+	sort.Strings(l.files)
+
+	numFunctions := 0
+	for _, fileName := range l.files {
+		funcNames := make([]string, 0, len(metadata[fileName]))
+		for funcName := range metadata[fileName] {
+			funcNames = append(funcNames, funcName)
+		}
+		sort.Strings(funcNames)
+		l.functions[fileName] = funcNames
+		l.funcRanges[fileName] = make(map[string]BVRange)
+		l.normalizedFiles[fileName] = fileName
+
+		fileStart := len(l.regions)
+		for _, funcName := range funcNames {
+			funcStart := len(l.regions)
+			l.regions = append(l.regions, metadata[fileName][funcName]...)
+			for _, cr := range metadata[fileName][funcName] {
+				if (cr.FileName == "" || cr.FileName == fileName) && cr.NormalizedFileName != "" {
+					l.normalizedFiles[fileName] = cr.NormalizedFileName
+					break
+				}
+			}
+			l.funcRanges[fileName][funcName] = BVRange{Start: funcStart, End: len(l.regions)}
+		}
+		l.fileRanges[fileName] = BVRange{Start: fileStart, End: len(l.regions)}
+		l.fileStarts = append(l.fileStarts, fileStart)
+		numFunctions += len(funcNames)
+	}
+
+	l.Properties = CovMapProperties{
+		NumFiles:     len(l.files),
+		NumFunctions: numFunctions,
+		NumRegions:   len(l.regions),
+	}
+
+	return l
+}
+
+// Fingerprint identifies the layout, so that vectors built with different layouts are not mixed up
+func (l *CoverageLayout) Fingerprint() LayoutFingerprint {
+	l.fingerprintOnce.Do(func() {
+		if l.fingerprint == (LayoutFingerprint{}) {
+			l.fingerprint = fingerprintLayout(l)
+		}
+	})
+	return l.fingerprint
+}
+
+// NumRegions returns the length of the bit vectors the layout describes
+func (l *CoverageLayout) NumRegions() int {
+	return len(l.regions)
+}
+
+// Files returns the names of all files, in vector order
+func (l *CoverageLayout) Files() []string {
+	return l.files
+}
+
+// Functions returns the names of the functions in a file, in vector order
+func (l *CoverageLayout) Functions(fileName string) []string {
+	return l.functions[fileName]
+}
+
+// Region returns the region at index i of a vector
+func (l *CoverageLayout) Region(i int) (CodeRegion, bool) {
+	if i < 0 || i >= len(l.regions) {
+		return CodeRegion{}, false
+	}
+	return l.regions[i], true
+}
+
+// Regions returns every region, indexed by vector position
+func (l *CoverageLayout) Regions() []CodeRegion {
+	return l.regions
+}
+
+// FileAt returns the name of the file containing index i
+func (l *CoverageLayout) FileAt(i int) (string, bool) {
+	if i < 0 || i >= len(l.regions) {
+		return "", false
+	}
+
+	// Files without regions share their start with the next file, so find the last file
+	// starting at or before i
+	f := sort.Search(len(l.fileStarts), func(j int) bool {
+		return l.fileStarts[j] > i
+	}) - 1
+	return l.files[f], true
+}
+
+// Locate returns the file, function and index within the function of the region at index i
+func (l *CoverageLayout) Locate(i int) (string, string, int, bool) {
+	fileName, ok := l.FileAt(i)
+	if !ok {
+		return "", "", 0, false
+	}
+
+	funcNames := l.functions[fileName]
+	f := sort.Search(len(funcNames), func(j int) bool {
+		return l.funcRanges[fileName][funcNames[j]].Start > i
+	}) - 1
+	funcName := funcNames[f]
+	return fileName, funcName, i - l.funcRanges[fileName][funcName].Start, true
+}
+
+// Index returns the vector index of a region, given its file, function and index within the
+// function
+func (l *CoverageLayout) Index(fileName string, funcName string, region int) (int, bool) {
+	r, ok := l.FunctionRange(fileName, funcName)
+	if !ok || region < 0 || region >= r.Len() {
+		return 0, false
+	}
+	return r.Start + region, true
+}
+
+func (l *CoverageLayout) FileRange(fileName string) (BVRange, bool) {
+	r, ok := l.fileRanges[fileName]
+	return r, ok
+}
+
+func (l *CoverageLayout) FunctionRange(fileName string, funcName string) (BVRange, bool) {
+	r, ok := l.funcRanges[fileName][funcName]
+	return r, ok
+}
+
+// FileRanges returns the range of indices covered by each file
+func (l *CoverageLayout) FileRanges() map[string]BVRange {
+	ranges := make(map[string]BVRange, len(l.fileRanges))
+	for k, v := range l.fileRanges {
+		ranges[k] = v
+	}
+	return ranges
+}
+
+// Structure returns the number of regions in each function, as ConvertCovMapToStructure does
+func (l *CoverageLayout) Structure() map[string]map[string]int {
+	structure := make(map[string]map[string]int)
+	for fileName, funcRanges := range l.funcRanges {
+		structure[fileName] = make(map[string]int)
+		for funcName, r := range funcRanges {
+			structure[fileName][funcName] = r.Len()
+		}
+	}
+	return structure
+}
+
+// Metadata returns a copy of the regions of each function, as ReadCovMetadata does
+func (l *CoverageLayout) Metadata() map[string]map[string][]CodeRegion {
+	regions := append([]CodeRegion(nil), l.regions...)
+	metadata := make(map[string]map[string][]CodeRegion)
+	for fileName, funcRanges := range l.funcRanges {
+		metadata[fileName] = make(map[string][]CodeRegion)
+		for funcName, r := range funcRanges {
+			metadata[fileName][funcName] = regions[r.Start:r.End:r.End]
+		}
+	}
+	return metadata
+}
+
+// CodeRegionMap returns the same map as GenerateBVIndexToCodeRegionMap
+func (l *CoverageLayout) CodeRegionMap() map[int]CodeRegion {
+	codeRegionMap := make(map[int]CodeRegion, len(l.regions))
+	for i, cr := range l.regions {
+		codeRegionMap[i] = cr
+	}
+	return codeRegionMap
+}
+
+// CovMap converts a bit vector with this layout back into a coverage map
+func (l *CoverageLayout) CovMap(bv []bool) (map[string]map[string][]bool, error) {
+	if len(bv) != len(l.regions) {
+		return nil, errors.New("bv length does not match layout")
+	}
+	return ConvertBoolsToCovMap(bv, l.Structure())
+}
+
+// CovMapFromBitVector is CovMap for packed vectors
+func (l *CoverageLayout) CovMapFromBitVector(bv *BitVector) (map[string]map[string][]bool, error) {
+	return l.CovMap(bv.Bools())
+}
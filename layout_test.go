@@ -0,0 +1,170 @@
+package profparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// layoutTestReport lists files and functions out of order, with a function and a file without
+// regions
+const layoutTestReport = "[FILE] z.cc\n[FUNCTION] b\n[BLOCK] 0 0 1,1,1,1 1\n[BLOCK] 0 0 2,1,2,1 0\n" +
+	"[FUNCTION] a\n[BLOCK] 0 0 3,1,3,1 1\n[FUNCTION] e\n" +
+	"[FILE] a.cc\n[FUNCTION] f\n[BLOCK] 0 0 4,1,4,1 0\n[FILE] m.cc\n"
+
+func TestCoverageLayoutMatchesMaps(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	covMap, props, err := ParseCovMap(strings.NewReader(layoutTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, _, err := ParseCovMetadata(strings.NewReader(layoutTestReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bv := ConvertCovMapToBools(covMap)
+	structure := ConvertCovMapToStructure(covMap)
+
+	if l.NumRegions() != len(bv) || l.Properties != props {
+		t.Fatalf("%d regions and properties %+v, want %d and %+v", l.NumRegions(), l.Properties, len(bv), props)
+	}
+	if !reflect.DeepEqual(l.Structure(), structure) {
+		t.Errorf("structure %v, want %v", l.Structure(), structure)
+	}
+	if !reflect.DeepEqual(l.CodeRegionMap(), GenerateBVIndexToCodeRegionMap(structure, metadata)) {
+		t.Error("code region map differs")
+	}
+	if !reflect.DeepEqual(l.Metadata(), metadata) {
+		t.Error("metadata differs")
+	}
+	// Changing the returned metadata leaves the layout alone
+	fromLayout := l.Metadata()
+	fromLayout["z.cc"]["a"][0].LineStart = 9
+	_ = append(fromLayout["z.cc"]["a"], CodeRegion{})
+	if !reflect.DeepEqual(l.Metadata(), metadata) {
+		t.Error("changing the metadata changed the layout")
+	}
+	if !reflect.DeepEqual(l.Files(), []string{"a.cc", "m.cc", "z.cc"}) {
+		t.Errorf("files %v", l.Files())
+	}
+	if !reflect.DeepEqual(l.Functions("z.cc"), []string{"a", "b", "e"}) {
+		t.Errorf("functions of z.cc %v", l.Functions("z.cc"))
+	}
+
+	back, err := l.CovMapFromBitVector(BitVectorFromBools(bv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, covMap) {
+		t.Errorf("cov map %v, want %v", back, covMap)
+	}
+	if _, err = l.CovMap(bv[1:]); err == nil {
+		t.Error("expected an error for a vector of the wrong length")
+	}
+}
+
+func TestCoverageLayoutLocate(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	tests := []struct {
+		index    int
+		fileName string
+		funcName string
+		region   int
+		ok       bool
+	}{
+		{-1, "", "", 0, false},
+		{0, "a.cc", "f", 0, true},
+		{1, "z.cc", "a", 0, true},
+		{2, "z.cc", "b", 0, true},
+		{3, "z.cc", "b", 1, true},
+		{4, "", "", 0, false},
+	}
+	for _, tt := range tests {
+		fileName, funcName, region, ok := l.Locate(tt.index)
+		if fileName != tt.fileName || funcName != tt.funcName || region != tt.region || ok != tt.ok {
+			t.Errorf("Locate(%d) = %s, %s, %d, %v, want %s, %s, %d, %v", tt.index, fileName, funcName, region,
+				ok, tt.fileName, tt.funcName, tt.region, tt.ok)
+		}
+		if !tt.ok {
+			continue
+		}
+		if i, ok := l.Index(fileName, funcName, region); !ok || i != tt.index {
+			t.Errorf("Index(%s, %s, %d) = %d, %v", fileName, funcName, region, i, ok)
+		}
+		if r, _ := l.Region(tt.index); r.FileName != fileName || r.FuncName != funcName {
+			t.Errorf("region %d is in %s/%s", tt.index, r.FileName, r.FuncName)
+		}
+	}
+
+	if _, ok := l.Index("z.cc", "b", 2); ok {
+		t.Error("found a region past the end of a function")
+	}
+	if _, ok := l.Index("z.cc", "missing", 0); ok {
+		t.Error("found a region of a missing function")
+	}
+	if _, ok := l.Region(4); ok {
+		t.Error("found a region past the end of the vector")
+	}
+}
+
+func TestCoverageLayoutRanges(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	tests := []struct {
+		fileName string
+		funcName string
+		want     BVRange
+		ok       bool
+	}{
+		{"a.cc", "", BVRange{0, 1}, true},
+		{"m.cc", "", BVRange{1, 1}, true},
+		{"z.cc", "", BVRange{1, 4}, true},
+		{"z.cc", "a", BVRange{1, 2}, true},
+		{"z.cc", "b", BVRange{2, 4}, true},
+		{"z.cc", "e", BVRange{4, 4}, true},
+		{"y.cc", "", BVRange{}, false},
+		{"z.cc", "missing", BVRange{}, false},
+	}
+	for _, tt := range tests {
+		var r BVRange
+		var ok bool
+		if tt.funcName == "" {
+			r, ok = l.FileRange(tt.fileName)
+		} else {
+			r, ok = l.FunctionRange(tt.fileName, tt.funcName)
+		}
+		if r != tt.want || ok != tt.ok {
+			t.Errorf("range of %s %s = %v, %v, want %v, %v", tt.fileName, tt.funcName, r, ok, tt.want, tt.ok)
+		}
+	}
+
+	// The empty file shares its start with z.cc, which owns the index
+	if f, _ := l.FileAt(1); f != "z.cc" {
+		t.Errorf("index 1 is in %s", f)
+	}
+	if ranges := l.FileRanges(); len(ranges) != 3 || ranges["m.cc"].Len() != 0 {
+		t.Errorf("file ranges %v", ranges)
+	}
+}
+
+func TestCoverageLayoutFingerprint(t *testing.T) {
+	l := mustParseLayout(t, layoutTestReport)
+	tests := []struct {
+		name   string
+		report string
+		same   bool
+	}{
+		{"same report", layoutTestReport, true},
+		{"counts differ", strings.Replace(layoutTestReport, "1,1,1,1 1", "1,1,1,1 0", 1), true},
+		{"region moved", strings.Replace(layoutTestReport, "3,1,3,1", "3,1,3,2", 1), false},
+		{"region added", layoutTestReport + "[FUNCTION] g\n[BLOCK] 0 0 5,1,5,1 1\n", false},
+		{"function renamed", strings.Replace(layoutTestReport, "[FUNCTION] a\n", "[FUNCTION] c\n", 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := mustParseLayout(t, tt.report)
+			if same := other.Fingerprint() == l.Fingerprint(); same != tt.same {
+				t.Errorf("same fingerprint = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
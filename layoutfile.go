@@ -0,0 +1,428 @@
+package profparse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	layoutFileMagic   = "PPLAYOUT"
+	layoutFileVersion = 1
+
+	// Magic, version, source size, source modification time, source hash, fingerprint, checksum
+	// of everything after the header, four properties and the body length. The body is followed
+	// by the normalized name of each file.
+	layoutFileHeaderSize = 8 + 4 + 8 + 8 + sha256.Size + 16 + 4 + 4*8 + 8
+)
+
+// crcTable is used for the checksums in layout and bit vector files
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LayoutFingerprint identifies a layout: two layouts with the same fingerprint have the same
+// files, functions and regions in the same order. Region counters are left out, so a layout read
+// from a binary matches the one read from a coverage report for the same build.
+type LayoutFingerprint [16]byte
+
+func (f LayoutFingerprint) String() string {
+	return hex.EncodeToString(f[:])
+}
+
+// LayoutSource identifies the coverage report a cached layout file was built from
+type LayoutSource struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+	Hash    [sha256.Size]byte
+}
+
+// LayoutPathForCovFile returns the path of the cached layout file for a coverage report
+func LayoutPathForCovFile(covFile string) string {
+	return covFile + ".layout"
+}
+
+// LoadCoverageLayout returns the layout of a coverage report, using the cached layout file next
+// to it when it is up to date. Otherwise the report is parsed and the cache rebuilt. The cache is
+// considered up to date if the report has the same size and modification time it had when the
+// cache was built, or failing that, the same content.
+func LoadCoverageLayout(covFile string) (*CoverageLayout, error) {
+	info, err := os.Stat(covFile)
+	if err != nil {
+		return nil, err
+	}
+
+	layoutFile := LayoutPathForCovFile(covFile)
+	cached, source, err := ReadLayoutFile(layoutFile)
+	if err == nil {
+		if source.Size == info.Size() && source.ModTime == info.ModTime().UnixNano() {
+			return cached, nil
+		}
+
+		// Hashing the report is much cheaper than parsing it
+		hash, err := hashFile(covFile)
+		if err != nil {
+			return nil, err
+		}
+		if hash == source.Hash {
+			log.Debugf("Coverage report %s was touched but not changed", covFile)
+			source.Size = info.Size()
+			source.ModTime = info.ModTime().UnixNano()
+			err = WriteLayoutFile(layoutFile, cached, source)
+			if err != nil {
+				log.Warnf("Could not cache layout for %s: %v", covFile, err)
+			}
+			return cached, nil
+		}
+	} else if !os.IsNotExist(err) {
+		log.Warnf("Ignoring cached layout %s: %v", layoutFile, err)
+	}
+
+	f, err := os.Open(covFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	layout, err := ParseCoverageLayout(io.TeeReader(f, h))
+	if err != nil {
+		return nil, err
+	}
+
+	newSource := LayoutSource{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+	copy(newSource.Hash[:], h.Sum(nil))
+
+	err = WriteLayoutFile(layoutFile, layout, newSource)
+	if err != nil {
+		log.Warnf("Could not cache layout for %s: %v", covFile, err)
+	}
+
+	return layout, nil
+}
+
+// WriteLayoutFile writes a layout to disk, along with the identity of the report it was built from.
+// The body of the file holds every file, function and region in vector order.
+func WriteLayoutFile(fName string, l *CoverageLayout, source LayoutSource) error {
+	var buf bytes.Buffer
+	encodeLayout(&buf, l, true)
+	body := buf.Bytes()
+	fingerprint := l.Fingerprint()
+
+	normalized := make([]byte, 0)
+	for _, fileName := range l.files {
+		normalized = appendLayoutString(normalized, l.normalizedFiles[fileName])
+	}
+	checksum := crc32.Update(crc32.Checksum(body, crcTable), crcTable, normalized)
+
+	header := make([]byte, layoutFileHeaderSize)
+	copy(header, layoutFileMagic)
+	binary.LittleEndian.PutUint32(header[8:], layoutFileVersion)
+	binary.LittleEndian.PutUint64(header[12:], uint64(source.Size))
+	binary.LittleEndian.PutUint64(header[20:], uint64(source.ModTime))
+	pos := 28
+	pos += copy(header[pos:], source.Hash[:])
+	pos += copy(header[pos:], fingerprint[:])
+	binary.LittleEndian.PutUint32(header[pos:], checksum)
+	pos += 4
+	for _, v := range []int{l.Properties.NumFiles, l.Properties.NumFunctions, l.Properties.NumRegions,
+		l.Properties.NumBranches, len(body)} {
+		binary.LittleEndian.PutUint64(header[pos:], uint64(v))
+		pos += 8
+	}
+
+	// Write to a temporary file first so that concurrent runs never see a partial layout. Each
+	// writer gets its own, so they cannot write over each other's.
+	f, err := ioutil.TempFile(filepath.Dir(fName), filepath.Base(fName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	for _, b := range [][]byte{header, body, normalized} {
+		_, err = f.Write(b)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, fName)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// ReadLayoutFile reads a layout written by WriteLayoutFile
+func ReadLayoutFile(fName string) (*CoverageLayout, LayoutSource, error) {
+	var source LayoutSource
+
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, source, err
+	}
+
+	if len(data) < layoutFileHeaderSize || string(data[:8]) != layoutFileMagic {
+		return nil, source, errors.New("not a layout file")
+	}
+	if binary.LittleEndian.Uint32(data[8:]) != layoutFileVersion {
+		return nil, source, errors.New("unsupported layout file version")
+	}
+
+	pos := 12
+	source.Size = int64(binary.LittleEndian.Uint64(data[pos:]))
+	source.ModTime = int64(binary.LittleEndian.Uint64(data[pos+8:]))
+	pos += 16
+	copy(source.Hash[:], data[pos:])
+	pos += sha256.Size
+
+	var fingerprint LayoutFingerprint
+	copy(fingerprint[:], data[pos:])
+	pos += len(fingerprint)
+	checksum := binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+
+	var props CovMapProperties
+	props.NumFiles = int(binary.LittleEndian.Uint64(data[pos:]))
+	props.NumFunctions = int(binary.LittleEndian.Uint64(data[pos+8:]))
+	props.NumRegions = int(binary.LittleEndian.Uint64(data[pos+16:]))
+	props.NumBranches = int(binary.LittleEndian.Uint64(data[pos+24:]))
+	pos += 32
+
+	bodyLen := binary.LittleEndian.Uint64(data[pos:])
+	pos += 8
+	if bodyLen > uint64(len(data)-pos) {
+		return nil, source, errors.New("truncated layout file")
+	}
+	body := data[pos : pos+int(bodyLen)]
+	if crc32.Checksum(data[pos:], crcTable) != checksum {
+		return nil, source, errors.New("corrupt layout file")
+	}
+
+	metadata, files, err := decodeLayoutBody(body)
+	if err != nil {
+		return nil, source, err
+	}
+
+	r := &layoutReader{data: data[pos+int(bodyLen):]}
+	normalizedFiles := make(map[string]string, len(files))
+	for _, fileName := range files {
+		normalized := r.string()
+		normalizedFiles[fileName] = normalized
+		for _, regions := range metadata[fileName] {
+			for i := range regions {
+				regions[i].NormalizedFileName = normalized
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, source, r.err
+	}
+
+	l := NewCoverageLayout(metadata)
+	l.Properties = props
+	l.normalizedFiles = normalizedFiles
+	l.fingerprint = fingerprint
+	return l, source, nil
+}
+
+func hashFile(fName string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := os.Open(fName)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// fingerprintLayout hashes the body WriteLayoutFile would write, without the region counters
+func fingerprintLayout(l *CoverageLayout) LayoutFingerprint {
+	h := sha256.New()
+	encodeLayout(h, l, false)
+
+	var fingerprint LayoutFingerprint
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+func encodeLayout(w io.Writer, l *CoverageLayout, counters bool) {
+	buf := make([]byte, 0, 1<<16)
+	flush := func() {
+		w.Write(buf)
+		buf = buf[:0]
+	}
+
+	buf = appendUvarint(buf, uint64(len(l.files)))
+	for _, fileName := range l.files {
+		buf = appendLayoutString(buf, fileName)
+		funcNames := l.functions[fileName]
+		buf = appendUvarint(buf, uint64(len(funcNames)))
+		for _, funcName := range funcNames {
+			buf = appendLayoutString(buf, funcName)
+			r := l.funcRanges[fileName][funcName]
+			buf = appendUvarint(buf, uint64(r.Len()))
+			for _, cr := range l.regions[r.Start:r.End] {
+				buf = appendVarint(buf, int64(cr.LineStart))
+				buf = appendVarint(buf, int64(cr.ColumnStart))
+				buf = appendVarint(buf, int64(cr.LineEnd))
+				buf = appendVarint(buf, int64(cr.ColumnEnd))
+				buf = appendVarint(buf, int64(cr.FileID))
+				buf = appendVarint(buf, int64(cr.ExpandedFileID))
+				buf = appendVarint(buf, int64(cr.Kind))
+				if counters {
+					buf = appendVarint(buf, int64(cr.Counter.Kind))
+					buf = appendVarint(buf, int64(cr.Counter.ID))
+				}
+			}
+			if len(buf) > 1<<15 {
+				flush()
+			}
+		}
+	}
+	flush()
+}
+
+func decodeLayoutBody(body []byte) (map[string]map[string][]CodeRegion, []string, error) {
+	r := &layoutReader{data: body}
+	metadata := make(map[string]map[string][]CodeRegion)
+
+	numFiles := r.uvarint()
+	if numFiles > uint64(len(body)) {
+		return nil, nil, errors.New("corrupt layout file")
+	}
+	files := make([]string, 0, numFiles)
+	for i := uint64(0); i < numFiles && r.err == nil; i++ {
+		fileName := r.string()
+		files = append(files, fileName)
+		metadata[fileName] = make(map[string][]CodeRegion)
+
+		numFuncs := r.uvarint()
+		for j := uint64(0); j < numFuncs && r.err == nil; j++ {
+			funcName := r.string()
+			numRegions := r.uvarint()
+			if numRegions > uint64(len(body)) {
+				return nil, nil, errors.New("corrupt layout file")
+			}
+
+			regions := make([]CodeRegion, numRegions)
+			for k := range regions {
+				cr := &regions[k]
+				cr.FileName = fileName
+				cr.FuncName = funcName
+				cr.LineStart = int(r.varint())
+				cr.ColumnStart = int(r.varint())
+				cr.LineEnd = int(r.varint())
+				cr.ColumnEnd = int(r.varint())
+				cr.FileID = int(r.varint())
+				cr.ExpandedFileID = int(r.varint())
+				cr.Kind = RegionKind(r.varint())
+				cr.Counter.Kind = CounterKind(r.varint())
+				cr.Counter.ID = int(r.varint())
+			}
+			metadata[fileName][funcName] = regions
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	return metadata, files, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendLayoutString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// layoutReader is a bounds checked cursor over the body of a layout file
+type layoutReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *layoutReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = errors.New("corrupt layout file")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *layoutReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = errors.New("corrupt layout file")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *layoutReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.err = errors.New("corrupt layout file")
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+int(n)])
+	r.pos += int(n)
+	return s
+}
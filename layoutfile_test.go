@@ -0,0 +1,174 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const layoutFileTestReport = "[FILE] /b/out/Release/../../z.cc\n" +
+	"[FUNCTION] b\n[BLOCK] 0,1 gap 1,1,1,1 1\n[BLOCK] 0 0 2,1,2,1 0\n" +
+	"[FUNCTION] a\n[BLOCK] 0 0 3,1,3,1 1\n[FUNCTION] e\n" +
+	"[FILE] a.cc\n[FUNCTION] f\n[BLOCK] 0 0 4,1,4,1 0\n[FILE] m.cc\n"
+
+func checkSameLayout(t *testing.T, got *CoverageLayout, want *CoverageLayout) {
+	t.Helper()
+	if got.Fingerprint() != want.Fingerprint() || got.Properties != want.Properties {
+		t.Errorf("fingerprint %v and properties %v, want %v and %v", got.Fingerprint(), got.Properties,
+			want.Fingerprint(), want.Properties)
+	}
+	if !reflect.DeepEqual(got.Regions(), want.Regions()) || !reflect.DeepEqual(got.Metadata(), want.Metadata()) {
+		t.Error("regions differ")
+	}
+	if !reflect.DeepEqual(got.normalizedFiles, want.normalizedFiles) {
+		t.Errorf("normalized files = %v, want %v", got.normalizedFiles, want.normalizedFiles)
+	}
+}
+
+func TestLoadCoverageLayout(t *testing.T) {
+	dir := t.TempDir()
+	covFile := filepath.Join(dir, "coverage.txt")
+	if err := ioutil.WriteFile(covFile, []byte(layoutFileTestReport), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ReadCoverageLayout(covFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T)
+		regions int
+	}{
+		{"builds the cache", func(t *testing.T) {}, 4},
+		{"reads the cache", func(t *testing.T) {}, 4},
+		{"report touched", func(t *testing.T) {
+			if err := os.Chtimes(covFile, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, 4},
+		{"report changed", func(t *testing.T) {
+			err := ioutil.WriteFile(covFile, []byte(layoutFileTestReport+"[FUNCTION] g\n[BLOCK] 0 0 5,1,5,1 1\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.prepare(t)
+			l, err := LoadCoverageLayout(covFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.NumRegions() != tt.regions {
+				t.Fatalf("%d regions, want %d", l.NumRegions(), tt.regions)
+			}
+			cached, source, err := ReadLayoutFile(LayoutPathForCovFile(covFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(covFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.Size != info.Size() || source.ModTime != info.ModTime().UnixNano() {
+				t.Errorf("cache records size %d and time %d", source.Size, source.ModTime)
+			}
+			checkSameLayout(t, cached, l)
+			if tt.regions == 4 {
+				checkSameLayout(t, l, want)
+			}
+		})
+	}
+
+	// Temporary files never outlive a write
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files left in the directory", len(files))
+	}
+}
+
+func TestReadLayoutFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	layoutFile := filepath.Join(dir, "coverage.txt.layout")
+	if err := WriteLayoutFile(layoutFile, mustParseLayout(t, layoutFileTestReport), LayoutSource{}); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := ioutil.ReadFile(layoutFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"bad magic", modified(func(d []byte) []byte { d[0] = 'X'; return d })},
+		{"other version", modified(func(d []byte) []byte { binary.LittleEndian.PutUint32(d[8:], 2); return d })},
+		{"corrupt body", modified(func(d []byte) []byte { d[layoutFileHeaderSize+5] ^= 0xff; return d })},
+		{"corrupt normalized names", modified(func(d []byte) []byte { d[len(d)-2] ^= 0xff; return d })},
+		{"truncated", valid[:len(valid)-3]},
+		{"trailing data", append(append([]byte{}, valid...), 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(fName, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := ReadLayoutFile(fName); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestWriteLayoutFileConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	layoutFile := filepath.Join(dir, "coverage.txt.layout")
+	l := mustParseLayout(t, layoutFileTestReport)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = WriteLayoutFile(layoutFile, l, LayoutSource{Size: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cached, _, err := ReadLayoutFile(layoutFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameLayout(t, cached, l)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("%d files left in the directory", len(files))
+	}
+}
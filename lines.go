@@ -0,0 +1,511 @@
+package profparse
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// LineCoverage holds the execution count of every line of every file in a layout, derived from
+// its regions the way llvm-cov derives line coverage
+type LineCoverage struct {
+	Files map[string]*FileLineCoverage
+}
+
+// FileLineCoverage holds the execution count of each line of a file. Lines outside of any region,
+// and lines in skipped regions, are not mapped.
+type FileLineCoverage struct {
+	FileName           string
+	NormalizedFileName string
+
+	FirstLine int      // Line of Counts[0]
+	Counts    []uint64 // One per line from FirstLine
+	Mapped    []bool
+}
+
+// lineSegment is a CoverageSegment in LLVM's terms: a point in a file from which a count applies,
+// until the next segment
+type lineSegment struct {
+	Line          int
+	Col           int
+	Count         uint64
+	HasCount      bool
+	IsRegionEntry bool
+	IsGapRegion   bool
+}
+
+type countedRegion struct {
+	CodeRegion
+	Count uint64
+}
+
+func (r *countedRegion) start() linePos {
+	return linePos{r.LineStart, r.ColumnStart}
+}
+
+func (r *countedRegion) end() linePos {
+	return linePos{r.LineEnd, r.ColumnEnd}
+}
+
+type linePos struct {
+	Line int
+	Col  int
+}
+
+func (p linePos) less(q linePos) bool {
+	return p.Line < q.Line || (p.Line == q.Line && p.Col < q.Col)
+}
+
+// ComputeLineCoverage derives line coverage from a region vector with layout l. Each covered
+// region counts as executed once.
+func ComputeLineCoverage(l *CoverageLayout, bv []bool) (*LineCoverage, error) {
+	if len(bv) != l.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	counts := make([]uint64, len(bv))
+	for i, covered := range bv {
+		if covered {
+			counts[i] = 1
+		}
+	}
+	return ComputeLineCoverageFromCounts(l, counts)
+}
+
+// ComputeLineCoverageFromBitVector is ComputeLineCoverage for packed vectors
+func ComputeLineCoverageFromBitVector(l *CoverageLayout, bv *BitVector) (*LineCoverage, error) {
+	if bv.Len() != l.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	counts := make([]uint64, bv.Len())
+	bv.ForEach(func(i int) {
+		counts[i] = 1
+	})
+	return ComputeLineCoverageFromCounts(l, counts)
+}
+
+// ComputeLineCoverageFromCounts is ComputeLineCoverage for a count vector
+func ComputeLineCoverageFromCounts(l *CoverageLayout, counts []uint64) (*LineCoverage, error) {
+	if len(counts) != l.NumRegions() {
+		return nil, errors.New("count vector length does not match layout")
+	}
+
+	lc := &LineCoverage{
+		Files: make(map[string]*FileLineCoverage),
+	}
+
+	for _, fileName := range l.files {
+		r := l.fileRanges[fileName]
+
+		// Only regions in the file itself are used. Regions in macro expansions have other file
+		// IDs, and their lines belong to wherever the macro was defined.
+		regions := make([]countedRegion, 0, r.Len())
+		for i := r.Start; i < r.End; i++ {
+			cr := l.regions[i]
+			if cr.FileID != 0 || cr.LineStart <= 0 || cr.LineEnd < cr.LineStart {
+				continue
+			}
+			if cr.Kind != RegionCode && cr.Kind != RegionExpansion && cr.Kind != RegionSkipped && cr.Kind != RegionGap {
+				continue
+			}
+			regions = append(regions, countedRegion{CodeRegion: cr, Count: counts[i]})
+		}
+
+		segments := buildLineSegments(regions)
+		flc := lineCoverageFromSegments(segments)
+		flc.FileName = fileName
+		flc.NormalizedFileName = l.normalizedFiles[fileName]
+		lc.Files[fileName] = flc
+	}
+
+	return lc, nil
+}
+
+// sortNestedRegions sorts regions by start, putting enclosing regions before the regions they
+// contain, and code regions before expansion and skipped regions covering the same area
+func sortNestedRegions(regions []countedRegion) {
+	sort.SliceStable(regions, func(i, j int) bool {
+		a, b := &regions[i], &regions[j]
+		if a.start() != b.start() {
+			return a.start().less(b.start())
+		}
+		if a.end() != b.end() {
+			return b.end().less(a.end())
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// combineRegions merges regions covering the same area, adding up the counts of those of the
+// same kind as the first
+func combineRegions(regions []countedRegion) []countedRegion {
+	if len(regions) == 0 {
+		return regions
+	}
+
+	active := 0
+	for i := 1; i < len(regions); i++ {
+		if regions[active].start() != regions[i].start() || regions[active].end() != regions[i].end() {
+			active += 1
+			regions[active] = regions[i]
+			continue
+		}
+		if regions[i].Kind == regions[active].Kind {
+			regions[active].Count += regions[i].Count
+		}
+	}
+	return regions[:active+1]
+}
+
+// buildLineSegments turns the regions of a file into segments, following LLVM's SegmentBuilder
+func buildLineSegments(regions []countedRegion) []lineSegment {
+	sortNestedRegions(regions)
+	regions = combineRegions(regions)
+
+	b := &segmentBuilder{
+		segments: make([]lineSegment, 0, 2*len(regions)),
+		active:   make([]*countedRegion, 0),
+	}
+
+	for i := range regions {
+		cr := &regions[i]
+		start := cr.start()
+
+		// Active regions which end before the current region starts are completed
+		stillActive := make([]*countedRegion, 0, len(b.active))
+		completed := make([]*countedRegion, 0)
+		for _, a := range b.active {
+			if start.less(a.end()) {
+				stillActive = append(stillActive, a)
+			} else {
+				completed = append(completed, a)
+			}
+		}
+		if len(completed) > 0 {
+			firstCompleted := len(stillActive)
+			b.active = append(stillActive, completed...)
+			b.completeRegionsUntil(&start, firstCompleted)
+		}
+
+		gap := cr.Kind == RegionGap
+
+		if start == cr.end() {
+			// Zero length regions never become active. The last one is skipped, and others take the
+			// count of the region they are in.
+			skipped := i+1 == len(regions) || cr.Kind == RegionSkipped
+			if len(b.active) == 0 {
+				b.startSegment(cr, start, !gap, skipped)
+			} else {
+				b.startSegment(b.active[len(b.active)-1], start, !gap, skipped)
+			}
+			if skipped && len(b.active) > 0 {
+				b.startSegment(b.active[len(b.active)-1], start, false, false)
+			}
+			continue
+		}
+
+		if i+1 == len(regions) || start != regions[i+1].start() {
+			b.startSegment(cr, start, !gap, false)
+		}
+		b.active = append(b.active, cr)
+	}
+
+	if len(b.active) > 0 {
+		b.completeRegionsUntil(nil, 0)
+	}
+
+	return b.segments
+}
+
+type segmentBuilder struct {
+	segments []lineSegment
+	active   []*countedRegion
+}
+
+func (b *segmentBuilder) startSegment(cr *countedRegion, pos linePos, isRegionEntry bool, emitSkipped bool) {
+	hasCount := !emitSkipped && cr.Kind != RegionSkipped
+
+	// Skip segments that would not change how the line is rendered
+	if len(b.segments) > 0 && !isRegionEntry && !emitSkipped {
+		last := b.segments[len(b.segments)-1]
+		if last.HasCount == hasCount && last.Count == cr.Count && !last.IsRegionEntry {
+			return
+		}
+	}
+
+	s := lineSegment{
+		Line:          pos.Line,
+		Col:           pos.Col,
+		HasCount:      hasCount,
+		IsRegionEntry: isRegionEntry,
+	}
+	if hasCount {
+		s.Count = cr.Count
+		s.IsGapRegion = cr.Kind == RegionGap
+	}
+	b.segments = append(b.segments, s)
+}
+
+// completeRegionsUntil emits the segments for the ends of the completed regions, which are
+// b.active[firstCompleted:], and pops them. next is the start of the next region, or nil at the end
+// of the file.
+func (b *segmentBuilder) completeRegionsUntil(next *linePos, firstCompleted int) {
+	completed := b.active[firstCompleted:]
+	sort.SliceStable(completed, func(i, j int) bool {
+		return completed[i].end().less(completed[j].end())
+	})
+
+	for i := firstCompleted + 1; i < len(b.active); i++ {
+		region := b.active[i]
+		pos := b.active[i-1].end()
+
+		if next != nil && pos == *next {
+			break
+		}
+		if pos == region.end() {
+			continue
+		}
+
+		// Use the count of the last completed region ending here
+		for j := i + 1; j < len(b.active); j++ {
+			if region.end() == b.active[j].end() {
+				region = b.active[j]
+			}
+		}
+		b.startSegment(region, pos, false, false)
+	}
+
+	last := b.active[len(b.active)-1]
+	if firstCompleted > 0 && (next == nil || last.end() != *next) {
+		// Fill the gap up to the next region with the innermost region still active
+		b.startSegment(b.active[firstCompleted-1], last.end(), false, false)
+	} else if firstCompleted == 0 && (next == nil || *next != last.end()) {
+		// Nothing is active any more, so mark the gap up to the next region as not executed
+		b.startSegment(last, last.end(), false, true)
+	}
+
+	b.active = b.active[:firstCompleted]
+}
+
+// lineCoverageFromSegments computes the count of each line from segments, as LLVM's
+// LineCoverageStats does
+func lineCoverageFromSegments(segments []lineSegment) *FileLineCoverage {
+	flc := &FileLineCoverage{
+		Counts: make([]uint64, 0),
+		Mapped: make([]bool, 0),
+	}
+	if len(segments) == 0 {
+		return flc
+	}
+
+	flc.FirstLine = segments[0].Line
+	lastLine := segments[len(segments)-1].Line
+	flc.Counts = make([]uint64, lastLine-flc.FirstLine+1)
+	flc.Mapped = make([]bool, lastLine-flc.FirstLine+1)
+
+	isStartOfRegion := func(s *lineSegment) bool {
+		return !s.IsGapRegion && s.HasCount && s.IsRegionEntry
+	}
+
+	var wrapped *lineSegment
+	next := 0
+	for line := flc.FirstLine; line <= lastLine; line++ {
+		start := next
+		for next < len(segments) && segments[next].Line == line {
+			next += 1
+		}
+		lineSegments := segments[start:next]
+
+		regionStarts := 0
+		for i := range lineSegments {
+			if isStartOfRegion(&lineSegments[i]) {
+				regionStarts += 1
+			}
+		}
+		startOfSkipped := len(lineSegments) > 0 && !lineSegments[0].HasCount && lineSegments[0].IsRegionEntry
+
+		mapped := !startOfSkipped && ((wrapped != nil && wrapped.HasCount) || regionStarts > 0)
+		if mapped {
+			var count uint64
+			if wrapped != nil {
+				count = wrapped.Count
+			}
+			for i := range lineSegments {
+				if isStartOfRegion(&lineSegments[i]) && lineSegments[i].Count > count {
+					count = lineSegments[i].Count
+				}
+			}
+			flc.Counts[line-flc.FirstLine] = count
+			flc.Mapped[line-flc.FirstLine] = true
+		}
+
+		if len(lineSegments) > 0 {
+			wrapped = &lineSegments[len(lineSegments)-1]
+		}
+	}
+
+	return flc
+}
+
+// Line returns the execution count of a line, and whether it is mapped at all
+func (f *FileLineCoverage) Line(line int) (uint64, bool) {
+	i := line - f.FirstLine
+	if i < 0 || i >= len(f.Counts) || !f.Mapped[i] {
+		return 0, false
+	}
+	return f.Counts[i], true
+}
+
+// Covered returns true if a line was executed
+func (f *FileLineCoverage) Covered(line int) bool {
+	count, mapped := f.Line(line)
+	return mapped && count > 0
+}
+
+// MappedLines returns the numbers of all mapped lines, in order
+func (f *FileLineCoverage) MappedLines() []int {
+	lines := make([]int, 0)
+	for i, mapped := range f.Mapped {
+		if mapped {
+			lines = append(lines, f.FirstLine+i)
+		}
+	}
+	return lines
+}
+
+// CoveredLines returns the numbers of all executed lines, in order
+func (f *FileLineCoverage) CoveredLines() []int {
+	lines := make([]int, 0)
+	for i, mapped := range f.Mapped {
+		if mapped && f.Counts[i] > 0 {
+			lines = append(lines, f.FirstLine+i)
+		}
+	}
+	return lines
+}
+
+// Summary returns the number of mapped lines and the number of those executed
+func (f *FileLineCoverage) Summary() (int, int) {
+	mapped := 0
+	covered := 0
+	for i := range f.Mapped {
+		if f.Mapped[i] {
+			mapped += 1
+			if f.Counts[i] > 0 {
+				covered += 1
+			}
+		}
+	}
+	return mapped, covered
+}
+
+// SortedFiles returns the names of all files, sorted
+func (lc *LineCoverage) SortedFiles() []string {
+	fileNames := make([]string, 0, len(lc.Files))
+	for k := range lc.Files {
+		fileNames = append(fileNames, k)
+	}
+	sort.Strings(fileNames)
+	return fileNames
+}
+
+// WriteLineCoverageToFile writes the mapped lines of every file as a CSV file, with the file, line
+// and execution count of one line per row
+func WriteLineCoverageToFile(lc *LineCoverage, fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+
+	err = writer.Write([]string{"File", "Line", "Count"})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range lc.SortedFiles() {
+		flc := lc.Files[name]
+		for i, mapped := range flc.Mapped {
+			if !mapped {
+				continue
+			}
+			err = writer.Write([]string{
+				name,
+				strconv.Itoa(flc.FirstLine + i),
+				strconv.FormatUint(flc.Counts[i], 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ReadLineCoverageFile reads line coverage written by WriteLineCoverageToFile. Files with no
+// mapped lines are not recorded by the file, so are missing from the result.
+func ReadLineCoverageFile(fileName string) (*LineCoverage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lc := &LineCoverage{
+		Files: make(map[string]*FileLineCoverage),
+	}
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	header := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header {
+			header = false
+			continue
+		}
+
+		line, err := strconv.Atoi(record[1])
+		if err != nil || line <= 0 {
+			return nil, errors.New("invalid line number: " + record[1])
+		}
+		count, err := strconv.ParseUint(record[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		flc, ok := lc.Files[record[0]]
+		if !ok {
+			flc = &FileLineCoverage{
+				FileName:  record[0],
+				FirstLine: line,
+			}
+			lc.Files[record[0]] = flc
+		}
+		if line < flc.FirstLine+len(flc.Counts) {
+			return nil, errors.New("lines of " + record[0] + " are out of order")
+		}
+		for flc.FirstLine+len(flc.Counts) < line {
+			flc.Counts = append(flc.Counts, 0)
+			flc.Mapped = append(flc.Mapped, false)
+		}
+		flc.Counts = append(flc.Counts, count)
+		flc.Mapped = append(flc.Mapped, true)
+	}
+
+	return lc, nil
+}
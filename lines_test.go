@@ -0,0 +1,294 @@
+package profparse
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testdata/lines/lines.o holds hand encoded coverage mapping sections for one file, with gaps,
+// skipped code, a loop, a ternary, a zero length region and a whole line region. lines.json and
+// lines.lcov are what llvm-cov 14 makes of them:
+//
+//	yaml2obj -o lines.o lines.yaml
+//	llvm-profdata merge -o lines.profdata lines.proftext
+//	llvm-cov export -instr-profile lines.profdata lines.o > lines.json
+//	llvm-cov export -format=lcov -instr-profile lines.profdata lines.o > lines.lcov
+
+// linesTestCounts returns the layout and count vector of testdata/lines/lines.o
+func linesTestCounts(t *testing.T) (*CoverageLayout, []uint64) {
+	t.Helper()
+	mappings, err := ReadCoverageMapping(filepath.Join("testdata", "lines", "lines.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadProfdata(filepath.Join("testdata", "lines", "lines.profdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := CoverageLayoutFromRecords(MappingRecords(mappings, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	countMap, _, err := CountMapFromRecords(MappingRecords(mappings, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, ConvertCountMapToCounts(countMap)
+}
+
+// readLcovLines returns the DA records of an lcov file, by source file
+func readLcovLines(t *testing.T, fName string) map[string]map[int]uint64 {
+	t.Helper()
+	f, err := os.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := make(map[string]map[int]uint64)
+	var file string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		text := s.Text()
+		if strings.HasPrefix(text, "SF:") {
+			file = text[3:]
+			lines[file] = make(map[int]uint64)
+		}
+		if !strings.HasPrefix(text, "DA:") {
+			continue
+		}
+		fields := strings.Split(text[3:], ",")
+		line, err := strconv.Atoi(fields[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[file][line] = count
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestLineCoverageMatchesLlvmCov(t *testing.T) {
+	l, counts := linesTestCounts(t)
+	lc, err := ComputeLineCoverageFromCounts(l, counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readLcovLines(t, filepath.Join("testdata", "lines", "lines.lcov"))
+	if len(lc.Files) != len(want) {
+		t.Errorf("%d files, want %d", len(lc.Files), len(want))
+	}
+	for fileName, wantLines := range want {
+		flc, ok := lc.Files[fileName]
+		if !ok {
+			t.Errorf("no line coverage for %s", fileName)
+			continue
+		}
+		got := make(map[int]uint64)
+		for _, line := range flc.MappedLines() {
+			got[line], _ = flc.Line(line)
+		}
+		if !reflect.DeepEqual(got, wantLines) {
+			t.Errorf("%s has lines %v, want %v", fileName, got, wantLines)
+		}
+	}
+}
+
+func TestLineSegmentsMatchLlvmCov(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "lines", "lines.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export struct {
+		Data []struct {
+			Files []struct {
+				Filename string
+				Segments [][6]interface{}
+			}
+		}
+	}
+	if err = json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	l, counts := linesTestCounts(t)
+	for _, file := range export.Data[0].Files {
+		var want []lineSegment
+		for _, s := range file.Segments {
+			want = append(want, lineSegment{
+				Line:          int(s[0].(float64)),
+				Col:           int(s[1].(float64)),
+				Count:         uint64(s[2].(float64)),
+				HasCount:      s[3].(bool),
+				IsRegionEntry: s[4].(bool),
+				IsGapRegion:   s[5].(bool),
+			})
+		}
+
+		r, ok := l.FileRange(file.Filename)
+		if !ok {
+			t.Errorf("%s is not in the layout", file.Filename)
+			continue
+		}
+		var regions []countedRegion
+		for i := r.Start; i < r.End; i++ {
+			regions = append(regions, countedRegion{CodeRegion: l.regions[i], Count: counts[i]})
+		}
+		got := buildLineSegments(regions)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has segments\n%+v\nwant\n%+v", file.Filename, got, want)
+		}
+	}
+}
+
+func TestComputeLineCoverage(t *testing.T) {
+	region := func(l1, c1, l2, c2 int, kind RegionKind) CodeRegion {
+		return CodeRegion{FileName: "a.cc", LineStart: l1, ColumnStart: c1, LineEnd: l2, ColumnEnd: c2, Kind: kind}
+	}
+	l := NewCoverageLayout(map[string]map[string][]CodeRegion{
+		"a.cc": {
+			"f": {
+				region(1, 13, 8, 2, RegionCode),
+				region(2, 7, 2, 8, RegionCode),
+				region(2, 9, 3, 5, RegionGap),
+				region(3, 5, 3, 14, RegionCode),
+				region(3, 14, 5, 3, RegionGap),
+				region(5, 3, 8, 2, RegionCode),
+				region(6, 1, 6, 7, RegionSkipped),
+			},
+			"g": {region(10, 10, 12, 2, RegionCode)},
+		},
+		"b.cc": {"h": {}},
+	})
+
+	tests := []struct {
+		name    string
+		bv      []bool
+		lines   map[int]uint64
+		covered []int
+	}{
+		{"early return", []bool{true, true, false, false, true, true, false, false},
+			map[int]uint64{1: 1, 2: 1, 3: 0, 4: 1, 5: 1, 7: 1, 8: 1, 10: 0, 11: 0, 12: 0}, []int{1, 2, 4, 5, 7, 8}},
+		{"nothing", make([]bool, 8),
+			map[int]uint64{1: 0, 2: 0, 3: 0, 4: 0, 5: 0, 7: 0, 8: 0, 10: 0, 11: 0, 12: 0}, []int{}},
+		{"only g", []bool{false, false, false, false, false, false, false, true},
+			map[int]uint64{1: 0, 2: 0, 3: 0, 4: 0, 5: 0, 7: 0, 8: 0, 10: 1, 11: 1, 12: 1}, []int{10, 11, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc, err := ComputeLineCoverage(l, tt.bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packed, err := ComputeLineCoverageFromBitVector(l, BitVectorFromBools(tt.bv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(packed, lc) {
+				t.Error("line coverage of the packed vector differs")
+			}
+			if !reflect.DeepEqual(lc.SortedFiles(), []string{"a.cc", "b.cc"}) {
+				t.Errorf("files %v", lc.SortedFiles())
+			}
+			if mapped, _ := lc.Files["b.cc"].Summary(); mapped != 0 {
+				t.Errorf("b.cc has %d mapped lines", mapped)
+			}
+
+			f := lc.Files["a.cc"]
+			for line := 0; line < 14; line++ {
+				count, mapped := f.Line(line)
+				want, ok := tt.lines[line]
+				if mapped != ok || count != want {
+					t.Errorf("line %d has count %d, mapped %v, want %d, %v", line, count, mapped, want, ok)
+				}
+				if f.Covered(line) != (want > 0) {
+					t.Errorf("line %d covered %v", line, f.Covered(line))
+				}
+			}
+			if got := f.CoveredLines(); !reflect.DeepEqual(got, tt.covered) {
+				t.Errorf("covered lines %v, want %v", got, tt.covered)
+			}
+			if mapped, covered := f.Summary(); mapped != len(tt.lines) || covered != len(tt.covered) {
+				t.Errorf("summary %d, %d, want %d, %d", mapped, covered, len(tt.lines), len(tt.covered))
+			}
+		})
+	}
+
+	if _, err := ComputeLineCoverage(l, make([]bool, 7)); err == nil {
+		t.Error("computed line coverage of a vector of the wrong length")
+	}
+	if _, err := ComputeLineCoverageFromBitVector(l, NewBitVector(9)); err == nil {
+		t.Error("computed line coverage of a packed vector of the wrong length")
+	}
+	if _, err := ComputeLineCoverageFromCounts(l, make([]uint64, 1)); err == nil {
+		t.Error("computed line coverage of a count vector of the wrong length")
+	}
+}
+
+func TestLineCoverageFileRoundTrip(t *testing.T) {
+	l, counts := linesTestCounts(t)
+	lc, err := ComputeLineCoverageFromCounts(l, counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "lines.csv")
+	if err = WriteLineCoverageToFile(lc, fName); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadLineCoverageFile(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.SortedFiles(), lc.SortedFiles()) {
+		t.Fatalf("files %v, want %v", got.SortedFiles(), lc.SortedFiles())
+	}
+	for name, want := range lc.Files {
+		f := got.Files[name]
+		if !reflect.DeepEqual(f.MappedLines(), want.MappedLines()) {
+			t.Errorf("%s has mapped lines %v, want %v", name, f.MappedLines(), want.MappedLines())
+		}
+		for _, line := range want.MappedLines() {
+			count, _ := f.Line(line)
+			if wantCount, _ := want.Line(line); count != wantCount {
+				t.Errorf("%s:%d has count %d, want %d", name, line, count, wantCount)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"bad line", "File,Line,Count\na.cc,x,1\n"},
+		{"zero line", "File,Line,Count\na.cc,0,1\n"},
+		{"bad count", "File,Line,Count\na.cc,1,-1\n"},
+		{"out of order", "File,Line,Count\na.cc,2,1\na.cc,1,1\n"},
+		{"repeated line", "File,Line,Count\na.cc,2,1\na.cc,2,1\n"},
+		{"missing field", "File,Line,Count\na.cc,2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(dir, "invalid.csv")
+			if err := ioutil.WriteFile(fName, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadLineCoverageFile(fName); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
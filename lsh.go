@@ -0,0 +1,443 @@
+package profparse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+)
+
+// An LSH index file stores the MinHash signatures of crawls; the band buckets are rebuilt when it
+// is read:
+//
+//	header: "PPLH", u16 version, u16 granularity, 16 byte layout fingerprint, u32 number of hashes,
+//	  u32 number of bands, u64 seed, u32 checksum of the exclude vector, u32 number of crawls,
+//	  u64 number of bits in each vector
+//	crawls: for each crawl, u16-length site, crawl and path, then its signature as u32 values
+//	trailer: u32 checksum of the header and crawls, "PPLH"
+//
+// All integers are little endian.
+const (
+	lshMagic       = "PPLH"
+	lshVersion     = 1
+	lshHeaderSize  = 56
+	lshTrailerSize = 8
+)
+
+// MinHasher computes MinHash signatures of coverage vectors, whose similarity estimates the
+// Jaccard index of the vectors. Each covered region is hashed once into one of NumHashes bins
+// (one permutation hashing), and empty bins borrow the value of the next bin that is not, so
+// computing a signature takes time linear in the regions covered.
+type MinHasher struct {
+	NumHashes int
+	Seed      uint64
+}
+
+// MinHashSignature is the MinHash signature of a vector, one value per hash
+type MinHashSignature []uint32
+
+// mix64 is the splitmix64 finalizer, a cheap hash of 64 bit integers
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Signature returns the signature of the regions covered by bv and not set in exclude, which may be
+// nil
+func (h MinHasher) Signature(bv *BitVector, exclude *BitVector) (MinHashSignature, error) {
+	if h.NumHashes < 1 {
+		return nil, errors.New("minhash needs at least one hash")
+	}
+	if exclude != nil && exclude.Len() != bv.Len() {
+		return nil, errors.New("bv length does not match exclude vector length")
+	}
+
+	sig := make(MinHashSignature, h.NumHashes)
+	filled := make([]bool, h.NumHashes)
+	for i, w := range bv.words {
+		if exclude != nil {
+			w &^= exclude.words[i]
+		}
+		for w != 0 {
+			j := bits.LeadingZeros64(w)
+			w &^= 1 << uint(63-j)
+
+			x := mix64(uint64(i*64+j) + h.Seed*0x9e3779b97f4a7c15)
+			bin := int((x >> 32) * uint64(h.NumHashes) >> 32)
+			if v := uint32(x); !filled[bin] || v < sig[bin] {
+				sig[bin] = v
+				filled[bin] = true
+			}
+		}
+	}
+
+	// Fill each empty bin from the next bin to its right that is not empty, hashing in the
+	// distance so that different empty bins do not all agree
+	for b := range sig {
+		if filled[b] {
+			continue
+		}
+		sig[b] = math.MaxUint32
+		for d := 1; d < h.NumHashes; d++ {
+			from := (b + d) % h.NumHashes
+			if filled[from] {
+				sig[b] = uint32(mix64(uint64(sig[from]) | uint64(d)<<32))
+				break
+			}
+		}
+	}
+
+	return sig, nil
+}
+
+// EstimateJaccard returns the fraction of values two signatures share, an estimate of the Jaccard
+// index of their vectors
+func (s MinHashSignature) EstimateJaccard(o MinHashSignature) float64 {
+	if len(s) != len(o) || len(s) == 0 {
+		return 0
+	}
+	same := 0
+	for i := range s {
+		if s[i] == o[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(s))
+}
+
+// LSHCrawl is a crawl in an LSH index
+type LSHCrawl struct {
+	Site      string
+	Crawl     string
+	Path      string // Path of the crawl's vector, to compare it exactly
+	Signature MinHashSignature
+}
+
+// LSHCandidate is a crawl found by an LSH query
+type LSHCandidate struct {
+	Index    int // Position of the crawl in LSHIndex.Crawls
+	Estimate float64
+}
+
+// LSHIndex finds crawls with similar signatures by splitting signatures into bands of rows. Crawls
+// that agree on every row of any band are candidates, so with b bands of r rows, crawls with a
+// Jaccard index of s are found with probability 1-(1-s^r)^b. It is safe for concurrent queries.
+type LSHIndex struct {
+	Hasher      MinHasher
+	Bands       int
+	Granularity BVGranularity
+	Layout      LayoutFingerprint
+	NumBits     int // Length of the indexed vectors, 0 if the index is empty
+	Crawls      []LSHCrawl
+
+	excludeSum uint32
+	buckets    []map[uint64][]int32
+}
+
+// NewLSHIndex returns an empty index of signatures from hasher, split into the given number of
+// bands. exclude, which may be nil, is the vector the signatures are computed with.
+func NewLSHIndex(hasher MinHasher, bands int, exclude *BitVector) (*LSHIndex, error) {
+	if hasher.NumHashes < 1 || bands < 1 || hasher.NumHashes%bands != 0 {
+		return nil, errors.New("number of hashes must be a multiple of the number of bands")
+	}
+
+	x := &LSHIndex{
+		Hasher:     hasher,
+		Bands:      bands,
+		Crawls:     make([]LSHCrawl, 0),
+		excludeSum: lshExcludeSum(exclude),
+		buckets:    make([]map[uint64][]int32, bands),
+	}
+	for b := range x.buckets {
+		x.buckets[b] = make(map[uint64][]int32)
+	}
+	return x, nil
+}
+
+func lshExcludeSum(exclude *BitVector) uint32 {
+	if exclude == nil {
+		return 0
+	}
+	return crc32.Checksum(exclude.Bytes(), crcTable)
+}
+
+// CheckExclude returns an error if the index was built with another exclude vector
+func (x *LSHIndex) CheckExclude(exclude *BitVector) error {
+	if lshExcludeSum(exclude) != x.excludeSum {
+		return errors.New("exclude vector does not match the one the index was built with")
+	}
+	return nil
+}
+
+// CheckVector returns an error if bv, read with header h, cannot be compared with the indexed
+// vectors
+func (x *LSHIndex) CheckVector(bv *BitVector, h BVHeader) error {
+	err := CheckSameLayout(BVHeader{Layout: x.Layout, Granularity: x.Granularity}, h)
+	if err != nil {
+		return err
+	}
+	if x.NumBits > 0 && bv.Len() != x.NumBits {
+		return errors.New("bit vector length does not match the index")
+	}
+	return nil
+}
+
+// bandKey hashes the rows of band b of a signature
+func (x *LSHIndex) bandKey(sig MinHashSignature, b int) uint64 {
+	rows := x.Hasher.NumHashes / x.Bands
+	key := uint64(b)
+	for _, v := range sig[b*rows : (b+1)*rows] {
+		key = mix64(key ^ uint64(v))
+	}
+	return key
+}
+
+// Add adds a crawl to the index
+func (x *LSHIndex) Add(c LSHCrawl) error {
+	if len(c.Signature) != x.Hasher.NumHashes {
+		return errors.New("signature length does not match index")
+	}
+
+	i := int32(len(x.Crawls))
+	x.Crawls = append(x.Crawls, c)
+	for b := range x.buckets {
+		key := x.bandKey(c.Signature, b)
+		x.buckets[b][key] = append(x.buckets[b][key], i)
+	}
+	return nil
+}
+
+// Query returns the crawls that share a band with sig, most similar first
+func (x *LSHIndex) Query(sig MinHashSignature) ([]LSHCandidate, error) {
+	if len(sig) != x.Hasher.NumHashes {
+		return nil, errors.New("signature length does not match index")
+	}
+
+	seen := make(map[int32]bool)
+	candidates := make([]LSHCandidate, 0)
+	for b := range x.buckets {
+		for _, i := range x.buckets[b][x.bandKey(sig, b)] {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			candidates = append(candidates, LSHCandidate{
+				Index:    int(i),
+				Estimate: sig.EstimateJaccard(x.Crawls[i].Signature),
+			})
+		}
+	}
+
+	sort.Slice(candidates, func(a, b int) bool {
+		if candidates[a].Estimate != candidates[b].Estimate {
+			return candidates[a].Estimate > candidates[b].Estimate
+		}
+		return candidates[a].Index < candidates[b].Index
+	})
+	return candidates, nil
+}
+
+// BuildLSHIndex computes the signatures of the vectors at covPaths with workers goroutines and adds
+// them to a new index, in order. Vectors that cannot be read, or whose layout or length differs from
+// the first readable vector, are logged and left out of the index; their paths are returned.
+func BuildLSHIndex(covPaths []string, hasher MinHasher, bands int, exclude *BitVector, workers int) (*LSHIndex,
+	[]string, error) {
+	x, err := NewLSHIndex(hasher, bands, exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(covPaths) == 0 {
+		return x, nil, nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	start, first, h, skipped, err := readFirstVector(covPaths)
+	if err != nil {
+		return nil, skipped, err
+	}
+	covPaths = covPaths[start:]
+	x.Granularity = h.Granularity
+	x.Layout = h.Layout
+	x.NumBits = first.Len()
+
+	crawls := make([]LSHCrawl, len(covPaths))
+	errs := make([]error, len(covPaths))
+	indices := make(chan int, len(covPaths))
+	for i := range covPaths {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				bv, err := readMatchingVector(covPaths[i], h, first.Len())
+				if err == nil {
+					crawls[i].Signature, err = hasher.Signature(bv, exclude)
+					if err != nil {
+						err = errors.New(covPaths[i] + ": " + err.Error())
+					}
+				}
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				crawls[i].Site, crawls[i].Crawl = CrawlForCovPath(covPaths[i])
+				crawls[i].Path = covPaths[i]
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range crawls {
+		if errs[i] != nil {
+			log.Warnf("Skipping %v", errs[i])
+			skipped = append(skipped, covPaths[i])
+			continue
+		}
+		if err = x.Add(c); err != nil {
+			return nil, skipped, err
+		}
+	}
+	return x, skipped, nil
+}
+
+// WriteLSHIndex writes an index to disk
+func WriteLSHIndex(fName string, x *LSHIndex) error {
+	f, err := os.Create(fName)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(w, crc)
+
+	header := make([]byte, lshHeaderSize)
+	copy(header, lshMagic)
+	binary.LittleEndian.PutUint16(header[4:], lshVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(x.Granularity))
+	copy(header[8:], x.Layout[:])
+	binary.LittleEndian.PutUint32(header[24:], uint32(x.Hasher.NumHashes))
+	binary.LittleEndian.PutUint32(header[28:], uint32(x.Bands))
+	binary.LittleEndian.PutUint64(header[32:], x.Hasher.Seed)
+	binary.LittleEndian.PutUint32(header[40:], x.excludeSum)
+	binary.LittleEndian.PutUint32(header[44:], uint32(len(x.Crawls)))
+	binary.LittleEndian.PutUint64(header[48:], uint64(x.NumBits))
+	out.Write(header)
+
+	buf := make([]byte, 0)
+	for _, c := range x.Crawls {
+		if len(c.Site) > 0xffff || len(c.Crawl) > 0xffff || len(c.Path) > 0xffff {
+			f.Close()
+			return errors.New("crawl identifier too long")
+		}
+		buf = appendBVString(buf[:0], c.Site)
+		buf = appendBVString(buf, c.Crawl)
+		buf = appendBVString(buf, c.Path)
+		for _, v := range c.Signature {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], v)
+			buf = append(buf, b[:]...)
+		}
+		out.Write(buf)
+	}
+
+	trailer := make([]byte, lshTrailerSize)
+	binary.LittleEndian.PutUint32(trailer, crc.Sum32())
+	copy(trailer[4:], lshMagic)
+	w.Write(trailer)
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadLSHIndex reads an index written by WriteLSHIndex
+func ReadLSHIndex(fName string) (*LSHIndex, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := parseLSHIndex(data)
+	if err != nil {
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+	return x, nil
+}
+
+func parseLSHIndex(data []byte) (*LSHIndex, error) {
+	errCorrupt := errors.New("corrupt lsh index")
+	if len(data) < lshHeaderSize+lshTrailerSize || string(data[:4]) != lshMagic {
+		return nil, errors.New("not an lsh index")
+	}
+	if binary.LittleEndian.Uint16(data[4:]) != lshVersion {
+		return nil, errors.New("unsupported lsh index version")
+	}
+	trailer := data[len(data)-lshTrailerSize:]
+	body := data[:len(data)-lshTrailerSize]
+	if string(trailer[4:]) != lshMagic || crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(trailer) {
+		return nil, errCorrupt
+	}
+
+	hasher := MinHasher{
+		NumHashes: int(binary.LittleEndian.Uint32(data[24:])),
+		Seed:      binary.LittleEndian.Uint64(data[32:]),
+	}
+	x, err := NewLSHIndex(hasher, int(binary.LittleEndian.Uint32(data[28:])), nil)
+	if err != nil {
+		return nil, errCorrupt
+	}
+	x.Granularity = BVGranularity(binary.LittleEndian.Uint16(data[6:]))
+	copy(x.Layout[:], data[8:])
+	x.excludeSum = binary.LittleEndian.Uint32(data[40:])
+	numCrawls := int(binary.LittleEndian.Uint32(data[44:]))
+	x.NumBits = int(binary.LittleEndian.Uint64(data[48:]))
+
+	pos := lshHeaderSize
+	for i := 0; i < numCrawls; i++ {
+		var c LSHCrawl
+		var ok bool
+		c.Site, pos, ok = readBVString(body, pos)
+		if ok {
+			c.Crawl, pos, ok = readBVString(body, pos)
+		}
+		if ok {
+			c.Path, pos, ok = readBVString(body, pos)
+		}
+		if !ok || len(body)-pos < 4*hasher.NumHashes {
+			return nil, errCorrupt
+		}
+		c.Signature = make(MinHashSignature, hasher.NumHashes)
+		for k := range c.Signature {
+			c.Signature[k] = binary.LittleEndian.Uint32(body[pos:])
+			pos += 4
+		}
+		x.Add(c)
+	}
+	if pos != len(body) {
+		return nil, errCorrupt
+	}
+
+	return x, nil
+}
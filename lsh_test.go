@@ -0,0 +1,238 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMinHashEstimate(t *testing.T) {
+	r := rand.New(rand.NewSource(21))
+	const n = 200000
+	h := MinHasher{NumHashes: 256, Seed: 7}
+
+	for _, shared := range []float64{0.0, 0.1, 0.5, 0.9, 0.99} {
+		a := NewBitVector(n)
+		b := NewBitVector(n)
+		for i := 0; i < n; i++ {
+			if r.Float64() < 0.1 {
+				a.Set(i)
+				b.SetTo(i, r.Float64() < 0.5+shared/2)
+			} else if r.Float64() < 0.05 {
+				b.Set(i)
+			}
+		}
+		sa, err := h.Signature(a, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := h.Signature(b, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := CompareBitVectors(a, b, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est := sa.EstimateJaccard(sb); math.Abs(est-o.Jaccard()) > 0.1 {
+			t.Errorf("estimated %.3f for a jaccard index of %.3f", est, o.Jaccard())
+		}
+	}
+}
+
+func TestMinHashSignature(t *testing.T) {
+	const n = 200000
+	h := MinHasher{NumHashes: 256, Seed: 7}
+	sparse := NewBitVector(n)
+	sparse.Set(5)
+	sparse.Set(100)
+	withoutLast := sparse.Clone()
+	withoutLast.Clear(100)
+	exclude := NewBitVector(n)
+	exclude.Set(100)
+
+	signature := func(bv *BitVector, exclude *BitVector) MinHashSignature {
+		sig, err := h.Signature(bv, exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	tests := []struct {
+		name string
+		a    MinHashSignature
+		b    MinHashSignature
+		min  float64
+		max  float64
+	}{
+		{"identical sparse vectors", signature(sparse, nil), signature(sparse.Clone(), nil), 1, 1},
+		{"empty and sparse vectors", signature(NewBitVector(n), nil), signature(sparse, nil), 0, 0.1},
+		{"excluded region", signature(sparse, exclude), signature(withoutLast, nil), 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if est := tt.a.EstimateJaccard(tt.b); est < tt.min || est > tt.max {
+				t.Errorf("estimate = %v, want between %v and %v", est, tt.min, tt.max)
+			}
+		})
+	}
+	if !reflect.DeepEqual(tests[2].a, tests[2].b) {
+		t.Error("excluding a region does not give the signature of the vector without it")
+	}
+}
+
+func TestLSHIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(22))
+	const numBits = 20000
+	dir := t.TempDir()
+	paths, _ := writeTestVectors(t, dir, r, 60, numBits)
+
+	// Every tenth crawl is a near duplicate of the same vector
+	base := randomBools(r, numBits)
+	for i := 0; i < len(paths); i += 10 {
+		bv := append([]bool{}, base...)
+		for k := 0; k < 50; k++ {
+			j := r.Intn(len(bv))
+			bv[j] = !bv[j]
+		}
+		if err := WriteBVFile(paths[i], bv, BVHeader{Layout: LayoutFingerprint{1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	x, skipped, err := BuildLSHIndex(paths, MinHasher{NumHashes: 128, Seed: 3}, 32, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 || len(x.Crawls) != len(paths) {
+		t.Fatalf("indexed %d crawls, skipped %v", len(x.Crawls), skipped)
+	}
+	out := filepath.Join(dir, "index.lsh")
+	if err = WriteLSHIndex(out, x); err != nil {
+		t.Fatal(err)
+	}
+	y, err := ReadLSHIndex(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x.Crawls, y.Crawls) || y.Bands != 32 || y.Hasher != x.Hasher || y.Layout != x.Layout ||
+		y.NumBits != numBits {
+		t.Fatal("index read back differs")
+	}
+	if y.CheckExclude(nil) != nil || y.CheckExclude(NewBitVector(numBits)) == nil {
+		t.Error("exclude vector check")
+	}
+
+	bv, h, err := ReadBitVectorFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		bv *BitVector
+		h  BVHeader
+		ok bool
+	}{
+		{bv, h, true},
+		{bv, BVHeader{}, true},
+		{bv, BVHeader{Layout: LayoutFingerprint{2}}, false},
+		{bv, BVHeader{Layout: LayoutFingerprint{1}, Granularity: FunctionGranularity}, false},
+		{NewBitVector(numBits - 1), h, false},
+	}
+	for i, c := range checks {
+		if err := y.CheckVector(c.bv, c.h); (err == nil) != c.ok {
+			t.Errorf("check %d: %v", i, err)
+		}
+	}
+	sig, err := y.Hasher.Signature(bv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := y.Query(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	similar := 0
+	for _, c := range candidates {
+		if c.Estimate > 0.8 {
+			similar++
+			if c.Index%10 != 0 {
+				t.Errorf("crawl %d is not a near duplicate", c.Index)
+			}
+		}
+	}
+	if similar != 6 {
+		t.Errorf("found %d near duplicates, want 6", similar)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[100] ^= 1
+	if err = ioutil.WriteFile(out, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadLSHIndex(out); err == nil {
+		t.Error("read a corrupt index")
+	}
+	if _, err = NewLSHIndex(MinHasher{NumHashes: 100}, 32, nil); err == nil {
+		t.Error("expected an error for bands that do not divide the hashes")
+	}
+}
+
+func TestLSHIndexSkipsBadVectors(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	paths, vectors := writeTestVectors(t, t.TempDir(), r, 20, 3000)
+
+	layout := BVHeader{Layout: LayoutFingerprint{1}}
+	otherLayout := BVHeader{Layout: LayoutFingerprint{2}}
+	bad := map[int]func(string) error{
+		0:  os.Remove,
+		4:  func(p string) error { return ioutil.WriteFile(p, []byte("garbage"), 0644) },
+		9:  func(p string) error { return WriteBVFile(p, randomBools(r, 2999), layout) },
+		15: func(p string) error { return WriteBVFile(p, randomBools(r, 3000), otherLayout) },
+	}
+	var goodPaths, wantSkipped []string
+	var goodVectors [][]bool
+	for i, covPath := range paths {
+		if breakVector, ok := bad[i]; ok {
+			if err := breakVector(covPath); err != nil {
+				t.Fatal(err)
+			}
+			wantSkipped = append(wantSkipped, covPath)
+			continue
+		}
+		goodPaths = append(goodPaths, covPath)
+		goodVectors = append(goodVectors, vectors[i])
+	}
+
+	hasher := MinHasher{NumHashes: 64, Seed: 5}
+	x, skipped, err := BuildLSHIndex(paths, hasher, 16, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped %v, want %v", skipped, wantSkipped)
+	}
+	if len(x.Crawls) != len(goodPaths) {
+		t.Fatalf("indexed %d crawls, want %d", len(x.Crawls), len(goodPaths))
+	}
+	for i, c := range x.Crawls {
+		sig, err := hasher.Signature(BitVectorFromBools(goodVectors[i]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Path != goodPaths[i] || !reflect.DeepEqual(c.Signature, sig) {
+			t.Errorf("crawl %d is %s, want %s", i, c.Path, goodPaths[i])
+		}
+	}
+
+	_, _, err = BuildLSHIndex(paths[:1], hasher, 16, nil, 1)
+	if err == nil {
+		t.Error("expected an error when no vector can be read")
+	}
+}
@@ -0,0 +1,282 @@
+package profparse
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type RegionKind int
+
+// Region kinds, numbered as in LLVM's CounterMappingRegion
+const (
+	RegionCode RegionKind = iota
+	RegionExpansion
+	RegionSkipped
+	RegionGap
+	RegionBranch
+	RegionMCDCDecision
+	RegionMCDCBranch
+)
+
+func (k RegionKind) String() string {
+	switch k {
+	case RegionCode:
+		return "code"
+	case RegionExpansion:
+		return "expansion"
+	case RegionSkipped:
+		return "skipped"
+	case RegionGap:
+		return "gap"
+	case RegionBranch:
+		return "branch"
+	case RegionMCDCDecision:
+		return "mcdc-decision"
+	case RegionMCDCBranch:
+		return "mcdc-branch"
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// ParseRegionKind accepts either the name of a region kind or its number
+func ParseRegionKind(s string) (RegionKind, error) {
+	for k := RegionCode; k <= RegionMCDCBranch; k++ {
+		if s == k.String() {
+			return k, nil
+		}
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < int(RegionCode) || n > int(RegionMCDCBranch) {
+		return RegionCode, errors.New("invalid region kind")
+	}
+	return RegionKind(n), nil
+}
+
+type CounterKind int
+
+// Counter kinds, numbered as in the tag bits of LLVM's encoded counters
+const (
+	CounterZero CounterKind = iota
+	CounterReference
+	CounterSubtract
+	CounterAdd
+)
+
+// Counter is either zero, a reference to one of a function's profile counters, or a reference
+// to one of its counter expressions
+type Counter struct {
+	Kind CounterKind
+	ID   int
+}
+
+// CounterExpression is LHS - RHS or LHS + RHS, depending on Kind
+type CounterExpression struct {
+	Kind CounterKind
+	LHS  Counter
+	RHS  Counter
+}
+
+type MappingRegion struct {
+	Kind           RegionKind
+	Count          Counter
+	FalseCount     Counter // Only used by branch regions
+	FileID         int
+	ExpandedFileID int
+	LineStart      int
+	ColumnStart    int
+	LineEnd        int
+	ColumnEnd      int
+}
+
+// FunctionMapping is the coverage mapping of a single function, describing how to compute the
+// execution count of each of its regions from the counters in a profile
+type FunctionMapping struct {
+	Name        string
+	NameRef     uint64
+	Hash        uint64
+	Filenames   []string
+	Expressions []CounterExpression
+	Regions     []MappingRegion
+}
+
+// FileName returns the file the function is defined in
+func (fm *FunctionMapping) FileName() string {
+	if len(fm.Filenames) == 0 {
+		return ""
+	}
+	return fm.Filenames[0]
+}
+
+// Evaluate computes the value of c given the function's profile counters. As in llvm-cov,
+// references to counters that are not in the profile evaluate to zero.
+func (fm *FunctionMapping) Evaluate(c Counter, counters []uint64) (uint64, error) {
+	return fm.evaluate(c, counters, 0)
+}
+
+func (fm *FunctionMapping) evaluate(c Counter, counters []uint64, depth int) (uint64, error) {
+	if depth > len(fm.Expressions) {
+		return 0, errors.New("cyclic counter expression in " + fm.Name)
+	}
+
+	switch c.Kind {
+	case CounterZero:
+		return 0, nil
+	case CounterReference:
+		if c.ID < 0 || c.ID >= len(counters) {
+			return 0, nil
+		}
+		return counters[c.ID], nil
+	case CounterSubtract, CounterAdd:
+		if c.ID < 0 || c.ID >= len(fm.Expressions) {
+			return 0, errors.New("invalid counter expression in " + fm.Name)
+		}
+		e := fm.Expressions[c.ID]
+		lhs, err := fm.evaluate(e.LHS, counters, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		rhs, err := fm.evaluate(e.RHS, counters, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if e.Kind == CounterAdd {
+			return lhs + rhs, nil
+		}
+		if rhs > lhs {
+			return 0, nil
+		}
+		return lhs - rhs, nil
+	}
+
+	return 0, errors.New("invalid counter kind in " + fm.Name)
+}
+
+// CounterSource provides the profile counters for a function, identified by the MD5 of its
+// name and its structural hash. Profile implements it.
+type CounterSource interface {
+	LookupRef(nameRef uint64, hash uint64) ([]uint64, bool)
+}
+
+// MappingRecords produces the same records a coverage report for the profile would contain,
+// using the coverage mappings to compute region execution counts. Branch and MC/DC branch
+// regions are reported as BranchRecords, MC/DC decision regions are left out, and each function
+// is only reported once per file.
+func MappingRecords(mappings []FunctionMapping, counters CounterSource) RecordSource {
+	return &mappingRecordSource{
+		mappings: mappings,
+		counters: counters,
+	}
+}
+
+type mappingRecordSource struct {
+	mappings []FunctionMapping
+	counters CounterSource
+}
+
+func (m *mappingRecordSource) Walk(fn func(Record) error) error {
+	fileOrder := make([]string, 0)
+	fileFuncs := make(map[string][]int)
+	seenFuncs := make(map[string]map[string]bool)
+
+	for i := range m.mappings {
+		fileName := m.mappings[i].FileName()
+		if fileName == "" {
+			return errors.New("function " + m.mappings[i].Name + " has no filenames")
+		}
+
+		if _, ok := seenFuncs[fileName]; !ok {
+			seenFuncs[fileName] = make(map[string]bool)
+			fileOrder = append(fileOrder, fileName)
+		}
+		funcName := m.mappings[i].funcName()
+		if seenFuncs[fileName][funcName] {
+			continue
+		}
+		seenFuncs[fileName][funcName] = true
+		fileFuncs[fileName] = append(fileFuncs[fileName], i)
+	}
+
+	for _, fileName := range fileOrder {
+		err := fn(Record{Kind: FileRecord, File: fileName})
+		if err != nil {
+			return err
+		}
+
+		for _, i := range fileFuncs[fileName] {
+			err = m.walkFunction(&m.mappings[i], fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *mappingRecordSource) walkFunction(fm *FunctionMapping, fn func(Record) error) error {
+	fileName := fm.FileName()
+	funcName := fm.funcName()
+
+	err := fn(Record{Kind: FunctionRecord, File: fileName, Function: funcName})
+	if err != nil {
+		return err
+	}
+
+	counters, _ := m.counters.LookupRef(fm.NameRef, fm.Hash)
+
+	for _, mr := range fm.Regions {
+		if mr.Kind == RegionMCDCDecision {
+			continue
+		}
+
+		executions, err := fm.Evaluate(mr.Count, counters)
+		if err != nil {
+			return err
+		}
+
+		rec := Record{
+			Kind:       RegionRecord,
+			File:       fileName,
+			Function:   funcName,
+			Executions: executions,
+		}
+		if mr.Kind == RegionBranch || mr.Kind == RegionMCDCBranch {
+			rec.Kind = BranchRecord
+			rec.FalseExecutions, err = fm.Evaluate(mr.FalseCount, counters)
+			if err != nil {
+				return err
+			}
+		}
+		rec.Region.FileName = fileName
+		if mr.FileID > 0 && mr.FileID < len(fm.Filenames) {
+			rec.Region.FileName = fm.Filenames[mr.FileID]
+		}
+		rec.Region.FuncName = funcName
+		rec.Region.LineStart = mr.LineStart
+		rec.Region.ColumnStart = mr.ColumnStart
+		rec.Region.LineEnd = mr.LineEnd
+		rec.Region.ColumnEnd = mr.ColumnEnd
+		rec.Region.FileID = mr.FileID
+		rec.Region.ExpandedFileID = mr.ExpandedFileID
+		rec.Region.Kind = mr.Kind
+		rec.Region.Counter = mr.Count
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// funcName returns the name of the function, falling back to its name hash when the
+// name is unknown
+func (fm *FunctionMapping) funcName() string {
+	if fm.Name == "" {
+		return fmt.Sprintf("%016x", fm.NameRef)
+	}
+	return fm.Name
+}
@@ -0,0 +1,490 @@
+package profparse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// A coverage matrix stores the vectors of many crawls transposed, with one row of crawl bits per
+// region, so that the crawls covering a region can be read without reading every vector. Columns
+// are split into blocks of the same width, and each block is stored row by row:
+//
+//	header: "PPRM", u16 version, u16 granularity, 16 byte layout fingerprint, u64 number of rows,
+//	  u64 number of columns, u32 columns per block, u32 reserved
+//	blocks: rows of u64 words of column bits, in BitVector bit order
+//	counts: u32 number of columns set in each row
+//	crawls: for each column, u16-length site and crawl, u64 number of rows set
+//	trailer: u64 offset of the counts, u64 offset of the crawls, u32 checksum of the header,
+//	  counts and crawls, "PPRM"
+//
+// All integers are little endian.
+const (
+	matrixMagic       = "PPRM"
+	matrixVersion     = 1
+	matrixHeaderSize  = 48
+	matrixTrailerSize = 24
+
+	// Rows read at once when scanning a matrix
+	matrixScanRows = 1 << 16
+)
+
+// MatrixCrawl is a column of a coverage matrix
+type MatrixCrawl struct {
+	Site    string
+	Crawl   string
+	Covered int // Number of regions the crawl covered
+}
+
+// CoverageMatrix reads a coverage matrix file. It is safe for concurrent use.
+type CoverageMatrix struct {
+	Granularity BVGranularity
+	Layout      LayoutFingerprint
+	Crawls      []MatrixCrawl
+
+	f          *os.File
+	numRows    int
+	blockWords int
+	numBlocks  int
+	counts     []uint32
+	crawlIndex map[packKey]int
+}
+
+// BuildCoverageMatrix transposes the vectors at covPaths into a coverage matrix. Columns are
+// transposed a block at a time, with blocks as wide as memoryBudget allows, so the whole matrix is
+// never held in memory. Vectors that cannot be read, or whose layout or length differs from the
+// first readable vector, are logged and left out of the matrix; their paths are returned.
+func BuildCoverageMatrix(outFile string, covPaths []string, memoryBudget int64, workers int) ([]string, error) {
+	if len(covPaths) == 0 {
+		return nil, errors.New("no vectors to build a coverage matrix from")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	start, first, h, skipped, err := readFirstVector(covPaths)
+	if err != nil {
+		return skipped, err
+	}
+	remaining := append([]string{}, covPaths[start:]...)
+	numRows := first.Len()
+	numCols := len(remaining)
+
+	// Each worker holds one vector, and the block being transposed takes the rest
+	blockBudget := memoryBudget - int64(workers)*int64(numRows/8)
+	blockWords := int(blockBudget / 8 / int64(numRows+1))
+	if blockWords < 1 {
+		blockWords = 1
+	}
+	if blockWords > (numCols+63)/64 {
+		blockWords = (numCols + 63) / 64
+	}
+	log.Infof("Transposing %d vectors in blocks of %d columns", numCols, blockWords*64)
+
+	f, err := os.Create(outFile)
+	if err != nil {
+		return skipped, err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	// The header is written last, once the number of columns is known
+	header := make([]byte, matrixHeaderSize)
+	w.Write(header)
+
+	crawls := make([]MatrixCrawl, 0, numCols)
+	counts := make([]uint32, numRows)
+	block := make([]uint64, numRows*blockWords)
+	numBlocks := 0
+
+	for len(remaining) > 0 {
+		blockCols := blockWords * 64
+		if blockCols > len(remaining) {
+			blockCols = len(remaining)
+		}
+		for i := range block {
+			block[i] = 0
+		}
+		blockCrawls := make([]MatrixCrawl, blockCols)
+		errs := make([]error, blockCols)
+
+		// Each worker fills whole words, so no two of them write the same word
+		groups := make(chan int, blockWords)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for g := range groups {
+					for c := g * 64; c < (g+1)*64 && c < blockCols; c++ {
+						errs[c] = transposeColumn(remaining[c], h, numRows, block, blockWords, g, c, &blockCrawls[c])
+					}
+				}
+			}()
+		}
+		for g := 0; g*64 < blockCols; g++ {
+			groups <- g
+		}
+		close(groups)
+		wg.Wait()
+
+		// Vectors that could not be transposed are dropped, and the block transposed again with
+		// the vectors after it
+		kept := make([]string, 0, len(remaining))
+		for c, err := range errs {
+			if err != nil {
+				log.Warnf("Skipping %v", err)
+				skipped = append(skipped, remaining[c])
+			} else {
+				kept = append(kept, remaining[c])
+			}
+		}
+		if len(kept) < blockCols {
+			remaining = append(kept, remaining[blockCols:]...)
+			continue
+		}
+
+		var word [8]byte
+		for r := 0; r < numRows; r++ {
+			for _, x := range block[r*blockWords : (r+1)*blockWords] {
+				counts[r] += uint32(bits.OnesCount64(x))
+				binary.LittleEndian.PutUint64(word[:], x)
+				w.Write(word[:])
+			}
+		}
+		crawls = append(crawls, blockCrawls...)
+		remaining = remaining[blockCols:]
+		numBlocks++
+		log.Infof("Transposed block %d, %d vectors left", numBlocks, len(remaining))
+	}
+
+	if len(crawls) == 0 {
+		f.Close()
+		os.Remove(outFile)
+		return skipped, errors.New("no readable vectors to build a coverage matrix from")
+	}
+
+	copy(header, matrixMagic)
+	binary.LittleEndian.PutUint16(header[4:], matrixVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(h.Granularity))
+	copy(header[8:], h.Layout[:])
+	binary.LittleEndian.PutUint64(header[24:], uint64(numRows))
+	binary.LittleEndian.PutUint64(header[32:], uint64(len(crawls)))
+	binary.LittleEndian.PutUint32(header[40:], uint32(blockWords*64))
+	crc := crc32.New(crcTable)
+	crc.Write(header)
+
+	countsOffset := int64(matrixHeaderSize) + int64(numBlocks)*int64(numRows)*int64(blockWords)*8
+	tail := make([]byte, 4*numRows)
+	for r, count := range counts {
+		binary.LittleEndian.PutUint32(tail[4*r:], count)
+	}
+	crawlsOffset := countsOffset + int64(len(tail))
+	for _, c := range crawls {
+		tail = appendBVString(tail, c.Site)
+		tail = appendBVString(tail, c.Crawl)
+		var covered [8]byte
+		binary.LittleEndian.PutUint64(covered[:], uint64(c.Covered))
+		tail = append(tail, covered[:]...)
+	}
+	crc.Write(tail)
+
+	trailer := make([]byte, matrixTrailerSize)
+	binary.LittleEndian.PutUint64(trailer, uint64(countsOffset))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(crawlsOffset))
+	binary.LittleEndian.PutUint32(trailer[16:], crc.Sum32())
+	copy(trailer[20:], matrixMagic)
+	w.Write(tail)
+	w.Write(trailer)
+
+	err = w.Flush()
+	if err == nil {
+		_, err = f.WriteAt(header, 0)
+	}
+	if err != nil {
+		f.Close()
+		return skipped, err
+	}
+	return skipped, f.Close()
+}
+
+// readFirstVector reads the first vector of covPaths that can be read, which the others are checked
+// against, returning its index. The paths of vectors before it are returned as skipped.
+func readFirstVector(covPaths []string) (int, *BitVector, BVHeader, []string, error) {
+	skipped := make([]string, 0)
+	for i, covPath := range covPaths {
+		bv, h, err := ReadBitVectorFile(covPath)
+		if err == nil {
+			return i, bv, h, skipped, nil
+		}
+		log.Warnf("Skipping %s: %v", covPath, err)
+		skipped = append(skipped, covPath)
+	}
+	return 0, nil, BVHeader{}, skipped, errors.New("none of the vectors can be read")
+}
+
+// readMatchingVector reads the vector at covPath, checking that it has the layout of h and numBits
+// regions
+func readMatchingVector(covPath string, h BVHeader, numBits int) (*BitVector, error) {
+	bv, bh, err := ReadBitVectorFile(covPath)
+	if err == nil {
+		err = CheckSameLayout(h, bh)
+	}
+	if err == nil && bv.Len() != numBits {
+		err = errors.New("bit vector length does not match other vectors")
+	}
+	if err != nil {
+		return nil, errors.New(covPath + ": " + err.Error())
+	}
+	return bv, nil
+}
+
+// transposeColumn reads the vector at covPath into column c of a block, as bits of word g
+func transposeColumn(covPath string, h BVHeader, numRows int, block []uint64, blockWords int, g int, c int,
+	crawl *MatrixCrawl) error {
+	bv, err := readMatchingVector(covPath, h, numRows)
+	if err != nil {
+		return err
+	}
+
+	mask := uint64(1) << uint(63-c%64)
+	bv.ForEach(func(r int) {
+		block[r*blockWords+g] |= mask
+	})
+
+	crawl.Site, crawl.Crawl = CrawlForCovPath(covPath)
+	crawl.Covered = bv.Count()
+	return nil
+}
+
+// OpenCoverageMatrix opens a coverage matrix file, reading its counts and crawls
+func OpenCoverageMatrix(fName string) (*CoverageMatrix, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readCoverageMatrix(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+	return m, nil
+}
+
+func readCoverageMatrix(f *os.File) (*CoverageMatrix, error) {
+	errCorrupt := errors.New("corrupt coverage matrix")
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < matrixHeaderSize+matrixTrailerSize {
+		return nil, errCorrupt
+	}
+
+	header := make([]byte, matrixHeaderSize)
+	trailer := make([]byte, matrixTrailerSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if _, err = f.ReadAt(trailer, size-matrixTrailerSize); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != matrixMagic || string(trailer[20:]) != matrixMagic {
+		return nil, errors.New("not a coverage matrix")
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != matrixVersion {
+		return nil, errors.New("unsupported coverage matrix version")
+	}
+
+	m := &CoverageMatrix{
+		f:           f,
+		Granularity: BVGranularity(binary.LittleEndian.Uint16(header[6:])),
+		crawlIndex:  make(map[packKey]int),
+	}
+	copy(m.Layout[:], header[8:])
+	numRows := binary.LittleEndian.Uint64(header[24:])
+	numCols := binary.LittleEndian.Uint64(header[32:])
+	blockCols := binary.LittleEndian.Uint32(header[40:])
+	countsOffset := int64(binary.LittleEndian.Uint64(trailer))
+	crawlsOffset := int64(binary.LittleEndian.Uint64(trailer[8:]))
+
+	if blockCols == 0 || blockCols%64 != 0 || numRows > 1<<40 || numCols > 1<<40 {
+		return nil, errCorrupt
+	}
+	m.numRows = int(numRows)
+	m.blockWords = int(blockCols / 64)
+	m.numBlocks = int((numCols + uint64(blockCols) - 1) / uint64(blockCols))
+	blocksSize := int64(m.numBlocks) * int64(m.numRows) * int64(m.blockWords) * 8
+	if countsOffset != matrixHeaderSize+blocksSize || crawlsOffset != countsOffset+4*int64(numRows) ||
+		crawlsOffset > size-matrixTrailerSize {
+		return nil, errCorrupt
+	}
+
+	tail := make([]byte, size-matrixTrailerSize-countsOffset)
+	if _, err = f.ReadAt(tail, countsOffset); err != nil {
+		return nil, err
+	}
+	crc := crc32.Update(crc32.Checksum(header, crcTable), crcTable, tail)
+	if crc != binary.LittleEndian.Uint32(trailer[16:]) {
+		return nil, errCorrupt
+	}
+
+	m.counts = make([]uint32, m.numRows)
+	for r := range m.counts {
+		m.counts[r] = binary.LittleEndian.Uint32(tail[4*r:])
+	}
+
+	pos := 4 * m.numRows
+	m.Crawls = make([]MatrixCrawl, 0)
+	for c := uint64(0); c < numCols; c++ {
+		var crawl MatrixCrawl
+		var ok bool
+		crawl.Site, pos, ok = readBVString(tail, pos)
+		if ok {
+			crawl.Crawl, pos, ok = readBVString(tail, pos)
+		}
+		if !ok || len(tail)-pos < 8 {
+			return nil, errCorrupt
+		}
+		crawl.Covered = int(binary.LittleEndian.Uint64(tail[pos:]))
+		pos += 8
+
+		m.crawlIndex[packKey{crawl.Site, crawl.Crawl, ""}] = len(m.Crawls)
+		m.Crawls = append(m.Crawls, crawl)
+	}
+	if pos != len(tail) {
+		return nil, errCorrupt
+	}
+
+	return m, nil
+}
+
+// Close closes the matrix file
+func (m *CoverageMatrix) Close() error {
+	return m.f.Close()
+}
+
+// NumRegions returns the number of rows of the matrix
+func (m *CoverageMatrix) NumRegions() int {
+	return m.numRows
+}
+
+// NumCrawls returns the number of columns of the matrix
+func (m *CoverageMatrix) NumCrawls() int {
+	return len(m.Crawls)
+}
+
+// CrawlIndex returns the column of a crawl
+func (m *CoverageMatrix) CrawlIndex(site string, crawl string) (int, bool) {
+	c, ok := m.crawlIndex[packKey{site, crawl, ""}]
+	return c, ok
+}
+
+// Count returns the number of crawls that covered a region
+func (m *CoverageMatrix) Count(region int) int {
+	return int(m.counts[region])
+}
+
+// Counts returns the number of crawls that covered each region
+func (m *CoverageMatrix) Counts() []int {
+	counts := make([]int, m.numRows)
+	for r, count := range m.counts {
+		counts[r] = int(count)
+	}
+	return counts
+}
+
+// Row returns the crawls that covered a region, as a vector with one bit per crawl
+func (m *CoverageMatrix) Row(region int) (*BitVector, error) {
+	return m.RangeRow(BVRange{Start: region, End: region + 1})
+}
+
+// CrawlsCovering lists the crawls that covered a region
+func (m *CoverageMatrix) CrawlsCovering(region int) ([]MatrixCrawl, error) {
+	row, err := m.Row(region)
+	if err != nil {
+		return nil, err
+	}
+
+	crawls := make([]MatrixCrawl, 0, row.Count())
+	row.ForEach(func(c int) {
+		crawls = append(crawls, m.Crawls[c])
+	})
+	return crawls, nil
+}
+
+// RangeRow returns the crawls that covered any region in r, such as a file or function range
+func (m *CoverageMatrix) RangeRow(r BVRange) (*BitVector, error) {
+	row := NewBitVector(len(m.Crawls))
+	err := m.scanRows(r, func(b int, region int, words []uint64) {
+		for i, x := range words {
+			if j := b*m.blockWords + i; j < len(row.words) {
+				row.words[j] |= x
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// CountsWithMask returns, for each region, the number of crawls set in mask that covered it
+func (m *CoverageMatrix) CountsWithMask(mask *BitVector) ([]int, error) {
+	if mask.Len() != len(m.Crawls) {
+		return nil, errors.New("mask length does not match number of crawls")
+	}
+
+	counts := make([]int, m.numRows)
+	err := m.scanRows(BVRange{Start: 0, End: m.numRows}, func(b int, region int, words []uint64) {
+		for i, x := range words {
+			if j := b*m.blockWords + i; j < len(mask.words) {
+				counts[region] += bits.OnesCount64(x & mask.words[j])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// scanRows calls fn with the words of every block of every row in r, reading each block in large
+// contiguous pieces
+func (m *CoverageMatrix) scanRows(r BVRange, fn func(b int, region int, words []uint64)) error {
+	if r.Start < 0 || r.End > m.numRows || r.Start > r.End {
+		return errors.New("region out of range")
+	}
+
+	rowBytes := m.blockWords * 8
+	for b := 0; b < m.numBlocks; b++ {
+		blockOffset := int64(matrixHeaderSize) + int64(b)*int64(m.numRows)*int64(rowBytes)
+		for start := r.Start; start < r.End; start += matrixScanRows {
+			end := start + matrixScanRows
+			if end > r.End {
+				end = r.End
+			}
+
+			buf := make([]byte, (end-start)*rowBytes)
+			if _, err := m.f.ReadAt(buf, blockOffset+int64(start)*int64(rowBytes)); err != nil {
+				return err
+			}
+
+			words := make([]uint64, m.blockWords)
+			for region := start; region < end; region++ {
+				row := buf[(region-start)*rowBytes:]
+				for i := range words {
+					words[i] = binary.LittleEndian.Uint64(row[8*i:])
+				}
+				fn(b, region, words)
+			}
+		}
+	}
+	return nil
+}
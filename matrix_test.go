@@ -0,0 +1,189 @@
+package profparse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestVectors writes n random vectors of numBits regions under dir, one crawl per vector
+func writeTestVectors(t *testing.T, dir string, r *rand.Rand, n int, numBits int) ([]string, [][]bool) {
+	t.Helper()
+	paths := make([]string, n)
+	vectors := make([][]bool, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("s%d.com", i%26), fmt.Sprintf("c%d", i/26), "coverage", "coverage.bv")
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0755); err != nil {
+			t.Fatal(err)
+		}
+		vectors[i] = randomBools(r, numBits)
+		err := WriteBVFile(paths[i], vectors[i], BVHeader{Layout: LayoutFingerprint{1}, Encoding: CompressedEncoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths, vectors
+}
+
+// checkMatrix compares every row of a matrix with the vectors it was built from
+func checkMatrix(t *testing.T, m *CoverageMatrix, paths []string, vectors [][]bool) {
+	t.Helper()
+	if m.NumCrawls() != len(vectors) {
+		t.Fatalf("%d crawls, want %d", m.NumCrawls(), len(vectors))
+	}
+	for c, covPath := range paths {
+		site, crawl := CrawlForCovPath(covPath)
+		if m.Crawls[c].Site != site || m.Crawls[c].Crawl != crawl {
+			t.Fatalf("column %d is %s/%s, want %s/%s", c, m.Crawls[c].Site, m.Crawls[c].Crawl, site, crawl)
+		}
+		if covered, _ := CountCoveredRegions(vectors[c]); m.Crawls[c].Covered != covered {
+			t.Errorf("column %d covers %d regions, want %d", c, m.Crawls[c].Covered, covered)
+		}
+	}
+
+	mask := NewBitVector(len(vectors))
+	for c := 0; c < len(vectors); c += 3 {
+		mask.Set(c)
+	}
+	masked, err := m.CountsWithMask(mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for reg := 0; reg < m.NumRegions(); reg++ {
+		row, err := m.Row(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]bool, len(vectors))
+		n, nm := 0, 0
+		for c := range vectors {
+			want[c] = vectors[c][reg]
+			if want[c] {
+				n++
+				if c%3 == 0 {
+					nm++
+				}
+			}
+		}
+		if !reflect.DeepEqual(row.Bools(), want) {
+			t.Fatalf("row %d differs", reg)
+		}
+		if m.Count(reg) != n || masked[reg] != nm {
+			t.Fatalf("row %d counts %d and %d masked, want %d and %d", reg, m.Count(reg), masked[reg], n, nm)
+		}
+	}
+}
+
+func TestCoverageMatrix(t *testing.T) {
+	dir := t.TempDir()
+	const numBits = 1000
+	paths, vectors := writeTestVectors(t, dir, rand.New(rand.NewSource(9)), 300, numBits)
+
+	tests := []struct {
+		name   string
+		budget int64
+	}{
+		{"one word per block", 1},
+		{"several blocks", 20000},
+		{"one block", 1 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "coverage.matrix")
+			skipped, err := BuildCoverageMatrix(out, paths, tt.budget, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(skipped) != 0 {
+				t.Errorf("skipped %v", skipped)
+			}
+			m, err := OpenCoverageMatrix(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if m.NumRegions() != numBits {
+				t.Fatalf("%d regions, want %d", m.NumRegions(), numBits)
+			}
+			checkMatrix(t, m, paths, vectors)
+
+			covering, err := m.CrawlsCovering(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(covering) != m.Count(10) {
+				t.Errorf("%d crawls cover region 10, want %d", len(covering), m.Count(10))
+			}
+			any, err := m.RangeRow(BVRange{Start: 10, End: 13})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for c := range vectors {
+				if any.Get(c) != (vectors[c][10] || vectors[c][11] || vectors[c][12]) {
+					t.Fatalf("range row differs for column %d", c)
+				}
+			}
+			if c, ok := m.CrawlIndex("s1.com", "c0"); !ok || c != 1 {
+				t.Errorf("crawl index = %d, %v", c, ok)
+			}
+		})
+	}
+}
+
+func TestCoverageMatrixSkipsBadVectors(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(10))
+	paths, vectors := writeTestVectors(t, dir, r, 200, 500)
+
+	// Break the first vector, some in the first block and one in the last
+	layout := BVHeader{Layout: LayoutFingerprint{1}}
+	otherLayout := BVHeader{Layout: LayoutFingerprint{2}}
+	bad := map[int]func(string) error{
+		0:   os.Remove,
+		5:   func(p string) error { return ioutil.WriteFile(p, []byte("garbage"), 0644) },
+		70:  func(p string) error { return WriteBVFile(p, randomBools(r, 499), layout) },
+		130: func(p string) error { return WriteBVFile(p, randomBools(r, 500), otherLayout) },
+		199: os.Remove,
+	}
+	var goodPaths, wantSkipped []string
+	var goodVectors [][]bool
+	for i, covPath := range paths {
+		if breakVector, ok := bad[i]; ok {
+			if err := breakVector(covPath); err != nil {
+				t.Fatal(err)
+			}
+			wantSkipped = append(wantSkipped, covPath)
+			continue
+		}
+		goodPaths = append(goodPaths, covPath)
+		goodVectors = append(goodVectors, vectors[i])
+	}
+
+	for _, budget := range []int64{1, 1 << 30} {
+		t.Run(fmt.Sprint(budget), func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "coverage.matrix")
+			skipped, err := BuildCoverageMatrix(out, paths, budget, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(skipped, wantSkipped) {
+				t.Errorf("skipped %v, want %v", skipped, wantSkipped)
+			}
+			m, err := OpenCoverageMatrix(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			checkMatrix(t, m, goodPaths, goodVectors)
+		})
+	}
+
+	_, err := BuildCoverageMatrix(filepath.Join(dir, "none.matrix"), paths[:1], 1<<20, 1)
+	if err == nil {
+		t.Error("expected an error when no vector can be read")
+	}
+}
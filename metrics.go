@@ -0,0 +1,316 @@
+package profparse
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Metric measures how alike two coverage vectors are
+type Metric interface {
+	Name() string
+
+	// Distance returns true if identical vectors score 0, rather than 1
+	Distance() bool
+
+	// Symmetric returns true if comparing a with b always scores the same as comparing b with a
+	Symmetric() bool
+
+	// Compare compares a and b, ignoring the regions set in exclude, which may be nil
+	Compare(a *BitVector, b *BitVector, exclude *BitVector) (float64, error)
+}
+
+// VectorOverlap counts how the covered regions of two vectors overlap, among the regions compared
+type VectorOverlap struct {
+	Both     int // Covered by both vectors
+	OnlyOne  int // Covered by the first vector only
+	OnlyTwo  int // Covered by the second vector only
+	Compared int // Regions not excluded
+}
+
+// CompareBitVectors counts the overlap of a and b, ignoring the regions set in exclude, which may
+// be nil
+func CompareBitVectors(a *BitVector, b *BitVector, exclude *BitVector) (VectorOverlap, error) {
+	var o VectorOverlap
+	if a.Len() != b.Len() {
+		return o, errors.New("bv lengths do not match")
+	}
+	if exclude != nil && exclude.Len() != a.Len() {
+		return o, errors.New("bv lengths do not match exclude vector length")
+	}
+
+	var ex []uint64
+	o.Compared = a.Len()
+	if exclude != nil {
+		ex = exclude.words
+		o.Compared -= exclude.Count()
+	}
+	o.addWords(a.words, b.words, ex)
+
+	return o, nil
+}
+
+// addWords adds the overlap of words of two vectors, ignoring the bits set in exclude, which may be
+// nil. Compared is left alone.
+func (o *VectorOverlap) addWords(a []uint64, b []uint64, exclude []uint64) {
+	for i, w := range a {
+		keep := ^uint64(0)
+		if exclude != nil {
+			keep = ^exclude[i]
+		}
+		o.Both += bits.OnesCount64(w & b[i] & keep)
+		o.OnlyOne += bits.OnesCount64(w &^ b[i] & keep)
+		o.OnlyTwo += bits.OnesCount64(b[i] &^ w & keep)
+	}
+}
+
+// Union returns the number of regions covered by either vector
+func (o VectorOverlap) Union() int {
+	return o.Both + o.OnlyOne + o.OnlyTwo
+}
+
+// Jaccard returns |A∩B| / |A∪B|, or 1 if neither vector covers anything
+func (o VectorOverlap) Jaccard() float64 {
+	if o.Union() == 0 {
+		return 1
+	}
+	return float64(o.Both) / float64(o.Union())
+}
+
+// Dice returns the Sørensen–Dice coefficient 2|A∩B| / (|A|+|B|), or 1 if neither vector covers
+// anything
+func (o VectorOverlap) Dice() float64 {
+	sizes := 2*o.Both + o.OnlyOne + o.OnlyTwo
+	if sizes == 0 {
+		return 1
+	}
+	return float64(2*o.Both) / float64(sizes)
+}
+
+// Hamming returns the number of regions covered by exactly one of the vectors
+func (o VectorOverlap) Hamming() float64 {
+	return float64(o.OnlyOne + o.OnlyTwo)
+}
+
+// NormalizedHamming returns the fraction of compared regions covered by exactly one of the vectors,
+// as the Percent Difference of the compare tools
+func (o VectorOverlap) NormalizedHamming() float64 {
+	if o.Compared == 0 {
+		return 0
+	}
+	return o.Hamming() / float64(o.Compared)
+}
+
+// Overlap returns the overlap coefficient |A∩B| / min(|A|,|B|), or 1 if either vector covers
+// nothing
+func (o VectorOverlap) Overlap() float64 {
+	smaller := o.Both + o.OnlyOne
+	if o.OnlyTwo < o.OnlyOne {
+		smaller = o.Both + o.OnlyTwo
+	}
+	if smaller == 0 {
+		return 1
+	}
+	return float64(o.Both) / float64(smaller)
+}
+
+// Containment returns the fraction of regions covered by the first vector that the second also
+// covers, |A∩B| / |A|, which is 1 if A⊆B
+func (o VectorOverlap) Containment() float64 {
+	if o.Both+o.OnlyOne == 0 {
+		return 1
+	}
+	return float64(o.Both) / float64(o.Both+o.OnlyOne)
+}
+
+type overlapMetric struct {
+	name      string
+	distance  bool
+	symmetric bool
+	score     func(VectorOverlap) float64
+}
+
+func (m overlapMetric) Name() string {
+	return m.name
+}
+
+func (m overlapMetric) Distance() bool {
+	return m.distance
+}
+
+func (m overlapMetric) Symmetric() bool {
+	return m.symmetric
+}
+
+func (m overlapMetric) Compare(a *BitVector, b *BitVector, exclude *BitVector) (float64, error) {
+	o, err := CompareBitVectors(a, b, exclude)
+	if err != nil {
+		return 0, err
+	}
+	return m.score(o), nil
+}
+
+var overlapMetrics = []overlapMetric{
+	{"jaccard", false, true, VectorOverlap.Jaccard},
+	{"dice", false, true, VectorOverlap.Dice},
+	{"hamming", true, true, VectorOverlap.Hamming},
+	{"normalized-hamming", true, true, VectorOverlap.NormalizedHamming},
+	{"overlap", false, true, VectorOverlap.Overlap},
+	{"containment", false, false, VectorOverlap.Containment},
+}
+
+// WeightedJaccard is the Jaccard index with a weight per region: the total weight of the regions
+// covered by both vectors over that of the regions covered by either
+type WeightedJaccard struct {
+	Weights []float64
+}
+
+func (m WeightedJaccard) Name() string {
+	return "weighted-jaccard"
+}
+
+func (m WeightedJaccard) Distance() bool {
+	return false
+}
+
+func (m WeightedJaccard) Symmetric() bool {
+	return true
+}
+
+func (m WeightedJaccard) Compare(a *BitVector, b *BitVector, exclude *BitVector) (float64, error) {
+	if a.Len() != b.Len() {
+		return 0, errors.New("bv lengths do not match")
+	}
+	if exclude != nil && exclude.Len() != a.Len() {
+		return 0, errors.New("bv lengths do not match exclude vector length")
+	}
+	if len(m.Weights) != a.Len() {
+		return 0, errors.New("number of weights does not match bv length")
+	}
+
+	var ex []uint64
+	if exclude != nil {
+		ex = exclude.words
+	}
+	var both, either float64
+	m.addWords(&both, &either, a.words, b.words, ex, 0)
+
+	if either == 0 {
+		return 1, nil
+	}
+	return both / either, nil
+}
+
+// addWords adds the weights of the regions covered by both and either of words of two vectors,
+// starting at word base, ignoring the bits set in exclude, which may be nil
+func (m WeightedJaccard) addWords(both *float64, either *float64, a []uint64, b []uint64, exclude []uint64,
+	base int) {
+	for i, w := range a {
+		union := w | b[i]
+		if exclude != nil {
+			union &^= exclude[i]
+		}
+		for union != 0 {
+			j := bits.LeadingZeros64(union)
+			union &^= 1 << uint(63-j)
+
+			weight := m.Weights[(base+i)*64+j]
+			*either += weight
+			if w&b[i]&(1<<uint(63-j)) != 0 {
+				*both += weight
+			}
+		}
+	}
+}
+
+// MetricNames returns the names accepted by ParseMetric
+func MetricNames() []string {
+	names := make([]string, 0, len(overlapMetrics)+1)
+	for _, m := range overlapMetrics {
+		names = append(names, m.name)
+	}
+	names = append(names, WeightedJaccard{}.Name())
+	sort.Strings(names)
+	return names
+}
+
+// ParseMetric returns the metric with the given name. weights are the region weights of
+// weighted-jaccard, and are ignored by the other metrics.
+func ParseMetric(name string, weights []float64) (Metric, error) {
+	for _, m := range overlapMetrics {
+		if m.name == name {
+			return m, nil
+		}
+	}
+
+	if name == (WeightedJaccard{}).Name() {
+		if weights == nil {
+			return nil, errors.New("weighted-jaccard requires region weights")
+		}
+		return WeightedJaccard{Weights: weights}, nil
+	}
+
+	return nil, errors.New("unknown metric: " + name)
+}
+
+// ReadRegionWeights reads per-region weights for WeightedJaccard from a csv with Region Number and
+// Weight columns, such as a region coverage csv with an added Weight column. Weights must be finite
+// and not negative. Regions not listed have weight 0.
+func ReadRegionWeights(fName string, numRegions int) ([]float64, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	regionCol, weightCol := -1, -1
+	for i, name := range header {
+		switch name {
+		case "Region Number":
+			regionCol = i
+		case "Weight":
+			weightCol = i
+		}
+	}
+	if regionCol < 0 || weightCol < 0 {
+		return nil, errors.New(fName + ": missing Region Number or Weight column")
+	}
+
+	weights := make([]float64, numRegions)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		region, err := strconv.Atoi(record[regionCol])
+		if err != nil {
+			return nil, err
+		}
+		if region < 0 || region >= numRegions {
+			return nil, errors.New(fName + ": region out of range")
+		}
+		weights[region], err = strconv.ParseFloat(record[weightCol], 64)
+		if err != nil {
+			return nil, err
+		}
+		if weights[region] < 0 || math.IsInf(weights[region], 0) || math.IsNaN(weights[region]) {
+			return nil, errors.New(fName + ": invalid weight " + record[weightCol])
+		}
+	}
+
+	return weights, nil
+}
@@ -0,0 +1,256 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVectorOverlapScores(t *testing.T) {
+	tests := []struct {
+		o      VectorOverlap
+		scores map[string]float64
+	}{
+		{VectorOverlap{Both: 2, OnlyOne: 1, OnlyTwo: 3, Compared: 10}, map[string]float64{
+			"jaccard": 2.0 / 6, "dice": 4.0 / 8, "hamming": 4, "normalized-hamming": 0.4, "overlap": 2.0 / 3,
+			"containment": 2.0 / 3}},
+		{VectorOverlap{Both: 2, OnlyOne: 3, OnlyTwo: 1, Compared: 6}, map[string]float64{
+			"jaccard": 2.0 / 6, "dice": 4.0 / 8, "hamming": 4, "normalized-hamming": 4.0 / 6, "overlap": 2.0 / 3,
+			"containment": 2.0 / 5}},
+		{VectorOverlap{Both: 3, Compared: 3}, map[string]float64{
+			"jaccard": 1, "dice": 1, "hamming": 0, "normalized-hamming": 0, "overlap": 1, "containment": 1}},
+		{VectorOverlap{OnlyTwo: 4, Compared: 4}, map[string]float64{
+			"jaccard": 0, "dice": 0, "hamming": 4, "normalized-hamming": 1, "overlap": 1, "containment": 1}},
+		{VectorOverlap{OnlyOne: 4, Compared: 4}, map[string]float64{
+			"jaccard": 0, "dice": 0, "hamming": 4, "normalized-hamming": 1, "overlap": 1, "containment": 0}},
+		{VectorOverlap{Compared: 5}, map[string]float64{
+			"jaccard": 1, "dice": 1, "hamming": 0, "normalized-hamming": 0, "overlap": 1, "containment": 1}},
+		{VectorOverlap{}, map[string]float64{
+			"jaccard": 1, "dice": 1, "hamming": 0, "normalized-hamming": 0, "overlap": 1, "containment": 1}},
+	}
+	for _, tt := range tests {
+		for _, m := range overlapMetrics {
+			if got := m.score(tt.o); got != tt.scores[m.name] {
+				t.Errorf("%+v: %s = %v, want %v", tt.o, m.name, got, tt.scores[m.name])
+			}
+		}
+	}
+}
+
+// referenceScores computes every metric from []bool vectors
+func referenceScores(a []bool, b []bool, exclude []bool, weights []float64) map[string]float64 {
+	var both, onlyOne, onlyTwo, compared int
+	var weightBoth, weightEither float64
+	for i := range a {
+		if exclude != nil && exclude[i] {
+			continue
+		}
+		compared++
+		switch {
+		case a[i] && b[i]:
+			both++
+			weightBoth += weights[i]
+		case a[i]:
+			onlyOne++
+		case b[i]:
+			onlyTwo++
+		}
+		if a[i] || b[i] {
+			weightEither += weights[i]
+		}
+	}
+
+	ratio := func(x float64, y float64, empty float64) float64 {
+		if y == 0 {
+			return empty
+		}
+		return x / y
+	}
+	return map[string]float64{
+		"jaccard":            ratio(float64(both), float64(both+onlyOne+onlyTwo), 1),
+		"dice":               ratio(float64(2*both), float64(2*both+onlyOne+onlyTwo), 1),
+		"hamming":            float64(onlyOne + onlyTwo),
+		"normalized-hamming": ratio(float64(onlyOne+onlyTwo), float64(compared), 0),
+		"overlap":            ratio(float64(both), math.Min(float64(both+onlyOne), float64(both+onlyTwo)), 1),
+		"containment":        ratio(float64(both), float64(both+onlyOne), 1),
+		"weighted-jaccard":   ratio(weightBoth, weightEither, 1),
+	}
+}
+
+func TestMetricsMatchBools(t *testing.T) {
+	r := rand.New(rand.NewSource(30))
+	for _, n := range []int{0, 1, 63, 64, 65, 500, 1000} {
+		for trial := 0; trial < 20; trial++ {
+			a, b := randomBools(r, n), randomBools(r, n)
+			var exclude []bool
+			if trial%3 != 0 {
+				exclude = randomBools(r, n)
+			}
+			weights := make([]float64, n)
+			for i := range weights {
+				weights[i] = r.Float64()
+			}
+			want := referenceScores(a, b, exclude, weights)
+
+			va, vb := BitVectorFromBools(a), BitVectorFromBools(b)
+			var vexclude *BitVector
+			if exclude != nil {
+				vexclude = BitVectorFromBools(exclude)
+			}
+			for _, name := range MetricNames() {
+				m, err := ParseMetric(name, weights)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := m.Compare(va, vb, vexclude)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if math.Abs(got-want[name]) > 1e-9 {
+					t.Errorf("%d bits: %s = %v, want %v", n, name, got, want[name])
+				}
+			}
+
+			if exclude == nil {
+				exclude = make([]bool, n)
+			}
+			diff, total, _ := DiffBVsWithExclude(a, b, exclude)
+			o, err := CompareBitVectors(va, vb, BitVectorFromBools(exclude))
+			if err != nil || o.OnlyOne+o.OnlyTwo != diff || o.Compared != total {
+				t.Errorf("%d bits: overlap %+v, %v, want %d of %d differing", n, o, err, diff, total)
+			}
+		}
+	}
+}
+
+func TestMetricProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(31))
+	n := 300
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = r.Float64()
+	}
+	for _, name := range MetricNames() {
+		m, err := ParseMetric(name, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Name() != name {
+			t.Errorf("%s is named %s", name, m.Name())
+		}
+
+		for trial := 0; trial < 20; trial++ {
+			a, b := BitVectorFromBools(randomBools(r, n)), BitVectorFromBools(randomBools(r, n))
+			same, err := m.Compare(a, a.Clone(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Distance() && same != 0 || !m.Distance() && same != 1 {
+				t.Errorf("%s scores identical vectors %v", name, same)
+			}
+
+			ab, err := m.Compare(a, b, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ba, err := m.Compare(b, a, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Symmetric() && math.Abs(ab-ba) > 1e-9 {
+				t.Errorf("%s is not symmetric: %v and %v", name, ab, ba)
+			}
+		}
+
+		if _, err = m.Compare(NewBitVector(n), NewBitVector(n-1), nil); err == nil {
+			t.Errorf("%s compared vectors of different lengths", name)
+		}
+		if _, err = m.Compare(NewBitVector(n), NewBitVector(n), NewBitVector(n+1)); err == nil {
+			t.Errorf("%s compared with an exclude vector of the wrong length", name)
+		}
+	}
+
+	containment, err := ParseMetric("containment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containment.Symmetric() {
+		t.Error("containment is symmetric")
+	}
+	small := BitVectorFromBools([]bool{true, false, false})
+	large := BitVectorFromBools([]bool{true, true, false})
+	if got, _ := containment.Compare(small, large, nil); got != 1 {
+		t.Errorf("containment of a subset is %v", got)
+	}
+	if got, _ := containment.Compare(large, small, nil); got != 0.5 {
+		t.Errorf("containment of a superset is %v", got)
+	}
+}
+
+func TestParseMetric(t *testing.T) {
+	names := MetricNames()
+	want := []string{"containment", "dice", "hamming", "jaccard", "normalized-hamming", "overlap", "weighted-jaccard"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("metric names %v, want %v", names, want)
+	}
+	if _, err := ParseMetric("weighted-jaccard", nil); err == nil {
+		t.Error("parsed weighted-jaccard without weights")
+	}
+	if _, err := ParseMetric("cosine", nil); err == nil {
+		t.Error("parsed an unknown metric")
+	}
+	m, err := ParseMetric("weighted-jaccard", []float64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Compare(NewBitVector(3), NewBitVector(3), nil); err == nil {
+		t.Error("compared vectors with the wrong number of weights")
+	}
+}
+
+func TestReadRegionWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		weights []float64
+	}{
+		{"weights", "File,Region Number,Weight\na.cc,2,0.5\nb.cc,0,1.5\n", []float64{1.5, 0, 0.5, 0}},
+		{"columns in any order", "Weight,Region Number\n2,3\n", []float64{0, 0, 0, 2}},
+		{"no regions", "Region Number,Weight\n", []float64{0, 0, 0, 0}},
+		{"missing weight column", "File,Region Number\na.cc,1\n", nil},
+		{"region out of range", "Region Number,Weight\n4,1\n", nil},
+		{"negative region", "Region Number,Weight\n-1,1\n", nil},
+		{"bad region", "Region Number,Weight\nx,1\n", nil},
+		{"bad weight", "Region Number,Weight\n1,x\n", nil},
+		{"negative weight", "Region Number,Weight\n1,-1\n", nil},
+		{"infinite weight", "Region Number,Weight\n1,+Inf\n", nil},
+		{"NaN weight", "Region Number,Weight\n1,NaN\n", nil},
+		{"short record", "Region Number,Weight\n1\n", nil},
+		{"empty", "", nil},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(dir, "weights.csv")
+			if err := ioutil.WriteFile(fName, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			weights, err := ReadRegionWeights(fName, 4)
+			if tt.weights == nil {
+				if err == nil {
+					t.Errorf("read %v, expected an error", weights)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("read %v, want %v", weights, tt.weights)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package profparse
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// PrefixRewrite replaces a leading From in a path with To
+type PrefixRewrite struct {
+	From string
+	To   string
+}
+
+// PathNormalizer maps the file names found in coverage reports onto paths relative to the root of
+// the source tree, so that reports from builds in different out directories or on different
+// machines line up. Relative file names are taken to be relative to the build directory, as they
+// are in reports produced by llvm-cov.
+type PathNormalizer struct {
+	// Rewrites are applied before anything else. Only the first matching rewrite is used.
+	Rewrites []PrefixRewrite
+
+	// SourceRoots are absolute paths to source checkouts, all of which are treated as the same tree
+	SourceRoots []string
+
+	// OutDir is the build directory, relative to the source root
+	OutDir string
+
+	// DetectOutDir treats any out/<name> directory as a build directory, whatever its name
+	DetectOutDir bool
+
+	// GenDir is prepended to the paths of generated files (those in the gen directory of a
+	// build directory). If it is empty, generated files are placed in the source tree alongside
+	// the files they were generated from.
+	GenDir string
+}
+
+// DefaultPathNormalizer returns a normalizer for Chromium style builds in out/Default, which also
+// recognizes absolute paths into any other out directory
+func DefaultPathNormalizer() *PathNormalizer {
+	return &PathNormalizer{
+		OutDir:       "out/Default",
+		DetectOutDir: true,
+	}
+}
+
+// NormalizerFlags registers the -out-dir and -source-root flags shared by the commands that build
+// trees. The returned function builds the normalizer they describe, once flag.Parse has been called.
+func NormalizerFlags() func() *PathNormalizer {
+	outDir := flag.String("out-dir", "out/Default",
+		"Build directory the coverage file was generated in, relative to the source root")
+	sourceRoot := flag.String("source-root", "",
+		"Absolute path to the source checkout the instrumented binary was built from")
+
+	return func() *PathNormalizer {
+		n := DefaultPathNormalizer()
+		n.OutDir = *outDir
+		if *sourceRoot != "" {
+			n.SourceRoots = []string{*sourceRoot}
+		}
+		return n
+	}
+}
+
+// Normalize returns the normalized form of fileName. Absolute paths outside of the source tree
+// are cleaned but otherwise left alone.
+func (n *PathNormalizer) Normalize(fileName string) string {
+	p := fileName
+	for _, rw := range n.Rewrites {
+		if strings.HasPrefix(p, rw.From) {
+			p = rw.To + p[len(rw.From):]
+			break
+		}
+	}
+
+	if !path.IsAbs(p) {
+		return n.outRelative(p, n.OutDir)
+	}
+
+	for _, root := range n.SourceRoots {
+		root = strings.TrimSuffix(root, "/")
+		if strings.HasPrefix(p, root+"/") {
+			return n.sourceRelative(p[len(root)+1:])
+		}
+	}
+
+	if n.DetectOutDir {
+		if outDir, rest, ok := detectOutDir(p); ok {
+			return n.outRelative(rest, outDir)
+		}
+	}
+
+	return path.Clean(p)
+}
+
+// sourceRelative normalizes a path relative to the root of the source tree
+func (n *PathNormalizer) sourceRelative(p string) string {
+	if n.OutDir != "" && strings.HasPrefix(p, n.OutDir+"/") {
+		return n.outRelative(p[len(n.OutDir)+1:], n.OutDir)
+	}
+
+	if n.DetectOutDir && strings.HasPrefix(p, "out/") {
+		rest := strings.TrimPrefix(p, "out/")
+		if j := strings.Index(rest, "/"); j > 0 {
+			return n.outRelative(rest[j+1:], "out/"+rest[:j])
+		}
+	}
+
+	return path.Clean(p)
+}
+
+// outRelative normalizes a path relative to the build directory outDir
+func (n *PathNormalizer) outRelative(p string, outDir string) string {
+	if p == "gen" || strings.HasPrefix(p, "gen/") {
+		generated := strings.TrimPrefix(strings.TrimPrefix(p, "gen"), "/")
+		if n.GenDir == "" {
+			return path.Clean(generated)
+		}
+		return path.Join(n.GenDir, generated)
+	}
+
+	return path.Clean(path.Join(outDir, p))
+}
+
+// TreeParts splits the normalized form of fileName into its path segments
+func (n *PathNormalizer) TreeParts(fileName string) []string {
+	return strings.Split(n.Normalize(fileName), "/")
+}
+
+// detectOutDir finds the last out/<name> directory in p, returning it relative to the source root
+// that contains it, along with the rest of the path
+func detectOutDir(p string) (string, string, bool) {
+	i := strings.LastIndex(p, "/out/")
+	for i >= 0 {
+		rest := p[i+len("/out/"):]
+		j := strings.Index(rest, "/")
+		if j > 0 {
+			return "out/" + rest[:j], rest[j+1:], true
+		}
+		i = strings.LastIndex(p[:i], "/out/")
+	}
+	return "", "", false
+}
+
+// NormalizePaths sets the normalized file names on the records produced by src
+func NormalizePaths(src RecordSource, n *PathNormalizer) RecordSource {
+	return &normalizedRecordSource{
+		src:        src,
+		normalizer: n,
+		cache:      make(map[string]string),
+	}
+}
+
+type normalizedRecordSource struct {
+	src        RecordSource
+	normalizer *PathNormalizer
+	cache      map[string]string
+}
+
+func (s *normalizedRecordSource) Walk(fn func(Record) error) error {
+	return s.src.Walk(func(rec Record) error {
+		rec.NormalizedFile = s.normalize(rec.File)
+		if rec.Kind == RegionRecord || rec.Kind == BranchRecord {
+			regionFile := rec.Region.FileName
+			if regionFile == "" {
+				regionFile = rec.File
+			}
+			rec.Region.NormalizedFileName = s.normalize(regionFile)
+		}
+		return fn(rec)
+	})
+}
+
+func (s *normalizedRecordSource) normalize(fileName string) string {
+	normalized, ok := s.cache[fileName]
+	if !ok {
+		normalized = s.normalizer.Normalize(fileName)
+		s.cache[fileName] = normalized
+	}
+	return normalized
+}
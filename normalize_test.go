@@ -0,0 +1,97 @@
+package profparse
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	custom := &PathNormalizer{
+		SourceRoots: []string{"/b/s/w/ir/"},
+		OutDir:      "out/cov",
+		GenDir:      "gen",
+		Rewrites:    []PrefixRewrite{{"/mnt/src", "/b/s/w/ir"}},
+	}
+	tests := []struct {
+		name string
+		n    *PathNormalizer
+		in   string
+		want string
+	}{
+		{"relative to out", DefaultPathNormalizer(), "../../base/a.cc", "base/a.cc"},
+		{"generated", DefaultPathNormalizer(), "gen/base/b.h", "base/b.h"},
+		{"other out dir", DefaultPathNormalizer(),
+			"/home/pmurley/chromium/src/out/chrome_cov_unstripped/../../base/a.cc", "base/a.cc"},
+		{"generated in other out dir", DefaultPathNormalizer(), "/home/x/src/out/Release/gen/c.cc", "c.cc"},
+		{"outside the tree", DefaultPathNormalizer(), "/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"build output", DefaultPathNormalizer(), "obj/x.cc", "out/Default/obj/x.cc"},
+		{"source root", custom, "/b/s/w/ir/base/a.cc", "base/a.cc"},
+		{"rewrite", custom, "/mnt/src/base/a.cc", "base/a.cc"},
+		{"gen dir", custom, "/b/s/w/ir/out/cov/gen/x.cc", "gen/x.cc"},
+		{"custom out dir", custom, "../../v8/a.cc", "v8/a.cc"},
+		{"relative gen dir", custom, "gen/y.cc", "gen/y.cc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.n.Normalize(tt.in); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizedMetadata(t *testing.T) {
+	report := "[FILE] ../../a/x.cc\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 5\n" +
+		"[FILE] gen/a/y.cc\n[FUNCTION] g\n[BLOCK] 0 0 1,2,3,4 0\n"
+	md, _, err := ParseCovMetadata(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := md["../../a/x.cc"]["f"][0]
+	if cr.NormalizedFileName != "a/x.cc" || cr.FileName != "../../a/x.cc" {
+		t.Errorf("file %q normalized to %q", cr.FileName, cr.NormalizedFileName)
+	}
+
+	covMap, _, err := ParseCovMap(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := GetTreeSummary(covMap, -1)
+	if tree["a"].TotalRegions != 2 || tree["a"].CoveredRegions != 1 {
+		t.Errorf("a covers %d out of %d regions", tree["a"].CoveredRegions, tree["a"].TotalRegions)
+	}
+}
+
+func TestNormalizerFlags(t *testing.T) {
+	saved := flag.CommandLine
+	defer func() { flag.CommandLine = saved }()
+
+	tests := []struct {
+		name  string
+		args  []string
+		in    string
+		want  string
+		roots int
+	}{
+		{"defaults", nil, "../../base/a.cc", "base/a.cc", 0},
+		{"out dir", []string{"-out-dir", "out/cov"}, "obj/x.cc", "out/cov/obj/x.cc", 0},
+		{"source root", []string{"-source-root", "/b/s/w/ir"}, "/b/s/w/ir/base/a.cc", "base/a.cc", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			newNormalizer := NormalizerFlags()
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			n := newNormalizer()
+			if got := n.Normalize(tt.in); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(n.SourceRoots) != tt.roots || !n.DetectOutDir {
+				t.Errorf("normalizer %+v", n)
+			}
+		})
+	}
+}
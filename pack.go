@@ -0,0 +1,806 @@
+package profparse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A pack stores the bit vectors of a results set in one file:
+//
+//	"PPBK", u16 version, u16 reserved
+//	vectors, each a complete versioned .bv file without crawl identifiers
+//	index: u32 number of entries, then for each entry
+//	  u16-length site, crawl and name, 16 byte layout fingerprint, u16 granularity, u64 length in
+//	  bits, u64 offset and u64 size of its vector, 16 byte content hash
+//	  then u32 number of crawl files, such as metadata.json, then for each file u16-length site,
+//	  crawl and name, u64 offset and u64 size of its contents, 16 byte content hash
+//	trailer: u64 offset of the index, u32 checksum of the index, "PPBK"
+//
+// Entries with identical vectors share them. Appending to a pack writes vectors after its trailer,
+// then a new index and trailer on Close. Until then, and if the append never finishes, readers use
+// the last complete trailer, so the pack reads as it was before the append.
+const (
+	packMagic       = "PPBK"
+	packVersion     = 1
+	packHeaderSize  = 8
+	packTrailerSize = 16
+)
+
+// PackEntry is a vector in a pack. Vectors are named as in a MIDA results set, e.g. coverage.bv
+// or coverage.function.bv.
+type PackEntry struct {
+	Site        string
+	Crawl       string
+	Name        string
+	Layout      LayoutFingerprint
+	Granularity BVGranularity
+	NumBits     int
+
+	offset int64
+	size   int64
+	sum    [16]byte
+	file   bool // A crawl file rather than a vector
+}
+
+// Path returns the path of the vector or crawl file relative to the root of a results set
+func (e PackEntry) Path() string {
+	if e.file {
+		return path.Join(e.Site, e.Crawl, e.Name)
+	}
+	return path.Join(e.Site, e.Crawl, "coverage", e.Name)
+}
+
+type packKey struct {
+	site  string
+	crawl string
+	name  string
+}
+
+func (e PackEntry) key() packKey {
+	return packKey{e.Site, e.Crawl, e.Name}
+}
+
+// Pack reads a pack file. It is safe for concurrent use.
+type Pack struct {
+	Entries []PackEntry // Sorted by site, crawl and name
+	Files   []PackEntry // Crawl files, sorted likewise
+
+	f         *os.File
+	index     map[packKey]int
+	fileIndex map[packKey]int
+}
+
+// IsPackFile returns true if fName is a pack file
+func IsPackFile(fName string) bool {
+	f, err := os.Open(fName)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	_, err = io.ReadFull(f, magic[:])
+	return err == nil && string(magic[:]) == packMagic
+}
+
+// OpenPack opens a pack file and reads its index
+func OpenPack(fName string) (*Pack, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, files, _, err := readPackIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+
+	p := &Pack{
+		Entries:   entries,
+		Files:     files,
+		f:         f,
+		index:     make(map[packKey]int, len(entries)),
+		fileIndex: make(map[packKey]int, len(files)),
+	}
+	for i, e := range entries {
+		p.index[e.key()] = i
+	}
+	for i, e := range files {
+		p.fileIndex[e.key()] = i
+	}
+
+	return p, nil
+}
+
+// Close closes the pack file
+func (p *Pack) Close() error {
+	return p.f.Close()
+}
+
+// Lookup finds the vector of a crawl with the given name
+func (p *Pack) Lookup(site string, crawl string, name string) (PackEntry, bool) {
+	i, ok := p.index[packKey{site, crawl, name}]
+	if !ok {
+		return PackEntry{}, false
+	}
+	return p.Entries[i], true
+}
+
+// LookupFile finds a crawl file, such as metadata.json
+func (p *Pack) LookupFile(site string, crawl string, name string) (PackEntry, bool) {
+	i, ok := p.fileIndex[packKey{site, crawl, name}]
+	if !ok {
+		return PackEntry{}, false
+	}
+	return p.Files[i], true
+}
+
+// ReadFile returns the contents of a crawl file
+func (p *Pack) ReadFile(e PackEntry) ([]byte, error) {
+	data := make([]byte, e.size)
+	_, err := p.f.ReadAt(data, e.offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadData returns the contents of the .bv file of an entry, with its crawl identifiers
+func (p *Pack) ReadData(e PackEntry) ([]byte, error) {
+	blob, err := p.ReadFile(e)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, h, err := parseVersionedBVFile(blob)
+	if err != nil {
+		return nil, errors.New(e.Path() + ": " + err.Error())
+	}
+	h.Site = e.Site
+	h.Crawl = e.Crawl
+	header, err := bvFileHeader(h.NumBits, payload, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, payload...), nil
+}
+
+// ReadBV is ReadBVFile for an entry
+func (p *Pack) ReadBV(e PackEntry) ([]bool, BVHeader, error) {
+	data, err := p.ReadData(e)
+	if err != nil {
+		return nil, BVHeader{}, err
+	}
+	return ParseBVFile(data)
+}
+
+// ReadBitVector is ReadBitVectorFile for an entry
+func (p *Pack) ReadBitVector(e PackEntry) (*BitVector, BVHeader, error) {
+	data, err := p.ReadData(e)
+	if err != nil {
+		return nil, BVHeader{}, err
+	}
+	return ParseBitVectorFile(data)
+}
+
+// readPackIndex reads the vectors and crawl files of a pack and returns the offset of the end of
+// its trailer
+func readPackIndex(f *os.File) ([]PackEntry, []PackEntry, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	size := fi.Size()
+
+	var header [packHeaderSize]byte
+	if size < packHeaderSize+packTrailerSize {
+		return nil, nil, 0, errors.New("truncated pack file")
+	}
+	if _, err = f.ReadAt(header[:], 0); err != nil {
+		return nil, nil, 0, err
+	}
+	if string(header[:4]) != packMagic {
+		return nil, nil, 0, errors.New("not a pack file")
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != packVersion {
+		return nil, nil, 0, errors.New("unsupported pack version")
+	}
+
+	data, indexOffset, end, err := findPackTrailer(f, size)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	errCorrupt := errors.New("corrupt pack index")
+	pos := 0
+	var lists [2][]PackEntry
+	for list := range lists {
+		if len(data)-pos < 4 {
+			return nil, nil, 0, errCorrupt
+		}
+		numEntries := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		lists[list] = make([]PackEntry, 0)
+		for i := 0; i < numEntries; i++ {
+			e := PackEntry{file: list == 1}
+			var ok bool
+			e.Site, pos, ok = readBVString(data, pos)
+			if ok {
+				e.Crawl, pos, ok = readBVString(data, pos)
+			}
+			if ok {
+				e.Name, pos, ok = readBVString(data, pos)
+			}
+			if !ok {
+				return nil, nil, 0, errCorrupt
+			}
+			if !e.file {
+				if len(data)-pos < 16+2+8 {
+					return nil, nil, 0, errCorrupt
+				}
+				copy(e.Layout[:], data[pos:])
+				e.Granularity = BVGranularity(binary.LittleEndian.Uint16(data[pos+16:]))
+				e.NumBits = int(binary.LittleEndian.Uint64(data[pos+18:]))
+				pos += 26
+			}
+			if len(data)-pos < 8+8+16 {
+				return nil, nil, 0, errCorrupt
+			}
+			e.offset = int64(binary.LittleEndian.Uint64(data[pos:]))
+			e.size = int64(binary.LittleEndian.Uint64(data[pos+8:]))
+			copy(e.sum[:], data[pos+16:])
+			pos += 32
+
+			if e.offset < packHeaderSize || e.size < 0 || e.offset > indexOffset ||
+				e.size > indexOffset-e.offset {
+				return nil, nil, 0, errCorrupt
+			}
+			lists[list] = append(lists[list], e)
+		}
+	}
+	if pos != len(data) {
+		return nil, nil, 0, errCorrupt
+	}
+
+	return lists[0], lists[1], end, nil
+}
+
+// findPackTrailer returns the index of a pack, its offset and the offset of the end of its trailer.
+// The trailer is normally at the end of the file, but an append that did not finish leaves vectors
+// after it, so otherwise the file is searched backwards for the last complete trailer.
+func findPackTrailer(f *os.File, size int64) ([]byte, int64, int64, error) {
+	data, indexOffset, err := readPackTrailer(f, size)
+	if err == nil {
+		return data, indexOffset, size, nil
+	}
+
+	const chunkSize = 1 << 20
+	buf := make([]byte, chunkSize+packTrailerSize)
+	for chunkEnd := size - 1; chunkEnd > packHeaderSize; chunkEnd -= chunkSize {
+		start := chunkEnd - chunkSize
+		if start < packHeaderSize {
+			start = packHeaderSize
+		}
+		// Chunks overlap so that a trailer split between two of them is still found
+		chunk := buf[:chunkEnd-start+packTrailerSize]
+		if start+int64(len(chunk)) > size {
+			chunk = chunk[:size-start]
+		}
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return nil, 0, 0, err
+		}
+
+		for i := len(chunk); ; {
+			i = bytes.LastIndex(chunk[:i], []byte(packMagic))
+			if i < 0 {
+				break
+			}
+			end := start + int64(i) + int64(len(packMagic))
+			if end >= size {
+				continue
+			}
+			data, indexOffset, err := readPackTrailer(f, end)
+			if err == nil {
+				return data, indexOffset, end, nil
+			}
+		}
+	}
+
+	return nil, 0, 0, errors.New("pack file has no index, it may not have been closed")
+}
+
+// readPackTrailer reads the trailer ending at end and returns the index it points to, once its
+// checksum has been checked
+func readPackTrailer(f *os.File, end int64) ([]byte, int64, error) {
+	var trailer [packTrailerSize]byte
+	if end < packHeaderSize+packTrailerSize {
+		return nil, 0, errors.New("truncated pack file")
+	}
+	if _, err := f.ReadAt(trailer[:], end-packTrailerSize); err != nil {
+		return nil, 0, err
+	}
+	if string(trailer[12:]) != packMagic {
+		return nil, 0, errors.New("pack file has no index, it may not have been closed")
+	}
+
+	indexOffset := int64(binary.LittleEndian.Uint64(trailer[:]))
+	indexEnd := end - packTrailerSize
+	if indexOffset < packHeaderSize || indexOffset > indexEnd {
+		return nil, 0, errors.New("corrupt pack index")
+	}
+	data := make([]byte, indexEnd-indexOffset)
+	if _, err := f.ReadAt(data, indexOffset); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(trailer[8:]) {
+		return nil, 0, errors.New("corrupt pack index")
+	}
+
+	return data, indexOffset, nil
+}
+
+// PackWriter builds a pack file. Vectors can be added from several goroutines at once.
+type PackWriter struct {
+	f         *os.File
+	pos       int64
+	entries   []PackEntry
+	index     map[packKey]int
+	files     []PackEntry
+	fileIndex map[packKey]int
+	blobs     map[[16]byte]PackEntry // Where each distinct vector or file is stored
+	lock      sync.Mutex
+
+	// Number of vectors added that were already stored
+	Deduplicated int
+}
+
+// CreatePack creates an empty pack, replacing fName if it exists
+func CreatePack(fName string) (*PackWriter, error) {
+	f, err := os.Create(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [packHeaderSize]byte
+	copy(header[:], packMagic)
+	binary.LittleEndian.PutUint16(header[4:], packVersion)
+	if _, err = f.Write(header[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &PackWriter{
+		f:         f,
+		pos:       packHeaderSize,
+		index:     make(map[packKey]int),
+		fileIndex: make(map[packKey]int),
+		blobs:     make(map[[16]byte]PackEntry),
+	}, nil
+}
+
+// AppendPack opens an existing pack to add vectors to it. Vectors are written after the trailer of
+// the pack, so it can still be read as it was until Close writes the new index.
+func AppendPack(fName string) (*PackWriter, error) {
+	f, err := os.OpenFile(fName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, files, end, err := readPackIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New(fName + ": " + err.Error())
+	}
+
+	w := &PackWriter{
+		f:         f,
+		pos:       end,
+		entries:   entries,
+		index:     make(map[packKey]int, len(entries)),
+		files:     files,
+		fileIndex: make(map[packKey]int, len(files)),
+		blobs:     make(map[[16]byte]PackEntry),
+	}
+	for i, e := range entries {
+		w.index[e.key()] = i
+		w.blobs[e.sum] = e
+	}
+	for i, e := range files {
+		w.fileIndex[e.key()] = i
+		w.blobs[e.sum] = e
+	}
+
+	return w, nil
+}
+
+// Add adds the contents of a .bv file in any format to the pack, replacing any vector with the
+// same site, crawl and name
+func (w *PackWriter) Add(site string, crawl string, name string, data []byte) error {
+	var payload []byte
+	var h BVHeader
+	var err error
+	if isVersionedBVFile(data) {
+		payload, h, err = parseVersionedBVFile(data)
+	} else {
+		var bv *BitVector
+		bv, h, err = ParseBitVectorFile(data)
+		if err == nil {
+			payload = bv.Bytes()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Crawl identifiers are kept in the index, so identical vectors can be shared
+	h.Site = ""
+	h.Crawl = ""
+	header, err := bvFileHeader(h.NumBits, payload, h)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	hash.Write(header)
+	hash.Write(payload)
+
+	e := PackEntry{
+		Site:        site,
+		Crawl:       crawl,
+		Name:        name,
+		Layout:      h.Layout,
+		Granularity: h.Granularity,
+		NumBits:     h.NumBits,
+	}
+	copy(e.sum[:], hash.Sum(nil))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err = w.store(&e, header, payload); err != nil {
+		return err
+	}
+	if i, ok := w.index[e.key()]; ok {
+		w.entries[i] = e
+	} else {
+		w.index[e.key()] = len(w.entries)
+		w.entries = append(w.entries, e)
+	}
+
+	return nil
+}
+
+// AddFile adds a crawl file, such as metadata.json, to the pack, replacing any file with the same
+// site, crawl and name
+func (w *PackWriter) AddFile(site string, crawl string, name string, data []byte) error {
+	e := PackEntry{
+		Site:  site,
+		Crawl: crawl,
+		Name:  name,
+		file:  true,
+	}
+	sum := sha256.Sum256(data)
+	copy(e.sum[:], sum[:])
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.store(&e, data); err != nil {
+		return err
+	}
+	if i, ok := w.fileIndex[e.key()]; ok {
+		w.files[i] = e
+	} else {
+		w.fileIndex[e.key()] = len(w.files)
+		w.files = append(w.files, e)
+	}
+
+	return nil
+}
+
+// store writes the contents of e, unless identical contents are already stored, and sets its
+// offset and size. The lock must be held.
+func (w *PackWriter) store(e *PackEntry, contents ...[]byte) error {
+	if stored, ok := w.blobs[e.sum]; ok {
+		e.offset = stored.offset
+		e.size = stored.size
+		w.Deduplicated += 1
+		return nil
+	}
+
+	e.offset = w.pos
+	for _, b := range contents {
+		if _, err := w.f.WriteAt(b, w.pos); err != nil {
+			return err
+		}
+		w.pos += int64(len(b))
+	}
+	e.size = w.pos - e.offset
+	w.blobs[e.sum] = *e
+
+	return nil
+}
+
+// AddBVFile adds a .bv file to the pack
+func (w *PackWriter) AddBVFile(site string, crawl string, name string, fName string) error {
+	data, err := readBVFileData(fName)
+	if err != nil {
+		return err
+	}
+	return w.Add(site, crawl, name, data)
+}
+
+// Len returns the number of entries in the pack
+func (w *PackWriter) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.entries)
+}
+
+// Close writes the index of the pack and closes it
+func (w *PackWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var index []byte
+	for _, entries := range [][]PackEntry{w.entries, w.files} {
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i], entries[j]
+			if a.Site != b.Site {
+				return a.Site < b.Site
+			}
+			if a.Crawl != b.Crawl {
+				return a.Crawl < b.Crawl
+			}
+			return a.Name < b.Name
+		})
+
+		var count [4]byte
+		binary.LittleEndian.PutUint32(count[:], uint32(len(entries)))
+		index = append(index, count[:]...)
+		for _, e := range entries {
+			index = appendBVString(index, e.Site)
+			index = appendBVString(index, e.Crawl)
+			index = appendBVString(index, e.Name)
+
+			if !e.file {
+				var vector [26]byte
+				copy(vector[:], e.Layout[:])
+				binary.LittleEndian.PutUint16(vector[16:], uint16(e.Granularity))
+				binary.LittleEndian.PutUint64(vector[18:], uint64(e.NumBits))
+				index = append(index, vector[:]...)
+			}
+
+			var fixed [32]byte
+			binary.LittleEndian.PutUint64(fixed[:], uint64(e.offset))
+			binary.LittleEndian.PutUint64(fixed[8:], uint64(e.size))
+			copy(fixed[16:], e.sum[:])
+			index = append(index, fixed[:]...)
+		}
+	}
+
+	var trailer [packTrailerSize]byte
+	binary.LittleEndian.PutUint64(trailer[:], uint64(w.pos))
+	binary.LittleEndian.PutUint32(trailer[8:], crc32.Checksum(index, crcTable))
+	copy(trailer[12:], packMagic)
+
+	_, err := w.f.WriteAt(append(index, trailer[:]...), w.pos)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err == nil {
+		// Only once the new trailer is safely written, drop the vectors of any earlier append that
+		// did not finish
+		err = w.f.Truncate(w.pos + int64(len(index)) + packTrailerSize)
+	}
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// Packs opened to read vectors through paths within them
+var openPacks = make(map[string]*Pack)
+var openPacksLock sync.Mutex
+
+// cachedPack returns the pack at fName, opening it on first use. It returns nil if fName is not a
+// pack.
+func cachedPack(fName string) (*Pack, error) {
+	openPacksLock.Lock()
+	defer openPacksLock.Unlock()
+
+	if p, ok := openPacks[fName]; ok {
+		return p, nil
+	}
+	if !IsPackFile(fName) {
+		return nil, nil
+	}
+
+	p, err := OpenPack(fName)
+	if err != nil {
+		return nil, err
+	}
+	openPacks[fName] = p
+	return p, nil
+}
+
+// packForPath splits a path within a pack, such as pack/site/crawl/coverage/coverage.bv, into the
+// pack and the components that follow it. depth is the number of components expected. It returns
+// nil if the path is not within a pack.
+func packForPath(p string, depth int) (*Pack, []string, error) {
+	p = path.Clean(p)
+	parts := strings.Split(p, "/")
+	if len(parts) <= depth {
+		return nil, nil, nil
+	}
+
+	packPath := strings.Join(parts[:len(parts)-depth], "/")
+	if packPath == "" {
+		packPath = "/"
+	}
+	pack, err := cachedPack(packPath)
+	if pack == nil || err != nil {
+		return nil, nil, err
+	}
+	return pack, parts[len(parts)-depth:], nil
+}
+
+// readBVFileData reads a .bv file, which may also be a vector within a pack, e.g.
+// pack/site/crawl/coverage/coverage.bv
+func readBVFileData(fName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fName)
+	// Paths within a pack go through a regular file
+	if err == nil || !isNotDirError(err) {
+		return data, err
+	}
+
+	pack, parts, packErr := packForPath(fName, 4)
+	if packErr != nil {
+		return nil, packErr
+	}
+	if pack == nil || parts[2] != "coverage" {
+		return nil, err
+	}
+	e, ok := pack.Lookup(parts[0], parts[1], parts[3])
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: fName, Err: os.ErrNotExist}
+	}
+	return pack.ReadData(e)
+}
+
+// ReadCrawlFile reads a file of a crawl, such as metadata.json, which may also be a file within a
+// pack, e.g. pack/site/crawl/metadata.json
+func ReadCrawlFile(fName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err == nil || !isNotDirError(err) {
+		return data, err
+	}
+
+	pack, parts, packErr := packForPath(fName, 3)
+	if packErr != nil {
+		return nil, packErr
+	}
+	if pack == nil {
+		return nil, err
+	}
+	e, ok := pack.LookupFile(parts[0], parts[1], parts[2])
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: fName, Err: os.ErrNotExist}
+	}
+	return pack.ReadFile(e)
+}
+
+// GlobBVFiles returns the .bv files matching pattern, as filepath.Glob. Patterns may also match
+// vectors within a pack, e.g. pack/*/*/coverage/coverage.bv, as long as the path of the pack itself
+// has no wildcards.
+func GlobBVFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil || len(matches) > 0 {
+		return matches, err
+	}
+
+	pack, parts, err := packForPath(pattern, 4)
+	if pack == nil || err != nil {
+		return matches, err
+	}
+
+	packPath := strings.TrimSuffix(path.Clean(pattern), "/"+strings.Join(parts, "/"))
+	for _, e := range pack.Entries {
+		match := true
+		for i, name := range []string{e.Site, e.Crawl, "coverage", e.Name} {
+			ok, err := path.Match(parts[i], name)
+			if err != nil {
+				return nil, err
+			}
+			match = match && ok
+		}
+		if match {
+			matches = append(matches, path.Join(packPath, e.Path()))
+		}
+	}
+
+	return matches, nil
+}
+
+func isNotDirError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// packCovPaths lists the vectors named name in a pack, as paths within it
+func packCovPaths(packPath string, p *Pack, site string, name string, onePerSite bool) []string {
+	results := make([]string, 0)
+	for i, e := range p.Entries {
+		if e.Name != name || (site != "" && e.Site != site) {
+			continue
+		}
+		// Entries are sorted, so the last crawl of a site is the one before the next site
+		if onePerSite {
+			last := true
+			for _, next := range p.Entries[i+1:] {
+				if next.Site != e.Site {
+					break
+				}
+				if next.Name == name {
+					last = false
+					break
+				}
+			}
+			if !last {
+				continue
+			}
+		}
+		results = append(results, path.Join(packPath, e.Path()))
+	}
+	return results
+}
+
+// packSites lists the sites in a pack, as paths within it
+func packSites(packPath string, p *Pack) []string {
+	results := make([]string, 0)
+	for i, e := range p.Entries {
+		if i == 0 || p.Entries[i-1].Site != e.Site {
+			results = append(results, path.Join(packPath, e.Site))
+		}
+	}
+	return results
+}
+
+// packCrawls lists the crawls of site in a pack, as paths within it. An empty site lists all of
+// them.
+func packCrawls(packPath string, p *Pack, site string, onePerSite bool) []string {
+	results := make([]string, 0)
+	for i, e := range p.Entries {
+		if site != "" && e.Site != site {
+			continue
+		}
+		if i > 0 && p.Entries[i-1].Site == e.Site && p.Entries[i-1].Crawl == e.Crawl {
+			continue
+		}
+		crawlPath := path.Join(packPath, e.Site, e.Crawl)
+		if onePerSite && len(results) > 0 && path.Dir(results[len(results)-1]) == path.Dir(crawlPath) {
+			results[len(results)-1] = crawlPath
+			continue
+		}
+		results = append(results, crawlPath)
+	}
+	return results
+}
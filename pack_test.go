@@ -0,0 +1,278 @@
+package profparse
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// randomBools returns a vector of n regions, about a third of them covered
+func randomBools(r *rand.Rand, n int) []bool {
+	bv := make([]bool, n)
+	for i := range bv {
+		bv[i] = r.Intn(3) == 0
+	}
+	return bv
+}
+
+// writeTestResults writes a MIDA results set with a coverage.bv for each crawl, returning the
+// vector of each site/crawl
+func writeTestResults(t *testing.T, root string, sites []string, crawls []string, numBits int) map[string][]bool {
+	t.Helper()
+	r := rand.New(rand.NewSource(int64(len(root))))
+	vectors := make(map[string][]bool)
+	shared := randomBools(r, numBits)
+	for _, site := range sites {
+		for i, crawl := range crawls {
+			fName := filepath.Join(root, site, crawl, "coverage", "coverage.bv")
+			if err := os.MkdirAll(filepath.Dir(fName), 0755); err != nil {
+				t.Fatal(err)
+			}
+			// Later crawls share a vector, so packs can deduplicate them
+			bv := shared
+			if i == 0 {
+				bv = randomBools(r, numBits)
+			}
+			err := WriteBVFile(fName, bv, BVHeader{Site: site, Crawl: crawl, Encoding: CompressedEncoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			vectors[site+"/"+crawl] = bv
+		}
+	}
+	return vectors
+}
+
+func addTestCrawls(t *testing.T, w *PackWriter, crawlPaths []string) {
+	t.Helper()
+	for _, c := range crawlPaths {
+		site, crawl := filepath.Base(filepath.Dir(c)), filepath.Base(c)
+		err := w.AddBVFile(site, crawl, "coverage.bv", filepath.Join(c, "coverage", "coverage.bv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkPackVectors(t *testing.T, packPath string, want map[string][]bool) {
+	t.Helper()
+	p, err := OpenPack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if len(p.Entries) != len(want) {
+		t.Fatalf("pack has %d entries, want %d", len(p.Entries), len(want))
+	}
+	for _, e := range p.Entries {
+		bv, h, err := p.ReadBV(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bv, want[e.Site+"/"+e.Crawl]) {
+			t.Errorf("%s: vector differs", e.Path())
+		}
+		if h.Site != e.Site || h.Crawl != e.Crawl {
+			t.Errorf("%s: header has site %q and crawl %q", e.Path(), h.Site, h.Crawl)
+		}
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	results := filepath.Join(dir, "results")
+	want := writeTestResults(t, results, []string{"a.com", "b.com"}, []string{"c1", "c2", "c3"}, 300)
+	crawlPaths, err := GetPathsMidaResults(results, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packPath := filepath.Join(dir, "results.pack")
+	w, err := CreatePack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths[:4])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = AppendPack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths[4:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Deduplicated == 0 {
+		t.Error("identical vectors were not shared")
+	}
+	checkPackVectors(t, packPath, want)
+
+	// Vectors within the pack read as if the pack were a results directory
+	covPaths, err := GetCovPathsMIDAResults(packPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(covPaths) != len(want) {
+		t.Fatalf("found %d vectors in the pack, want %d", len(covPaths), len(want))
+	}
+	for _, covPath := range covPaths {
+		bv, _, err := ReadBVFile(covPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(covPath, "/")
+		if !reflect.DeepEqual(bv, want[parts[len(parts)-4]+"/"+parts[len(parts)-3]]) {
+			t.Errorf("%s: vector differs", covPath)
+		}
+	}
+	_, _, err = ReadBVFile(filepath.Join(packPath, "a.com", "missing", "coverage", "coverage.bv"))
+	if !os.IsNotExist(err) {
+		t.Errorf("reading a missing vector: err = %v", err)
+	}
+}
+
+func TestPackInterruptedAppend(t *testing.T) {
+	dir := t.TempDir()
+	results := filepath.Join(dir, "results")
+	want := writeTestResults(t, results, []string{"a.com", "b.com", "c.com"}, []string{"c1", "c2"}, 500)
+	crawlPaths, err := GetPathsMidaResults(results, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packPath := filepath.Join(dir, "results.pack")
+	w, err := CreatePack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths[:2])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string][]bool)
+	for _, c := range crawlPaths[:2] {
+		key := filepath.Base(filepath.Dir(c)) + "/" + filepath.Base(c)
+		before[key] = want[key]
+	}
+
+	// An append that dies before Close leaves the pack as it was
+	w, err = AppendPack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths[2:4])
+	w.f.Close()
+	checkPackVectors(t, packPath, before)
+
+	// The next append writes over the unfinished one
+	w, err = AppendPack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCrawls(t, w, crawlPaths[2:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkPackVectors(t, packPath, want)
+}
+
+func TestPackUnclosed(t *testing.T) {
+	packPath := filepath.Join(t.TempDir(), "results.pack")
+	w, err := CreatePack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Add("a.com", "c1", "coverage.bv", bvFileFromBools(t, randomBools(rand.New(rand.NewSource(1)), 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.f.Close()
+
+	if _, err = OpenPack(packPath); err == nil || !strings.Contains(err.Error(), "no index") {
+		t.Errorf("opening an unclosed pack: err = %v", err)
+	}
+}
+
+func bvFileFromBools(t *testing.T, bv []bool) []byte {
+	t.Helper()
+	fName := filepath.Join(t.TempDir(), "coverage.bv")
+	if err := WriteBVFile(fName, bv, BVHeader{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPackCrawlFiles(t *testing.T) {
+	dir := t.TempDir()
+	packPath := filepath.Join(dir, "results.pack")
+	w, err := CreatePack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vector := bvFileFromBools(t, randomBools(rand.New(rand.NewSource(2)), 100))
+	files := map[string]string{
+		"a.com/c1/metadata.json":          `{"success":true}`,
+		"a.com/c1/resource_metadata.json": `{}`,
+		"b.com/c1/metadata.json":          `{"success":true}`,
+	}
+	for name, contents := range files {
+		parts := strings.Split(name, "/")
+		if err = w.AddFile(parts[0], parts[1], parts[2], []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Add(parts[0], parts[1], "coverage.bv", vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	crawlPaths, err := GetPathsMidaResults(packPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crawlPaths) != 2 {
+		t.Fatalf("found crawls %v", crawlPaths)
+	}
+	for name, contents := range files {
+		data, err := ReadCrawlFile(filepath.Join(packPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s = %q, want %q", name, data, contents)
+		}
+	}
+	_, err = ReadCrawlFile(filepath.Join(packPath, "b.com", "c1", "resource_metadata.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("reading a missing file: err = %v", err)
+	}
+
+	// Identical files share their contents, and files do not show up as vectors
+	p, err := OpenPack(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if len(p.Entries) != 2 || len(p.Files) != 3 {
+		t.Errorf("pack has %d vectors and %d files", len(p.Entries), len(p.Files))
+	}
+	a, _ := p.LookupFile("a.com", "c1", "metadata.json")
+	b, _ := p.LookupFile("b.com", "c1", "metadata.json")
+	if a.offset != b.offset {
+		t.Error("identical files were not shared")
+	}
+}
@@ -0,0 +1,327 @@
+package profparse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type RecordKind int
+
+const (
+	FileRecord RecordKind = iota
+	FunctionRecord
+	RegionRecord
+	BranchRecord
+)
+
+func (k RecordKind) String() string {
+	switch k {
+	case FileRecord:
+		return "FILE"
+	case FunctionRecord:
+		return "FUNCTION"
+	case RegionRecord:
+		return "BLOCK"
+	case BranchRecord:
+		return "BRANCH"
+	}
+	return "UNKNOWN"
+}
+
+// Record is a single event emitted by Parser. File and Function are always set to the
+// enclosing file and function (if any), Region and Executions only for RegionRecord and
+// BranchRecord. For branches, Executions is the number of times the condition was true and
+// FalseExecutions the number of times it was false. File is the path exactly as it appears in
+// the report; NormalizedFile is only set by NormalizePaths.
+type Record struct {
+	Kind            RecordKind
+	Line            int
+	File            string
+	NormalizedFile  string
+	Function        string
+	Region          CodeRegion
+	Executions      uint64
+	FalseExecutions uint64
+}
+
+// RecordSource is anything that can produce a stream of coverage records, such as Parser
+// or ExportReader
+type RecordSource interface {
+	Walk(fn func(Record) error) error
+}
+
+// ParseError describes a malformed line in a coverage report
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parser reads the [FILE]/[FUNCTION]/[BLOCK] text report produced by our custom version of
+// llvm-cov from any io.Reader. Lines may be arbitrarily long. Region lines have the form
+//
+//	[BLOCK] <file id>[,<expanded file id>] <kind> <line start>,<col start>,<line end>,<col end> <count>
+//
+// where kind is either LLVM's numeric region kind or its name (code, expansion, skipped, gap, branch).
+// The report has no counter or expression reference, so the Counter of its regions is left zero.
+// Branch lines carry both the true and false counts of the branch:
+//
+//	[BRANCH] <file id>[,<expanded file id>] <line start>,<col start>,<line end>,<col end> <true count> <false count>
+type Parser struct {
+	reader      *bufio.Reader
+	line        int
+	currentFile string
+	currentFunc string
+	record      Record
+	err         error
+}
+
+func NewParser(r io.Reader) *Parser {
+	return &Parser{
+		reader: bufio.NewReaderSize(r, 1<<20),
+	}
+}
+
+// Next advances the parser to the next record, returning false at the end of the input
+// or on error. Err should be checked once Next returns false.
+func (p *Parser) Next() bool {
+	if p.err != nil {
+		return false
+	}
+
+	for {
+		line, err := p.readLine()
+		if err == io.EOF && len(line) == 0 {
+			return false
+		} else if err != nil && err != io.EOF {
+			p.err = err
+			return false
+		}
+		p.line += 1
+
+		ok, perr := p.parseLine(line)
+		if perr != nil {
+			p.err = &ParseError{Line: p.line, Text: line, Err: perr}
+			return false
+		}
+		if ok {
+			return true
+		}
+		if err == io.EOF {
+			return false
+		}
+	}
+}
+
+// Record returns the most recent record read by Next
+func (p *Parser) Record() Record {
+	return p.record
+}
+
+// Err returns the first error encountered by the parser, if any
+func (p *Parser) Err() error {
+	return p.err
+}
+
+// Walk calls fn for each record in the input, stopping at the first error returned
+// either by the parser or by fn
+func (p *Parser) Walk(fn func(Record) error) error {
+	for p.Next() {
+		err := fn(p.record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.Err()
+}
+
+func (p *Parser) readLine() (string, error) {
+	var sb strings.Builder
+	for {
+		chunk, err := p.reader.ReadSlice('\n')
+		sb.Write(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimRight(sb.String(), "\r\n"), err
+	}
+}
+
+func (p *Parser) parseLine(line string) (bool, error) {
+	pieces := strings.Split(strings.TrimSpace(line), " ")
+	if len(pieces) < 2 {
+		return false, nil
+	}
+
+	switch pieces[0] {
+	case "[FILE]":
+		p.currentFile = pieces[1]
+		p.currentFunc = ""
+		p.record = Record{
+			Kind: FileRecord,
+			Line: p.line,
+			File: p.currentFile,
+		}
+		return true, nil
+
+	case "[FUNCTION]":
+		if p.currentFile == "" {
+			return false, errors.New("function without a file")
+		}
+
+		p.currentFunc = pieces[1]
+		p.record = Record{
+			Kind:     FunctionRecord,
+			Line:     p.line,
+			File:     p.currentFile,
+			Function: p.currentFunc,
+		}
+		return true, nil
+
+	case "[BLOCK]":
+		if p.currentFile == "" || p.currentFunc == "" {
+			return false, errors.New("block without a function or file")
+		}
+
+		if len(pieces) != 5 {
+			return false, errors.New("wrong number of pieces in BLOCK line")
+		}
+
+		cr, err := parseCodeRegion(pieces[3])
+		if err != nil {
+			return false, err
+		}
+
+		cr.FileID, cr.ExpandedFileID, err = parseFileIDs(pieces[1])
+		if err != nil {
+			return false, err
+		}
+
+		cr.Kind, err = ParseRegionKind(pieces[2])
+		if err != nil {
+			return false, err
+		}
+		cr.FileName = p.currentFile
+		cr.FuncName = p.currentFunc
+
+		executions, err := strconv.ParseUint(pieces[4], 10, 64)
+		if err != nil {
+			return false, errors.New("invalid execution count")
+		}
+
+		p.record = Record{
+			Kind:       RegionRecord,
+			Line:       p.line,
+			File:       p.currentFile,
+			Function:   p.currentFunc,
+			Region:     cr,
+			Executions: executions,
+		}
+		return true, nil
+
+	case "[BRANCH]":
+		if p.currentFile == "" || p.currentFunc == "" {
+			return false, errors.New("branch without a function or file")
+		}
+
+		if len(pieces) != 5 {
+			return false, errors.New("wrong number of pieces in BRANCH line")
+		}
+
+		cr, err := parseCodeRegion(pieces[2])
+		if err != nil {
+			return false, err
+		}
+
+		cr.FileID, cr.ExpandedFileID, err = parseFileIDs(pieces[1])
+		if err != nil {
+			return false, err
+		}
+		cr.Kind = RegionBranch
+		cr.FileName = p.currentFile
+		cr.FuncName = p.currentFunc
+
+		trueExecutions, err := strconv.ParseUint(pieces[3], 10, 64)
+		if err != nil {
+			return false, errors.New("invalid execution count")
+		}
+		falseExecutions, err := strconv.ParseUint(pieces[4], 10, 64)
+		if err != nil {
+			return false, errors.New("invalid execution count")
+		}
+
+		p.record = Record{
+			Kind:            BranchRecord,
+			Line:            p.line,
+			File:            p.currentFile,
+			Function:        p.currentFunc,
+			Region:          cr,
+			Executions:      trueExecutions,
+			FalseExecutions: falseExecutions,
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// parseFileIDs parses "<file id>" or "<file id>,<expanded file id>"
+func parseFileIDs(s string) (int, int, error) {
+	ids := strings.Split(s, ",")
+	if len(ids) > 2 {
+		return 0, 0, errors.New("invalid file ID")
+	}
+
+	fileID, err := strconv.Atoi(ids[0])
+	if err != nil {
+		return 0, 0, errors.New("invalid file ID")
+	}
+
+	expandedFileID := 0
+	if len(ids) == 2 {
+		expandedFileID, err = strconv.Atoi(ids[1])
+		if err != nil {
+			return 0, 0, errors.New("invalid expanded file ID")
+		}
+	}
+
+	return fileID, expandedFileID, nil
+}
+
+func parseCodeRegion(s string) (CodeRegion, error) {
+	var cr CodeRegion
+
+	codeIndices := strings.Split(s, ",")
+	if len(codeIndices) != 4 {
+		return cr, errors.New("invalid line/column numbers")
+	}
+
+	var vals [4]int
+	for i, ci := range codeIndices {
+		v, err := strconv.Atoi(ci)
+		if err != nil {
+			return cr, errors.New("invalid line/column numbers")
+		}
+		vals[i] = v
+	}
+
+	cr.LineStart = vals[0]
+	cr.ColumnStart = vals[1]
+	cr.LineEnd = vals[2]
+	cr.ColumnEnd = vals[3]
+
+	return cr, nil
+}
@@ -0,0 +1,108 @@
+package profparse
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParserRecords(t *testing.T) {
+	report := "llvm-cov report\n" +
+		"[FILE] a.cc\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 5\r\n[BLOCK] 0,1 expansion 5,6,7,8 0\n" +
+		"[BRANCH] 0 2,3,2,9 4 1\n" +
+		"[FILE] b.cc\n[FUNCTION] g\n[BLOCK] 1 skipped 9,1,9,5 18446744073709551615"
+
+	type record struct {
+		Kind       RecordKind
+		Line       int
+		File       string
+		Function   string
+		Executions uint64
+		False      uint64
+		Region     CodeRegion
+	}
+	region := func(file string, function string, lines [4]int, fileID int, expanded int, kind RegionKind) CodeRegion {
+		return CodeRegion{FileName: file, FuncName: function, LineStart: lines[0], ColumnStart: lines[1],
+			LineEnd: lines[2], ColumnEnd: lines[3], FileID: fileID, ExpandedFileID: expanded, Kind: kind}
+	}
+	want := []record{
+		{FileRecord, 2, "a.cc", "", 0, 0, CodeRegion{}},
+		{FunctionRecord, 3, "a.cc", "f", 0, 0, CodeRegion{}},
+		{RegionRecord, 4, "a.cc", "f", 5, 0, region("a.cc", "f", [4]int{1, 2, 3, 4}, 0, 0, RegionCode)},
+		{RegionRecord, 5, "a.cc", "f", 0, 0, region("a.cc", "f", [4]int{5, 6, 7, 8}, 0, 1, RegionExpansion)},
+		{BranchRecord, 6, "a.cc", "f", 4, 1, region("a.cc", "f", [4]int{2, 3, 2, 9}, 0, 0, RegionBranch)},
+		{FileRecord, 7, "b.cc", "", 0, 0, CodeRegion{}},
+		{FunctionRecord, 8, "b.cc", "g", 0, 0, CodeRegion{}},
+		{RegionRecord, 9, "b.cc", "g", 18446744073709551615, 0,
+			region("b.cc", "g", [4]int{9, 1, 9, 5}, 1, 0, RegionSkipped)},
+	}
+
+	var got []record
+	p := NewParser(strings.NewReader(report))
+	for p.Next() {
+		rec := p.Record()
+		got = append(got, record{rec.Kind, rec.Line, rec.File, rec.Function, rec.Executions, rec.FalseExecutions,
+			rec.Region})
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseCovMap(t *testing.T) {
+	long := strings.Repeat("x", 200000)
+	report := "[FILE] a.cc\n[FUNCTION] " + long + "\n[BLOCK] 0 0 1,2,3,4 5\n[BLOCK] 0 0 1,2,3,4 0\n" +
+		"[FILE] b.cc\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 7\n[FUNCTION] e\n"
+
+	covMap, props, err := ParseCovMap(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string][]bool{
+		"a.cc": {long: {true, false}},
+		"b.cc": {"f": {true}, "e": {}},
+	}
+	if !reflect.DeepEqual(covMap, want) {
+		t.Errorf("cov map = %v", covMap)
+	}
+	if props != (CovMapProperties{NumFiles: 2, NumFunctions: 3, NumRegions: 3}) {
+		t.Errorf("properties = %+v", props)
+	}
+	if bv := ConvertCovMapToBools(covMap); !reflect.DeepEqual(bv, []bool{true, false, true}) {
+		t.Errorf("vector = %v", bv)
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		report string
+		line   int
+	}{
+		{"block outside a function", "[FILE] a\n[BLOCK] 0 0 1,2,3,4 5\n", 2},
+		{"function outside a file", "[FUNCTION] f\n", 1},
+		{"bad region", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0 0 1,2,x,4 5\n", 3},
+		{"short region", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3 5\n", 3},
+		{"bad count", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4 -5\n", 3},
+		{"missing count", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0 0 1,2,3,4\n", 3},
+		{"bad file id", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0,1,2 0 1,2,3,4 5\n", 3},
+		{"bad kind", "[FILE] a\n[FUNCTION] f\n[BLOCK] 0 bogus 1,2,3,4 5\n", 3},
+		{"bad branch count", "[FILE] a\n[FUNCTION] f\n[BRANCH] 0 1,2,3,4 5 x\n", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseCovMap(strings.NewReader(tt.report))
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("err = %v, want a ParseError", err)
+			}
+			if pe.Line != tt.line {
+				t.Errorf("error on line %d, want %d", pe.Line, tt.line)
+			}
+		})
+	}
+}
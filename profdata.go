@@ -0,0 +1,347 @@
+package profparse
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	indexedProfMagic = 0x8169666f72706cff
+
+	// High bits of the version field that hold flags rather than the version number
+	profVariantMask     = 0xffffffff00000000
+	profVariantMaskCSIR = 1 << 57
+
+	// Newest indexed profile format version we know how to read
+	maxIndexedProfVersion = 12
+)
+
+type ProfileKey struct {
+	NameRef uint64
+	Hash    uint64
+}
+
+// FunctionProfile holds the counters recorded for a single function. Name may be empty if the
+// profile only identified the function by the MD5 of its name.
+type FunctionProfile struct {
+	Name     string
+	NameRef  uint64
+	Hash     uint64
+	Counters []uint64
+}
+
+// Profile is a set of function counters read from a .profdata file, keyed by function name and
+// structural hash
+type Profile struct {
+	Functions map[ProfileKey]*FunctionProfile
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		Functions: make(map[ProfileKey]*FunctionProfile),
+	}
+}
+
+// FunctionNameRef returns the MD5-based hash LLVM uses to refer to a function name
+func FunctionNameRef(name string) uint64 {
+	sum := md5.Sum([]byte(name))
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+// Add adds the counters for a function to the profile, summing them with any counters already
+// present for the same function
+func (p *Profile) Add(fp FunctionProfile) error {
+	key := ProfileKey{NameRef: fp.NameRef, Hash: fp.Hash}
+	existing, ok := p.Functions[key]
+	if !ok {
+		counters := make([]uint64, len(fp.Counters))
+		copy(counters, fp.Counters)
+		fp.Counters = counters
+		p.Functions[key] = &fp
+		return nil
+	}
+
+	if len(existing.Counters) != len(fp.Counters) {
+		return fmt.Errorf("mismatched counter count for function %016x", fp.NameRef)
+	}
+	if existing.Name == "" {
+		existing.Name = fp.Name
+	}
+	for i, c := range fp.Counters {
+		if existing.Counters[i] > ^uint64(0)-c {
+			existing.Counters[i] = ^uint64(0)
+		} else {
+			existing.Counters[i] += c
+		}
+	}
+
+	return nil
+}
+
+// Merge adds all of the functions in other to the profile
+func (p *Profile) Merge(other *Profile) error {
+	for _, fp := range other.Functions {
+		err := p.Add(*fp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Profile) Lookup(name string, hash uint64) ([]uint64, bool) {
+	return p.LookupRef(FunctionNameRef(name), hash)
+}
+
+func (p *Profile) LookupRef(nameRef uint64, hash uint64) ([]uint64, bool) {
+	fp, ok := p.Functions[ProfileKey{NameRef: nameRef, Hash: hash}]
+	if !ok {
+		return nil, false
+	}
+	return fp.Counters, true
+}
+
+// ReadProfdata reads an indexed profile, as written by llvm-profdata merge
+func ReadProfdata(fname string) (*Profile, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseProfdata(content)
+}
+
+// GenBVFromProfdata writes the bit vector for an indexed profile to outfile, without needing
+// llvm-cov. The mappings must come from the binary the profile was collected from.
+func GenBVFromProfdata(profdataFile string, mappings []FunctionMapping, outfile string) error {
+	profile, err := ReadProfdata(profdataFile)
+	if err != nil {
+		return err
+	}
+
+	records := MappingRecords(mappings, profile)
+	covMap, _, err := CovMapFromRecords(records)
+	if err != nil {
+		return err
+	}
+
+	layout, err := CoverageLayoutFromRecords(records)
+	if err != nil {
+		return err
+	}
+
+	return WriteBVFile(outfile, ConvertCovMapToBools(covMap), BVHeaderForCovPath(outfile, layout))
+}
+
+// profdataReader is a bounds checked cursor over an indexed profile
+type profdataReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *profdataReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos < 0 || r.pos+8 > len(r.data) {
+		r.err = errors.New("truncated profdata file")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+	return v
+}
+
+func (r *profdataReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos < 0 || r.pos+4 > len(r.data) {
+		r.err = errors.New("truncated profdata file")
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *profdataReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.err = errors.New("truncated profdata file")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// skipSummary skips over a profile summary, which we have no use for
+func (r *profdataReader) skipSummary() {
+	numFields := r.uint64()
+	numEntries := r.uint64()
+	if r.err != nil {
+		return
+	}
+	if numFields > uint64(len(r.data)) || numEntries > uint64(len(r.data)) {
+		r.err = errors.New("invalid profile summary")
+		return
+	}
+	r.bytes(8 * (numFields + 3*numEntries))
+}
+
+// ParseProfdata parses the contents of an indexed profile. Only the function counters are
+// read; value profiles, MC/DC bitmaps and the other optional sections are skipped.
+func ParseProfdata(data []byte) (*Profile, error) {
+	r := &profdataReader{data: data}
+
+	magic := r.uint64()
+	if r.err != nil || magic != indexedProfMagic {
+		return nil, errors.New("not an indexed profile")
+	}
+
+	rawVersion := r.uint64()
+	version := rawVersion &^ profVariantMask
+	if version < 1 || version > maxIndexedProfVersion {
+		return nil, fmt.Errorf("unsupported indexed profile version %d", version)
+	}
+
+	r.uint64() // Unused (MaxFunctionCount before version 4)
+	hashType := r.uint64()
+	hashOffset := r.uint64()
+	if version >= 8 {
+		r.uint64() // MemProfOffset
+	}
+	if version >= 9 {
+		r.uint64() // BinaryIdOffset
+	}
+	if version >= 10 {
+		r.uint64() // TemporalProfTracesOffset
+	}
+	if version >= 12 {
+		r.uint64() // VTableNamesOffset
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if hashType != 0 {
+		return nil, fmt.Errorf("unsupported profile hash type %d", hashType)
+	}
+
+	if version >= 4 {
+		r.skipSummary()
+		if rawVersion&profVariantMaskCSIR != 0 {
+			r.skipSummary()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	payload := r.pos
+
+	if hashOffset > uint64(len(data)) {
+		return nil, errors.New("invalid profile hash table offset")
+	}
+	r.pos = int(hashOffset)
+	r.uint64() // NumBuckets
+	numEntries := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Walk the buckets of the on disk hash table in order rather than hashing into them,
+	// as we want every entry anyway
+	profile := NewProfile()
+	r.pos = payload
+	itemsLeftInBucket := 0
+	for i := uint64(0); i < numEntries; i++ {
+		for itemsLeftInBucket == 0 {
+			b := r.bytes(2)
+			if r.err != nil {
+				return nil, r.err
+			}
+			itemsLeftInBucket = int(binary.LittleEndian.Uint16(b))
+		}
+		itemsLeftInBucket -= 1
+
+		r.uint64() // Key hash
+		keyLen := r.uint64()
+		dataLen := r.uint64()
+		name := string(r.bytes(keyLen))
+		recordData := r.bytes(dataLen)
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		err := readProfdataRecords(profile, name, recordData, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return profile, nil
+}
+
+// readProfdataRecords reads the records for every function sharing a given name
+func readProfdataRecords(profile *Profile, name string, data []byte, version uint64) error {
+	r := &profdataReader{data: data}
+	nameRef := FunctionNameRef(name)
+
+	for r.pos+8 < len(data) {
+		hash := r.uint64()
+
+		numCounters := uint64(len(data))/8 - 1
+		if version != 1 {
+			numCounters = r.uint64()
+		}
+		if r.err != nil || numCounters > uint64(len(data))/8 {
+			return errors.New("invalid profile record for " + name)
+		}
+
+		counters := make([]uint64, numCounters)
+		for i := range counters {
+			counters[i] = r.uint64()
+		}
+
+		if version > 10 {
+			numBitmapBytes := r.uint64()
+			if numBitmapBytes > uint64(len(data))/8 {
+				return errors.New("invalid profile record for " + name)
+			}
+			r.bytes(8 * numBitmapBytes)
+		}
+
+		if version > 2 {
+			// Value profile data starts with its total size
+			start := r.pos
+			totalSize := r.uint32()
+			if totalSize < 8 {
+				return errors.New("invalid value profile data for " + name)
+			}
+			r.pos = start
+			r.bytes(uint64(totalSize))
+		}
+
+		if r.err != nil {
+			return errors.New("invalid profile record for " + name)
+		}
+
+		err := profile.Add(FunctionProfile{
+			Name:     name,
+			NameRef:  nameRef,
+			Hash:     hash,
+			Counters: counters,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package profparse
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The indexed profiles in testdata/profdata were written by llvm-profdata 14 from the text
+// profiles next to them:
+//
+//	llvm-profdata merge -o small.profdata small.proftext
+//	llvm-profdata merge -o many.profdata many.proftext
+//	llvm-profdata merge --sparse -o many_sparse.profdata many.proftext
+
+// readProftext reads a text profile, as accepted by llvm-profdata merge
+func readProftext(t *testing.T, fName string) *Profile {
+	t.Helper()
+	f, err := os.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProfile()
+	number := func(i int) uint64 {
+		v, err := strconv.ParseUint(lines[i], 10, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", fName, err)
+		}
+		return v
+	}
+	for i := 0; i < len(lines); {
+		fp := FunctionProfile{Name: lines[i], NameRef: FunctionNameRef(lines[i]), Hash: number(i + 1)}
+		numCounters := int(number(i + 2))
+		for k := 0; k < numCounters; k++ {
+			fp.Counters = append(fp.Counters, number(i+3+k))
+		}
+		if err = p.Add(fp); err != nil {
+			t.Fatal(err)
+		}
+		i += 3 + numCounters
+	}
+	return p
+}
+
+func TestReadProfdata(t *testing.T) {
+	tests := []struct {
+		profdata string
+		proftext string
+		sparse   bool
+	}{
+		{"small.profdata", "small.proftext", false},
+		{"many.profdata", "many.proftext", false},
+		{"many_sparse.profdata", "many.proftext", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profdata, func(t *testing.T) {
+			p, err := ReadProfdata(filepath.Join("testdata", "profdata", tt.profdata))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := readProftext(t, filepath.Join("testdata", "profdata", tt.proftext))
+
+			// Sparse profiles leave out functions that never ran
+			for key, fp := range want.Functions {
+				zero := true
+				for _, c := range fp.Counters {
+					zero = zero && c == 0
+				}
+				if tt.sparse && zero {
+					delete(want.Functions, key)
+				}
+			}
+			if len(p.Functions) != len(want.Functions) {
+				t.Errorf("%d functions, want %d", len(p.Functions), len(want.Functions))
+			}
+			for key, fp := range want.Functions {
+				got, ok := p.Functions[key]
+				if !ok {
+					t.Errorf("%s (%d) is missing", fp.Name, fp.Hash)
+					continue
+				}
+				if !reflect.DeepEqual(got, fp) {
+					t.Errorf("%s = %+v, want %+v", fp.Name, got, fp)
+				}
+			}
+		})
+	}
+}
+
+func TestParseProfdataInvalid(t *testing.T) {
+	valid, err := ReadProfdata(filepath.Join("testdata", "profdata", "small.profdata"))
+	if err != nil || len(valid.Functions) != 3 {
+		t.Fatalf("reading a valid profile: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "profdata", "small.profdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(f func(d []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", modified(func(d []byte) []byte { d[0] ^= 0xff; return d })},
+		{"future version", modified(func(d []byte) []byte { d[8] = 99; return d })},
+		{"hash table past end", modified(func(d []byte) []byte { d[39] = 0x7f; return d })},
+		{"truncated", data[:len(data)/2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseProfdata(tt.data); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestMappingRecordsFromProfdata(t *testing.T) {
+	p, err := ReadProfdata(filepath.Join("testdata", "profdata", "small.profdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// main's counters are 10, 0 and 7; its second region counts counter 0 minus counter 2
+	main := FunctionMapping{
+		Name:      "main",
+		NameRef:   FunctionNameRef("main"),
+		Hash:      1234,
+		Filenames: []string{"m.c"},
+		Expressions: []CounterExpression{
+			{Kind: CounterSubtract, LHS: Counter{CounterReference, 0}, RHS: Counter{CounterReference, 2}},
+		},
+		Regions: []MappingRegion{
+			{Count: Counter{CounterReference, 0}},
+			{Count: Counter{CounterSubtract, 0}},
+			{Count: Counter{CounterReference, 1}},
+			{Kind: RegionBranch},
+		},
+	}
+	// A function without a profile counts nothing
+	missing := main
+	missing.Name = "absent"
+	missing.NameRef = FunctionNameRef("absent")
+
+	counts, _, err := CountMapFromRecords(MappingRecords([]FunctionMapping{main, missing}, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts["m.c"]["main"], []uint64{10, 3, 0}) {
+		t.Errorf("main counts = %v, want [10 3 0]", counts["m.c"]["main"])
+	}
+	if !reflect.DeepEqual(counts["m.c"]["absent"], []uint64{0, 0, 0}) {
+		t.Errorf("absent counts = %v, want [0 0 0]", counts["m.c"]["absent"])
+	}
+}
+
+func TestProfileAdd(t *testing.T) {
+	p := NewProfile()
+	add := func(counters ...uint64) error {
+		return p.Add(FunctionProfile{Name: "f", NameRef: FunctionNameRef("f"), Hash: 1, Counters: counters})
+	}
+	counters := []uint64{1, ^uint64(0) - 1}
+	if err := add(counters...); err != nil {
+		t.Fatal(err)
+	}
+	counters[0] = 5
+	if err := add(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := p.Lookup("f", 1); !reflect.DeepEqual(c, []uint64{3, ^uint64(0)}) {
+		t.Errorf("counters = %v, want [3 %d]", c, ^uint64(0))
+	}
+	if err := add(1); err == nil {
+		t.Error("expected an error for a mismatched counter count")
+	}
+}
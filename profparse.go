@@ -8,6 +8,7 @@ import (
 	"errors"
 	log "github.com/sirupsen/logrus"
 	b "github.com/teamnsrg/mida/base"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -19,25 +20,47 @@ import (
 )
 
 type CodeRegion struct {
-	FileName    string
-	FuncName    string
-	LineStart   int
-	ColumnStart int
-	LineEnd     int
-	ColumnEnd   int
-	FileID      int
+	FileName           string
+	NormalizedFileName string
+	FuncName           string
+	LineStart          int
+	ColumnStart        int
+	LineEnd            int
+	ColumnEnd          int
+	FileID             int
+	ExpandedFileID     int
+	Kind               RegionKind
+
+	// Counter is only set for regions read from a binary's coverage mapping, by MappingRecords.
+	// Text reports and llvm-cov export JSON only give execution counts, so for them it is always
+	// the zero counter.
+	Counter Counter
 }
 
 type CovSummary struct {
 	TotalRegions   int
 	CoveredRegions int
 	PercentCovered float64
+
+	// Functions with at least one covered region
+	TotalFunctions   int
+	CoveredFunctions int
+}
+
+// BranchSummary counts the branches in part of the tree. CoveredBranches have had both directions
+// taken, and PercentCovered is the fraction of all directions taken.
+type BranchSummary struct {
+	TotalBranches     int
+	CoveredBranches   int
+	CoveredDirections int
+	PercentCovered    float64
 }
 
 type CovMapProperties struct {
 	NumFiles     int
 	NumFunctions int
 	NumRegions   int
+	NumBranches  int
 }
 
 func CombineBVs(vectors [][]bool) ([]bool, int, error) {
@@ -78,66 +101,43 @@ func ReadFileToCovMap(fName string) (map[string]map[string][]bool, CovMapPropert
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	return ParseCovMap(f)
+}
 
+// ParseCovMap reads a coverage report from r, returning a coverage map containing whether
+// or not each region was executed
+func ParseCovMap(r io.Reader) (map[string]map[string][]bool, CovMapProperties, error) {
+	return CovMapFromRecords(NewParser(r))
+}
+
+// CovMapFromRecords builds a coverage map from the records produced by src
+func CovMapFromRecords(src RecordSource) (map[string]map[string][]bool, CovMapProperties, error) {
 	covMap := make(map[string]map[string][]bool)
-	currentFile := ""
-	currentFunc := ""
 
 	totalRegions := 0
-	coveredRegions := 0
 	totalFiles := 0
 	totalFuncs := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		pieces := strings.Split(strings.TrimSpace(line), " ")
-		if len(pieces) < 2 {
-			continue
-		}
 
-		if pieces[0] == "[FILE]" {
-			currentFile = pieces[1]
-			if _, ok := covMap[currentFile]; !ok {
-				covMap[currentFile] = make(map[string][]bool)
+	err := src.Walk(func(rec Record) error {
+		switch rec.Kind {
+		case FileRecord:
+			if _, ok := covMap[rec.File]; !ok {
+				covMap[rec.File] = make(map[string][]bool)
 			}
-
 			totalFiles += 1
-		} else if pieces[0] == "[FUNCTION]" {
-			if currentFile == "" {
-				return nil, CovMapProperties{}, errors.New("function without a file")
-			}
-
-			currentFunc = pieces[1]
-			if _, ok := covMap[currentFile][currentFunc]; !ok {
-				covMap[currentFile][currentFunc] = make([]bool, 0)
+		case FunctionRecord:
+			if _, ok := covMap[rec.File][rec.Function]; !ok {
+				covMap[rec.File][rec.Function] = make([]bool, 0)
 			}
-
 			totalFuncs += 1
-		} else if pieces[0] == "[BLOCK]" {
-			if currentFile == "" || currentFunc == "" {
-				return nil, CovMapProperties{}, errors.New("block without a function or file")
-			}
-
-			if len(pieces) != 5 {
-				return nil, CovMapProperties{}, errors.New("wrong number of pieces in BLOCK line")
-			}
-
-			executions, err := strconv.ParseUint(pieces[4], 10, 64)
-			if err != nil {
-				return nil, CovMapProperties{}, err
-			}
-
+		case RegionRecord:
+			covMap[rec.File][rec.Function] = append(covMap[rec.File][rec.Function], rec.Executions != 0)
 			totalRegions += 1
-
-			if executions != 0 {
-				coveredRegions += 1
-
-				covMap[currentFile][currentFunc] = append(covMap[currentFile][currentFunc], true)
-			} else {
-				covMap[currentFile][currentFunc] = append(covMap[currentFile][currentFunc], false)
-			}
-
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, CovMapProperties{}, err
 	}
 
 	props := CovMapProperties{
@@ -159,83 +159,57 @@ func ReadCovMetadata(fname string) (map[string]map[string][]CodeRegion, CovMapPr
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	return ParseCovMetadata(f)
+}
+
+// ReadCovMetadataWithNormalizer is ReadCovMetadata, normalizing file names with n rather than
+// DefaultPathNormalizer
+func ReadCovMetadataWithNormalizer(fname string, n *PathNormalizer) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, CovMapProperties{}, err
+	}
+	defer f.Close()
+
+	return CovMetadataFromRecords(NormalizePaths(NewParser(f), n))
+}
+
+// ParseCovMetadata is ReadCovMetadata for an arbitrary io.Reader
+func ParseCovMetadata(r io.Reader) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
+	return CovMetadataFromRecords(NormalizePaths(NewParser(r), DefaultPathNormalizer()))
+}
 
+// CovMetadataFromRecords builds a metadata map from the records produced by src. The map is keyed
+// by file names as they appear in the report, matching the coverage map; the normalized name of
+// each region's file is kept in its NormalizedFileName, and falls back to the original name if
+// src does not normalize paths.
+func CovMetadataFromRecords(src RecordSource) (map[string]map[string][]CodeRegion, CovMapProperties, error) {
 	metaMap := make(map[string]map[string][]CodeRegion)
-	currentFile := ""
-	currentFunc := ""
 	totalFiles := 0
 	totalFuncs := 0
 	totalRegions := 0
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		pieces := strings.Split(strings.TrimSpace(line), " ")
-		if len(pieces) < 2 {
-			continue
-		}
-
-		if pieces[0] == "[FILE]" {
-			currentFile = pieces[1]
-			if strings.HasPrefix(currentFile, "/home/pmurley/chromium/src/out/chrome_cov_unstripped") {
-				currentFile = currentFile[53:]
-			}
+	err := src.Walk(func(rec Record) error {
+		currentFile := rec.File
+		switch rec.Kind {
+		case FileRecord:
 			if _, ok := metaMap[currentFile]; !ok {
 				metaMap[currentFile] = make(map[string][]CodeRegion)
 				totalFiles += 1
 			}
-		} else if pieces[0] == "[FUNCTION]" {
-			if currentFile == "" {
-				return nil, CovMapProperties{}, errors.New("function without a file")
-			}
-
-			currentFunc = pieces[1]
-			if _, ok := metaMap[currentFile][currentFunc]; !ok {
-				metaMap[currentFile][currentFunc] = make([]CodeRegion, 0)
+		case FunctionRecord:
+			if _, ok := metaMap[currentFile][rec.Function]; !ok {
+				metaMap[currentFile][rec.Function] = make([]CodeRegion, 0)
 				totalFuncs += 1
 			}
-		} else if pieces[0] == "[BLOCK]" {
-			if currentFile == "" || currentFunc == "" {
-				return nil, CovMapProperties{}, errors.New("block without a function or file")
-			}
-
-			if len(pieces) != 5 {
-				return nil, CovMapProperties{}, errors.New("wrong number of pieces in BLOCK line")
-			}
-
-			var cr CodeRegion
-			cr.FileName = currentFile
-			cr.FuncName = currentFunc
-
-			codeIndices := strings.Split(pieces[3], ",")
-			if len(codeIndices) != 4 {
-				return nil, CovMapProperties{}, errors.New("invalid line/column numbers")
-			}
-
-			cr.LineStart, err = strconv.Atoi(codeIndices[0])
-			if err != nil {
-				return nil, CovMapProperties{}, errors.New("invalid line/column numbers")
-			}
-
-			cr.ColumnStart, err = strconv.Atoi(codeIndices[1])
-			if err != nil {
-				return nil, CovMapProperties{}, errors.New("invalid line/column numbers")
-			}
-
-			cr.LineEnd, err = strconv.Atoi(codeIndices[2])
-			if err != nil {
-				return nil, CovMapProperties{}, errors.New("invalid line/column numbers")
-			}
-
-			cr.ColumnEnd, err = strconv.Atoi(codeIndices[3])
-			if err != nil {
-				return nil, CovMapProperties{}, errors.New("invalid line/column numbers")
-			}
-
-			metaMap[currentFile][currentFunc] = append(metaMap[currentFile][currentFunc], cr)
+		case RegionRecord:
+			metaMap[currentFile][rec.Function] = append(metaMap[currentFile][rec.Function], recordCodeRegion(rec))
 			totalRegions += 1
-
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, CovMapProperties{}, err
 	}
 
 	props := CovMapProperties{
@@ -247,6 +221,23 @@ func ReadCovMetadata(fname string) (map[string]map[string][]CodeRegion, CovMapPr
 	return metaMap, props, nil
 }
 
+// recordCodeRegion returns the region of a record, with both of its file names filled in. Regions
+// expanded from another file keep that file's name, and only fall back to the record's file if
+// the source did not set one.
+func recordCodeRegion(rec Record) CodeRegion {
+	cr := rec.Region
+	if cr.FileName == "" {
+		cr.FileName = rec.File
+	}
+	if cr.NormalizedFileName == "" && cr.FileName == rec.File {
+		cr.NormalizedFileName = rec.NormalizedFile
+	}
+	if cr.NormalizedFileName == "" {
+		cr.NormalizedFileName = cr.FileName
+	}
+	return cr
+}
+
 func ConvertCovMapToStructure(covMap map[string]map[string][]bool) map[string]map[string]int {
 	structure := make(map[string]map[string]int)
 
@@ -297,6 +288,30 @@ func GenCustomCovTxtFileFromProfdata(profdataFile string, instrumentedBinary str
 	return nil
 }
 
+// GenExportFileFromProfdata runs a stock llvm-cov export, producing JSON that can be read with
+// ExportReader in place of the output of our custom llvm-cov
+func GenExportFileFromProfdata(profdataFile string, instrumentedBinary string, outfile string, llvmCovBinary string, numThreads int) error {
+	f, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(llvmCovBinary, "export",
+		"-format=text", "-skip-expansions",
+		"-instr-profile="+profdataFile, "-j="+strconv.Itoa(numThreads),
+		instrumentedBinary)
+
+	cmd.Stdout = f
+
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func WriteCovMapToFile(fname string, covMap map[string]map[string][]bool) error {
 
 	f, err := os.Create(fname)
@@ -334,6 +349,8 @@ func WriteCovMapToFile(fname string, covMap map[string]map[string][]bool) error
 	return nil
 }
 
+// WriteFileFromBV writes a bit vector to disk in the original, unversioned format. Use WriteBVFile
+// to record the layout of the vector as well.
 func WriteFileFromBV(fName string, bv []bool) error {
 	f, err := os.Create(fName)
 	if err != nil {
@@ -355,13 +372,10 @@ func WriteFileFromBV(fName string, bv []bool) error {
 	return nil
 }
 
+// ReadBVFileToBV reads a bit vector file written by either WriteFileFromBV or WriteBVFile. Use
+// ReadBVFileWithLayout to make sure the vector has the expected layout.
 func ReadBVFileToBV(fname string) ([]bool, error) {
-	content, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return nil, err
-	}
-
-	bv, err := bytesToBools(content)
+	bv, _, err := ReadBVFile(fname)
 	if err != nil {
 		return nil, err
 	}
@@ -479,16 +493,7 @@ func boolsToBytes(t []bool) ([]byte, error) {
 		return nil, err
 	}
 
-	b := make([]byte, (len(t)+7)/8)
-	for i, x := range t {
-		if x {
-			b[i/8] |= 0x80 >> uint(i%8)
-		}
-	}
-
-	b = append(buf.Bytes(), b...)
-
-	return b, nil
+	return append(buf.Bytes(), packBools(t)...), nil
 }
 
 func bytesToBools(b []byte) ([]bool, error) {
@@ -504,6 +509,10 @@ func bytesToBools(b []byte) ([]bool, error) {
 		return nil, err
 	}
 
+	if uint64(len(b)-4) != (uint64(numBits)+7)/8 {
+		return nil, errors.New("bit vector length does not match file size")
+	}
+
 	t := make([]bool, numBits)
 	for i, x := range b[4:] {
 		for j := 0; j < 8; j++ {
@@ -616,6 +625,13 @@ func DiffTwoCovMaps(c1 map[string]map[string][]bool, c2 map[string]map[string][]
 }
 
 func GetSitePathsMidaResults(midaResultsPath string) ([]string, error) {
+	if pack, err := cachedPack(midaResultsPath); pack != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return packSites(midaResultsPath, pack), nil
+	}
+
 	results := make([]string, 0)
 
 	dirs, err := ioutil.ReadDir(midaResultsPath)
@@ -634,6 +650,14 @@ func GetCovPathCrawl(crawlPath string) (string, error) {
 	covPath := path.Join(crawlPath, "coverage", "coverage.bv")
 	if _, err := os.Stat(covPath); os.IsNotExist(err) {
 		return "", errors.New("coverage data does not exist")
+	} else if isNotDirError(err) {
+		pack, parts, err := packForPath(crawlPath, 2)
+		if pack == nil || err != nil {
+			return "", errors.New("coverage data does not exist")
+		}
+		if _, ok := pack.Lookup(parts[0], parts[1], "coverage.bv"); !ok {
+			return "", errors.New("coverage data does not exist")
+		}
 	}
 
 	return covPath, nil
@@ -641,6 +665,17 @@ func GetCovPathCrawl(crawlPath string) (string, error) {
 
 func GetCovPathsSite(sitePath string) ([]string, error) {
 	subDirs, err := ioutil.ReadDir(sitePath)
+	if isNotDirError(err) {
+		if pack, parts, packErr := packForPath(sitePath, 1); pack != nil {
+			result := packCovPaths(path.Dir(path.Clean(sitePath)), pack, parts[0], "coverage.bv", false)
+			if len(result) == 0 {
+				return nil, errors.New("no valid coverage data for site")
+			}
+			return result, nil
+		} else if packErr != nil {
+			return nil, packErr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -665,8 +700,16 @@ func GetCovPathsSite(sitePath string) ([]string, error) {
 }
 
 // Given the path to a MIDA crawl results directory, returns a slice of strings containing
-// the paths to all of the coverage (.cov) files contained in it
+// the paths to all of the coverage (.cov) files contained in it. rootPath may also be a pack, in
+// which case the paths are within it and can be read by ReadBVFile.
 func GetCovPathsMIDAResults(rootPath string, onePerSite bool) ([]string, error) {
+	if pack, err := cachedPack(rootPath); pack != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return packCovPaths(rootPath, pack, "", "coverage.bv", onePerSite), nil
+	}
+
 	results := make([]string, 0)
 
 	dirs, err := ioutil.ReadDir(rootPath)
@@ -690,6 +733,17 @@ func GetCovPathsMIDAResults(rootPath string, onePerSite bool) ([]string, error)
 
 func GetPathsSite(sitePath string) ([]string, error) {
 	subDirs, err := ioutil.ReadDir(sitePath)
+	if isNotDirError(err) {
+		if pack, parts, packErr := packForPath(sitePath, 1); pack != nil {
+			result := packCrawls(path.Dir(path.Clean(sitePath)), pack, parts[0], false)
+			if len(result) == 0 {
+				return nil, errors.New("no valid results for site")
+			}
+			return result, nil
+		} else if packErr != nil {
+			return nil, packErr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -707,6 +761,13 @@ func GetPathsSite(sitePath string) ([]string, error) {
 }
 
 func GetPathsMidaResults(rootPath string, onePerSite bool) ([]string, error) {
+	if pack, err := cachedPack(rootPath); pack != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return packCrawls(rootPath, pack, "", onePerSite), nil
+	}
+
 	results := make([]string, 0)
 
 	dirs, err := ioutil.ReadDir(rootPath)
@@ -823,7 +884,7 @@ func GetThresholdBV(vectors [][]bool, threshold float64) ([]bool, error) {
 }
 
 func LoadMidaMetadata(filename string) (b.TaskSummary, error) {
-	jsonBytes, err := os.ReadFile(filename)
+	jsonBytes, err := ReadCrawlFile(filename)
 	if err != nil {
 		return b.TaskSummary{}, err
 	}
@@ -838,7 +899,7 @@ func LoadMidaMetadata(filename string) (b.TaskSummary, error) {
 }
 
 func LoadMidaResourceData(filename string) (map[string]b.DTResource, error) {
-	jsonBytes, err := os.ReadFile(filename)
+	jsonBytes, err := ReadCrawlFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -852,6 +913,9 @@ func LoadMidaResourceData(filename string) (map[string]b.DTResource, error) {
 	return resourceData, nil
 }
 
+// CountCoveredRegions returns the number of covered regions and the length of bv. Every region
+// counts, including gap and skipped regions. To leave those out, pass the exclude vector of
+// CoverageLayout.ExcludeBV(CountedRegions) to CountCoveredRegionsWithExclude.
 func CountCoveredRegions(bv []bool) (int, int) {
 	total := len(bv)
 	covered := 0
@@ -0,0 +1,431 @@
+package profparse
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	rawProfMagic64 = uint64(255)<<56 | uint64('l')<<48 | uint64('p')<<40 | uint64('r')<<32 |
+		uint64('o')<<24 | uint64('f')<<16 | uint64('r')<<8 | uint64(129)
+	rawProfMagic32 = uint64(255)<<56 | uint64('l')<<48 | uint64('p')<<40 | uint64('r')<<32 |
+		uint64('o')<<24 | uint64('f')<<16 | uint64('R')<<8 | uint64(129)
+
+	minRawProfVersion = 5
+	maxRawProfVersion = 10
+
+	profVariantMaskByteCoverage = 1 << 60
+
+	// Separator between function names in a names section
+	profNameSeparator = '\x01'
+)
+
+// rawProfHeader holds the fields of a raw profile header that we need. Fields that only exist
+// in some versions are left at zero for the others.
+type rawProfHeader struct {
+	Version                      uint64
+	BinaryIdsSize                uint64
+	NumData                      uint64
+	PaddingBytesBeforeCounters   uint64
+	NumCounters                  uint64
+	PaddingBytesAfterCounters    uint64
+	NumBitmapBytes               uint64
+	PaddingBytesAfterBitmapBytes uint64
+	NamesSize                    uint64
+	CountersDelta                uint64
+	BitmapDelta                  uint64
+	NamesDelta                   uint64
+	NumVTables                   uint64
+	VNamesSize                   uint64
+	ValueKindLast                uint64
+}
+
+// headerFields returns pointers to the header fields present in the given version, in
+// the order they are stored in the file
+func (h *rawProfHeader) headerFields(version uint64) []*uint64 {
+	fields := []*uint64{&h.Version}
+	if version >= 6 {
+		fields = append(fields, &h.BinaryIdsSize)
+	}
+	fields = append(fields, &h.NumData, &h.PaddingBytesBeforeCounters, &h.NumCounters, &h.PaddingBytesAfterCounters)
+	if version >= 9 {
+		fields = append(fields, &h.NumBitmapBytes, &h.PaddingBytesAfterBitmapBytes)
+	}
+	fields = append(fields, &h.NamesSize, &h.CountersDelta)
+	if version >= 9 {
+		fields = append(fields, &h.BitmapDelta)
+	}
+	fields = append(fields, &h.NamesDelta)
+	if version >= 10 {
+		fields = append(fields, &h.NumVTables, &h.VNamesSize)
+	}
+	return append(fields, &h.ValueKindLast)
+}
+
+// dataRecordSize returns the size of a per function data record in a 64-bit raw profile
+func (h *rawProfHeader) dataRecordSize(version uint64) uint64 {
+	// NameRef, FuncHash, CounterPtr, FunctionPointer, Values
+	size := uint64(5 * 8)
+	if version >= 9 {
+		size += 8 // BitmapPtr
+	}
+	// NumCounters, NumValueSites
+	size += 4 + 2*(h.ValueKindLast+1)
+	if version >= 9 {
+		size += 4 // NumBitmapBytes
+	}
+	return alignTo8(size)
+}
+
+func alignTo8(n uint64) uint64 {
+	return (n + 7) &^ 7
+}
+
+// addRawOffset returns offset+size, or an error if the result would pass the end of a profile of n
+// bytes
+func addRawOffset(offset uint64, size uint64, n uint64) (uint64, error) {
+	if offset > n || size > n-offset {
+		return 0, errors.New("truncated raw profile")
+	}
+	return offset + size, nil
+}
+
+// addRawOffsets adds each of sizes to offset, as addRawOffset does
+func addRawOffsets(n uint64, offset uint64, sizes ...uint64) (uint64, error) {
+	var err error
+	for _, size := range sizes {
+		offset, err = addRawOffset(offset, size, n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// ReadProfraw reads a raw profile, as written by an instrumented binary. Files containing several
+// concatenated profiles are merged.
+func ReadProfraw(fname string) (*Profile, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := NewProfile()
+	err = ParseProfraw(content, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// ReadProfraws reads and merges the raw profiles from one crawl in memory, in place of
+// MergeProfraws. Like llvm-profdata's --failure-mode=any, unreadable profiles are logged and
+// skipped, and an error is only returned if none of them could be read.
+func ReadProfraws(profraws []string) (*Profile, error) {
+	profile := NewProfile()
+	succeeded := 0
+
+	for _, profraw := range profraws {
+		p, err := ReadProfraw(profraw)
+		if err != nil {
+			log.Errorf("%s: %v", profraw, err)
+			continue
+		}
+
+		err = profile.Merge(p)
+		if err != nil {
+			log.Errorf("%s: %v", profraw, err)
+			continue
+		}
+		succeeded += 1
+	}
+
+	if succeeded == 0 {
+		return nil, errors.New("no valid raw profiles")
+	}
+
+	return profile, nil
+}
+
+// GetProfrawPathsCrawl returns the paths of the raw profiles left by a crawl
+func GetProfrawPathsCrawl(crawlPath string) ([]string, error) {
+	profraws, err := filepath.Glob(path.Join(crawlPath, "coverage", "*.profraw"))
+	if err != nil {
+		return nil, err
+	}
+	if len(profraws) == 0 {
+		return nil, errors.New("raw profile data does not exist")
+	}
+
+	return profraws, nil
+}
+
+// GenBVFromProfraws writes the bit vector for a set of raw profiles to outfile, without needing
+// llvm-profdata or llvm-cov. The mappings must come from the binary the profiles were collected from.
+func GenBVFromProfraws(profraws []string, mappings []FunctionMapping, outfile string) error {
+	profile, err := ReadProfraws(profraws)
+	if err != nil {
+		return err
+	}
+
+	records := MappingRecords(mappings, profile)
+	covMap, _, err := CovMapFromRecords(records)
+	if err != nil {
+		return err
+	}
+
+	layout, err := CoverageLayoutFromRecords(records)
+	if err != nil {
+		return err
+	}
+
+	return WriteBVFile(outfile, ConvertCovMapToBools(covMap), BVHeaderForCovPath(outfile, layout))
+}
+
+// ParseProfraw parses the contents of a raw profile, adding its counters to profile
+func ParseProfraw(data []byte, profile *Profile) error {
+	pos := uint64(0)
+	for {
+		// Profiles may be separated by zero padding
+		for pos < uint64(len(data)) && data[pos] == 0 {
+			pos += 1
+		}
+		if pos == uint64(len(data)) {
+			return nil
+		}
+		if pos%8 != 0 {
+			return errors.New("misaligned raw profile")
+		}
+
+		end, err := parseRawProfile(data[pos:], profile)
+		if err != nil {
+			return err
+		}
+		pos += end
+	}
+}
+
+// parseRawProfile parses a single raw profile at the start of data, returning its length
+func parseRawProfile(data []byte, profile *Profile) (uint64, error) {
+	if len(data) < 16 {
+		return 0, errors.New("truncated raw profile")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint64(data)
+	if magic == swapUint64(rawProfMagic64) || magic == swapUint64(rawProfMagic32) {
+		order = binary.BigEndian
+		magic = order.Uint64(data)
+	}
+	if magic == rawProfMagic32 {
+		return 0, errors.New("32-bit raw profiles are not supported")
+	}
+	if magic != rawProfMagic64 {
+		return 0, errors.New("not a raw profile")
+	}
+
+	rawVersion := order.Uint64(data[8:])
+	version := rawVersion &^ profVariantMask
+	if version < minRawProfVersion || version > maxRawProfVersion {
+		return 0, fmt.Errorf("unsupported raw profile version %d", version)
+	}
+
+	var h rawProfHeader
+	fields := h.headerFields(version)
+	headerSize := uint64(8 * (len(fields) + 1))
+	if uint64(len(data)) < headerSize {
+		return 0, errors.New("truncated raw profile")
+	}
+	for i, field := range fields {
+		*field = order.Uint64(data[8*(i+1):])
+	}
+	if h.ValueKindLast > 16 {
+		return 0, errors.New("invalid raw profile header")
+	}
+
+	counterSize := uint64(8)
+	if rawVersion&profVariantMaskByteCoverage != 0 {
+		counterSize = 1
+	}
+
+	// The sizes come from the file, so each section is checked against the data before it is added
+	// to the offsets
+	n := uint64(len(data))
+	recordSize := h.dataRecordSize(version)
+	if h.NumData > n/recordSize || h.NumCounters > n/counterSize || h.NumVTables > n/(3*8) ||
+		h.NamesSize > n || h.VNamesSize > n {
+		return 0, errors.New("truncated raw profile")
+	}
+	dataOffset, err := addRawOffset(headerSize, h.BinaryIdsSize, n)
+	if err != nil {
+		return 0, err
+	}
+	countersOffset, err := addRawOffsets(n, dataOffset, h.NumData*recordSize, h.PaddingBytesBeforeCounters)
+	if err != nil {
+		return 0, err
+	}
+	countersSize := h.NumCounters * counterSize
+	namesOffset, err := addRawOffsets(n, countersOffset, countersSize, h.PaddingBytesAfterCounters,
+		h.NumBitmapBytes, h.PaddingBytesAfterBitmapBytes)
+	if err != nil {
+		return 0, err
+	}
+	valueDataOffset, err := addRawOffset(namesOffset, alignTo8(h.NamesSize), n)
+	if err != nil {
+		return 0, err
+	}
+	if version >= 10 {
+		// Virtual table profile data and names sit between the names and the value data
+		valueDataOffset, err = addRawOffsets(n, valueDataOffset, alignTo8(h.NumVTables*3*8), alignTo8(h.VNamesSize))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	names, err := ReadProfNames(data[namesOffset : namesOffset+h.NamesSize])
+	if err != nil {
+		return 0, err
+	}
+
+	counters := data[countersOffset : countersOffset+countersSize]
+	countersDelta := h.CountersDelta
+	valueDataPos := valueDataOffset
+
+	for i := uint64(0); i < h.NumData; i++ {
+		record := data[dataOffset+i*recordSize : dataOffset+(i+1)*recordSize]
+		nameRef := order.Uint64(record[0:])
+		funcHash := order.Uint64(record[8:])
+		counterPtr := order.Uint64(record[16:])
+		numCountersOffset := uint64(40)
+		if version >= 9 {
+			numCountersOffset = 48
+		}
+		numCounters := uint64(order.Uint32(record[numCountersOffset:]))
+
+		numValueKinds := 0
+		for k := uint64(0); k <= h.ValueKindLast; k++ {
+			if order.Uint16(record[numCountersOffset+4+2*k:]) != 0 {
+				numValueKinds += 1
+			}
+		}
+
+		// From version 7 on, counter pointers are relative to the data record itself
+		counterOffset := counterPtr - countersDelta
+		if version >= 7 {
+			countersDelta -= recordSize
+		}
+		if counterOffset%counterSize != 0 || counterOffset > countersSize || numCounters*counterSize > countersSize-counterOffset {
+			return 0, fmt.Errorf("invalid counter offset for function %016x", nameRef)
+		}
+
+		fp := FunctionProfile{
+			Name:     names[nameRef],
+			NameRef:  nameRef,
+			Hash:     funcHash,
+			Counters: make([]uint64, numCounters),
+		}
+		for j := range fp.Counters {
+			start := counterOffset + uint64(j)*counterSize
+			if counterSize == 1 {
+				// Single byte coverage counters are cleared when the block runs
+				if counters[start] == 0 {
+					fp.Counters[j] = 1
+				}
+			} else {
+				fp.Counters[j] = order.Uint64(counters[start:])
+			}
+		}
+
+		err = profile.Add(fp)
+		if err != nil {
+			return 0, err
+		}
+
+		if numValueKinds > 0 {
+			if valueDataPos+8 > uint64(len(data)) {
+				return 0, errors.New("truncated raw profile value data")
+			}
+			totalSize := uint64(order.Uint32(data[valueDataPos:]))
+			if totalSize < 8 || valueDataPos+totalSize > uint64(len(data)) {
+				return 0, errors.New("invalid raw profile value data")
+			}
+			valueDataPos += totalSize
+		}
+	}
+
+	return valueDataPos, nil
+}
+
+// ReadProfNames decodes a names section, as found in raw profiles and in the __llvm_prf_names
+// section of instrumented binaries, returning the names keyed by their MD5 based hash
+func ReadProfNames(section []byte) (map[uint64]string, error) {
+	names := make(map[uint64]string)
+
+	pos := 0
+	for pos < len(section) {
+		uncompressedSize, n := binary.Uvarint(section[pos:])
+		if n <= 0 {
+			return nil, errors.New("invalid names section")
+		}
+		pos += n
+
+		compressedSize, n := binary.Uvarint(section[pos:])
+		if n <= 0 {
+			return nil, errors.New("invalid names section")
+		}
+		pos += n
+
+		size := uncompressedSize
+		if compressedSize != 0 {
+			size = compressedSize
+		}
+		if size > uint64(len(section)-pos) {
+			return nil, errors.New("invalid names section")
+		}
+		chunk := section[pos : pos+int(size)]
+		pos += int(size)
+
+		if compressedSize != 0 {
+			zr, err := zlib.NewReader(bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			chunk, err = ioutil.ReadAll(zr)
+			zr.Close()
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(chunk)) != uncompressedSize {
+				return nil, errors.New("invalid compressed names")
+			}
+		}
+
+		for _, name := range strings.Split(string(chunk), string(profNameSeparator)) {
+			if name != "" {
+				names[FunctionNameRef(name)] = name
+			}
+		}
+
+		// Skip padding between chunks
+		for pos < len(section) && section[pos] == 0 {
+			pos += 1
+		}
+	}
+
+	return names, nil
+}
+
+func swapUint64(v uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return binary.BigEndian.Uint64(b[:])
+}
@@ -0,0 +1,160 @@
+package profparse
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rawHeaderV8 returns the header of a version 8 raw profile, as written by clang 14
+func rawHeaderV8(numData uint64, numCounters uint64, namesSize uint64) []byte {
+	var b bytes.Buffer
+	for _, v := range []uint64{
+		rawProfMagic64,
+		8,            // Version
+		0,            // BinaryIdsSize
+		numData,      // NumData
+		0,            // PaddingBytesBeforeCounters
+		numCounters,  // NumCounters
+		0,            // PaddingBytesAfterCounters
+		namesSize,    // NamesSize
+		numData * 48, // CountersDelta
+		0,            // NamesDelta
+		1,            // ValueKindLast
+	} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// testProfraw returns a raw profile holding main, with counters 5 and 0, and foo, with counter 9
+func testProfraw(compressNames bool) []byte {
+	names := []byte("main\x01foo")
+	section := []byte{byte(len(names)), 0}
+	if compressNames {
+		var zb bytes.Buffer
+		w := zlib.NewWriter(&zb)
+		w.Write(names)
+		w.Close()
+		section[1] = byte(zb.Len())
+		names = zb.Bytes()
+	}
+	section = append(section, names...)
+
+	var b bytes.Buffer
+	b.Write(rawHeaderV8(2, 3, uint64(len(section))))
+	record := func(name string, hash uint64, counterPtr uint64, numCounters uint32) {
+		binary.Write(&b, binary.LittleEndian, []uint64{FunctionNameRef(name), hash, counterPtr, 0, 0})
+		binary.Write(&b, binary.LittleEndian, numCounters)
+		binary.Write(&b, binary.LittleEndian, []uint16{0, 0})
+	}
+	// Counter pointers are relative to each record
+	record("main", 11, 96, 2)
+	record("foo", 22, 64, 1)
+	binary.Write(&b, binary.LittleEndian, []uint64{5, 0, 9})
+	b.Write(section)
+	for b.Len()%8 != 0 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func TestParseProfraw(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		main []uint64
+		foo  []uint64
+	}{
+		{"plain names", testProfraw(false), []uint64{5, 0}, []uint64{9}},
+		{"compressed names", testProfraw(true), []uint64{5, 0}, []uint64{9}},
+		{"concatenated", append(testProfraw(true), testProfraw(false)...), []uint64{10, 0}, []uint64{18}},
+		{"zero padded", append(append(testProfraw(false), make([]byte, 16)...), testProfraw(false)...),
+			[]uint64{10, 0}, []uint64{18}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProfile()
+			if err := ParseProfraw(tt.data, p); err != nil {
+				t.Fatal(err)
+			}
+			if c, ok := p.Lookup("main", 11); !ok || !reflect.DeepEqual(c, tt.main) {
+				t.Errorf("main counters = %v, want %v", c, tt.main)
+			}
+			if c, ok := p.Lookup("foo", 22); !ok || !reflect.DeepEqual(c, tt.foo) {
+				t.Errorf("foo counters = %v, want %v", c, tt.foo)
+			}
+			if name := p.Functions[ProfileKey{FunctionNameRef("foo"), 22}].Name; name != "foo" {
+				t.Errorf("foo name = %q", name)
+			}
+		})
+	}
+}
+
+func TestParseProfrawInvalid(t *testing.T) {
+	valid := testProfraw(false)
+	withHeader := func(numData, numCounters, namesSize uint64) []byte {
+		return append(rawHeaderV8(numData, numCounters, namesSize), valid[88:]...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not a profile", []byte("not a raw profile"), "not a raw profile"},
+		{"truncated header", valid[:40], "truncated raw profile"},
+		{"truncated body", valid[:len(valid)-16], "truncated raw profile"},
+		{"names size overflow", append(rawHeaderV8(0, 0, math.MaxUint64-87), make([]byte, 8)...),
+			"truncated raw profile"},
+		{"names past end", withHeader(2, 3, 1<<20), "truncated raw profile"},
+		{"data count overflow", withHeader(math.MaxUint64/48+1, 3, 10), "truncated raw profile"},
+		{"counter count overflow", withHeader(2, math.MaxUint64/8+1, 10), "truncated raw profile"},
+		{"counters past end", withHeader(2, 1<<20, 10), "truncated raw profile"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ParseProfraw(tt.data, NewProfile())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadProfrawsSkipsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a.profraw": testProfraw(false),
+		"b.profraw": testProfraw(true),
+		"c.profraw": []byte("garbage"),
+	}
+	var paths []string
+	for name, data := range files {
+		paths = append(paths, filepath.Join(dir, name))
+		if err := ioutil.WriteFile(paths[len(paths)-1], data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := ReadProfraws(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := p.Lookup("main", 11); !reflect.DeepEqual(c, []uint64{10, 0}) {
+		t.Errorf("main counters = %v", c)
+	}
+
+	_, err = ReadProfraws([]string{filepath.Join(dir, "c.profraw")})
+	if err == nil {
+		t.Error("expected an error when no profile can be read")
+	}
+}
@@ -0,0 +1,278 @@
+package profparse
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// ProjectedLayout describes vectors with one bit per function or per file of a region layout.
+// Entries are in the same order as in the region vectors, so the index of a function or file only
+// changes when the region layout does.
+type ProjectedLayout struct {
+	Regions     *CoverageLayout
+	Granularity BVGranularity
+
+	files     []string
+	functions []string // Empty at file granularity
+	ranges    []BVRange
+	indices   map[functionKey]int
+
+	fingerprint LayoutFingerprint
+}
+
+// NewProjectedLayout builds the layout of function or file vectors projected from vectors with
+// layout l
+func NewProjectedLayout(l *CoverageLayout, g BVGranularity) (*ProjectedLayout, error) {
+	if g != FunctionGranularity && g != FunctionEntryGranularity && g != FileGranularity {
+		return nil, errors.New("cannot project vectors to " + g.String() + " granularity")
+	}
+
+	p := &ProjectedLayout{
+		Regions:     l,
+		Granularity: g,
+		files:       make([]string, 0),
+		functions:   make([]string, 0),
+		ranges:      make([]BVRange, 0),
+		indices:     make(map[functionKey]int),
+	}
+
+	for _, fileName := range l.files {
+		if g == FileGranularity {
+			p.indices[functionKey{fileName, ""}] = len(p.ranges)
+			p.files = append(p.files, fileName)
+			p.ranges = append(p.ranges, l.fileRanges[fileName])
+			continue
+		}
+
+		for _, funcName := range l.functions[fileName] {
+			p.indices[functionKey{fileName, funcName}] = len(p.ranges)
+			p.files = append(p.files, fileName)
+			p.functions = append(p.functions, funcName)
+			p.ranges = append(p.ranges, l.funcRanges[fileName][funcName])
+		}
+	}
+
+	// Projections of the same layout to different granularities must not be mixed up, even when
+	// they happen to have the same length
+	regions := l.Fingerprint()
+	h := sha256.New()
+	h.Write(regions[:])
+	h.Write([]byte{byte(g)})
+	copy(p.fingerprint[:], h.Sum(nil))
+
+	return p, nil
+}
+
+// Fingerprint identifies the projected layout, as CoverageLayout.Fingerprint does
+func (p *ProjectedLayout) Fingerprint() LayoutFingerprint {
+	return p.fingerprint
+}
+
+// Len returns the length of the projected vectors
+func (p *ProjectedLayout) Len() int {
+	return len(p.ranges)
+}
+
+// Name returns the file and function at index i of a projected vector. The function is empty at
+// file granularity.
+func (p *ProjectedLayout) Name(i int) (string, string, bool) {
+	if i < 0 || i >= len(p.ranges) {
+		return "", "", false
+	}
+	if p.Granularity == FileGranularity {
+		return p.files[i], "", true
+	}
+	return p.files[i], p.functions[i], true
+}
+
+// Index returns the index of a function or file in a projected vector. funcName is ignored at file
+// granularity.
+func (p *ProjectedLayout) Index(fileName string, funcName string) (int, bool) {
+	if p.Granularity == FileGranularity {
+		funcName = ""
+	}
+	i, ok := p.indices[functionKey{fileName, funcName}]
+	return i, ok
+}
+
+// Range returns the regions making up index i of a projected vector
+func (p *ProjectedLayout) Range(i int) (BVRange, bool) {
+	if i < 0 || i >= len(p.ranges) {
+		return BVRange{}, false
+	}
+	return p.ranges[i], true
+}
+
+// Project converts a region vector into a projected vector
+func (p *ProjectedLayout) Project(bv []bool) ([]bool, error) {
+	if len(bv) != p.Regions.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	projected := make([]bool, len(p.ranges))
+	for i, r := range p.ranges {
+		if p.Granularity == FunctionEntryGranularity {
+			projected[i] = r.Len() > 0 && bv[r.Start]
+			continue
+		}
+
+		for j := r.Start; j < r.End; j++ {
+			if bv[j] {
+				projected[i] = true
+				break
+			}
+		}
+	}
+
+	return projected, nil
+}
+
+// ProjectBitVector is Project for packed vectors
+func (p *ProjectedLayout) ProjectBitVector(bv *BitVector) (*BitVector, error) {
+	if bv.Len() != p.Regions.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	projected := NewBitVector(len(p.ranges))
+	for i, r := range p.ranges {
+		if p.Granularity == FunctionEntryGranularity {
+			projected.SetTo(i, r.Len() > 0 && bv.Get(r.Start))
+			continue
+		}
+
+		if bv.AnyInRange(r.Start, r.End) {
+			projected.Set(i)
+		}
+	}
+
+	return projected, nil
+}
+
+// ProjectExclude converts a region exclude vector into a projected one. A function or file is only
+// excluded if all of its regions are, or at function entry granularity, if its entry region is.
+func (p *ProjectedLayout) ProjectExclude(excludeBV []bool) ([]bool, error) {
+	if len(excludeBV) != p.Regions.NumRegions() {
+		return nil, errors.New("exclude bv length does not match layout")
+	}
+
+	projected := make([]bool, len(p.ranges))
+	for i, r := range p.ranges {
+		if r.Len() == 0 {
+			continue
+		}
+		if p.Granularity == FunctionEntryGranularity {
+			projected[i] = excludeBV[r.Start]
+			continue
+		}
+
+		projected[i] = true
+		for j := r.Start; j < r.End; j++ {
+			if !excludeBV[j] {
+				projected[i] = false
+				break
+			}
+		}
+	}
+
+	return projected, nil
+}
+
+// ProjectExcludeBitVector is ProjectExclude for packed vectors
+func (p *ProjectedLayout) ProjectExcludeBitVector(excludeBV *BitVector) (*BitVector, error) {
+	if excludeBV.Len() != p.Regions.NumRegions() {
+		return nil, errors.New("exclude bv length does not match layout")
+	}
+
+	projected, err := p.ProjectExclude(excludeBV.Bools())
+	if err != nil {
+		return nil, err
+	}
+	return BitVectorFromBools(projected), nil
+}
+
+// CoveredRegions counts the covered regions of each function or file in a region vector
+func (p *ProjectedLayout) CoveredRegions(bv []bool) ([]int, error) {
+	if len(bv) != p.Regions.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	counts := make([]int, len(p.ranges))
+	for i, r := range p.ranges {
+		for j := r.Start; j < r.End; j++ {
+			if bv[j] {
+				counts[i] += 1
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// CoveredRegionsFromBitVector is CoveredRegions for packed vectors
+func (p *ProjectedLayout) CoveredRegionsFromBitVector(bv *BitVector) ([]int, error) {
+	if bv.Len() != p.Regions.NumRegions() {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	counts := make([]int, len(p.ranges))
+	for i, r := range p.ranges {
+		counts[i] = bv.CountRange(r.Start, r.End)
+	}
+
+	return counts, nil
+}
+
+// Header returns the header of a projected vector, taking the crawl identifiers from covPath as
+// BVHeaderForCovPath does
+func (p *ProjectedLayout) Header(covPath string) BVHeader {
+	h := BVHeader{
+		Granularity: p.Granularity,
+		Layout:      p.fingerprint,
+	}
+	h.Site, h.Crawl = CrawlForCovPath(covPath)
+
+	return h
+}
+
+// ProjectBVFile reads a region vector file and writes its projection, keeping its crawl identifiers
+func (p *ProjectedLayout) ProjectBVFile(inFile string, outFile string) error {
+	bv, h, err := ReadBVFile(inFile)
+	if err != nil {
+		return err
+	}
+	if h.HasLayout() && h.Layout != p.Regions.Fingerprint() {
+		return errors.New(inFile + ": bit vector was built for a different layout")
+	}
+	if h.Granularity != RegionGranularity {
+		return errors.New(inFile + ": bit vector is already projected")
+	}
+
+	projected, err := p.Project(bv)
+	if err != nil {
+		return err
+	}
+
+	h.Granularity = p.Granularity
+	h.Layout = p.fingerprint
+	return WriteBVFile(outFile, projected, h)
+}
+
+// ReadBVFileWithProjection is ReadBVFileWithLayout for projected vectors
+func ReadBVFileWithProjection(fName string, p *ProjectedLayout) ([]bool, error) {
+	bv, h, err := ReadBVFile(fName)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Granularity != p.Granularity {
+		return nil, errors.New(fName + ": bit vector has " + h.Granularity.String() + " granularity")
+	}
+	if h.HasLayout() && h.Layout != p.fingerprint {
+		return nil, errors.New(fName + ": bit vector was built for a different layout")
+	}
+	if len(bv) != p.Len() {
+		return nil, errors.New(fName + ": bit vector length does not match layout")
+	}
+
+	return bv, nil
+}
@@ -0,0 +1,267 @@
+package profparse
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// projectionTestLayout has a.cc:h at 0-2, b.cc:f at 3 and b.cc:g at 4-5, with an empty file and
+// an empty function
+func projectionTestLayout() *CoverageLayout {
+	return NewCoverageLayout(map[string]map[string][]CodeRegion{
+		"b.cc": {"g": {{LineStart: 1}, {LineStart: 2}}, "f": {{LineStart: 5}}, "e": {}},
+		"a.cc": {"h": {{LineStart: 1}, {LineStart: 3}, {LineStart: 4}}},
+		"c.cc": {},
+	})
+}
+
+func TestProjectedLayout(t *testing.T) {
+	l := projectionTestLayout()
+	bv := []bool{false, true, false, false, false, true}
+	exclude := []bool{true, true, true, false, true, false}
+
+	tests := []struct {
+		g         BVGranularity
+		names     [][2]string
+		projected []bool
+		exclude   []bool
+		covered   []int
+	}{
+		{FunctionGranularity, [][2]string{{"a.cc", "h"}, {"b.cc", "e"}, {"b.cc", "f"}, {"b.cc", "g"}},
+			[]bool{true, false, false, true}, []bool{true, false, false, false}, []int{1, 0, 0, 1}},
+		{FunctionEntryGranularity, [][2]string{{"a.cc", "h"}, {"b.cc", "e"}, {"b.cc", "f"}, {"b.cc", "g"}},
+			[]bool{false, false, false, false}, []bool{true, false, false, true}, []int{1, 0, 0, 1}},
+		{FileGranularity, [][2]string{{"a.cc", ""}, {"b.cc", ""}, {"c.cc", ""}},
+			[]bool{true, true, false}, []bool{true, false, false}, []int{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.g.String(), func(t *testing.T) {
+			p, err := NewProjectedLayout(l, tt.g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Len() != len(tt.names) {
+				t.Fatalf("%d entries, want %d", p.Len(), len(tt.names))
+			}
+			for i, name := range tt.names {
+				fileName, funcName, ok := p.Name(i)
+				if !ok || fileName != name[0] || funcName != name[1] {
+					t.Errorf("entry %d is %s/%s, want %s/%s", i, fileName, funcName, name[0], name[1])
+				}
+				if j, ok := p.Index(name[0], name[1]); !ok || j != i {
+					t.Errorf("Index(%s, %s) = %d, %v, want %d", name[0], name[1], j, ok, i)
+				}
+			}
+			if _, _, ok := p.Name(p.Len()); ok {
+				t.Error("found a name past the end of the vector")
+			}
+
+			projected, err := p.Project(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			projectedExclude, err := p.ProjectExclude(exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			covered, err := p.CoveredRegions(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(projected, tt.projected) {
+				t.Errorf("projected %v, want %v", projected, tt.projected)
+			}
+			if !reflect.DeepEqual(projectedExclude, tt.exclude) {
+				t.Errorf("projected exclude %v, want %v", projectedExclude, tt.exclude)
+			}
+			if !reflect.DeepEqual(covered, tt.covered) {
+				t.Errorf("covered regions %v, want %v", covered, tt.covered)
+			}
+
+			if _, err = p.Project(bv[1:]); err == nil {
+				t.Error("projected a vector of the wrong length")
+			}
+			if _, err = p.ProjectExclude(exclude[1:]); err == nil {
+				t.Error("projected an exclude vector of the wrong length")
+			}
+		})
+	}
+
+	if _, err := NewProjectedLayout(l, RegionGranularity); err == nil {
+		t.Error("expected an error projecting to region granularity")
+	}
+}
+
+func TestProjectedLayoutBitVectors(t *testing.T) {
+	r := rand.New(rand.NewSource(16))
+	l := mustParseLayout(t, layoutFileTestReport+"[FILE] n.cc\n[FUNCTION] k\n"+
+		"[BLOCK] 0 0 1,1,1,1 1\n[BLOCK] 0 0 2,1,2,1 1\n[BLOCK] 0 0 3,1,3,1 1\n")
+	for _, g := range []BVGranularity{FunctionGranularity, FunctionEntryGranularity, FileGranularity} {
+		p, err := NewProjectedLayout(l, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			bv := randomBools(r, l.NumRegions())
+			projected, err := p.Project(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packed, err := p.ProjectBitVector(BitVectorFromBools(bv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(packed.Bools(), projected) {
+				t.Fatalf("%v: packed projection of %v differs", g, bv)
+			}
+
+			exclude, err := p.ProjectExclude(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packedExclude, err := p.ProjectExcludeBitVector(BitVectorFromBools(bv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(packedExclude.Bools(), exclude) {
+				t.Fatalf("%v: packed exclude projection of %v differs", g, bv)
+			}
+
+			covered, err := p.CoveredRegions(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packedCovered, err := p.CoveredRegionsFromBitVector(BitVectorFromBools(bv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(packedCovered, covered) {
+				t.Fatalf("%v: packed covered regions of %v differ", g, bv)
+			}
+		}
+	}
+}
+
+// Sparse vectors must not be scanned past the end of each function, which made projecting a
+// mostly uncovered vector quadratic
+func TestProjectedLayoutSparseBitVector(t *testing.T) {
+	// Built directly, as a layout of this size takes seconds to build from metadata
+	const numFunctions = 640000
+	const regionsPerFunction = 10
+	l := &CoverageLayout{regions: make([]CodeRegion, numFunctions*regionsPerFunction)}
+	p := &ProjectedLayout{Regions: l, Granularity: FunctionGranularity, ranges: make([]BVRange, numFunctions)}
+	for i := range p.ranges {
+		p.ranges[i] = BVRange{Start: i * regionsPerFunction, End: (i + 1) * regionsPerFunction}
+	}
+
+	// The first 100 functions are covered, and one region of function 200
+	bv := NewBitVector(l.NumRegions())
+	for i := 0; i < 1000; i++ {
+		bv.Set(i)
+	}
+	bv.Set(2000)
+
+	start := time.Now()
+	projected, err := p.ProjectBitVector(bv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered, err := p.CoveredRegionsFromBitVector(bv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("projecting a sparse vector took %v", elapsed)
+	}
+
+	if projected.Count() != 101 || !projected.Get(99) || projected.Get(100) || !projected.Get(200) {
+		t.Errorf("projected %d functions", projected.Count())
+	}
+	for i, want := range map[int]int{0: 10, 99: 10, 100: 0, 200: 1, 201: 0, numFunctions - 1: 0} {
+		if covered[i] != want {
+			t.Errorf("function %d has %d covered regions, want %d", i, covered[i], want)
+		}
+	}
+}
+
+func TestProjectBVFile(t *testing.T) {
+	l := projectionTestLayout()
+	functions, err := NewProjectedLayout(l, FunctionGranularity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := NewProjectedLayout(l, FunctionEntryGranularity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprints := map[LayoutFingerprint]bool{l.Fingerprint(): true, functions.Fingerprint(): true,
+		entries.Fingerprint(): true}
+	if len(fingerprints) != 3 {
+		t.Error("projections share a fingerprint")
+	}
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "site.com", "crawl", "coverage", "coverage.bv")
+	if err = os.MkdirAll(filepath.Dir(in), 0755); err != nil {
+		t.Fatal(err)
+	}
+	bv := []bool{false, true, false, false, false, true}
+	h := BVHeaderForCovPath(in, l)
+	h.Encoding = CompressedEncoding
+	if err = WriteBVFile(in, bv, h); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(filepath.Dir(in), "function.bv")
+	if err = functions.ProjectBVFile(in, out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBVFileWithProjection(out, functions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []bool{true, false, false, true}) {
+		t.Errorf("projection %v", got)
+	}
+	_, outHeader, err := ReadBVFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The projection keeps the encoding of the region vector
+	wantHeader := functions.Header(out)
+	wantHeader.Version = bvFileVersion
+	wantHeader.Encoding = CompressedEncoding
+	wantHeader.NumBits = functions.Len()
+	if outHeader != wantHeader {
+		t.Errorf("header %+v, want %+v", outHeader, wantHeader)
+	}
+
+	tests := []struct {
+		name string
+		err  func() error
+	}{
+		{"region layout", func() error { _, err := ReadBVFileWithLayout(out, l); return err }},
+		{"other granularity", func() error { _, err := ReadBVFileWithProjection(out, entries); return err }},
+		{"region vector", func() error { _, err := ReadBVFileWithProjection(in, functions); return err }},
+		{"projected twice", func() error { return functions.ProjectBVFile(out, out+".2") }},
+		{"other layout", func() error {
+			other, err := NewProjectedLayout(mustParseLayout(t, layoutTestReport), FunctionGranularity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return other.ProjectBVFile(in, out+".3")
+		}},
+		{"mixed layouts", func() error { return CheckSameLayout(BVHeader{}, outHeader, h) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.err(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,625 @@
+package profparse
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// LayoutMapping matches the regions of one layout with those of another, typically the layouts of
+// two builds of the same browser, so that vectors can be translated between them
+type LayoutMapping struct {
+	From *CoverageLayout
+	To   *CoverageLayout
+
+	// Index holds the index in To of each region in From, or -1 if it could not be mapped
+	Index []int
+
+	files     map[string]string
+	functions map[functionKey]functionKey
+}
+
+type functionKey struct {
+	File     string
+	Function string
+}
+
+// FunctionChangeKind describes how a function differs between two layouts
+type FunctionChangeKind int
+
+const (
+	FunctionAdded FunctionChangeKind = iota
+	FunctionRemoved
+	FunctionChanged // Same name, but some of its regions differ
+	FunctionRenamed // Matched by the shape of its regions
+	FunctionMoved   // Same name, but in a different file
+)
+
+func (k FunctionChangeKind) String() string {
+	switch k {
+	case FunctionAdded:
+		return "added"
+	case FunctionRemoved:
+		return "removed"
+	case FunctionChanged:
+		return "changed"
+	case FunctionRenamed:
+		return "renamed"
+	case FunctionMoved:
+		return "moved"
+	}
+	return strconv.Itoa(int(k))
+}
+
+type FunctionChange struct {
+	Kind          FunctionChangeKind
+	OldFile       string
+	OldFunction   string
+	NewFile       string
+	NewFunction   string
+	OldRegions    int
+	NewRegions    int
+	MappedRegions int
+}
+
+// LayoutDiff lists the differences between two layouts
+type LayoutDiff struct {
+	AddedFiles         []string
+	RemovedFiles       []string
+	Functions          []FunctionChange
+	UnchangedFunctions int
+}
+
+// NewLayoutMapping matches the regions of from with those of to. Files are matched by their
+// normalized names, then functions by name, falling back to the shape of their regions for
+// functions that were renamed or whose name is ambiguous. Regions are matched by their kind and
+// position relative to the start of their function, then by their absolute position.
+func NewLayoutMapping(from *CoverageLayout, to *CoverageLayout) *LayoutMapping {
+	m := &LayoutMapping{
+		From:      from,
+		To:        to,
+		Index:     make([]int, from.NumRegions()),
+		files:     make(map[string]string),
+		functions: make(map[functionKey]functionKey),
+	}
+	for i := range m.Index {
+		m.Index[i] = -1
+	}
+
+	toFiles := make(map[string]string)
+	for _, fileName := range to.files {
+		toFiles[to.normalizedFiles[fileName]] = fileName
+	}
+	for _, fileName := range from.files {
+		if toFile, ok := toFiles[from.normalizedFiles[fileName]]; ok {
+			m.files[fileName] = toFile
+		} else if _, ok := to.fileRanges[fileName]; ok {
+			m.files[fileName] = fileName
+		}
+	}
+
+	// Each function in to is matched at most once, so that Index stays one to one
+	matchedTo := make(map[functionKey]bool)
+	match := func(f functionKey, t functionKey) {
+		if matchedTo[t] {
+			return
+		}
+		m.functions[f] = t
+		matchedTo[t] = true
+	}
+
+	// Functions that kept their name and file
+	for _, fileName := range from.files {
+		toFile, ok := m.files[fileName]
+		if !ok {
+			continue
+		}
+		for _, funcName := range from.functions[fileName] {
+			if _, ok := to.funcRanges[toFile][funcName]; ok {
+				match(functionKey{fileName, funcName}, functionKey{toFile, funcName})
+			}
+		}
+	}
+
+	// Functions that moved to another file, or whose file was renamed. A name may belong to several
+	// functions, such as static functions in different files, in which case the shape of their
+	// regions must also match.
+	toByName := make(map[string][]functionKey)
+	for _, fileName := range to.files {
+		for _, funcName := range to.functions[fileName] {
+			t := functionKey{fileName, funcName}
+			if !matchedTo[t] {
+				toByName[funcName] = append(toByName[funcName], t)
+			}
+		}
+	}
+	var fromNames []string
+	fromByName := make(map[string][]functionKey)
+	for _, fileName := range from.files {
+		for _, funcName := range from.functions[fileName] {
+			f := functionKey{fileName, funcName}
+			if _, ok := m.functions[f]; ok {
+				continue
+			}
+			if _, ok := fromByName[funcName]; !ok {
+				fromNames = append(fromNames, funcName)
+			}
+			fromByName[funcName] = append(fromByName[funcName], f)
+		}
+	}
+	for _, funcName := range fromNames {
+		fromCandidates, toCandidates := fromByName[funcName], toByName[funcName]
+		if len(toCandidates) == 0 {
+			continue
+		}
+		if len(fromCandidates) == 1 && len(toCandidates) == 1 {
+			match(fromCandidates[0], toCandidates[0])
+			continue
+		}
+
+		fromShapes := make(map[uint64][]functionKey)
+		for _, f := range fromCandidates {
+			r := from.funcRanges[f.File][f.Function]
+			h := functionShape(from.regions[r.Start:r.End])
+			fromShapes[h] = append(fromShapes[h], f)
+		}
+		toShapes := make(map[uint64][]functionKey)
+		for _, t := range toCandidates {
+			r := to.funcRanges[t.File][t.Function]
+			h := functionShape(to.regions[r.Start:r.End])
+			toShapes[h] = append(toShapes[h], t)
+		}
+		for _, f := range fromCandidates {
+			r := from.funcRanges[f.File][f.Function]
+			h := functionShape(from.regions[r.Start:r.End])
+			if len(fromShapes[h]) == 1 && len(toShapes[h]) == 1 {
+				match(f, toShapes[h][0])
+			}
+		}
+	}
+
+	// Functions that were renamed, matched by shape within matching files when the shape is unique.
+	// Functions with a single region all look alike, so they are never matched this way.
+	for _, fileName := range from.files {
+		toFile, ok := m.files[fileName]
+		if !ok {
+			continue
+		}
+
+		fromShapes := make(map[uint64][]string)
+		for _, funcName := range from.functions[fileName] {
+			r := from.funcRanges[fileName][funcName]
+			if _, ok := m.functions[functionKey{fileName, funcName}]; !ok && r.Len() > 1 {
+				h := functionShape(from.regions[r.Start:r.End])
+				fromShapes[h] = append(fromShapes[h], funcName)
+			}
+		}
+		toShapes := make(map[uint64][]string)
+		for _, funcName := range to.functions[toFile] {
+			r := to.funcRanges[toFile][funcName]
+			if !matchedTo[functionKey{toFile, funcName}] && r.Len() > 1 {
+				h := functionShape(to.regions[r.Start:r.End])
+				toShapes[h] = append(toShapes[h], funcName)
+			}
+		}
+
+		for h, funcNames := range fromShapes {
+			if len(funcNames) == 1 && len(toShapes[h]) == 1 {
+				match(functionKey{fileName, funcNames[0]}, functionKey{toFile, toShapes[h][0]})
+			}
+		}
+	}
+
+	for f, t := range m.functions {
+		fr := from.funcRanges[f.File][f.Function]
+		tr := to.funcRanges[t.File][t.Function]
+		for i, j := range matchRegions(from.regions[fr.Start:fr.End], to.regions[tr.Start:tr.End]) {
+			if j >= 0 {
+				m.Index[fr.Start+i] = tr.Start + j
+			}
+		}
+	}
+
+	return m
+}
+
+// regionKey identifies a region within its function. Lines in the function's own file are
+// relative to the start of the function; those in other files, such as macro expansions, are not.
+type regionKey struct {
+	LineStart   int
+	ColumnStart int
+	LineEnd     int
+	ColumnEnd   int
+	Kind        RegionKind
+}
+
+func relativeRegionKeys(regions []CodeRegion) []regionKey {
+	keys := make([]regionKey, len(regions))
+	if len(regions) == 0 {
+		return keys
+	}
+
+	base := regions[0].LineStart
+	for i, cr := range regions {
+		k := regionKey{cr.LineStart, cr.ColumnStart, cr.LineEnd, cr.ColumnEnd, cr.Kind}
+		if cr.FileID == 0 {
+			k.LineStart -= base
+			k.LineEnd -= base
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
+// functionShape hashes the relative positions of a function's regions, which do not change when
+// code elsewhere in the file moves the function up or down
+func functionShape(regions []CodeRegion) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, k := range relativeRegionKeys(regions) {
+		for _, v := range []int{k.LineStart, k.ColumnStart, k.LineEnd, k.ColumnEnd, int(k.Kind)} {
+			binary.LittleEndian.PutUint64(buf[:], uint64(v))
+			h.Write(buf[:])
+		}
+	}
+	return h.Sum64()
+}
+
+// matchRegions returns the index in to of each region in from, or -1. Each region in to is
+// matched at most once, and regions with equal keys are matched in order.
+func matchRegions(from []CodeRegion, to []CodeRegion) []int {
+	index := make([]int, len(from))
+	for i := range index {
+		index[i] = -1
+	}
+	used := make([]bool, len(to))
+
+	absoluteKeys := func(regions []CodeRegion) []regionKey {
+		keys := make([]regionKey, len(regions))
+		for i, cr := range regions {
+			keys[i] = regionKey{cr.LineStart, cr.ColumnStart, cr.LineEnd, cr.ColumnEnd, cr.Kind}
+		}
+		return keys
+	}
+
+	passes := [][2][]regionKey{
+		{relativeRegionKeys(from), relativeRegionKeys(to)},
+		{absoluteKeys(from), absoluteKeys(to)},
+	}
+	for _, pass := range passes {
+		fromKeys, toKeys := pass[0], pass[1]
+
+		candidates := make(map[regionKey][]int)
+		for j, k := range toKeys {
+			if !used[j] {
+				candidates[k] = append(candidates[k], j)
+			}
+		}
+
+		for i, k := range fromKeys {
+			if index[i] >= 0 || len(candidates[k]) == 0 {
+				continue
+			}
+			j := candidates[k][0]
+			candidates[k] = candidates[k][1:]
+			index[i] = j
+			used[j] = true
+		}
+	}
+
+	return index
+}
+
+// NumMapped returns the number of regions in From that have a match in To
+func (m *LayoutMapping) NumMapped() int {
+	mapped := 0
+	for _, j := range m.Index {
+		if j >= 0 {
+			mapped += 1
+		}
+	}
+	return mapped
+}
+
+// UnmappedRegions returns the indices of the regions in From that have no match in To
+func (m *LayoutMapping) UnmappedRegions() []int {
+	unmapped := make([]int, 0)
+	for i, j := range m.Index {
+		if j < 0 {
+			unmapped = append(unmapped, i)
+		}
+	}
+	return unmapped
+}
+
+// MappedBV returns a vector in the To layout, set for every region with a match in From. Its
+// inverse can be used as an exclude vector when comparing translated vectors with native ones.
+func (m *LayoutMapping) MappedBV() []bool {
+	mapped := make([]bool, m.To.NumRegions())
+	for _, j := range m.Index {
+		if j >= 0 {
+			mapped[j] = true
+		}
+	}
+	return mapped
+}
+
+// MappedBitVector is MappedBV for packed vectors
+func (m *LayoutMapping) MappedBitVector() *BitVector {
+	mapped := NewBitVector(m.To.NumRegions())
+	for _, j := range m.Index {
+		if j >= 0 {
+			mapped.Set(j)
+		}
+	}
+	return mapped
+}
+
+// TranslateBV translates a vector from the From layout to the To layout. Regions with no match in
+// From are left unset.
+func (m *LayoutMapping) TranslateBV(bv []bool) ([]bool, error) {
+	if len(bv) != len(m.Index) {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	translated := make([]bool, m.To.NumRegions())
+	for i, j := range m.Index {
+		if j >= 0 {
+			translated[j] = bv[i]
+		}
+	}
+	return translated, nil
+}
+
+// TranslateBitVector is TranslateBV for packed vectors
+func (m *LayoutMapping) TranslateBitVector(bv *BitVector) (*BitVector, error) {
+	if bv.Len() != len(m.Index) {
+		return nil, errors.New("bv length does not match layout")
+	}
+
+	translated := NewBitVector(m.To.NumRegions())
+	bv.ForEach(func(i int) {
+		if j := m.Index[i]; j >= 0 {
+			translated.Set(j)
+		}
+	})
+	return translated, nil
+}
+
+// TranslateBVFile translates a bit vector file from the From layout to the To layout, keeping its
+// crawl identifiers
+func (m *LayoutMapping) TranslateBVFile(inFile string, outFile string) error {
+	bv, h, err := ReadBVFile(inFile)
+	if err != nil {
+		return err
+	}
+	if h.HasLayout() && h.Layout != m.From.Fingerprint() {
+		return errors.New(inFile + ": bit vector was built for a different layout")
+	}
+	if h.Granularity != RegionGranularity {
+		return errors.New(inFile + ": only region vectors can be translated")
+	}
+
+	translated, err := m.TranslateBV(bv)
+	if err != nil {
+		return err
+	}
+
+	h.Layout = m.To.Fingerprint()
+	return WriteBVFile(outFile, translated, h)
+}
+
+// Diff lists the files and functions added, removed or changed between From and To
+func (m *LayoutMapping) Diff() LayoutDiff {
+	var d LayoutDiff
+
+	matchedToFiles := make(map[string]bool)
+	for _, toFile := range m.files {
+		matchedToFiles[toFile] = true
+	}
+	for _, fileName := range m.From.files {
+		if _, ok := m.files[fileName]; !ok {
+			d.RemovedFiles = append(d.RemovedFiles, fileName)
+		}
+	}
+	for _, fileName := range m.To.files {
+		if !matchedToFiles[fileName] {
+			d.AddedFiles = append(d.AddedFiles, fileName)
+		}
+	}
+
+	matchedTo := make(map[functionKey]bool)
+	for _, fileName := range m.From.files {
+		for _, funcName := range m.From.functions[fileName] {
+			f := functionKey{fileName, funcName}
+			fr := m.From.funcRanges[fileName][funcName]
+			t, ok := m.functions[f]
+			if !ok {
+				d.Functions = append(d.Functions, FunctionChange{
+					Kind:        FunctionRemoved,
+					OldFile:     fileName,
+					OldFunction: funcName,
+					OldRegions:  fr.Len(),
+				})
+				continue
+			}
+			matchedTo[t] = true
+
+			tr := m.To.funcRanges[t.File][t.Function]
+			c := FunctionChange{
+				OldFile:     fileName,
+				OldFunction: funcName,
+				NewFile:     t.File,
+				NewFunction: t.Function,
+				OldRegions:  fr.Len(),
+				NewRegions:  tr.Len(),
+			}
+			unchanged := fr.Len() == tr.Len()
+			for i := fr.Start; i < fr.End; i++ {
+				if m.Index[i] >= 0 {
+					c.MappedRegions += 1
+				}
+				if m.Index[i] != tr.Start+i-fr.Start {
+					unchanged = false
+				}
+			}
+
+			switch {
+			case t.Function != funcName:
+				c.Kind = FunctionRenamed
+			case m.files[fileName] != t.File:
+				c.Kind = FunctionMoved
+			case !unchanged:
+				c.Kind = FunctionChanged
+			default:
+				d.UnchangedFunctions += 1
+				continue
+			}
+			d.Functions = append(d.Functions, c)
+		}
+	}
+
+	for _, fileName := range m.To.files {
+		for _, funcName := range m.To.functions[fileName] {
+			if !matchedTo[functionKey{fileName, funcName}] {
+				d.Functions = append(d.Functions, FunctionChange{
+					Kind:        FunctionAdded,
+					NewFile:     fileName,
+					NewFunction: funcName,
+					NewRegions:  m.To.funcRanges[fileName][funcName].Len(),
+				})
+			}
+		}
+	}
+
+	return d
+}
+
+// WriteLayoutDiffToFile writes a layout diff as a CSV file, with one row per added or removed file
+// and one per added, removed or changed function
+func WriteLayoutDiffToFile(d LayoutDiff, fileName string) error {
+	return WriteLayoutDiffToFileWithNames(d, fileName, NameMangled)
+}
+
+// WriteLayoutDiffToFileWithNames is WriteLayoutDiffToFile, writing function names in the given style
+func WriteLayoutDiffToFileWithNames(d LayoutDiff, fileName string, style NameStyle) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+	names := NewFunctionNameFormatter(style)
+
+	header := []string{"Change", "Old File"}
+	header = append(header, names.Header("Old Function")...)
+	header = append(header, "New File")
+	header = append(header, names.Header("New Function")...)
+	header = append(header, "Old Regions", "New Regions", "Mapped Regions")
+	err = writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	row := func(change string, oldFile string, oldFunction string, newFile string, newFunction string, counts ...string) []string {
+		r := []string{change, oldFile}
+		r = append(r, names.Format(oldFunction)...)
+		r = append(r, newFile)
+		r = append(r, names.Format(newFunction)...)
+		return append(r, counts...)
+	}
+
+	for _, fileName := range d.RemovedFiles {
+		err = writer.Write(row("file removed", fileName, "", "", "", "", "", ""))
+		if err != nil {
+			return err
+		}
+	}
+	for _, fileName := range d.AddedFiles {
+		err = writer.Write(row("file added", "", "", fileName, "", "", "", ""))
+		if err != nil {
+			return err
+		}
+	}
+
+	changes := make([]FunctionChange, len(d.Functions))
+	copy(changes, d.Functions)
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		if changes[i].OldFile+changes[i].NewFile != changes[j].OldFile+changes[j].NewFile {
+			return changes[i].OldFile+changes[i].NewFile < changes[j].OldFile+changes[j].NewFile
+		}
+		return changes[i].OldFunction+changes[i].NewFunction < changes[j].OldFunction+changes[j].NewFunction
+	})
+
+	for _, c := range changes {
+		err = writer.Write(row(
+			c.Kind.String(),
+			c.OldFile,
+			c.OldFunction,
+			c.NewFile,
+			c.NewFunction,
+			strconv.Itoa(c.OldRegions),
+			strconv.Itoa(c.NewRegions),
+			strconv.Itoa(c.MappedRegions),
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteUnmappedRegionsToFile writes the regions of From with no match in To as a CSV file
+func WriteUnmappedRegionsToFile(m *LayoutMapping, fileName string) error {
+	return WriteUnmappedRegionsToFileWithNames(m, fileName, NameMangled)
+}
+
+// WriteUnmappedRegionsToFileWithNames is WriteUnmappedRegionsToFile, writing function names in the
+// given style
+func WriteUnmappedRegionsToFileWithNames(m *LayoutMapping, fileName string, style NameStyle) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+	names := NewFunctionNameFormatter(style)
+
+	header := []string{"Index", "File"}
+	header = append(header, names.Header("Function")...)
+	header = append(header, "Kind", "Line Start", "Column Start", "Line End", "Column End")
+	err = writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range m.UnmappedRegions() {
+		cr := m.From.regions[i]
+		record := []string{strconv.Itoa(i), cr.FileName}
+		record = append(record, names.Format(cr.FuncName)...)
+		err = writer.Write(append(record,
+			cr.Kind.String(),
+			strconv.Itoa(cr.LineStart),
+			strconv.Itoa(cr.ColumnStart),
+			strconv.Itoa(cr.LineEnd),
+			strconv.Itoa(cr.ColumnEnd),
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,138 @@
+package profparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseLayout(t *testing.T, report string) *CoverageLayout {
+	t.Helper()
+	layout, err := ParseCoverageLayout(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestLayoutDiff(t *testing.T) {
+	from := mustParseLayout(t, "[FILE] /b/out/A/../../x.cc\n"+
+		"[FUNCTION] keep\n[BLOCK] 0 0 10,1,12,1 1\n[BLOCK] 0 0 11,3,11,9 0\n"+
+		"[FUNCTION] ren\n[BLOCK] 0 0 20,1,25,1 1\n[BLOCK] 0 0 21,2,21,8 1\n"+
+		"[FUNCTION] chg\n[BLOCK] 0 0 30,1,35,1 1\n[BLOCK] 0 0 31,2,31,8 1\n"+
+		"[FUNCTION] gone\n[BLOCK] 0 0 40,1,41,1 1\n"+
+		"[FILE] old.cc\n[FUNCTION] mv\n[BLOCK] 0 0 1,1,2,1 1\n")
+	to := mustParseLayout(t, "[FILE] /c/out/B/../../x.cc\n"+
+		"[FUNCTION] keep\n[BLOCK] 0 0 15,1,17,1 1\n[BLOCK] 0 0 16,3,16,9 0\n"+
+		"[FUNCTION] ren2\n[BLOCK] 0 0 25,1,30,1 1\n[BLOCK] 0 0 26,2,26,8 1\n"+
+		"[FUNCTION] chg\n[BLOCK] 0 0 35,1,41,1 1\n[BLOCK] 0 0 0,0,0,0 1\n[BLOCK] 0 0 36,2,36,8 1\n"+
+		"[FUNCTION] new\n[BLOCK] 0 0 50,1,51,1 1\n"+
+		"[FILE] new.cc\n[FUNCTION] mv\n[BLOCK] 0 0 1,1,2,1 1\n")
+
+	m := NewLayoutMapping(from, to)
+	d := m.Diff()
+
+	kinds := make(map[string]FunctionChangeKind)
+	for _, c := range d.Functions {
+		kinds[c.OldFunction+"/"+c.NewFunction] = c.Kind
+	}
+	want := map[string]FunctionChangeKind{
+		"ren/ren2": FunctionRenamed,
+		"chg/chg":  FunctionChanged,
+		"gone/":    FunctionRemoved,
+		"/new":     FunctionAdded,
+		"mv/mv":    FunctionMoved,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("function changes = %v, want %v", kinds, want)
+	}
+	if d.UnchangedFunctions != 1 {
+		t.Errorf("unchanged functions = %d, want 1", d.UnchangedFunctions)
+	}
+	if !reflect.DeepEqual(d.AddedFiles, []string{"new.cc"}) || !reflect.DeepEqual(d.RemovedFiles, []string{"old.cc"}) {
+		t.Errorf("added files %v, removed files %v", d.AddedFiles, d.RemovedFiles)
+	}
+
+	// The first region of chg grew and gone was removed
+	if m.NumMapped() != from.NumRegions()-2 {
+		t.Errorf("mapped %d regions, want %d", m.NumMapped(), from.NumRegions()-2)
+	}
+}
+
+func TestLayoutMappingAmbiguousNames(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want map[string]string // From file of each helper to its To file
+	}{
+		{
+			name: "two helpers, one target",
+			from: "[FILE] a.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,5,1 1\n[BLOCK] 0 0 2,1,2,5 1\n" +
+				"[FILE] b.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,9,1 1\n[BLOCK] 0 0 3,1,3,5 1\n",
+			to:   "[FILE] c.cc\n[FUNCTION] helper\n[BLOCK] 0 0 7,1,15,1 1\n[BLOCK] 0 0 9,1,9,5 1\n",
+			want: map[string]string{"b.cc": "c.cc"},
+		},
+		{
+			name: "two helpers, same shape",
+			from: "[FILE] a.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,5,1 1\n" +
+				"[FILE] b.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,5,1 1\n",
+			to:   "[FILE] c.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,5,1 1\n",
+			want: map[string]string{},
+		},
+		{
+			name: "two helpers, two targets",
+			from: "[FILE] a.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,5,1 1\n[BLOCK] 0 0 2,1,2,5 1\n" +
+				"[FILE] b.cc\n[FUNCTION] helper\n[BLOCK] 0 0 1,1,9,1 1\n[BLOCK] 0 0 3,1,3,5 1\n",
+			to: "[FILE] c.cc\n[FUNCTION] helper\n[BLOCK] 0 0 11,1,19,1 1\n[BLOCK] 0 0 13,1,13,5 1\n" +
+				"[FILE] d.cc\n[FUNCTION] helper\n[BLOCK] 0 0 21,1,25,1 1\n[BLOCK] 0 0 22,1,22,5 1\n",
+			want: map[string]string{"a.cc": "d.cc", "b.cc": "c.cc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := mustParseLayout(t, tt.from)
+			to := mustParseLayout(t, tt.to)
+			m := NewLayoutMapping(from, to)
+
+			got := make(map[string]string)
+			for f, to := range m.functions {
+				got[f.File] = to.File
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+
+			// Index must be one to one, or translated vectors lose regions
+			seen := make(map[int]bool)
+			for _, j := range m.Index {
+				if j < 0 {
+					continue
+				}
+				if seen[j] {
+					t.Fatalf("region %d of to is mapped twice: %v", j, m.Index)
+				}
+				seen[j] = true
+			}
+
+			bv := make([]bool, from.NumRegions())
+			for i := range bv {
+				bv[i] = true
+			}
+			translated, err := m.TranslateBV(bv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			covered := 0
+			for _, v := range translated {
+				if v {
+					covered++
+				}
+			}
+			if covered != m.NumMapped() {
+				t.Errorf("%d regions covered after translation, want %d", covered, m.NumMapped())
+			}
+		})
+	}
+}
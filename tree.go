@@ -8,7 +8,15 @@ import (
 	"strings"
 )
 
+// GetTreeSummary sums the coverage of covMap per directory, down to level. Every region counts,
+// including gap and skipped regions; GetTreeSummaryWithFilter and CountedRegions leave them out.
 func GetTreeSummary(covMap map[string]map[string][]bool, level int) map[string]CovSummary {
+	return GetTreeSummaryWithNormalizer(covMap, level, DefaultPathNormalizer())
+}
+
+// GetTreeSummaryWithNormalizer is GetTreeSummary, building the tree from the file names
+// normalized by n
+func GetTreeSummaryWithNormalizer(covMap map[string]map[string][]bool, level int, n *PathNormalizer) map[string]CovSummary {
 	tree := make(map[string]CovSummary)
 	for fileName := range covMap {
 		totalRegionsInFile := 0
@@ -31,12 +39,7 @@ func GetTreeSummary(covMap map[string]map[string][]bool, level int) map[string]C
 			}
 		}
 
-		parts := strings.Split(fileName, "/")
-		if parts[0] == ".." && parts[1] == ".." {
-			parts = parts[2:]
-		} else if parts[0] == "gen" {
-			parts = parts[1:]
-		}
+		parts := n.TreeParts(fileName)
 		for i := 0; i < len(parts) && (level <= 0 || i < level-1); i++ {
 			seg := strings.Join(parts[:i+1], "/")
 			if _, ok := tree[seg]; !ok {
@@ -51,6 +54,8 @@ func GetTreeSummary(covMap map[string]map[string][]bool, level int) map[string]C
 			regionSummary.TotalRegions += totalRegionsInFile
 			regionSummary.CoveredRegions += coveredRegionsInFile
 			regionSummary.PercentCovered = float64(regionSummary.CoveredRegions) / float64(regionSummary.TotalRegions)
+			regionSummary.TotalFunctions += totalFunctionsInFile
+			regionSummary.CoveredFunctions += coveredFunctionsInFile
 			tree[seg] = regionSummary
 		}
 	}
@@ -58,15 +63,56 @@ func GetTreeSummary(covMap map[string]map[string][]bool, level int) map[string]C
 	return tree
 }
 
+// GetBranchTreeSummary is GetTreeSummaryWithNormalizer for a branch map. Each direction of a branch
+// counts separately towards CoveredDirections, as in llvm-cov's branch totals.
+func GetBranchTreeSummary(branchMap map[string]map[string][]BranchCoverage, level int, n *PathNormalizer) map[string]BranchSummary {
+	tree := make(map[string]BranchSummary)
+	for fileName := range branchMap {
+		totalBranchesInFile := 0
+		coveredBranchesInFile := 0
+		coveredDirectionsInFile := 0
+
+		for funcName := range branchMap[fileName] {
+			for _, branch := range branchMap[fileName][funcName] {
+				totalBranchesInFile += 1
+				if branch.Covered() {
+					coveredBranchesInFile += 1
+				}
+				if branch.Taken {
+					coveredDirectionsInFile += 1
+				}
+				if branch.NotTaken {
+					coveredDirectionsInFile += 1
+				}
+			}
+		}
+
+		parts := n.TreeParts(fileName)
+		for i := 0; i < len(parts) && (level <= 0 || i < level-1); i++ {
+			seg := strings.Join(parts[:i+1], "/")
+
+			branchSummary := tree[seg]
+			branchSummary.TotalBranches += totalBranchesInFile
+			branchSummary.CoveredBranches += coveredBranchesInFile
+			branchSummary.CoveredDirections += coveredDirectionsInFile
+			if branchSummary.TotalBranches > 0 {
+				branchSummary.PercentCovered = float64(branchSummary.CoveredDirections) / float64(2*branchSummary.TotalBranches)
+			}
+			tree[seg] = branchSummary
+		}
+	}
+
+	return tree
+}
+
 func ConvertFileCoverageToTree(fc map[string]CovSummary) map[string]int {
+	return ConvertFileCoverageToTreeWithNormalizer(fc, DefaultPathNormalizer())
+}
+
+func ConvertFileCoverageToTreeWithNormalizer(fc map[string]CovSummary, n *PathNormalizer) map[string]int {
 	tree := make(map[string]int)
 	for k, v := range fc {
-		parts := strings.Split(k, "/")
-		if parts[0] == ".." && parts[1] == ".." {
-			parts = parts[2:]
-		} else if parts[0] == "gen" {
-			parts = parts[1:]
-		}
+		parts := n.TreeParts(k)
 
 		for i := 0; i < len(parts); i++ {
 			seg := strings.Join(parts[:i+1], "/")
@@ -95,6 +141,8 @@ func WriteTreeToFile(tree map[string]CovSummary, fileName string) error {
 		"Regions Covered",
 		"Total Regions",
 		"Percent Covered",
+		"Functions Covered",
+		"Total Functions",
 	})
 
 	keys := make([]string, 0, len(tree))
@@ -110,6 +158,8 @@ func WriteTreeToFile(tree map[string]CovSummary, fileName string) error {
 			strconv.Itoa(tree[k].CoveredRegions),
 			strconv.Itoa(tree[k].TotalRegions),
 			strconv.FormatFloat(tree[k].PercentCovered, 'f', 2, 64),
+			strconv.Itoa(tree[k].CoveredFunctions),
+			strconv.Itoa(tree[k].TotalFunctions),
 		})
 		if err != nil {
 			return err
@@ -119,3 +169,48 @@ func WriteTreeToFile(tree map[string]CovSummary, fileName string) error {
 	writer.Flush()
 	return nil
 }
+
+func WriteBranchTreeToFile(tree map[string]BranchSummary, fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+
+	// Write header
+	err = writer.Write([]string{
+		"Path",
+		"Branches Fully Covered",
+		"Directions Covered",
+		"Total Branches",
+		"Percent Covered",
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		err = writer.Write([]string{
+			k,
+			strconv.Itoa(tree[k].CoveredBranches),
+			strconv.Itoa(tree[k].CoveredDirections),
+			strconv.Itoa(tree[k].TotalBranches),
+			strconv.FormatFloat(tree[k].PercentCovered, 'f', 2, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}